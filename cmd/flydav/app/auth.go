@@ -0,0 +1,354 @@
+package app
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/pluveto/flydav/cmd/flydav/conf"
+	"github.com/pluveto/flydav/pkg/digestauth"
+	"github.com/pluveto/flydav/pkg/ipfilter"
+	"github.com/pluveto/flydav/pkg/logger"
+	"github.com/pluveto/flydav/pkg/tlsutil"
+)
+
+// authenticate logs in the user of a verified TLS client certificate, or
+// else checks the credentials of the request. With require_password both
+// have to name the same user.
+func (s *WebdavServer) authenticate(w http.ResponseWriter, r *http.Request) (string, ProfileService, *conf.AppPassword, bool) {
+	clientAuth := s.TLS.ClientAuth
+	if !s.TLS.Enabled || !clientAuth.Enabled {
+		return s.authenticateCredentials(w, r)
+	}
+	certUser, ok := s.certUser(r)
+	if !clientAuth.RequirePassword {
+		if ok {
+			return certUser, s.AuthService, nil, true
+		}
+		return s.authenticateCredentials(w, r)
+	}
+	if !ok {
+		http.Error(w, "Client certificate required.", http.StatusForbidden)
+		logger.WithField("ip", s.clientIP(r).String()).Warn("Forbidden: no valid client certificate")
+		return "", nil, nil, false
+	}
+	username, profiles, scope, ok := s.authenticateCredentials(w, r)
+	if ok && username != certUser {
+		http.Error(w, "Forbidden.", http.StatusForbidden)
+		logger.Warnf("Forbidden: user %s logged in with the client certificate of %s", username, certUser)
+		return "", nil, nil, false
+	}
+	return username, profiles, scope, ok
+}
+
+// certUser returns the user of a verified client certificate, if the auth
+// backend knows the user.
+func (s *WebdavServer) certUser(r *http.Request) (string, bool) {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+		return "", false
+	}
+	cert := r.TLS.VerifiedChains[0][0]
+	mapper := tlsutil.CertMapper{Field: s.TLS.ClientAuth.UsernameFrom, Users: s.TLS.ClientAuth.Users}
+	username, ok := mapper.Username(cert)
+	if !ok {
+		logger.Warnf("client certificate %q is not mapped to a user", cert.Subject)
+		return "", false
+	}
+	if err := s.resolveUser(username); err != nil {
+		logger.Warnf("client certificate %q maps to unknown user %s: %s", cert.Subject, username, err)
+		return "", false
+	}
+	logger.Debug("user ", username, " presented client certificate ", cert.Subject)
+	return username, true
+}
+
+// resolveUser checks that the AuthService knows username, looking the user
+// up in the backend if it only remembers users after a login.
+func (s *WebdavServer) resolveUser(username string) error {
+	if resolver, ok := s.AuthService.(UserResolver); ok {
+		return resolver.ResolveUser(username)
+	}
+	_, err := s.AuthService.GetAuthorizedSubDir(username)
+	return err
+}
+
+// authenticateCredentials checks the credentials of a request and replies
+// 401 if they are missing or wrong. Bearer tokens, also taken from the cookie set by the
+// OIDC login, go to the TokenAuthService and passwords to the AuthService,
+// which then also provides the settings of the user. Digest responses are
+// checked against the HA1 of the DigestAuthService. App passwords are tried
+// before the password of the backend and return their scope. Clients blocked
+// by the LoginGuard get 429 without their credentials being checked.
+// Passwords found in the CredentialCache are not checked again, and without
+// any credentials a session cookie is accepted.
+func (s *WebdavServer) authenticateCredentials(w http.ResponseWriter, r *http.Request) (string, ProfileService, *conf.AppPassword, bool) {
+	ip := s.clientIP(r)
+	if s.TokenAuthService != nil {
+		if token, fromCookie := bearerToken(r); token != "" {
+			if s.throttle(w, ip, "") {
+				return "", nil, nil, false
+			}
+			username, err := s.TokenAuthService.AuthenticateToken(token)
+			if err != nil {
+				s.loginFailed(ip, "", err)
+				if fromCookie {
+					http.SetCookie(w, &http.Cookie{Name: tokenCookie, Path: "/", MaxAge: -1})
+				}
+				w.Header().Set("WWW-Authenticate", `Bearer realm="Restricted", error="invalid_token"`)
+				http.Error(w, "Unauthorized.", http.StatusUnauthorized)
+				return "", nil, nil, false
+			}
+			s.loginSucceeded(ip, username)
+			return username, s.TokenAuthService, nil, true
+		}
+	}
+
+	if s.Digest != nil {
+		if credentials, ok, err := digestauth.Parse(r.Header.Get("Authorization")); ok {
+			username, ok := s.authenticateDigest(w, r, ip, credentials, err)
+			return username, s.AuthService, nil, ok
+		}
+	}
+
+	username, password, ok := r.BasicAuth()
+	if !ok {
+		if username, ok := s.session(w, r); ok {
+			return username, s.AuthService, nil, true
+		}
+		s.challenge(w, false)
+		return "", nil, nil, false
+	}
+	if s.throttle(w, ip, username) {
+		return "", nil, nil, false
+	}
+	scope, err := s.checkPassword(username, password)
+	if err != nil {
+		s.loginFailed(ip, username, err)
+		s.challenge(w, false)
+		return "", nil, nil, false
+	}
+	s.loginSucceeded(ip, username)
+	if scope == nil {
+		s.startSession(w, r, username)
+	}
+	return username, s.AuthService, scope, true
+}
+
+// authenticateDigest checks the response to a Digest challenge. Expired or
+// reused nonces are answered with a fresh one and do not count as failures.
+func (s *WebdavServer) authenticateDigest(w http.ResponseWriter, r *http.Request, ip net.IP, credentials *digestauth.Credentials, err error) (string, bool) {
+	if err != nil {
+		s.loginFailed(ip, "", err)
+		s.challenge(w, false)
+		return "", false
+	}
+	username := credentials.Username
+	if s.throttle(w, ip, username) {
+		return "", false
+	}
+	if !sameRequestURI(credentials.URI, r) {
+		err = errDigestURI
+	} else {
+		ha1, _ := s.DigestAuthService.HA1(username, credentials.Algorithm)
+		err = s.Digest.Verify(credentials, r.Method, ha1)
+	}
+	switch err {
+	case nil:
+		s.loginSucceeded(ip, username)
+		return username, true
+	case digestauth.ErrStale, digestauth.ErrReplay:
+		logger.Debug("digest login of ", username, ": ", err)
+		s.challenge(w, true)
+	default:
+		s.loginFailed(ip, username, err)
+		s.challenge(w, false)
+	}
+	return "", false
+}
+
+var errDigestURI = errors.New("digest uri does not match the request")
+
+// sameRequestURI compares the uri parameter of Digest credentials, which
+// some clients send as absolute URL, with the request.
+func sameRequestURI(uri string, r *http.Request) bool {
+	if uri == r.RequestURI {
+		return true
+	}
+	u, err := url.Parse(uri)
+	return err == nil && u.RequestURI() == r.URL.RequestURI()
+}
+
+// checkPassword tries the app passwords of the user, then the password of
+// the AuthService. It returns the app password that matched, if any.
+func (s *WebdavServer) checkPassword(username, password string) (*conf.AppPassword, error) {
+	version := func(scope string) string {
+		if scope == "" {
+			return s.credentialVersion(username)
+		}
+		return s.AppPasswordService.CredentialVersion(username, scope)
+	}
+	cache := s.CredentialCache
+	if cache != nil {
+		if scope, ok := cache.Verify(username, password, version); ok {
+			if scope == "" {
+				return nil, nil
+			}
+			s.AppPasswordService.Touch(username, scope)
+			appPassword, _ := s.AppPasswordService.Get(username, scope)
+			return appPassword, nil
+		}
+	}
+
+	if s.AppPasswordService != nil {
+		if appPassword, err := s.AppPasswordService.Authenticate(username, password); err == nil {
+			// without the password the backend knows the profile only by a lookup
+			if err := s.resolveUser(username); err != nil {
+				return nil, err
+			}
+			logger.Debug("user ", username, " logged in with app password ", appPassword.Name)
+			if cache != nil {
+				cache.Add(username, password, version(appPassword.Name), appPassword.Name)
+			}
+			return appPassword, nil
+		}
+	}
+	if err := s.AuthService.Authenticate(username, password); err != nil {
+		return nil, err
+	}
+	if cache != nil {
+		cache.Add(username, password, version(""), "")
+	}
+	return nil, nil
+}
+
+// credentialVersion returns "" for auth services that cannot tell, so that
+// only the TTL limits their cached logins.
+func (s *WebdavServer) credentialVersion(username string) string {
+	if versioner, ok := s.AuthService.(CredentialVersioner); ok {
+		return versioner.CredentialVersion(username)
+	}
+	return ""
+}
+
+// startSession sets a session cookie after a password login of a browser.
+// Other clients keep sending their credentials, sessions would only pile up
+// for them.
+func (s *WebdavServer) startSession(w http.ResponseWriter, r *http.Request, username string) {
+	if s.Sessions == nil || r.Header.Get("Sec-Fetch-Mode") == "" {
+		return
+	}
+	if cookie, err := r.Cookie(sessionCookie); err == nil {
+		if owner, _, ok := s.Sessions.Session(cookie.Value); ok && owner == username {
+			return
+		}
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookie,
+		Value:    s.Sessions.NewSession(username, s.credentialVersion(username)),
+		Path:     "/",
+		MaxAge:   int(s.Sessions.TTL().Seconds()),
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteStrictMode,
+	})
+}
+
+// session returns the user of a valid session cookie. Sessions end when the
+// password of the user changes. Backends that cannot tell, like LDAP, are
+// asked whether the user still exists instead, a changed password only ends
+// the session at its TTL.
+func (s *WebdavServer) session(w http.ResponseWriter, r *http.Request) (string, bool) {
+	if s.Sessions == nil {
+		return "", false
+	}
+	cookie, err := r.Cookie(sessionCookie)
+	if err != nil {
+		return "", false
+	}
+	username, version, ok := s.Sessions.Session(cookie.Value)
+	if ok && version == s.credentialVersion(username) {
+		if _, versioned := s.AuthService.(CredentialVersioner); versioned {
+			return username, true
+		}
+		err := s.resolveUser(username)
+		if err == nil {
+			return username, true
+		}
+		logger.Info("session of user ", username, " ended: ", err)
+	}
+	s.Sessions.Remove(cookie.Value)
+	http.SetCookie(w, &http.Cookie{Name: sessionCookie, Path: "/", MaxAge: -1})
+	return "", false
+}
+
+// throttle replies 429 if the LoginGuard blocks the client IP or username.
+func (s *WebdavServer) throttle(w http.ResponseWriter, ip net.IP, username string) bool {
+	if s.LoginGuard == nil {
+		return false
+	}
+	wait := s.LoginGuard.Check(ip, username)
+	if wait <= 0 {
+		return false
+	}
+	w.Header().Set("Retry-After", fmt.Sprint(math.Ceil(wait.Seconds())))
+	http.Error(w, "Too Many Requests.", http.StatusTooManyRequests)
+	logger.Debug("login of ", username, " from ", ip, " blocked for ", wait)
+	return true
+}
+
+func (s *WebdavServer) loginFailed(ip net.IP, username string, err error) {
+	logger.WithField("ip", ip.String()).Error("Unauthorized: ", err)
+	if s.LoginGuard != nil {
+		s.LoginGuard.Fail(ip, username)
+	}
+}
+
+func (s *WebdavServer) loginSucceeded(ip net.IP, username string) {
+	if s.LoginGuard != nil {
+		s.LoginGuard.Succeed(ip, username)
+	}
+}
+
+const sessionCookie = "flydav_session"
+
+// clientIP returns the address the request comes from, as told by trusted
+// proxies.
+func (s *WebdavServer) clientIP(r *http.Request) net.IP {
+	return ipfilter.ClientIP(r, s.TrustedProxies)
+}
+
+// challenge replies 401 with the schemes a client may use. Stale only
+// renews the nonce of Digest auth.
+func (s *WebdavServer) challenge(w http.ResponseWriter, stale bool) {
+	if s.Digest != nil {
+		for _, challenge := range s.Digest.Challenges(stale) {
+			w.Header().Add("WWW-Authenticate", challenge)
+		}
+	}
+	w.Header().Add("WWW-Authenticate", `Basic realm="Restricted"`)
+	if s.TokenAuthService != nil {
+		w.Header().Add("WWW-Authenticate", `Bearer realm="Restricted"`)
+	}
+	http.Error(w, "Unauthorized.", http.StatusUnauthorized)
+}
+
+// bearerToken returns the token of an "Authorization: Bearer" header, or
+// without any Authorization header the one of the login cookie.
+func bearerToken(r *http.Request) (string, bool) {
+	header := r.Header.Get("Authorization")
+	if header == "" {
+		if cookie, err := r.Cookie(tokenCookie); err == nil {
+			return cookie.Value, true
+		}
+		return "", false
+	}
+	scheme, token, ok := strings.Cut(header, " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") {
+		return "", false
+	}
+	return strings.TrimSpace(token), false
+}
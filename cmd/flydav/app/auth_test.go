@@ -0,0 +1,112 @@
+package app
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/pluveto/flydav/cmd/flydav/conf"
+	"github.com/pluveto/flydav/cmd/flydav/service"
+	"github.com/pluveto/flydav/pkg/credcache"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// directoryBackend knows the profiles of users only after a login or a
+// lookup, like the LDAP backend.
+type directoryBackend struct {
+	directory map[string]bool
+	profiles  map[string]bool
+}
+
+var errUnknownUser = errors.New("unknown user")
+
+func (b *directoryBackend) Authenticate(username, password string) error {
+	return service.ErrCrendential
+}
+
+func (b *directoryBackend) ResolveUser(username string) error {
+	if !b.directory[username] {
+		return errUnknownUser
+	}
+	b.profiles[username] = true
+	return nil
+}
+
+func (b *directoryBackend) profile(username string) error {
+	if !b.profiles[username] {
+		return errUnknownUser
+	}
+	return nil
+}
+
+func (b *directoryBackend) GetAuthorizedSubDir(username string) (string, error) {
+	return username, b.profile(username)
+}
+
+func (b *directoryBackend) GetStorage(username string) (string, error) {
+	return "", b.profile(username)
+}
+
+func (b *directoryBackend) GetPathPrefix(username string) (string, error) {
+	return "", b.profile(username)
+}
+
+func (b *directoryBackend) GetPermissions(username string) ([]conf.Permission, error) {
+	return conf.AllPermissions, b.profile(username)
+}
+
+func (b *directoryBackend) GetGroups(username string) ([]string, error) {
+	return nil, b.profile(username)
+}
+
+func (b *directoryBackend) GetMounts(username string) ([]conf.Mount, error) {
+	return nil, b.profile(username)
+}
+
+func TestCheckPasswordAppPassword(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("phone secret"), bcrypt.MinCost)
+	assert.NoError(t, err)
+	appPassword := []conf.AppPassword{{Name: "phone", PasswordHash: string(hash)}}
+	appPasswords, err := service.NewAppPasswordService([]conf.User{
+		{Username: "alice", AppPassword: appPassword},
+		{Username: "bob", AppPassword: appPassword},
+	}, "")
+	assert.NoError(t, err)
+	backend := &directoryBackend{directory: map[string]bool{"alice": true}, profiles: map[string]bool{}}
+	s := &WebdavServer{AuthService: backend, AppPasswordService: appPasswords}
+
+	scope, err := s.checkPassword("alice", "phone secret")
+	if assert.NoError(t, err) {
+		assert.Equal(t, "phone", scope.Name)
+	}
+	dir, err := s.AuthService.GetAuthorizedSubDir("alice")
+	assert.NoError(t, err, "the profile is known without a password login")
+	assert.Equal(t, "alice", dir)
+
+	_, err = s.checkPassword("bob", "phone secret")
+	assert.ErrorIs(t, err, errUnknownUser, "removed from the directory")
+}
+
+func TestSessionOfRemovedUser(t *testing.T) {
+	backend := &directoryBackend{directory: map[string]bool{"alice": true}, profiles: map[string]bool{}}
+	s := &WebdavServer{AuthService: backend, Sessions: credcache.New(time.Hour, 10)}
+	token := s.Sessions.NewSession("alice", "")
+	session := func() (string, bool) {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.AddCookie(&http.Cookie{Name: sessionCookie, Value: token})
+		return s.session(httptest.NewRecorder(), r)
+	}
+
+	username, ok := session()
+	assert.True(t, ok)
+	assert.Equal(t, "alice", username)
+	delete(backend.directory, "alice")
+	_, ok = session()
+	assert.False(t, ok, "the user is gone from the directory")
+	backend.directory["alice"] = true
+	_, ok = session()
+	assert.False(t, ok, "the session was removed")
+}
@@ -2,26 +2,118 @@ package app
 
 import (
 	"fmt"
+	"net"
 	"net/http"
+	"os"
+	"path"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/pluveto/flydav/cmd/flydav/conf"
 	"github.com/pluveto/flydav/cmd/flydav/service"
+	"github.com/pluveto/flydav/pkg/credcache"
+	"github.com/pluveto/flydav/pkg/cryptfs"
+	"github.com/pluveto/flydav/pkg/digestauth"
+	"github.com/pluveto/flydav/pkg/ipfilter"
+	"github.com/pluveto/flydav/pkg/listener"
+	"github.com/pluveto/flydav/pkg/logger"
+	"github.com/pluveto/flydav/pkg/loginguard"
+	"github.com/pluveto/flydav/pkg/misc"
+	_ "github.com/pluveto/flydav/pkg/s3fs"   // registers the "s3" storage backend
+	_ "github.com/pluveto/flydav/pkg/sftpfs" // registers the "sftp" storage backend
+	"github.com/pluveto/flydav/pkg/sharestore"
+	"github.com/pluveto/flydav/pkg/storage"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/net/webdav"
 )
 
 func Run(conf conf.Conf) {
-	if len(conf.Auth.User) == 1 {
+	if conf.Auth.Backend == "htpasswd" {
+		fmt.Println("Htpasswd:            ", conf.Auth.Htpasswd.Path)
+	} else if conf.Auth.Backend == "ldap" {
+		fmt.Println("LDAP:                ", conf.Auth.LDAP.URL)
+	} else if len(conf.Auth.User) == 1 {
 		fmt.Println("Username:            ", conf.Auth.User[0].Username)
 		fmt.Println("Password(Encrypted): ", conf.Auth.User[0].PasswordHash)
 	}
-	fmt.Println("Address:             ", fmt.Sprintf("http://%s:%d%s", conf.Server.Host, conf.Server.Port, conf.Server.Path))
+	scheme := "http"
+	if conf.Server.TLS.Enabled {
+		scheme = "https"
+	}
+	if len(conf.Server.Listen) == 0 {
+		fmt.Println("Address:             ", fmt.Sprintf("%s://%s:%d%s", scheme, conf.Server.Host, conf.Server.Port, conf.Server.Path))
+	}
+	for _, addr := range conf.Server.Listen {
+		fmt.Println("Listen:              ", addr, conf.Server.Path)
+	}
 	fmt.Println("Filesystem:          ", conf.Server.FsDir)
 
 	server := NewWebdavServer(
-		service.NewBasicAuthService(conf.Auth.User),
+		newAuthService(conf.Auth, conf.Path),
 		conf.Server.Host, conf.Server.Port, conf.Server.Path, conf.Server.FsDir,
 	)
+	server.TLS = conf.Server.TLS
+	server.Storages = newStorages(conf)
+	server.Public = conf.Server.Public
+	for _, public := range conf.Server.Public {
+		fmt.Println("Public:              ", fmt.Sprintf("%s://%s:%d%s", scheme, conf.Server.Host, conf.Server.Port, public.Path))
+	}
+	if conf.Share.Enabled {
+		server.Shares = newShareStore(conf)
+		server.Share = conf.Share
+		server.Share.Path = path.Clean("/" + conf.Share.Path)
+		server.Share.APIPath = path.Clean("/" + conf.Share.APIPath)
+		fmt.Println("Shares:              ", fmt.Sprintf("%s://%s:%d%s", scheme, conf.Server.Host, conf.Server.Port, server.Share.APIPath))
+	}
+	if conf.Auth.OIDC.Enabled {
+		oidcService, err := service.NewOIDCAuthService(conf.Auth.OIDC, conf.Auth.User, conf.Auth.Group)
+		if err != nil {
+			logger.Fatal("Failed to set up OpenID Connect: ", err)
+		}
+		server.TokenAuthService = oidcService
+		if conf.Auth.OIDC.RedirectURL != "" {
+			login, err := newOIDCLogin(conf.Auth.OIDC, oidcService.Verifier)
+			if err != nil {
+				logger.Fatal("Failed to set up OpenID Connect login: ", err)
+			}
+			server.AddMiddleware(login.middleware)
+		}
+	}
+	if len(conf.Auth.ACL) != 0 {
+		server.ACLService = service.NewACLService(conf.Auth.ACL)
+	}
+	if appPasswords := newAppPasswordService(conf); appPasswords != nil {
+		server.AppPasswordService = appPasswords
+	}
+	if digest := conf.Auth.Digest; digest.Enabled {
+		server.Digest = digestauth.New(digest.Realm, digest.Algorithms, time.Duration(digest.NonceTTL)*time.Second)
+		server.DigestAuthService = service.NewDigestService(conf.Auth.User)
+	}
+	server.IPFilter, server.UserIPFilters, server.TrustedProxies = newIPFilters(conf)
+	if conf.Auth.BruteForce.Enabled {
+		server.LoginGuard = newLoginGuard(conf.Auth.BruteForce)
+	}
+	if cache := conf.Auth.Cache; cache.Enabled {
+		server.CredentialCache = credcache.New(time.Duration(cache.TTL)*time.Second, cache.MaxEntries)
+	}
+	if cache := conf.Auth.Cache; cache.Session {
+		server.Sessions = credcache.New(time.Duration(cache.SessionTTL)*time.Second, cache.MaxEntries)
+	}
+	server.ShutdownTimeout = time.Duration(conf.Server.ShutdownTimeout) * time.Second
+	server.ListenAddrs = conf.Server.Listen
+	server.SocketOptions = listener.SocketOptions{
+		Owner: conf.Server.SocketOwner,
+		Group: conf.Server.SocketGroup,
+	}
+	if conf.Server.SocketMode != "" {
+		mode, err := strconv.ParseUint(conf.Server.SocketMode, 8, 32)
+		if err != nil {
+			logger.Fatal("invalid socket_mode: ", conf.Server.SocketMode)
+		}
+		server.SocketOptions.Mode = os.FileMode(mode)
+	}
 
 	if conf.CORS.Enabled {
 		server.AddMiddleware(func(next http.HandlerFunc) http.HandlerFunc {
@@ -61,7 +153,140 @@ func Run(conf conf.Conf) {
 				next.ServeHTTP(w, r)
 			})
 		})
-		fmt.Println("UI:                  ", fmt.Sprintf("http://%s:%d%s", conf.Server.Host, conf.Server.Port, conf.UI.Path))
+		fmt.Println("UI:                  ", fmt.Sprintf("%s://%s:%d%s", scheme, conf.Server.Host, conf.Server.Port, conf.UI.Path))
 	}
 	server.Listen()
 }
+
+// newAuthService sets up the backend of cnf. Upgraded password hashes of
+// [[auth.user]] entries are saved to the config file at confPath, if any.
+func newAuthService(cnf conf.Auth, confPath string) AuthService {
+	switch cnf.Backend {
+	case conf.BackendHtpasswd:
+		authService, err := service.NewHtpasswdAuthService(cnf.Htpasswd, cnf.User, cnf.Group)
+		if err != nil {
+			logger.Fatal("Failed to load htpasswd file: ", err)
+		}
+		if cnf.Hashing.Rehash {
+			authService.UpgradeHashes(cnf.Htpasswd.HashAlgorithm)
+		}
+		return authService
+	case conf.BackendLDAP:
+		authService, err := service.NewLDAPAuthService(cnf.LDAP, cnf.User, cnf.Group)
+		if err != nil {
+			logger.Fatal("Failed to set up LDAP authentication: ", err)
+		}
+		return authService
+	default:
+		authService := service.NewBasicAuthService(cnf.User, cnf.Group)
+		if cnf.Hashing.Rehash && confPath != "" {
+			authService.UpgradeHashes(cnf.Hashing.Algorithm, confPath)
+		}
+		return authService
+	}
+}
+
+func newLoginGuard(cnf conf.BruteForce) *loginguard.Guard {
+	allowlist, err := misc.ParseNetworks(cnf.Allowlist)
+	if err != nil {
+		logger.Fatal("Invalid brute_force allowlist: ", err)
+	}
+	second := func(n int) time.Duration { return time.Duration(n) * time.Second }
+	guard := loginguard.New(loginguard.Config{
+		MaxIPFailures:   cnf.MaxIPFailures,
+		MaxUserFailures: cnf.MaxUserFailures,
+		Backoff:         second(cnf.Backoff),
+		Lockout:         second(cnf.Lockout),
+		MaxLockout:      second(cnf.MaxLockout),
+		Forget:          second(cnf.ResetAfter),
+		Allowlist:       allowlist,
+	})
+	// a stable message with fields, for fail2ban and log based alerting
+	guard.OnLockout(func(lockout loginguard.Lockout) {
+		logger.WithFields(logrus.Fields{
+			"event":    "lockout",
+			"ip":       lockout.IP,
+			"username": lockout.Username,
+			"failures": lockout.Failures,
+			"until":    lockout.Until.Format(time.RFC3339),
+		}).Warn("login locked out")
+	})
+	return guard
+}
+
+// newAppPasswordService returns nil if no user has app passwords.
+func newAppPasswordService(cnf conf.Conf) *service.AppPasswordService {
+	for _, user := range cnf.Auth.User {
+		if len(user.AppPassword) == 0 {
+			continue
+		}
+		appPasswords, err := service.NewAppPasswordService(cnf.Auth.User, cnf.Server.StateDir)
+		if err != nil {
+			logger.Fatal("Failed to load the last use of app passwords: ", err)
+		}
+		return appPasswords
+	}
+	return nil
+}
+
+// newStorages opens the storages, which have been validated before.
+func newStorages(cnf conf.Conf) map[string]webdav.FileSystem {
+	ret := make(map[string]webdav.FileSystem)
+	for _, s := range cnf.Storage {
+		fs, err := storage.Open(s.Backend, s.Options)
+		if err != nil {
+			logger.Fatalf("Failed to open storage %s: %s", s.Name, err)
+		}
+		ret[s.Name] = encrypt(fs, s.Encryption, "storage "+s.Name)
+	}
+	if cnf.Server.Encryption.Enabled {
+		ret[""] = encrypt(webdav.Dir(cnf.Server.FsDir), cnf.Server.Encryption, "fs_dir")
+	}
+	return ret
+}
+
+// encrypt wraps fs to encrypt its files if enabled.
+func encrypt(fs webdav.FileSystem, enc conf.Encryption, owner string) webdav.FileSystem {
+	if !enc.Enabled {
+		return fs
+	}
+	key, err := cryptfs.LoadKey(enc.KeyFile)
+	if err != nil {
+		logger.Fatalf("Failed to load the encryption key of %s: %s", owner, err)
+	}
+	ret, err := cryptfs.New(fs, key, enc.EncryptNames)
+	if err != nil {
+		logger.Fatalf("Failed to encrypt %s: %s", owner, err)
+	}
+	return ret
+}
+
+// newShareStore opens the shares kept in the state_dir, or in memory
+// without one.
+func newShareStore(cnf conf.Conf) *sharestore.Store {
+	file := ""
+	if cnf.Server.StateDir != "" {
+		file = filepath.Join(cnf.Server.StateDir, "shares.json")
+	} else {
+		logger.Warn("state_dir is not set, shares are lost on restart")
+	}
+	shares, err := sharestore.Open(file, cnf.Auth.Hashing.Algorithm)
+	if err != nil {
+		logger.Fatal("Failed to load shares: ", err)
+	}
+	return shares
+}
+
+// newIPFilters parses the IP lists of the server and of the users, which
+// have been validated before.
+func newIPFilters(cnf conf.Conf) (*ipfilter.Filter, map[string]*ipfilter.Filter, []*net.IPNet) {
+	filter, _ := ipfilter.New(cnf.Server.AllowIPs, cnf.Server.DenyIPs)
+	users := make(map[string]*ipfilter.Filter)
+	for _, user := range cnf.Auth.User {
+		if userFilter, _ := ipfilter.New(user.AllowIPs, user.DenyIPs); userFilter != nil {
+			users[user.Username] = userFilter
+		}
+	}
+	trusted, _ := misc.ParseNetworks(cnf.Server.TrustedProxies)
+	return filter, users, trusted
+}
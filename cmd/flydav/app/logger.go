@@ -10,6 +10,9 @@ import (
 	"github.com/sirupsen/logrus"
 )
 
+// rotatedLoggers are closed by CloseLogger so that nothing is lost on exit.
+var rotatedLoggers []*lumberjack.Logger
+
 func InitLogger(cnf conf.Log, verbose bool) {
 	if(verbose){
 		println("verbose mode enabled")
@@ -64,18 +67,29 @@ func InitLogger(cnf conf.Log, verbose bool) {
 		case conf.LogFormatText:
 			currentLogger.SetFormatter(&logrus.TextFormatter{})
 		}
-		currentLogger.SetOutput(&lumberjack.Logger{
+		rotatedLogger := &lumberjack.Logger{
 			Filename:   file.Path,
 			MaxSize:    file.MaxSize,
 			MaxAge:     file.MaxAge,
 			MaxBackups: 3,
 			Compress:   true,
-		})
+		}
+		rotatedLoggers = append(rotatedLoggers, rotatedLogger)
+		currentLogger.SetOutput(rotatedLogger)
 		nextLoggerIndex++
 	}
 
 }
 
+// CloseLogger flushes and closes the log files opened by InitLogger.
+func CloseLogger() {
+	for _, l := range rotatedLoggers {
+		if err := l.Close(); err != nil {
+			os.Stderr.WriteString("failed to close log file " + l.Filename + ": " + err.Error() + "\n")
+		}
+	}
+}
+
 // levelToLogrusLevel converts a string to a logrus.Level
 func levelToLogrusLevel(level string) logrus.Level {
 	level = strings.ToLower(level)
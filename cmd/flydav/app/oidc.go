@@ -0,0 +1,152 @@
+package app
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"github.com/pluveto/flydav/cmd/flydav/conf"
+	"github.com/pluveto/flydav/pkg/logger"
+	"github.com/pluveto/flydav/pkg/oidcauth"
+	"golang.org/x/oauth2"
+)
+
+const (
+	tokenCookie     = "flydav_token"
+	oidcStateCookie = "flydav_oidc_state"
+	oidcLoginPath   = "/oidc/login"
+	oidcLogoutPath  = "/oidc/logout"
+)
+
+// oidcLogin implements the authorization code flow for the web UI. The ID
+// token ends up in an HttpOnly cookie, which is accepted like a bearer token,
+// so the browser never sees a password.
+type oidcLogin struct {
+	config       oauth2.Config
+	verifier     *oidcauth.Verifier
+	callbackPath string
+	secure       bool
+}
+
+func newOIDCLogin(cnf conf.OIDC, verifier *oidcauth.Verifier) (*oidcLogin, error) {
+	redirect, err := url.Parse(cnf.RedirectURL)
+	if err != nil {
+		return nil, err
+	}
+	return &oidcLogin{
+		config: oauth2.Config{
+			ClientID:     cnf.ClientID,
+			ClientSecret: cnf.ClientSecret,
+			Endpoint:     verifier.Endpoint(),
+			RedirectURL:  cnf.RedirectURL,
+			Scopes:       cnf.Scopes,
+		},
+		verifier:     verifier,
+		callbackPath: redirect.Path,
+		secure:       redirect.Scheme == "https",
+	}, nil
+}
+
+func (l *oidcLogin) middleware(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case oidcLoginPath:
+			l.login(w, r)
+		case l.callbackPath:
+			l.callback(w, r)
+		case oidcLogoutPath:
+			http.SetCookie(w, &http.Cookie{Name: tokenCookie, Path: "/", MaxAge: -1})
+			http.Redirect(w, r, returnTo(r.URL.Query().Get("return_to")), http.StatusFound)
+		default:
+			next(w, r)
+		}
+	}
+}
+
+func (l *oidcLogin) login(w http.ResponseWriter, r *http.Request) {
+	state, nonce := randomString(), randomString()
+	http.SetCookie(w, &http.Cookie{
+		Name: oidcStateCookie,
+		Value: url.Values{
+			"state":     {state},
+			"nonce":     {nonce},
+			"return_to": {returnTo(r.URL.Query().Get("return_to"))},
+		}.Encode(),
+		Path:     "/",
+		MaxAge:   600,
+		HttpOnly: true,
+		Secure:   l.secure,
+		SameSite: http.SameSiteLaxMode,
+	})
+	http.Redirect(w, r, l.config.AuthCodeURL(state, oidc.Nonce(nonce)), http.StatusFound)
+}
+
+func (l *oidcLogin) callback(w http.ResponseWriter, r *http.Request) {
+	cookie, err := r.Cookie(oidcStateCookie)
+	if err != nil {
+		http.Error(w, "Login expired, try again.", http.StatusBadRequest)
+		return
+	}
+	http.SetCookie(w, &http.Cookie{Name: oidcStateCookie, Path: "/", MaxAge: -1})
+	saved, _ := url.ParseQuery(cookie.Value)
+	query := r.URL.Query()
+	if query.Get("state") == "" || query.Get("state") != saved.Get("state") {
+		http.Error(w, "Invalid login state.", http.StatusBadRequest)
+		return
+	}
+	if query.Get("error") != "" {
+		logger.Warn("OIDC login failed: ", query.Get("error"), " ", query.Get("error_description"))
+		http.Error(w, "Unauthorized.", http.StatusUnauthorized)
+		return
+	}
+
+	token, err := l.config.Exchange(l.verifier.Context(), query.Get("code"))
+	if err != nil {
+		logger.Error("OIDC code exchange failed: ", err)
+		http.Error(w, "Unauthorized.", http.StatusUnauthorized)
+		return
+	}
+	rawIDToken, _ := token.Extra("id_token").(string)
+	id, err := l.verifier.Verify(r.Context(), rawIDToken)
+	if err == nil && id.Nonce != saved.Get("nonce") {
+		err = errors.New("nonce mismatch")
+	}
+	if err != nil {
+		logger.Error("OIDC ID token rejected: ", err)
+		http.Error(w, "Unauthorized.", http.StatusUnauthorized)
+		return
+	}
+
+	logger.Info("OIDC login of user ", id.Username)
+	http.SetCookie(w, &http.Cookie{
+		Name:     tokenCookie,
+		Value:    rawIDToken,
+		Path:     "/",
+		Expires:  id.Expiry,
+		HttpOnly: true,
+		Secure:   l.secure,
+		SameSite: http.SameSiteLaxMode,
+	})
+	http.Redirect(w, r, returnTo(saved.Get("return_to")), http.StatusFound)
+}
+
+// returnTo only allows local paths to avoid redirecting to other sites.
+func returnTo(path string) string {
+	if !strings.HasPrefix(path, "/") || strings.HasPrefix(path, "//") || strings.HasPrefix(path, "/\\") {
+		return "/"
+	}
+	return path
+}
+
+func randomString() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		// should never happen, the login would be guessable
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,319 @@
+package app
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/pluveto/flydav/cmd/flydav/conf"
+	"github.com/pluveto/flydav/pkg/mountfs"
+	"github.com/pluveto/flydav/pkg/overlayfs"
+	"golang.org/x/net/webdav"
+)
+
+// methodPermissions lists the permissions each method requires on the
+// request path. Methods not listed, such as OPTIONS, require none.
+var methodPermissions = map[string][]conf.Permission{
+	"GET":       {conf.PermRead},
+	"HEAD":      {conf.PermRead},
+	"PROPFIND":  {conf.PermRead},
+	"PUT":       {conf.PermWrite},
+	"POST":      {conf.PermWrite},
+	"PATCH":     {conf.PermWrite},
+	"MKCOL":     {conf.PermWrite},
+	"DELETE":    {conf.PermDelete},
+	"COPY":      {conf.PermRead},
+	"MOVE":      {conf.PermRead, conf.PermDelete},
+	"LOCK":      {conf.PermLock},
+	"UNLOCK":    {conf.PermLock},
+	"PROPPATCH": {conf.PermPropPatch},
+}
+
+// destinationPermissions lists what COPY and MOVE require on the Destination.
+// Replacing an existing one requires delete too, see checkRequest.
+var destinationPermissions = map[string][]conf.Permission{
+	"COPY": {conf.PermWrite},
+	"MOVE": {conf.PermWrite},
+}
+
+func hasPermission(granted []conf.Permission, perm conf.Permission) bool {
+	for _, p := range granted {
+		if p == perm {
+			return true
+		}
+	}
+	return false
+}
+
+// accessChecker decides what a user may do on paths of its file system.
+type accessChecker struct {
+	username string
+	groups   []string
+	granted  []conf.Permission
+	acl      ACLService
+	// root is the directory of the user's file system relative to its
+	// storage, ACL rules are matched against paths below it
+	root    string
+	storage string
+	// mounts replace root when the user's namespace is composed of mounts
+	mounts   map[string]conf.Mount
+	mountsFs *mountfs.FileSystem
+	// scope limits a login with an app password
+	scope *conf.AppPassword
+}
+
+// mount builds the namespace composed of mounts, each backed by the
+// directory of a storage built by build.
+func (c *accessChecker) mount(mounts []conf.Mount, build func(storage, dir string) webdav.FileSystem) webdav.FileSystem {
+	c.mounts = make(map[string]conf.Mount)
+	var fsMounts []mountfs.Mount
+	for _, m := range mounts {
+		m.Path = path.Clean("/" + m.Path)
+		c.mounts[m.Path] = m
+		fs := build(m.Storage, m.FsDir)
+		if len(m.Lower) > 0 {
+			lowers := make([]webdav.FileSystem, len(m.Lower))
+			for i, layer := range m.Lower {
+				lowers[i] = build(layer.Storage, layer.FsDir)
+			}
+			fs = overlayfs.New(fs, lowers...)
+		}
+		fsMounts = append(fsMounts, mountfs.Mount{Path: m.Path, FS: fs})
+	}
+	c.mountsFs = mountfs.New(fsMounts...)
+	return c.mountsFs
+}
+
+// resolve returns the path of name relative to its storage and the
+// permissions its mount is limited to. It fails for virtual directories between mounts.
+func (c *accessChecker) resolve(name string) (string, []conf.Permission, bool) {
+	if c.mountsFs == nil {
+		return path.Join("/", filepath.ToSlash(c.root), name), nil, true
+	}
+	m, rest := c.mountsFs.Resolve(name)
+	if m == nil {
+		return "", nil, false
+	}
+	mount := c.mounts[m.Path]
+	return path.Join("/", filepath.ToSlash(mount.FsDir), rest), mount.Permissions, true
+}
+
+// storageOf returns the storage holding name, see resolve.
+func (c *accessChecker) storageOf(name string) string {
+	if c.mountsFs == nil {
+		return c.storage
+	}
+	if m, _ := c.mountsFs.Resolve(name); m != nil {
+		return c.mounts[m.Path].Storage
+	}
+	return ""
+}
+
+// layered reports whether name is in an overlay mount, whose lower layers
+// are out of reach of shares.
+func (c *accessChecker) layered(name string) bool {
+	if c.mountsFs == nil {
+		return false
+	}
+	m, _ := c.mountsFs.Resolve(name)
+	return m != nil && len(c.mounts[m.Path].Lower) > 0
+}
+
+// inScope applies the limits of an app password, which ACL rules cannot
+// lift either.
+func (c *accessChecker) inScope(name string, perm conf.Permission) bool {
+	if c.scope == nil {
+		return true
+	}
+	if len(c.scope.Permissions) != 0 && !hasPermission(c.scope.Permissions, perm) {
+		return false
+	}
+	scope := path.Clean("/" + c.scope.Path)
+	name = path.Clean("/" + name)
+	if scope == "/" || name == scope || strings.HasPrefix(name, scope+"/") {
+		return true
+	}
+	// the directories leading to the scope can be listed
+	return perm == conf.PermRead && (name == "/" || strings.HasPrefix(scope, name+"/"))
+}
+
+func (c *accessChecker) allowed(name string, perm conf.Permission) bool {
+	if !c.inScope(name, perm) {
+		return false
+	}
+	resolved, limit, ok := c.resolve(name)
+	if !ok {
+		// virtual directories can only be listed
+		return perm == conf.PermRead
+	}
+	if len(limit) != 0 && !hasPermission(limit, perm) {
+		return false
+	}
+	if !hasPermission(c.granted, perm) {
+		return false
+	}
+	// ACL rules only narrow what the user and the mount grant
+	return c.acl == nil || c.acl.Decide(c.username, c.groups, resolved, perm) != conf.ACLDeny
+}
+
+// checkRequest returns the path and the permission denied to r, if any.
+// Paths outside of prefix are left to webdav.Handler, which rejects them.
+// Whether paths exist is looked up in fs.
+func (c *accessChecker) checkRequest(r *http.Request, prefix string, fs webdav.FileSystem) (string, conf.Permission, bool) {
+	stat := func(name string) os.FileInfo {
+		info, _ := fs.Stat(r.Context(), name)
+		return info
+	}
+	src, hasSrc := stripPrefix(r.URL.Path, prefix)
+	if hasSrc {
+		perms := methodPermissions[r.Method]
+		// locking a missing path creates an empty file there
+		if r.Method == "LOCK" && stat(src) == nil {
+			perms = append(perms[:len(perms):len(perms)], conf.PermWrite)
+		}
+		if perm, ok := c.allowedAll(src, perms); !ok {
+			return src, perm, false
+		}
+	}
+	dst, hasDst := "", false
+	if perms, ok := destinationPermissions[r.Method]; ok {
+		u, err := url.Parse(r.Header.Get("Destination"))
+		if err != nil {
+			return "", "", true
+		}
+		if dst, hasDst = stripPrefix(u.Path, prefix); hasDst {
+			info := stat(dst)
+			overwrite := r.Header.Get("Overwrite") != "F" && info != nil
+			if overwrite {
+				perms = append(perms[:len(perms):len(perms)], conf.PermDelete)
+			}
+			if perm, ok := c.allowedAll(dst, perms); !ok {
+				return dst, perm, false
+			}
+			// replacing a collection deletes what is in it
+			if overwrite && info.IsDir() && c.pathDependent() {
+				denied, perm, ok := checkTree(r.Context(), fs, dst, func(name string) (string, conf.Permission, bool) {
+					return name, conf.PermDelete, c.allowed(name, conf.PermDelete)
+				})
+				if !ok {
+					return denied, perm, false
+				}
+			}
+		}
+	}
+	// deleting, moving or copying a collection acts on everything in it,
+	// which may be protected by rules of its own
+	if !hasSrc || !c.pathDependent() || (r.Method == "COPY" && r.Header.Get("Depth") == "0") {
+		return "", "", true
+	}
+	if r.Method != "DELETE" && r.Method != "MOVE" && r.Method != "COPY" {
+		return "", "", true
+	}
+	if info := stat(src); info == nil || !info.IsDir() {
+		return "", "", true
+	}
+	return checkTree(r.Context(), fs, src, func(name string) (string, conf.Permission, bool) {
+		if perm, ok := c.allowedAll(name, methodPermissions[r.Method]); !ok || !hasDst {
+			return name, perm, ok
+		}
+		target := path.Join(dst, strings.TrimPrefix(name, path.Clean(src)))
+		perm, ok := c.allowedAll(target, destinationPermissions[r.Method])
+		return target, perm, ok
+	})
+}
+
+// allowedAll returns the first of perms not allowed on name, if any.
+func (c *accessChecker) allowedAll(name string, perms []conf.Permission) (conf.Permission, bool) {
+	for _, perm := range perms {
+		if !c.allowed(name, perm) {
+			return perm, false
+		}
+	}
+	return "", true
+}
+
+// pathDependent reports whether permissions may differ between a directory
+// and what is in it.
+func (c *accessChecker) pathDependent() bool {
+	return c.acl != nil || c.mountsFs != nil || (c.scope != nil && c.scope.Path != "")
+}
+
+// checkTree calls check for the entries below the directory name in fs,
+// until one is denied. Directories that cannot be listed are denied, the
+// request would fail on them anyway.
+func checkTree(ctx context.Context, fs webdav.FileSystem, name string, check func(name string) (string, conf.Permission, bool)) (string, conf.Permission, bool) {
+	f, err := fs.OpenFile(ctx, name, os.O_RDONLY, 0)
+	if err != nil {
+		return name, conf.PermRead, false
+	}
+	infos, err := f.Readdir(-1)
+	f.Close()
+	if err != nil {
+		return name, conf.PermRead, false
+	}
+	for _, info := range infos {
+		child := path.Join(name, info.Name())
+		if denied, perm, ok := check(child); !ok {
+			return denied, perm, false
+		}
+		if info.IsDir() {
+			if denied, perm, ok := checkTree(ctx, fs, child, check); !ok {
+				return denied, perm, false
+			}
+		}
+	}
+	return "", "", true
+}
+
+func stripPrefix(p, prefix string) (string, bool) {
+	if prefix == "" {
+		return p, true
+	}
+	if r := strings.TrimPrefix(p, prefix); len(r) < len(p) {
+		return r, true
+	}
+	return "", false
+}
+
+// wrap hides the entries the user cannot read from directory listings.
+// Without ACL rules or a path scope read access does not depend on the path.
+func (c *accessChecker) wrap(fs webdav.FileSystem) webdav.FileSystem {
+	if c.acl == nil && (c.scope == nil || c.scope.Path == "") {
+		return fs
+	}
+	return &aclFileSystem{FileSystem: fs, access: c}
+}
+
+type aclFileSystem struct {
+	webdav.FileSystem
+	access *accessChecker
+}
+
+func (fs *aclFileSystem) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (webdav.File, error) {
+	f, err := fs.FileSystem.OpenFile(ctx, name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return &aclFile{File: f, name: name, access: fs.access}, nil
+}
+
+type aclFile struct {
+	webdav.File
+	name   string
+	access *accessChecker
+}
+
+func (f *aclFile) Readdir(count int) ([]os.FileInfo, error) {
+	infos, err := f.File.Readdir(count)
+	visible := infos[:0]
+	for _, info := range infos {
+		if f.access.allowed(path.Join(f.name, info.Name()), conf.PermRead) {
+			visible = append(visible, info)
+		}
+	}
+	return visible, err
+}
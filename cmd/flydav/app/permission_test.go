@@ -0,0 +1,139 @@
+package app
+
+import (
+	"context"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/pluveto/flydav/cmd/flydav/conf"
+	"github.com/pluveto/flydav/cmd/flydav/service"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/webdav"
+)
+
+func newChecker(granted []conf.Permission, rules ...conf.ACLRule) *accessChecker {
+	return &accessChecker{
+		username: "alice",
+		groups:   []string{"staff"},
+		granted:  granted,
+		acl:      service.NewACLService(rules),
+		root:     "alice",
+	}
+}
+
+func TestAllowed(t *testing.T) {
+	allowAll := conf.ACLRule{Path: "/**", Action: conf.ACLAllow}
+	c := newChecker([]conf.Permission{conf.PermRead}, allowAll)
+	assert.True(t, c.allowed("/docs/a.txt", conf.PermRead))
+	assert.False(t, c.allowed("/docs/a.txt", conf.PermWrite), "an allow rule does not grant more")
+	assert.False(t, c.allowed("/docs/a.txt", conf.PermDelete))
+
+	c = newChecker(conf.AllPermissions,
+		conf.ACLRule{Path: "/alice/private/public/**", Action: conf.ACLAllow},
+		conf.ACLRule{Path: "/alice/private/**", Action: conf.ACLDeny},
+	)
+	assert.True(t, c.allowed("/docs/a.txt", conf.PermWrite))
+	assert.False(t, c.allowed("/private/a.txt", conf.PermRead), "deny rules narrow")
+	assert.True(t, c.allowed("/private/public/a.txt", conf.PermRead), "allow exempts from later rules")
+}
+
+func TestAllowedInMounts(t *testing.T) {
+	c := newChecker(conf.AllPermissions, conf.ACLRule{Groups: []string{"staff"}, Action: conf.ACLAllow, Path: "/**"})
+	fs := c.mount([]conf.Mount{
+		{Path: "/home", FsDir: "/alice"},
+		{Path: "/archive", FsDir: "/archive", Permissions: []conf.Permission{conf.PermRead}},
+	}, func(storage, dir string) webdav.FileSystem {
+		return webdav.NewMemFS()
+	})
+	assert.True(t, c.allowed("/home/a.txt", conf.PermWrite))
+	assert.True(t, c.allowed("/archive/a.txt", conf.PermRead))
+	assert.False(t, c.allowed("/archive/a.txt", conf.PermWrite), "read-only mounts stay read-only")
+	assert.False(t, c.allowed("/archive/a.txt", conf.PermDelete))
+
+	r := httptest.NewRequest("DELETE", "/webdav/archive/a.txt", nil)
+	name, perm, ok := c.checkRequest(r, "/webdav", fs)
+	assert.False(t, ok)
+	assert.Equal(t, "/archive/a.txt", name)
+	assert.Equal(t, conf.PermDelete, perm)
+}
+
+func TestCheckRequest(t *testing.T) {
+	ctx := context.Background()
+	fs := webdav.NewMemFS()
+	f, err := fs.OpenFile(ctx, "/a.txt", os.O_WRONLY|os.O_CREATE, 0644)
+	if assert.NoError(t, err) {
+		assert.NoError(t, f.Close())
+	}
+	check := func(c *accessChecker, method, target string, header map[string]string) (conf.Permission, bool) {
+		r := httptest.NewRequest(method, "/webdav"+target, nil)
+		for key, value := range header {
+			r.Header.Set(key, value)
+		}
+		_, perm, ok := c.checkRequest(r, "/webdav", fs)
+		return perm, ok
+	}
+
+	locker := newChecker([]conf.Permission{conf.PermRead, conf.PermLock})
+	_, ok := check(locker, "LOCK", "/a.txt", nil)
+	assert.True(t, ok)
+	perm, ok := check(locker, "LOCK", "/new.txt", nil)
+	assert.False(t, ok, "locking a missing path creates a file")
+	assert.Equal(t, conf.PermWrite, perm)
+
+	writer := newChecker([]conf.Permission{conf.PermRead, conf.PermWrite})
+	_, ok = check(writer, "COPY", "/a.txt", map[string]string{"Destination": "/webdav/b.txt"})
+	assert.True(t, ok)
+	perm, ok = check(writer, "COPY", "/a.txt", map[string]string{"Destination": "/webdav/a.txt"})
+	assert.False(t, ok, "overwriting deletes the destination")
+	assert.Equal(t, conf.PermDelete, perm)
+	_, ok = check(writer, "COPY", "/a.txt", map[string]string{"Destination": "/webdav/a.txt", "Overwrite": "F"})
+	assert.True(t, ok)
+}
+
+func TestCheckRequestTree(t *testing.T) {
+	ctx := context.Background()
+	fs := webdav.NewMemFS()
+	for _, dir := range []string{"/team", "/team/secret", "/out"} {
+		assert.NoError(t, fs.Mkdir(ctx, dir, 0755))
+	}
+	f, err := fs.OpenFile(ctx, "/team/secret/a.txt", os.O_WRONLY|os.O_CREATE, 0644)
+	if assert.NoError(t, err) {
+		assert.NoError(t, f.Close())
+	}
+	check := func(c *accessChecker, method, target, destination string) (string, conf.Permission, bool) {
+		r := httptest.NewRequest(method, "/webdav"+target, nil)
+		if destination != "" {
+			r.Header.Set("Destination", "/webdav"+destination)
+		}
+		return c.checkRequest(r, "/webdav", fs)
+	}
+
+	c := newChecker(conf.AllPermissions, conf.ACLRule{
+		Path: "/alice/team/secret/**", Action: conf.ACLDeny, Permissions: []conf.Permission{conf.PermDelete},
+	})
+	_, _, ok := check(c, "DELETE", "/team/secret/a.txt", "")
+	assert.False(t, ok)
+	name, perm, ok := check(c, "DELETE", "/team", "")
+	assert.False(t, ok, "deleting the parent deletes the denied child")
+	assert.Equal(t, "/team/secret", name)
+	assert.Equal(t, conf.PermDelete, perm)
+	_, _, ok = check(c, "MOVE", "/team", "/moved")
+	assert.False(t, ok, "moving the parent takes the child out of its rules")
+	_, _, ok = check(c, "COPY", "/team", "/copy")
+	assert.True(t, ok, "copying leaves the child in place")
+	_, _, ok = check(c, "COPY", "/out", "/team")
+	assert.False(t, ok, "overwriting the parent deletes the child")
+	_, _, ok = check(c, "DELETE", "/out", "")
+	assert.True(t, ok)
+
+	c = newChecker(conf.AllPermissions, conf.ACLRule{
+		Path: "/alice/out/team/secret/**", Action: conf.ACLDeny, Permissions: []conf.Permission{conf.PermWrite},
+	})
+	name, perm, ok = check(c, "COPY", "/team", "/out/team")
+	assert.False(t, ok, "the copy of the child would be written where writing is denied")
+	assert.Equal(t, "/out/team/secret", name)
+	assert.Equal(t, conf.PermWrite, perm)
+	_, _, ok = check(c, "COPY", "/team", "/copy")
+	assert.True(t, ok)
+}
@@ -0,0 +1,124 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"html"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/pluveto/flydav/cmd/flydav/conf"
+	"github.com/pluveto/flydav/pkg/logger"
+	"golang.org/x/net/webdav"
+)
+
+// publicMethods are the methods served on public directories.
+var publicMethods = []string{"GET", "HEAD", "OPTIONS", "PROPFIND"}
+
+// publicHandler serves a public directory without credentials.
+func (s *WebdavServer) publicHandler(public conf.Public) (string, http.HandlerFunc) {
+	prefix := path.Clean("/" + public.Path)
+	serve := readOnlyHandler(prefix, s.buildFileSystem(public.Storage, public.FsDir))
+	return prefix, func(w http.ResponseWriter, r *http.Request) {
+		logger.Info("public request: ", r.Method, r.URL.Path)
+		serve(w, r)
+	}
+}
+
+// readOnlyHandler serves fs below prefix with publicMethods. Directories are
+// listed for browsers on GET.
+func readOnlyHandler(prefix string, fs webdav.FileSystem) http.HandlerFunc {
+	davHandler := &webdav.Handler{
+		Prefix:     prefix,
+		FileSystem: readOnlyFileSystem{fs},
+		LockSystem: webdav.NewMemLS(),
+		Logger:     davLogger,
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "GET", "HEAD":
+			if name, ok := stripPrefix(r.URL.Path, prefix); ok {
+				if info, err := fs.Stat(r.Context(), name); err == nil && info.IsDir() {
+					serveDirectory(w, r, fs, name)
+					return
+				}
+			}
+			davHandler.ServeHTTP(w, r)
+		case "OPTIONS":
+			w.Header().Set("Allow", strings.Join(publicMethods, ", "))
+			w.Header().Set("DAV", "1")
+		case "PROPFIND":
+			// an infinite depth would walk the whole tree for anyone asking
+			if depth := r.Header.Get("Depth"); depth != "0" && depth != "1" {
+				http.Error(w, "Depth must be 0 or 1.", http.StatusForbidden)
+				return
+			}
+			davHandler.ServeHTTP(w, r)
+		default:
+			w.Header().Set("Allow", strings.Join(publicMethods, ", "))
+			http.Error(w, "Method Not Allowed.", http.StatusMethodNotAllowed)
+			logger.Warnf("Forbidden: %s %s is read-only", r.Method, r.URL.Path)
+		}
+	}
+}
+
+// serveDirectory lists a directory as links, like http.FileServer does.
+func serveDirectory(w http.ResponseWriter, r *http.Request, fs webdav.FileSystem, name string) {
+	if !strings.HasSuffix(r.URL.Path, "/") {
+		http.Redirect(w, r, path.Base(r.URL.Path)+"/", http.StatusMovedPermanently)
+		return
+	}
+	f, err := fs.OpenFile(r.Context(), name, os.O_RDONLY, 0)
+	if err != nil {
+		http.Error(w, "Not Found.", http.StatusNotFound)
+		return
+	}
+	defer f.Close()
+	infos, err := f.Readdir(-1)
+	if err != nil {
+		http.Error(w, "Internal Error.", http.StatusInternalServerError)
+		logger.Error("failed to list ", r.URL.Path, ": ", err)
+		return
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Name() < infos[j].Name() })
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	fmt.Fprintln(w, "<pre>")
+	for _, info := range infos {
+		entry := info.Name()
+		if info.IsDir() {
+			entry += "/"
+		}
+		link := url.URL{Path: entry}
+		fmt.Fprintf(w, "<a href=\"%s\">%s</a>\n", html.EscapeString(link.String()), html.EscapeString(entry))
+	}
+	fmt.Fprintln(w, "</pre>")
+}
+
+// readOnlyFileSystem refuses any change, should a method slip through.
+type readOnlyFileSystem struct {
+	webdav.FileSystem
+}
+
+func (readOnlyFileSystem) Mkdir(ctx context.Context, name string, perm os.FileMode) error {
+	return os.ErrPermission
+}
+
+func (readOnlyFileSystem) RemoveAll(ctx context.Context, name string) error {
+	return os.ErrPermission
+}
+
+func (readOnlyFileSystem) Rename(ctx context.Context, oldName, newName string) error {
+	return os.ErrPermission
+}
+
+func (fs readOnlyFileSystem) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (webdav.File, error) {
+	if flag&(os.O_WRONLY|os.O_RDWR|os.O_CREATE|os.O_TRUNC|os.O_APPEND) != 0 {
+		return nil, os.ErrPermission
+	}
+	return fs.FileSystem.OpenFile(ctx, name, flag, perm)
+}
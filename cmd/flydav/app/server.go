@@ -0,0 +1,140 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+
+	"github.com/pluveto/flydav/pkg/listener"
+	"github.com/pluveto/flydav/pkg/logger"
+)
+
+type boundServer struct {
+	server   *http.Server
+	listener net.Listener
+	// tls is decided before serving since Serve may set up server.TLSConfig
+	tls bool
+}
+
+// serverGroup runs several http.Servers on listeners taken from a pool and
+// stops them together.
+type serverGroup struct {
+	pool  *listener.Pool
+	bound []boundServer
+	errs  chan error
+}
+
+func newServerGroup(pool *listener.Pool) *serverGroup {
+	return &serverGroup{
+		pool: pool,
+		errs: make(chan error, 1),
+	}
+}
+
+// Add binds srv on every address, reusing inherited listeners.
+func (g *serverGroup) Add(srv *http.Server, addrs []string) {
+	for _, addr := range addrs {
+		ln, err := g.pool.Listen(addr)
+		if err != nil {
+			logger.Fatal("failed to listen on ", addr, ": ", err)
+		}
+		g.bound = append(g.bound, boundServer{server: srv, listener: ln, tls: srv.TLSConfig != nil})
+	}
+}
+
+// port returns the TCP port srv is bound on, 443 if that is one of them.
+func (g *serverGroup) port(srv *http.Server) (int, bool) {
+	port, ok := 0, false
+	for _, b := range g.bound {
+		addr, isTCP := b.listener.Addr().(*net.TCPAddr)
+		if b.server != srv || !isTCP {
+			continue
+		}
+		if !ok || addr.Port == 443 {
+			port, ok = addr.Port, true
+		}
+	}
+	return port, ok
+}
+
+func (g *serverGroup) Serve() {
+	g.pool.CloseUnused()
+	for _, b := range g.bound {
+		go func(srv *http.Server, ln net.Listener, useTLS bool) {
+			var err error
+			if useTLS {
+				err = srv.ServeTLS(ln, "", "")
+			} else {
+				err = srv.Serve(ln)
+			}
+			if !errors.Is(err, http.ErrServerClosed) {
+				g.errs <- err
+			}
+		}(b.server, b.listener, b.tls)
+		logger.Info("serving on ", b.listener.Addr())
+	}
+}
+
+// Shutdown stops accepting connections and waits for active requests until
+// ctx is done. Remaining connections are closed forcibly afterwards.
+func (g *serverGroup) Shutdown(ctx context.Context) {
+	var wg sync.WaitGroup
+	stopped := make(map[*http.Server]bool)
+	for _, b := range g.bound {
+		srv := b.server
+		if stopped[srv] {
+			continue
+		}
+		stopped[srv] = true
+		wg.Add(1)
+		go func(srv *http.Server) {
+			defer wg.Done()
+			if err := srv.Shutdown(ctx); err != nil {
+				logger.Warn("failed to drain connections, closing them: ", err)
+				srv.Close()
+			}
+		}(srv)
+	}
+	wg.Wait()
+}
+
+// waitForSignal blocks until the server is asked to stop or to hand over its
+// listeners to a new process, then drains active requests.
+func (s *WebdavServer) waitForSignal(group *serverGroup) {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, shutdownSignals...)
+	if upgradeSignal != nil {
+		signal.Notify(sigs, upgradeSignal)
+	}
+	defer signal.Stop(sigs)
+
+	for {
+		select {
+		case err := <-group.errs:
+			logger.Fatal("server stopped unexpectedly: ", err)
+		case sig := <-sigs:
+			if sig == upgradeSignal {
+				logger.Info("received ", sig, ", starting new process")
+				child, err := group.pool.Upgrade(s.ShutdownTimeout)
+				if err != nil {
+					logger.Error("upgrade failed, keep serving: ", err)
+					continue
+				}
+				logger.Info("new process ", child.Pid, " is ready")
+			}
+			logger.Info("shutting down, draining active requests for at most ", s.ShutdownTimeout)
+			ctx, cancel := context.WithTimeout(context.Background(), s.ShutdownTimeout)
+			group.Shutdown(ctx)
+			cancel()
+			if s.AppPasswordService != nil {
+				s.AppPasswordService.Flush()
+			}
+			logger.Info("server stopped")
+			return
+		}
+	}
+}
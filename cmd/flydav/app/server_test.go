@@ -0,0 +1,41 @@
+package app
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/pluveto/flydav/pkg/listener"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHTTPSRedirectBoundPort(t *testing.T) {
+	pool, err := listener.NewPool(listener.SocketOptions{})
+	assert.NoError(t, err)
+	group := newServerGroup(pool)
+	server, other := &http.Server{}, &http.Server{}
+	group.Add(other, []string{"localhost:0"})
+	group.Add(server, []string{"unix:" + filepath.Join(t.TempDir(), "dav.sock"), "127.0.0.1:0"})
+	defer func() {
+		for _, b := range group.bound {
+			b.listener.Close()
+		}
+	}()
+
+	port, ok := group.port(server)
+	assert.True(t, ok)
+	assert.Equal(t, group.bound[2].listener.Addr().(*net.TCPAddr).Port, port)
+	_, ok = group.port(&http.Server{})
+	assert.False(t, ok)
+
+	redirect := func(port int, target string) string {
+		w := httptest.NewRecorder()
+		(&httpsRedirect{port: port}).ServeHTTP(w, httptest.NewRequest("PUT", target, nil))
+		assert.Equal(t, http.StatusPermanentRedirect, w.Code)
+		return w.Header().Get("Location")
+	}
+	assert.Equal(t, "https://dav.example.com:8443/a%20b?x=1", redirect(8443, "http://dav.example.com:8080/a%20b?x=1"))
+	assert.Equal(t, "https://dav.example.com/a", redirect(443, "http://dav.example.com:8080/a"))
+}
@@ -0,0 +1,482 @@
+package app
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/pluveto/flydav/cmd/flydav/conf"
+	"github.com/pluveto/flydav/pkg/logger"
+	"github.com/pluveto/flydav/pkg/sharestore"
+	"golang.org/x/net/webdav"
+)
+
+// createShareRequest is the body of a POST to the share API.
+type createShareRequest struct {
+	Path         string     `json:"path"`
+	Mode         string     `json:"mode"` // sharestore.ModeRead by default
+	Password     string     `json:"password"`
+	Expires      *time.Time `json:"expires"`
+	ExpiresIn    int        `json:"expires_in"` // Seconds, if Expires is not set
+	MaxDownloads int        `json:"max_downloads"`
+}
+
+type shareResponse struct {
+	Token        string    `json:"token"`
+	URL          string    `json:"url"`
+	Path         string    `json:"path"`
+	Dir          bool      `json:"dir"`
+	Mode         string    `json:"mode"`
+	Password     bool      `json:"password"`
+	Created      time.Time `json:"created"`
+	Expires      time.Time `json:"expires"`
+	MaxDownloads int       `json:"max_downloads"`
+	Downloads    int       `json:"downloads"`
+}
+
+// shareAPI lets users create, list and delete their shares.
+func (s *WebdavServer) shareAPI(w http.ResponseWriter, r *http.Request) {
+	logger.Info("share API request: ", r.Method, r.URL.Path)
+	access, fs, _, ok := s.login(w, r)
+	if !ok {
+		return
+	}
+	token := strings.Trim(strings.TrimPrefix(r.URL.Path, s.Share.APIPath), "/")
+	switch {
+	case r.Method == "GET" && token == "":
+		ret := []shareResponse{}
+		for _, share := range s.Shares.List(access.username) {
+			ret = append(ret, s.shareResponse(r, share))
+		}
+		writeJSON(w, http.StatusOK, ret)
+	case r.Method == "POST" && token == "":
+		s.createShare(w, r, access, fs)
+	case r.Method == "DELETE" && token != "":
+		if err := s.Shares.Delete(access.username, token); err != nil {
+			if errors.Is(err, sharestore.ErrNotFound) {
+				http.Error(w, "Not Found.", http.StatusNotFound)
+				return
+			}
+			http.Error(w, "Internal Error.", http.StatusInternalServerError)
+			logger.Error("failed to delete share: ", err)
+			return
+		}
+		logger.Infof("user %s deleted share %s", access.username, token)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "Method Not Allowed.", http.StatusMethodNotAllowed)
+	}
+}
+
+func (s *WebdavServer) createShare(w http.ResponseWriter, r *http.Request, access *accessChecker, fs webdav.FileSystem) {
+	// forms of other sites cannot send JSON, which keeps them from creating
+	// links with the credentials the browser remembers
+	if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType != "application/json" {
+		http.Error(w, "Unsupported Media Type, send application/json.", http.StatusUnsupportedMediaType)
+		return
+	}
+	var req createShareRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<16)).Decode(&req); err != nil {
+		http.Error(w, "Invalid request: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	perm := conf.PermRead
+	switch req.Mode {
+	case "":
+		req.Mode = sharestore.ModeRead
+	case sharestore.ModeRead:
+	case sharestore.ModeUpload:
+		perm = conf.PermWrite
+	default:
+		http.Error(w, "Invalid mode "+req.Mode+".", http.StatusBadRequest)
+		return
+	}
+	if req.MaxDownloads < 0 {
+		http.Error(w, "Invalid max_downloads.", http.StatusBadRequest)
+		return
+	}
+
+	name := path.Clean("/" + req.Path)
+	if !access.allowed(name, perm) {
+		http.Error(w, "Forbidden.", http.StatusForbidden)
+		logger.Warnf("Forbidden: user %s lacks %s permission to share %s", access.username, perm, name)
+		return
+	}
+	resolved, _, ok := access.resolve(name)
+	if !ok || access.layered(name) {
+		http.Error(w, "Cannot share "+name+".", http.StatusBadRequest)
+		return
+	}
+	info, err := fs.Stat(r.Context(), name)
+	if err != nil {
+		http.Error(w, "Not Found.", http.StatusNotFound)
+		return
+	}
+	if req.Mode == sharestore.ModeUpload && !info.IsDir() {
+		http.Error(w, "Upload shares need a folder.", http.StatusBadRequest)
+		return
+	}
+
+	now := time.Now()
+	expires := now.Add(time.Duration(s.Share.DefaultTTL) * time.Second)
+	if req.Expires != nil {
+		expires = *req.Expires
+	} else if req.ExpiresIn > 0 {
+		expires = now.Add(time.Duration(req.ExpiresIn) * time.Second)
+	}
+	if !expires.After(now) {
+		http.Error(w, "Expiry is in the past.", http.StatusBadRequest)
+		return
+	}
+	if s.Share.MaxTTL > 0 && expires.After(now.Add(time.Duration(s.Share.MaxTTL)*time.Second)) {
+		http.Error(w, fmt.Sprintf("Expiry exceeds %d seconds.", s.Share.MaxTTL), http.StatusBadRequest)
+		return
+	}
+
+	share, err := s.Shares.Create(sharestore.Share{
+		Owner:        access.username,
+		Groups:       access.groups,
+		Path:         name,
+		Storage:      access.storageOf(name),
+		Target:       resolved,
+		Dir:          info.IsDir(),
+		Mode:         req.Mode,
+		Expires:      expires,
+		MaxDownloads: req.MaxDownloads,
+	}, req.Password)
+	if err != nil {
+		http.Error(w, "Internal Error.", http.StatusInternalServerError)
+		logger.Error("failed to create share: ", err)
+		return
+	}
+	logger.Infof("user %s shared %s for %s until %s", access.username, name, share.Mode, share.Expires.Format(time.RFC3339))
+	writeJSON(w, http.StatusCreated, s.shareResponse(r, share))
+}
+
+func (s *WebdavServer) shareResponse(r *http.Request, share sharestore.Share) shareResponse {
+	base := strings.TrimSuffix(s.Share.BaseURL, "/")
+	if base == "" {
+		scheme := "http"
+		if r.TLS != nil {
+			scheme = "https"
+		}
+		base = scheme + "://" + r.Host
+	}
+	return shareResponse{
+		Token:        share.Token,
+		URL:          base + s.Share.Path + "/" + share.Token,
+		Path:         share.Path,
+		Dir:          share.Dir,
+		Mode:         share.Mode,
+		Password:     share.PasswordHash != "",
+		Created:      share.Created,
+		Expires:      share.Expires,
+		MaxDownloads: share.MaxDownloads,
+		Downloads:    share.Downloads,
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		logger.Error("failed to write response: ", err)
+	}
+}
+
+// shareLink serves shares below Share.Path to anyone with the link, and the
+// password if the share has one.
+func (s *WebdavServer) shareLink(w http.ResponseWriter, r *http.Request) {
+	logger.Info("share request: ", r.Method, r.URL.Path)
+	token, _, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, s.Share.Path+"/"), "/")
+	share, ok := s.Shares.Get(token)
+	if ok && share.Storage != "" && s.Storages[share.Storage] == nil {
+		// the storage has been removed from the config since
+		ok = false
+	}
+	if !ok {
+		http.Error(w, "Not Found.", http.StatusNotFound)
+		return
+	}
+	if !s.unlockShare(w, r, share) {
+		return
+	}
+
+	perm := conf.PermRead
+	if share.Mode == sharestore.ModeUpload {
+		perm = conf.PermWrite
+	}
+	access, err := s.shareAccess(share, perm)
+	if err != nil {
+		http.Error(w, "Not Found.", http.StatusNotFound)
+		logger.Warnf("share %s of user %s is not served: %s", share.Token, share.Owner, err)
+		return
+	}
+
+	prefix := s.Share.Path + "/" + token
+	switch {
+	case share.Mode == sharestore.ModeUpload:
+		s.serveUpload(w, r, share, prefix, s.storageDir(share.Storage, share.Target), access)
+	case share.Dir:
+		s.serveSharedDir(w, r, share, prefix, access.wrap(s.storageDir(share.Storage, share.Target)), access)
+	default:
+		s.serveSharedFile(w, r, share, s.storageDir(share.Storage, path.Dir(share.Target)), path.Base(share.Target))
+	}
+}
+
+// shareAccess returns the access of a link to a share, limited to perm. The
+// owner is looked up again, so removing the owner or taking away the
+// permission, on the user, the mount or by access rules, ends the link.
+func (s *WebdavServer) shareAccess(share sharestore.Share, perm conf.Permission) (*accessChecker, error) {
+	var profiles ProfileService
+	if err := s.resolveUser(share.Owner); err == nil {
+		profiles = s.AuthService
+	} else if s.TokenAuthService == nil {
+		return nil, err
+	} else if _, err := s.TokenAuthService.GetAuthorizedSubDir(share.Owner); err == nil {
+		profiles = s.TokenAuthService
+	} else {
+		return nil, err
+	}
+	permissions, err := profiles.GetPermissions(share.Owner)
+	if err != nil {
+		return nil, err
+	}
+	groups, err := profiles.GetGroups(share.Owner)
+	if err != nil {
+		return nil, err
+	}
+	if !hasPermission(permissions, perm) {
+		return nil, fmt.Errorf("the owner lacks %s permission", perm)
+	}
+	if ok, err := ownerReaches(profiles, share, perm); err != nil || !ok {
+		if err == nil {
+			err = fmt.Errorf("the owner has no %s access to %s any more", perm, share.Path)
+		}
+		return nil, err
+	}
+	// access rules of the owner still apply, below a shared folder too
+	access := &accessChecker{
+		username: share.Owner,
+		groups:   groups,
+		granted:  []conf.Permission{perm},
+		acl:      s.ACLService,
+		root:     share.Target,
+	}
+	if !access.allowed("/", perm) {
+		return nil, fmt.Errorf("access rules deny %s on %s", perm, share.Target)
+	}
+	return access, nil
+}
+
+// ownerReaches reports whether the owner of a share still reaches its target
+// with perm, through the sub dir or one of the mounts.
+func ownerReaches(profiles ProfileService, share sharestore.Share, perm conf.Permission) (bool, error) {
+	within := func(storage, dir string) bool {
+		dir = path.Join("/", filepath.ToSlash(dir))
+		return storage == share.Storage && (dir == "/" || share.Target == dir || strings.HasPrefix(share.Target, dir+"/"))
+	}
+	mounts, err := profiles.GetMounts(share.Owner)
+	if err != nil {
+		return false, err
+	}
+	if len(mounts) == 0 {
+		storage, err := profiles.GetStorage(share.Owner)
+		if err != nil {
+			return false, err
+		}
+		subFsDir, err := profiles.GetAuthorizedSubDir(share.Owner)
+		if err != nil {
+			return false, err
+		}
+		return within(storage, subFsDir), nil
+	}
+	for _, mount := range mounts {
+		if within(mount.Storage, mount.FsDir) && (len(mount.Permissions) == 0 || hasPermission(mount.Permissions, perm)) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// unlockShare checks the password of a share, taken from Basic auth.
+func (s *WebdavServer) unlockShare(w http.ResponseWriter, r *http.Request, share sharestore.Share) bool {
+	if share.PasswordHash == "" {
+		return true
+	}
+	ip := s.clientIP(r)
+	if s.throttle(w, ip, "") {
+		return false
+	}
+	_, password, ok := r.BasicAuth()
+	if !ok {
+		w.Header().Set("WWW-Authenticate", `Basic realm="Share"`)
+		http.Error(w, "Unauthorized.", http.StatusUnauthorized)
+		return false
+	}
+	// usernames cannot contain a colon, so this key never clashes with one
+	key := "share:" + share.Token
+	version := func(string) string { return share.PasswordHash }
+	if s.CredentialCache != nil {
+		if _, ok := s.CredentialCache.Verify(key, password, version); ok {
+			return true
+		}
+	}
+	if !sharestore.CheckPassword(share, password) {
+		s.loginFailed(ip, "", fmt.Errorf("wrong password for share %s", share.Token))
+		w.Header().Set("WWW-Authenticate", `Basic realm="Share"`)
+		http.Error(w, "Unauthorized.", http.StatusUnauthorized)
+		return false
+	}
+	s.loginSucceeded(ip, "")
+	if s.CredentialCache != nil {
+		s.CredentialCache.Add(key, password, share.PasswordHash, "")
+	}
+	return true
+}
+
+// countDownload counts full downloads, and the first part of ranged ones.
+func (s *WebdavServer) countDownload(w http.ResponseWriter, r *http.Request, share sharestore.Share) bool {
+	if r.Method != "GET" {
+		return true
+	}
+	if rng := r.Header.Get("Range"); rng != "" && !strings.HasPrefix(rng, "bytes=0-") {
+		return true
+	}
+	switch err := s.Shares.Download(share.Token); {
+	case err == nil:
+		return true
+	case errors.Is(err, sharestore.ErrExhausted):
+		http.Error(w, "Download limit reached.", http.StatusGone)
+	case errors.Is(err, sharestore.ErrNotFound):
+		http.Error(w, "Not Found.", http.StatusNotFound)
+	default:
+		http.Error(w, "Internal Error.", http.StatusInternalServerError)
+		logger.Error("failed to count download of share: ", err)
+	}
+	return false
+}
+
+func (s *WebdavServer) serveSharedFile(w http.ResponseWriter, r *http.Request, share sharestore.Share, dir webdav.FileSystem, name string) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "Method Not Allowed.", http.StatusMethodNotAllowed)
+		return
+	}
+	f, err := dir.OpenFile(r.Context(), "/"+name, os.O_RDONLY, 0)
+	if err != nil {
+		http.Error(w, "Not Found.", http.StatusNotFound)
+		return
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil || info.IsDir() {
+		http.Error(w, "Not Found.", http.StatusNotFound)
+		return
+	}
+	if !s.countDownload(w, r, share) {
+		return
+	}
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": info.Name()}))
+	http.ServeContent(w, r, info.Name(), info.ModTime(), f)
+}
+
+func (s *WebdavServer) serveSharedDir(w http.ResponseWriter, r *http.Request, share sharestore.Share, prefix string, fs webdav.FileSystem, access *accessChecker) {
+	name, _ := stripPrefix(r.URL.Path, prefix)
+	if name == "" {
+		name = "/"
+	}
+	if !access.allowed(name, conf.PermRead) {
+		http.Error(w, "Forbidden.", http.StatusForbidden)
+		logger.Warnf("Forbidden: share %s of user %s does not allow reading %s", share.Token, share.Owner, name)
+		return
+	}
+	if r.Method == "GET" {
+		if info, err := fs.Stat(r.Context(), name); err == nil && !info.IsDir() && !s.countDownload(w, r, share) {
+			return
+		}
+	}
+	readOnlyHandler(prefix, fs)(w, r)
+}
+
+// uploadPage lets browsers put files into upload shares.
+const uploadPage = `<!DOCTYPE html>
+<meta charset="utf-8">
+<title>Upload</title>
+<input type="file" id="files" multiple>
+<button id="upload">Upload</button>
+<pre id="log"></pre>
+<script>
+document.getElementById("upload").onclick = async () => {
+  const log = document.getElementById("log")
+  for (const file of document.getElementById("files").files) {
+    const url = location.pathname.replace(/\/?$/, "/") + encodeURIComponent(file.name)
+    const res = await fetch(url, {method: "PUT", body: file})
+    log.textContent += file.name + ": " + (res.ok ? "uploaded" : res.status + " " + await res.text()) + "\n"
+  }
+}
+</script>
+`
+
+// serveUpload takes new files into an upload share. Existing files are
+// neither listed nor replaced.
+func (s *WebdavServer) serveUpload(w http.ResponseWriter, r *http.Request, share sharestore.Share, prefix string, dir webdav.FileSystem, access *accessChecker) {
+	name, _ := stripPrefix(r.URL.Path, prefix)
+	name = strings.TrimPrefix(name, "/")
+	switch {
+	case r.Method == "OPTIONS":
+		w.Header().Set("Allow", "GET, PUT, OPTIONS")
+	case (r.Method == "GET" || r.Method == "HEAD") && name == "":
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		io.WriteString(w, uploadPage)
+	case r.Method == "PUT" && name != "" && !strings.Contains(name, "/"):
+		if !access.allowed("/"+name, conf.PermWrite) {
+			http.Error(w, "Forbidden.", http.StatusForbidden)
+			logger.Warnf("Forbidden: share %s of user %s does not allow writing %s", share.Token, share.Owner, name)
+			return
+		}
+		f, err := dir.OpenFile(r.Context(), "/"+name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+		if errors.Is(err, os.ErrExist) {
+			http.Error(w, "File exists.", http.StatusConflict)
+			return
+		}
+		if isStorageFull(err) {
+			http.Error(w, "Insufficient Storage.", http.StatusInsufficientStorage)
+			logger.Warnf("storage full, upload of %s to share %s of user %s failed", name, share.Token, share.Owner)
+			return
+		}
+		if err != nil {
+			http.Error(w, "Internal Error.", http.StatusInternalServerError)
+			logger.Error("failed to create upload: ", err)
+			return
+		}
+		_, err = io.Copy(f, r.Body)
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			dir.RemoveAll(r.Context(), "/"+name)
+			if isStorageFull(err) {
+				http.Error(w, "Insufficient Storage.", http.StatusInsufficientStorage)
+				logger.Warnf("storage full, upload of %s to share %s of user %s failed", name, share.Token, share.Owner)
+				return
+			}
+			http.Error(w, "Internal Error.", http.StatusInternalServerError)
+			logger.Error("failed to write upload: ", err)
+			return
+		}
+		logger.Infof("uploaded %s to share %s of user %s", name, share.Token, share.Owner)
+		w.WriteHeader(http.StatusCreated)
+	default:
+		w.Header().Set("Allow", "GET, PUT, OPTIONS")
+		http.Error(w, "Method Not Allowed.", http.StatusMethodNotAllowed)
+	}
+}
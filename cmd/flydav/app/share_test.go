@@ -0,0 +1,65 @@
+package app
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/pluveto/flydav/cmd/flydav/conf"
+	"github.com/pluveto/flydav/cmd/flydav/service"
+	"github.com/pluveto/flydav/pkg/sharestore"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestShareAccess(t *testing.T) {
+	users := []conf.User{
+		{Username: "alice", SubFsDir: "alice"},
+		{Username: "reader", SubFsDir: "reader", Permissions: []conf.Permission{conf.PermRead}},
+		{Username: "carol", Mount: []conf.Mount{
+			{Path: "/archive", FsDir: "archive", Permissions: []conf.Permission{conf.PermRead}},
+		}},
+	}
+	s := &WebdavServer{
+		AuthService: service.NewBasicAuthService(users, nil),
+		ACLService: service.NewACLService([]conf.ACLRule{
+			{Path: "/alice/private/**", Action: conf.ACLDeny},
+		}),
+	}
+
+	_, err := s.shareAccess(sharestore.Share{Owner: "alice", Target: "/alice/docs/a.txt"}, conf.PermRead)
+	assert.NoError(t, err)
+	_, err = s.shareAccess(sharestore.Share{Owner: "alice", Target: "/bob/a.txt"}, conf.PermRead)
+	assert.Error(t, err, "outside the sub dir of the owner")
+	_, err = s.shareAccess(sharestore.Share{Owner: "alice", Target: "/alice/private/a.txt"}, conf.PermRead)
+	assert.Error(t, err, "access rules apply to single files")
+	_, err = s.shareAccess(sharestore.Share{Owner: "mallory", Target: "/mallory/a.txt"}, conf.PermRead)
+	assert.Error(t, err, "the owner has been removed")
+
+	_, err = s.shareAccess(sharestore.Share{Owner: "reader", Target: "/reader/inbox", Dir: true}, conf.PermRead)
+	assert.NoError(t, err)
+	_, err = s.shareAccess(sharestore.Share{Owner: "reader", Target: "/reader/inbox", Dir: true}, conf.PermWrite)
+	assert.Error(t, err, "the owner is read-only now")
+
+	_, err = s.shareAccess(sharestore.Share{Owner: "carol", Target: "/archive/2023"}, conf.PermRead)
+	assert.NoError(t, err)
+	_, err = s.shareAccess(sharestore.Share{Owner: "carol", Target: "/archive/2023"}, conf.PermWrite)
+	assert.Error(t, err, "the mount is read-only")
+}
+
+func TestCreateShareContentType(t *testing.T) {
+	s := &WebdavServer{}
+	access := newChecker(conf.AllPermissions)
+	create := func(contentType, body string) int {
+		r := httptest.NewRequest("POST", "/api/shares", strings.NewReader(body))
+		r.Header.Set("Content-Type", contentType)
+		w := httptest.NewRecorder()
+		s.createShare(w, r, access, nil)
+		return w.Code
+	}
+	body := `{"path": "/docs/report.pdf"}`
+	assert.Equal(t, http.StatusUnsupportedMediaType, create("text/plain", body), "a form of another site")
+	assert.Equal(t, http.StatusUnsupportedMediaType, create("application/x-www-form-urlencoded", body))
+	assert.Equal(t, http.StatusUnsupportedMediaType, create("", body))
+	assert.Equal(t, http.StatusBadRequest, create("application/json; charset=utf-8", "{"), "JSON is decoded")
+}
@@ -0,0 +1,13 @@
+//go:build !windows
+
+package app
+
+import (
+	"os"
+	"syscall"
+)
+
+var shutdownSignals = []os.Signal{syscall.SIGINT, syscall.SIGTERM}
+
+// upgradeSignal asks the server to re-exec its binary and hand over the listeners.
+var upgradeSignal os.Signal = syscall.SIGUSR2
@@ -0,0 +1,12 @@
+//go:build windows
+
+package app
+
+import (
+	"os"
+)
+
+var shutdownSignals = []os.Signal{os.Interrupt}
+
+// upgradeSignal is nil since listeners cannot be handed over on Windows.
+var upgradeSignal os.Signal
@@ -0,0 +1,115 @@
+package app
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/pluveto/flydav/cmd/flydav/conf"
+	"github.com/pluveto/flydav/pkg/logger"
+	"github.com/pluveto/flydav/pkg/tlsutil"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// buildTLSConfig returns the TLS config of the HTTPS listener and the handler
+// serving the plain HTTP redirect port, which answers ACME challenges before
+// passing requests to redirect.
+func buildTLSConfig(cnf conf.TLS, redirect http.Handler) (*tls.Config, http.Handler, error) {
+	minVersion, err := tlsutil.ParseVersion(cnf.MinVersion)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var tlsConfig *tls.Config
+	var plainHandler = redirect
+	if cnf.ACME.Enabled {
+		manager, err := newACMEManager(cnf.ACME)
+		if err != nil {
+			return nil, nil, err
+		}
+		tlsConfig = &tls.Config{
+			GetCertificate: manager.GetCertificate,
+			NextProtos:     []string{"h2", "http/1.1", acme.ALPNProto},
+		}
+		// HTTP-01 is only offered to the CA once the challenge handler is in use
+		if cnf.RedirectPort != 0 {
+			plainHandler = manager.HTTPHandler(plainHandler)
+		}
+	} else {
+		interval := time.Duration(cnf.ReloadInterval) * time.Second
+		reloader, err := tlsutil.NewCertReloader(cnf.CertFile, cnf.KeyFile, interval)
+		if err != nil {
+			return nil, nil, err
+		}
+		reloader.OnError(func(err error) {
+			logger.Error("failed to reload TLS certificate, keep serving the old one: ", err)
+		})
+		tlsConfig = &tls.Config{
+			GetCertificate: reloader.GetCertificate,
+		}
+	}
+
+	if cnf.ClientAuth.Enabled {
+		tlsConfig.ClientCAs, err = tlsutil.LoadCABundle(cnf.ClientAuth.CABundle, false)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to load client CA bundle: %w", err)
+		}
+		tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+		if cnf.ClientAuth.Require {
+			tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+		}
+	}
+
+	err = tlsutil.ApplyPolicy(tlsConfig, cnf.CipherPolicy, minVersion)
+	if err != nil {
+		return nil, nil, err
+	}
+	return tlsConfig, plainHandler, nil
+}
+
+func newACMEManager(cnf conf.ACME) (*autocert.Manager, error) {
+	client := &acme.Client{
+		DirectoryURL: cnf.DirectoryURL,
+	}
+	if client.DirectoryURL == "" {
+		client.DirectoryURL = autocert.DefaultACMEDirectory
+	}
+	if cnf.CABundle != "" {
+		pool, err := tlsutil.LoadCABundle(cnf.CABundle, true)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load ACME CA bundle: %w", err)
+		}
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+		client.HTTPClient = &http.Client{Transport: transport}
+	}
+
+	logger.Info("using ACME directory ", client.DirectoryURL, " for ", cnf.Domains)
+	return &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		Cache:      autocert.DirCache(cnf.CacheDir),
+		HostPolicy: autocert.HostWhitelist(cnf.Domains...),
+		Client:     client,
+		Email:      cnf.Email,
+	}, nil
+}
+
+// httpsRedirect sends plain HTTP clients to the same URL on the HTTPS port.
+// 308 is used so that WebDAV clients keep the method and body.
+type httpsRedirect struct {
+	port int // Set once the HTTPS listeners are bound
+}
+
+func (h *httpsRedirect) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	host, _, err := net.SplitHostPort(r.Host)
+	if err != nil {
+		host = r.Host
+	}
+	if h.port != 443 {
+		host = net.JoinHostPort(host, fmt.Sprint(h.port))
+	}
+	http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusPermanentRedirect)
+}
@@ -1,30 +1,119 @@
 package app
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"net"
 	"net/http"
 	"os"
 	"path/filepath"
 	"strings"
+	"syscall"
+	"time"
 
+	"github.com/pluveto/flydav/cmd/flydav/conf"
+	"github.com/pluveto/flydav/pkg/credcache"
+	"github.com/pluveto/flydav/pkg/digestauth"
+	"github.com/pluveto/flydav/pkg/ipfilter"
+	"github.com/pluveto/flydav/pkg/listener"
 	"github.com/pluveto/flydav/pkg/logger"
+	"github.com/pluveto/flydav/pkg/loginguard"
+	"github.com/pluveto/flydav/pkg/sharestore"
+	"github.com/pluveto/flydav/pkg/storage"
 	"github.com/sirupsen/logrus"
 	"golang.org/x/net/webdav"
 )
 
-type AuthService interface {
-	Authenticate(username, password string) error
+// ProfileService provides the settings of authenticated users.
+type ProfileService interface {
 	GetAuthorizedSubDir(username string) (string, error)
+	// GetStorage returns the storage holding the sub dir, "" for FsDir.
+	GetStorage(username string) (string, error)
 	GetPathPrefix(username string) (string, error)
+	GetPermissions(username string) ([]conf.Permission, error)
+	GetGroups(username string) ([]string, error)
+	GetMounts(username string) ([]conf.Mount, error)
+}
+
+type AuthService interface {
+	Authenticate(username, password string) error
+	ProfileService
+}
+
+// UserResolver is implemented by auth services that only know the profile
+// of a user after a login, to look it up in the backend without a password,
+// e.g. for client certificates.
+type UserResolver interface {
+	ResolveUser(username string) error
+}
+
+// TokenAuthService authenticates bearer tokens, e.g. OpenID Connect JWTs.
+type TokenAuthService interface {
+	AuthenticateToken(token string) (username string, err error)
+	ProfileService
+}
+
+// CredentialVersioner is implemented by auth services whose stored
+// credentials can change while running, e.g. a reloaded htpasswd file. A
+// changed version invalidates cached logins and sessions of the user.
+type CredentialVersioner interface {
+	CredentialVersion(username string) string
+}
+
+// AppPasswordService checks additional, scoped passwords of users.
+type AppPasswordService interface {
+	Authenticate(username, password string) (*conf.AppPassword, error)
+	Get(username, name string) (*conf.AppPassword, bool)
+	// CredentialVersion is "" for revoked or expired app passwords.
+	CredentialVersion(username, name string) string
+	Touch(username, name string)
+	// Flush saves what Touch recorded, it is called on shutdown.
+	Flush()
+}
+
+// DigestAuthService provides the stored HA1 hashes of users for Digest auth.
+type DigestAuthService interface {
+	HA1(username, algorithm string) (string, bool)
+}
+
+type ACLService interface {
+	// Decide returns the action of the first rule matching, or "" if none does.
+	Decide(username string, groups []string, path string, perm conf.Permission) conf.ACLAction
 }
 
 type WebdavServer struct {
-	AuthService AuthService
-	Host        string
-	Port        int
-	Path        string
-	FsDir       string
-	Middlewares []func(http.HandlerFunc) http.HandlerFunc
+	AuthService        AuthService
+	TokenAuthService   TokenAuthService   // Optional
+	ACLService         ACLService         // Optional
+	AppPasswordService AppPasswordService // Optional
+	DigestAuthService  DigestAuthService  // Optional, needs Digest
+	Digest             *digestauth.Server // Optional
+	IPFilter           *ipfilter.Filter   // Optional
+	// UserIPFilters limits where users log in from, by username
+	UserIPFilters   map[string]*ipfilter.Filter
+	TrustedProxies  []*net.IPNet
+	LoginGuard      *loginguard.Guard // Optional
+	CredentialCache *credcache.Cache  // Optional
+	Sessions        *credcache.Cache  // Optional
+	Host            string
+	Port            int
+	Path            string
+	FsDir           string
+	// Storages are the named backends besides FsDir, see storage.Open. The
+	// one named "" is FsDir itself when it is encrypted.
+	Storages map[string]webdav.FileSystem
+	TLS      conf.TLS
+	// Public directories are served without credentials
+	Public []conf.Public
+	Shares *sharestore.Store // Optional
+	Share  conf.Share
+	// ListenAddrs overrides Host and Port, see listener.Pool for the format
+	ListenAddrs   []string
+	SocketOptions listener.SocketOptions
+	// ShutdownTimeout bounds how long active requests are drained on shutdown
+	ShutdownTimeout time.Duration
+	Middlewares     []func(http.HandlerFunc) http.HandlerFunc
 }
 
 func NewWebdavServer(authService AuthService, host string, port int, path string, fsDir string) *WebdavServer {
@@ -72,58 +161,190 @@ func (s *WebdavServer) check() {
 	logger.Debug("FsDir: ", s.FsDir)
 }
 
+// wrapHandler applies the middlewares to h, after rejecting clients not
+// admitted by the IPFilter.
 func (s *WebdavServer) wrapHandler(h http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
+		if ip := s.clientIP(r); !s.IPFilter.Allowed(ip) {
+			http.Error(w, "Forbidden.", http.StatusForbidden)
+			logger.Warnf("Forbidden: client %s is not allowed for %s %s", ip, r.Method, r.URL.Path)
+			return
+		}
+		handler := h
 		for _, middleware := range s.Middlewares {
-			h = middleware(h)
+			handler = middleware(handler)
 		}
-		h(w, r)
+		handler(w, r)
 	}
 }
 
 func (s *WebdavServer) Listen() {
 	s.check()
 
+	for _, public := range s.Public {
+		prefix, handler := s.publicHandler(public)
+		http.HandleFunc(prefix+"/", s.wrapHandler(handler))
+	}
+	if s.Shares != nil {
+		http.HandleFunc(s.Share.APIPath, s.wrapHandler(s.shareAPI))
+		http.HandleFunc(s.Share.APIPath+"/", s.wrapHandler(s.shareAPI))
+		http.HandleFunc(s.Share.Path+"/", s.wrapHandler(s.shareLink))
+	}
 	lock := webdav.NewMemLS()
 	http.HandleFunc("/", s.wrapHandler(func(w http.ResponseWriter, r *http.Request) {
 		logger.Info("request: ", r.Method, r.URL.Path)
-		username, password, ok := r.BasicAuth()
+		access, fs, userPrefix, ok := s.login(w, r)
 		if !ok {
-			w.Header().Set("WWW-Authenticate", `Basic realm="Restricted"`)
-			http.Error(w, "Unauthorized.", http.StatusUnauthorized)
 			return
 		}
-		err := s.AuthService.Authenticate(username, password)
-		if err != nil {
-			w.Header().Set("WWW-Authenticate", `Basic realm="Restricted"`)
-			http.Error(w, "Unauthorized.", http.StatusUnauthorized)
-			logger.Error("Unauthorized: ", err)
-			return
+		username, scope := access.username, access.scope
+		davHandler := &webdav.Handler{
+			Prefix:     buildPathPrefix(s.Path, userPrefix),
+			FileSystem: access.wrap(fs),
+			LockSystem: lock,
 		}
-		subFsDir, err := s.AuthService.GetAuthorizedSubDir(username)
-		if err != nil {
-			http.Error(w, "Internal Error.", http.StatusInternalServerError)
-			logger.Errorf("Error when getting authorized sub dir for user %s: %s", username, err)
+		if denied, perm, ok := access.checkRequest(r, davHandler.Prefix, fs); !ok {
+			http.Error(w, "Forbidden.", http.StatusForbidden)
+			if scope != nil {
+				logger.Warnf("Forbidden: app password %s of user %s does not allow %s on %s for %s %s", scope.Name, username, perm, denied, r.Method, r.URL.Path)
+				return
+			}
+			logger.Warnf("Forbidden: user %s lacks %s permission on %s for %s %s", username, perm, denied, r.Method, r.URL.Path)
 			return
 		}
-		userPrefix, err := s.AuthService.GetPathPrefix(username)
+
+		serveDAV(w, r, davHandler)
+	}))
+
+	pool, err := listener.NewPool(s.SocketOptions)
+	if err != nil {
+		logger.Fatal("failed to inherit listeners: ", err)
+	}
+	group := newServerGroup(pool)
+
+	server := &http.Server{}
+	var plainHandler http.Handler
+	redirect := &httpsRedirect{port: s.Port}
+	if s.TLS.Enabled {
+		tlsConfig, handler, err := buildTLSConfig(s.TLS, redirect)
 		if err != nil {
-			http.Error(w, "Internal Error.", http.StatusInternalServerError)
-			logger.Errorf("Error when getting path prefix for user %s: %s", username, err)
+			logger.Fatal("failed to configure TLS: ", err)
 		}
-		davHandler := &webdav.Handler{
-			Prefix:     buildPathPrefix(s.Path, userPrefix),
-			FileSystem: buildDirName(s.FsDir, subFsDir),
-			LockSystem: lock,
-			Logger:     davLogger,
+		server.TLSConfig, plainHandler = tlsConfig, handler
+	}
+	group.Add(server, s.listenAddrs(pool))
+	if plainHandler != nil && s.TLS.RedirectPort != 0 {
+		// listen addresses and sockets passed by systemd override Port
+		if port, ok := group.port(server); ok {
+			redirect.port = port
 		}
+		redirectAddr := net.JoinHostPort(s.Host, fmt.Sprint(s.TLS.RedirectPort))
+		group.Add(&http.Server{Handler: plainHandler}, []string{redirectAddr})
+	}
+	group.Serve()
 
-		davHandler.ServeHTTP(w, r)
-	}))
+	if err := listener.Ready(); err == nil {
+		logger.Info("took over listeners from the previous process")
+	}
+	s.waitForSignal(group)
+}
 
-	addr := fmt.Sprintf("%s:%d", s.Host, s.Port)
-	err := http.ListenAndServe(addr, nil)
-	logger.Fatal("failed to listen and serve on", addr, ":", err)
+// login authenticates the request and sets up the file system of the user
+// and what the user may access there. It replies itself if that fails.
+func (s *WebdavServer) login(w http.ResponseWriter, r *http.Request) (*accessChecker, webdav.FileSystem, string, bool) {
+	username, profiles, scope, ok := s.authenticate(w, r)
+	if !ok {
+		return nil, nil, "", false
+	}
+	if ip := s.clientIP(r); !s.UserIPFilters[username].Allowed(ip) {
+		http.Error(w, "Forbidden.", http.StatusForbidden)
+		logger.Warnf("Forbidden: user %s is not allowed to log in from %s", username, ip)
+		return nil, nil, "", false
+	}
+	subFsDir, err := profiles.GetAuthorizedSubDir(username)
+	if err != nil {
+		http.Error(w, "Internal Error.", http.StatusInternalServerError)
+		logger.Errorf("Error when getting authorized sub dir for user %s: %s", username, err)
+		return nil, nil, "", false
+	}
+	storageName, err := profiles.GetStorage(username)
+	if err != nil {
+		http.Error(w, "Internal Error.", http.StatusInternalServerError)
+		logger.Errorf("Error when getting storage for user %s: %s", username, err)
+		return nil, nil, "", false
+	}
+	userPrefix, err := profiles.GetPathPrefix(username)
+	if err != nil {
+		http.Error(w, "Internal Error.", http.StatusInternalServerError)
+		logger.Errorf("Error when getting path prefix for user %s: %s", username, err)
+	}
+	permissions, err := profiles.GetPermissions(username)
+	if err != nil {
+		http.Error(w, "Internal Error.", http.StatusInternalServerError)
+		logger.Errorf("Error when getting permissions for user %s: %s", username, err)
+		return nil, nil, "", false
+	}
+	groups, err := profiles.GetGroups(username)
+	if err != nil {
+		http.Error(w, "Internal Error.", http.StatusInternalServerError)
+		logger.Errorf("Error when getting groups for user %s: %s", username, err)
+		return nil, nil, "", false
+	}
+	mounts, err := profiles.GetMounts(username)
+	if err != nil {
+		http.Error(w, "Internal Error.", http.StatusInternalServerError)
+		logger.Errorf("Error when getting mounts for user %s: %s", username, err)
+		return nil, nil, "", false
+	}
+	access := &accessChecker{
+		username: username,
+		groups:   groups,
+		granted:  permissions,
+		acl:      s.ACLService,
+		root:     subFsDir,
+		storage:  storageName,
+		scope:    scope,
+	}
+	var fs webdav.FileSystem
+	if len(mounts) != 0 {
+		fs = access.mount(mounts, s.buildFileSystem)
+	} else {
+		fs = s.buildFileSystem(storageName, subFsDir)
+	}
+	return access, fs, userPrefix, true
+}
+
+// listenAddrs returns the configured addresses. Without any, sockets passed
+// by systemd are used, falling back to Host and Port.
+func (s *WebdavServer) listenAddrs(pool *listener.Pool) []string {
+	if len(s.ListenAddrs) != 0 {
+		return s.ListenAddrs
+	}
+	if activated := pool.Activated(); len(activated) != 0 {
+		return activated
+	}
+	return []string{net.JoinHostPort(s.Host, fmt.Sprint(s.Port))}
+}
+
+// storageDir returns dir of a storage, "" being FsDir.
+func (s *WebdavServer) storageDir(storageName, dir string) webdav.FileSystem {
+	if storageName == "" && s.Storages[""] == nil {
+		return webdav.Dir(filepath.Join(s.FsDir, filepath.FromSlash(dir)))
+	}
+	return storage.Sub(s.Storages[storageName], dir)
+}
+
+// buildFileSystem returns dir of a storage like storageDir, creating it if
+// it is missing.
+func (s *WebdavServer) buildFileSystem(storageName, dir string) webdav.FileSystem {
+	if storageName == "" && s.Storages[""] == nil {
+		return buildDirName(s.FsDir, dir)
+	}
+	fs := s.Storages[storageName]
+	if err := storage.MkdirAll(context.Background(), fs, dir); err != nil {
+		logger.Errorf("failed to create %s in storage %s: %s", dir, storageName, err)
+	}
+	return storage.Sub(fs, dir)
 }
 
 func buildDirName(fsDir, subFsDir string) webdav.Dir {
@@ -155,3 +376,65 @@ func davLogger(r *http.Request, err error) {
 		ent.Info()
 	}
 }
+
+// isStorageFull tells whether err is due to a full disk or a storage at its
+// limits.
+func isStorageFull(err error) bool {
+	return errors.Is(err, syscall.ENOSPC)
+}
+
+// serveDAV serves r by h, answering 507 Insufficient Storage when the storage
+// is full. A PUT that ran out of room leaves a partial file behind, which is
+// removed so that it does not keep using the storage.
+func serveDAV(w http.ResponseWriter, r *http.Request, h *webdav.Handler) {
+	fullWriter := &storageFullWriter{ResponseWriter: w}
+	h.Logger = fullWriter.log
+	h.ServeHTTP(fullWriter, r)
+	if fullWriter.full && r.Method == "PUT" {
+		if name, ok := stripPrefix(r.URL.Path, h.Prefix); ok {
+			h.FileSystem.RemoveAll(r.Context(), name)
+		}
+	}
+	fullWriter.flush()
+}
+
+// storageFullWriter holds back the error responses of webdav.Handler, which
+// knows no 507 Insufficient Storage, until its Logger tells the cause.
+type storageFullWriter struct {
+	http.ResponseWriter
+	status int
+	body   []byte
+	full   bool
+}
+
+func (w *storageFullWriter) WriteHeader(status int) {
+	if status < 400 {
+		w.ResponseWriter.WriteHeader(status)
+		return
+	}
+	w.status = status
+}
+
+func (w *storageFullWriter) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		return w.ResponseWriter.Write(p)
+	}
+	w.body = append(w.body, p...)
+	return len(p), nil
+}
+
+func (w *storageFullWriter) log(r *http.Request, err error) {
+	w.full = isStorageFull(err)
+	davLogger(r, err)
+}
+
+func (w *storageFullWriter) flush() {
+	switch {
+	case w.status == 0:
+	case w.full:
+		http.Error(w.ResponseWriter, "Insufficient Storage.", http.StatusInsufficientStorage)
+	default:
+		w.ResponseWriter.WriteHeader(w.status)
+		w.ResponseWriter.Write(w.body)
+	}
+}
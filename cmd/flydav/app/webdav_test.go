@@ -0,0 +1,34 @@
+package app
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/pluveto/flydav/pkg/memfs"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/webdav"
+)
+
+func TestServeDAVStorageFull(t *testing.T) {
+	fs := memfs.New(memfs.Limits{MaxBytes: 10, MaxFiles: 2})
+	serve := func(method, target, body string) *httptest.ResponseRecorder {
+		h := &webdav.Handler{Prefix: "/webdav", FileSystem: fs, LockSystem: webdav.NewMemLS()}
+		w := httptest.NewRecorder()
+		serveDAV(w, httptest.NewRequest(method, "/webdav"+target, strings.NewReader(body)), h)
+		return w
+	}
+
+	assert.Equal(t, http.StatusCreated, serve("PUT", "/a.txt", "hello").Code)
+	w := serve("PUT", "/b.txt", "hello world")
+	assert.Equal(t, http.StatusInsufficientStorage, w.Code)
+	assert.Contains(t, w.Body.String(), "Insufficient Storage")
+	size, files := fs.Usage()
+	assert.Equal(t, int64(5), size, "the partial file is removed")
+	assert.Equal(t, 1, files)
+
+	assert.Equal(t, http.StatusCreated, serve("MKCOL", "/dir", "").Code)
+	assert.Equal(t, http.StatusInsufficientStorage, serve("MKCOL", "/dir2", "").Code, "past max_files")
+	assert.Equal(t, http.StatusNotFound, serve("GET", "/missing", "").Code, "other errors pass")
+}
@@ -4,6 +4,7 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+	"time"
 
 	"github.com/pluveto/flydav/pkg/logger"
 	"golang.org/x/crypto/bcrypt"
@@ -14,6 +15,35 @@ type HashMethond string
 const BcryptHash HashMethond = "bcrypt"
 const SHA256Hash HashMethond = "sha256"
 
+// Permission is an operation a user may perform on files.
+type Permission string
+
+const (
+	PermRead      Permission = "read"      // GET, HEAD, PROPFIND and the source of COPY and MOVE
+	PermWrite     Permission = "write"     // PUT, MKCOL, the destination of COPY and MOVE, and LOCK of a missing path
+	PermDelete    Permission = "delete"    // DELETE, the source of MOVE and a destination replaced by COPY or MOVE
+	PermLock      Permission = "lock"      // LOCK and UNLOCK
+	PermPropPatch Permission = "proppatch" // PROPPATCH
+)
+
+var AllPermissions = []Permission{PermRead, PermWrite, PermDelete, PermLock, PermPropPatch}
+
+type ACLAction string
+
+const (
+	ACLAllow ACLAction = "allow"
+	ACLDeny  ACLAction = "deny"
+)
+
+// AuthBackend is where users and their passwords come from.
+type AuthBackend string
+
+const (
+	BackendConfig   AuthBackend = "config"   // [[auth.user]] entries
+	BackendHtpasswd AuthBackend = "htpasswd" // An Apache htpasswd file
+	BackendLDAP     AuthBackend = "ldap"     // An LDAP or Active Directory server
+)
+
 func GetDefaultConf() Conf {
 	defaultFsDir, _ := os.Getwd()
 	if !strings.HasPrefix(defaultFsDir, "/home") {
@@ -31,12 +61,62 @@ func GetDefaultConf() Conf {
 			File:   []File{},
 		},
 		Server: Server{
-			Host:  "127.0.0.1",
-			Port:  7086,
-			Path:  "/webdav",
-			FsDir: defaultFsDir,
+			Host:            "127.0.0.1",
+			Port:            7086,
+			Path:            "/webdav",
+			FsDir:           defaultFsDir,
+			ShutdownTimeout: 30,
+			TLS: TLS{
+				Enabled:        false,
+				MinVersion:     "1.2",
+				CipherPolicy:   "intermediate",
+				ReloadInterval: 60,
+				ClientAuth: ClientAuth{
+					UsernameFrom: "cn",
+				},
+			},
 		},
 		Auth: Auth{
+			Backend: BackendConfig,
+			Hashing: Hashing{
+				Algorithm: "argon2id",
+				Rehash:    false,
+			},
+			BruteForce: BruteForce{
+				Enabled:         false,
+				MaxIPFailures:   10,
+				MaxUserFailures: 20,
+				Backoff:         1,
+				Lockout:         300,
+				MaxLockout:      86400,
+				ResetAfter:      3600,
+			},
+			Cache: Cache{
+				Enabled:    true,
+				TTL:        300,
+				MaxEntries: 1000,
+				SessionTTL: 43200,
+			},
+			Digest: Digest{
+				Realm:      "FlyDav",
+				Algorithms: []string{"SHA-256", "MD5"},
+				NonceTTL:   300,
+			},
+			Htpasswd: Htpasswd{
+				ReloadInterval: 5,
+				HashAlgorithm:  "bcrypt",
+			},
+			OIDC: OIDC{
+				UsernameClaim: "preferred_username",
+				GroupsClaim:   "groups",
+				Scopes:        []string{"openid", "profile", "email"},
+			},
+			LDAP: LDAP{
+				Timeout:            10,
+				UserFilter:         "(uid={username})",
+				GroupAttribute:     "memberOf",
+				GroupNameAttribute: "cn",
+			},
 			User: []User{
 				{
 					Username: "flydav",
@@ -56,6 +136,12 @@ func GetDefaultConf() Conf {
 		CORS: CORS{
 			Enabled: false,
 		},
+		Share: Share{
+			Path:       "/s",
+			APIPath:    "/api/shares",
+			DefaultTTL: 7 * 24 * 3600,
+			MaxTTL:     30 * 24 * 3600,
+		},
 	}
 }
 
@@ -65,6 +151,12 @@ type Conf struct {
 	Auth   Auth   `toml:"auth" yaml:"auth"`
 	UI     UI     `toml:"ui" yaml:"ui"`
 	CORS   CORS   `toml:"cors" yaml:"cors"`
+	Share  Share  `toml:"share" yaml:"share"`
+	// Storage defines backends that users, mounts and public directories can
+	// be put on instead of the server fs_dir.
+	Storage []Storage `toml:"storage" yaml:"storage"`
+	// Path is the file the config was loaded from, "" if none.
+	Path string `toml:"-" yaml:"-"`
 }
 
 type CORS struct {
@@ -82,23 +174,319 @@ type Server struct {
 	Port  int    `toml:"port" yaml:"port"`
 	Path  string `toml:"path" yaml:"path"`
 	FsDir string `toml:"fs_dir" yaml:"fs_dir"`
+	// Listen replaces host and port with one or more addresses like
+	// "0.0.0.0:7086", "unix:/run/flydav.sock" or "systemd:flydav.socket".
+	// When empty, sockets passed by systemd socket activation are used if any.
+	Listen      []string `toml:"listen" yaml:"listen"`
+	SocketMode  string   `toml:"socket_mode" yaml:"socket_mode"`   // Octal mode of unix socket files, e.g. "0660"
+	SocketOwner string   `toml:"socket_owner" yaml:"socket_owner"` // Owner of unix socket files
+	SocketGroup string   `toml:"socket_group" yaml:"socket_group"` // Group of unix socket files
+	// ShutdownTimeout is how many seconds active requests may take to finish
+	// after SIGTERM or SIGUSR2 before their connections are closed.
+	ShutdownTimeout int `toml:"shutdown_timeout" yaml:"shutdown_timeout"`
+	TLS             TLS `toml:"tls" yaml:"tls"`
+	// AllowIPs and DenyIPs admit clients by IP or CIDR, e.g. "10.0.0.0/8".
+	// Deny takes precedence, a non-empty AllowIPs admits nothing else.
+	AllowIPs []string `toml:"allow_ips" yaml:"allow_ips"`
+	DenyIPs  []string `toml:"deny_ips" yaml:"deny_ips"`
+	// TrustedProxies may tell the client IP by the Forwarded or
+	// X-Forwarded-For header.
+	TrustedProxies []string `toml:"trusted_proxies" yaml:"trusted_proxies"`
+	// Public serves directories read-only without credentials.
+	Public []Public `toml:"public" yaml:"public"`
+	// StateDir keeps data written while running, e.g. when app passwords
+	// were last used. Nothing is kept across restarts when empty.
+	StateDir string `toml:"state_dir" yaml:"state_dir"`
+	// Encryption encrypts the files written below FsDir.
+	Encryption Encryption `toml:"encryption" yaml:"encryption"`
+}
+
+type TLS struct {
+	Enabled        bool       `toml:"enabled" yaml:"enabled"`
+	CertFile       string     `toml:"cert_file" yaml:"cert_file"`
+	KeyFile        string     `toml:"key_file" yaml:"key_file"`
+	MinVersion     string     `toml:"min_version" yaml:"min_version"`         // "1.0", "1.1", "1.2" or "1.3"
+	CipherPolicy   string     `toml:"cipher_policy" yaml:"cipher_policy"`     // "modern", "intermediate" or "compatible"
+	ReloadInterval int        `toml:"reload_interval" yaml:"reload_interval"` // Seconds between checks for renewed certificate files
+	RedirectPort   int        `toml:"redirect_port" yaml:"redirect_port"`     // Plain HTTP port redirecting to HTTPS, 0 to disable
+	ACME           ACME       `toml:"acme" yaml:"acme"`
+	ClientAuth     ClientAuth `toml:"client_auth" yaml:"client_auth"`
+}
+
+// ClientAuth authenticates users by TLS client certificates issued by the
+// CAs of CABundle. The username comes from the certificate, its settings
+// from the auth backend as for a password login.
+type ClientAuth struct {
+	Enabled  bool   `toml:"enabled" yaml:"enabled"`
+	CABundle string `toml:"ca_bundle" yaml:"ca_bundle"`
+	// Require rejects TLS connections without a valid certificate. Otherwise
+	// clients without one log in with a password.
+	Require      bool   `toml:"require" yaml:"require"`
+	UsernameFrom string `toml:"username_from" yaml:"username_from"` // "cn", "email", "dns", "uri" or "subject"
+	// Users maps names taken from certificates to usernames. When set,
+	// certificates of other names log in nobody.
+	Users map[string]string `toml:"users" yaml:"users"`
+	// RequirePassword requires the credentials of the same user in addition
+	// to the certificate.
+	RequirePassword bool `toml:"require_password" yaml:"require_password"`
+}
+
+// ACME obtains certificates automatically instead of reading CertFile and KeyFile.
+// HTTP-01 challenges are answered on TLS.RedirectPort, TLS-ALPN-01 on the server port.
+type ACME struct {
+	Enabled      bool     `toml:"enabled" yaml:"enabled"`
+	Domains      []string `toml:"domains" yaml:"domains"`
+	Email        string   `toml:"email" yaml:"email"`
+	CacheDir     string   `toml:"cache_dir" yaml:"cache_dir"`         // Stores account key and certificates
+	DirectoryURL string   `toml:"directory_url" yaml:"directory_url"` // Defaults to Let's Encrypt production
+	CABundle     string   `toml:"ca_bundle" yaml:"ca_bundle"`         // Extra CAs trusted when talking to the ACME server, e.g. Pebble's
+}
+
+// Share lets users create links to files and folders for people without an
+// account. Shares are kept in the state_dir of the server.
+type Share struct {
+	Enabled bool   `toml:"enabled" yaml:"enabled"`
+	Path    string `toml:"path" yaml:"path"`         // Prefix of the links, e.g. "/s"
+	APIPath string `toml:"api_path" yaml:"api_path"` // Where users create, list and delete their shares
+	// BaseURL is put before the links returned by the API, e.g.
+	// "https://dav.example.com". Defaults to the host of the request.
+	BaseURL    string `toml:"base_url" yaml:"base_url"`
+	DefaultTTL int    `toml:"default_ttl" yaml:"default_ttl"` // Seconds until a share expires, if not requested otherwise
+	MaxTTL     int    `toml:"max_ttl" yaml:"max_ttl"`         // Seconds, 0 means no limit
 }
 
 type UI struct {
 	Enabled bool   `toml:"enabled" yaml:"enabled"`
-	Path    string `toml:"path" yaml:"path"`   // Path prefix. TODO: ui.path cannot equals to server.path
+	Path    string `toml:"path" yaml:"path"`     // Path prefix. TODO: ui.path cannot equals to server.path
 	Source  string `toml:"source" yaml:"source"` // Source location of the UI
 }
 
 type User struct {
-	SubPath       string      `toml:"sub_path" yaml:"sub_path"`
-	SubFsDir      string      `toml:"sub_fs_dir" yaml:"sub_fs_dir"`
-	Username      string      `toml:"username" yaml:"username"`
-	PasswordHash  string      `toml:"password_hash" yaml:"password_hash"`
-	PasswordCrypt HashMethond `toml:"password_crypt" yaml:"password_crypt"`
+	SubPath       string       `toml:"sub_path" yaml:"sub_path"`
+	SubFsDir      string       `toml:"sub_fs_dir" yaml:"sub_fs_dir"`
+	Storage       string       `toml:"storage" yaml:"storage"` // Name of a [[storage]] holding SubFsDir, "" for the server fs_dir
+	Username      string       `toml:"username" yaml:"username"`
+	PasswordHash  string       `toml:"password_hash" yaml:"password_hash"`
+	PasswordCrypt HashMethond  `toml:"password_crypt" yaml:"password_crypt"`
+	Permissions   []Permission `toml:"permissions" yaml:"permissions"` // Empty means all permissions
+	Groups        []string     `toml:"groups" yaml:"groups"`
+	// Mount composes the user's root of several directories. When the user or
+	// one of its groups has mounts, SubFsDir is not used.
+	Mount       []Mount       `toml:"mount" yaml:"mount"`
+	AppPassword []AppPassword `toml:"app_password" yaml:"app_password"`
+	// AllowIPs and DenyIPs limit where the user can log in from, in addition
+	// to the lists of the server.
+	AllowIPs []string `toml:"allow_ips" yaml:"allow_ips"`
+	DenyIPs  []string `toml:"deny_ips" yaml:"deny_ips"`
+	// DigestHA1 holds the hex H(username:realm:password) for Digest auth,
+	// one for each algorithm, which is told by the length.
+	DigestHA1 []string `toml:"digest_ha1" yaml:"digest_ha1"`
 }
+
+// AppPassword is an additional password of a user, e.g. for a phone or a
+// backup script. It can be limited, expire and be revoked on its own. App
+// passwords work with any backend, as long as the user has an [[auth.user]]
+// entry.
+type AppPassword struct {
+	Name          string       `toml:"name" yaml:"name"`                     // Unique per user, e.g. "phone"
+	PasswordHash  string       `toml:"password_hash" yaml:"password_hash"`   // Same formats as the password of the user
+	PasswordCrypt HashMethond  `toml:"password_crypt" yaml:"password_crypt"` // Only needed for "sha256"
+	Permissions   []Permission `toml:"permissions" yaml:"permissions"`       // Limits the permissions of the user, empty means no limit
+	Path          string       `toml:"path" yaml:"path"`                     // Limits access to a directory of the user, e.g. "/Backups"
+	Expires       time.Time    `toml:"expires" yaml:"expires"`               // Zero means never
+	Revoked       bool         `toml:"revoked" yaml:"revoked"`
+}
+
+// Public publishes a directory to anyone, over WebDAV (PROPFIND) and plain
+// GET. Methods that would change anything are rejected.
+type Public struct {
+	Path    string `toml:"path" yaml:"path"`       // URL prefix, e.g. "/public"
+	FsDir   string `toml:"fs_dir" yaml:"fs_dir"`   // Directory relative to server fs_dir, or to the storage
+	Storage string `toml:"storage" yaml:"storage"` // Name of a [[storage]], "" for the server fs_dir
+}
+
+// Mount attaches a directory at Path in the namespace of a user.
+type Mount struct {
+	Path        string       `toml:"path" yaml:"path"`               // Mount point, e.g. "/team-design"
+	FsDir       string       `toml:"fs_dir" yaml:"fs_dir"`           // Directory relative to server fs_dir, or to the storage
+	Storage     string       `toml:"storage" yaml:"storage"`         // Name of a [[storage]], "" for the server fs_dir
+	Permissions []Permission `toml:"permissions" yaml:"permissions"` // Restricts the user's permissions, empty means no restriction
+	Lower       []Layer      `toml:"lower" yaml:"lower"`             // Read-only layers under fs_dir, topmost first
+}
+
+// Layer is a read-only directory shown below the writable one of a mount,
+// see overlayfs.
+type Layer struct {
+	FsDir   string `toml:"fs_dir" yaml:"fs_dir"`
+	Storage string `toml:"storage" yaml:"storage"`
+}
+
+// Storage is a named file system backend, see storage.Register for the
+// available ones.
+type Storage struct {
+	Name    string            `toml:"name" yaml:"name"`       // Referred to by users, mounts and public directories
+	Backend string            `toml:"backend" yaml:"backend"` // e.g. "local" or "memory"
+	Options map[string]string `toml:"options" yaml:"options"` // Depend on the backend, e.g. dir of "local"
+	// Encryption encrypts the files of the storage, e.g. with a key of its
+	// own for the users kept on it.
+	Encryption Encryption `toml:"encryption" yaml:"encryption"`
+}
+
+// Encryption keeps files encrypted at rest, see cryptfs. It is meant for an
+// empty directory, files already there are not readable afterwards.
+type Encryption struct {
+	Enabled      bool   `toml:"enabled" yaml:"enabled"`
+	KeyFile      string `toml:"key_file" yaml:"key_file"`           // Base64 encoded key of 32 bytes, e.g. from openssl rand -base64 32
+	EncryptNames bool   `toml:"encrypt_names" yaml:"encrypt_names"` // Also encrypt file and directory names
+}
+
+// Group shares its mounts with every member.
+type Group struct {
+	Name    string   `toml:"name" yaml:"name"`
+	Members []string `toml:"members" yaml:"members"` // In addition to users listing the group in their groups
+	Mount   []Mount  `toml:"mount" yaml:"mount"`
+}
+
+// ACLRule allows or denies permissions on paths. Rules are evaluated in
+// order and the first matching one decides. They only narrow the
+// permissions of the user and the mount, allowing exempts from later rules.
+type ACLRule struct {
+	Users       []string     `toml:"users" yaml:"users"`             // Usernames, "*" matches everyone
+	Groups      []string     `toml:"groups" yaml:"groups"`           // Empty users and groups match everyone
+	Path        string       `toml:"path" yaml:"path"`               // Glob relative to fs_dir, "**" matches any depth
+	Action      ACLAction    `toml:"action" yaml:"action"`           // "allow" or "deny"
+	Permissions []Permission `toml:"permissions" yaml:"permissions"` // Empty means all permissions
+}
+
 type Auth struct {
-	User []User `toml:"user" yaml:"user"`
+	Backend AuthBackend `toml:"backend" yaml:"backend"` // "config", "htpasswd" or "ldap"
+	User    []User      `toml:"user" yaml:"user"`
+	Group   []Group     `toml:"group" yaml:"group"`
+	ACL     []ACLRule   `toml:"acl" yaml:"acl"`
+	Hashing Hashing     `toml:"hashing" yaml:"hashing"`
+	// BruteForce limits failed logins of all backends.
+	BruteForce BruteForce `toml:"brute_force" yaml:"brute_force"`
+	Cache      Cache      `toml:"cache" yaml:"cache"`
+	Digest     Digest     `toml:"digest" yaml:"digest"`
+	Htpasswd   Htpasswd   `toml:"htpasswd" yaml:"htpasswd"`
+	LDAP       LDAP       `toml:"ldap" yaml:"ldap"`
+	OIDC       OIDC       `toml:"oidc" yaml:"oidc"`
+}
+
+// Hashing controls new password hashes. The algorithm of an existing hash
+// is detected from its prefix, so password_crypt is only needed for the
+// unsalted hex "sha256" hashes.
+type Hashing struct {
+	Algorithm string `toml:"algorithm" yaml:"algorithm"` // "argon2id", "scrypt", "pbkdf2-sha256", "pbkdf2-sha512" or "bcrypt"
+	// Rehash replaces a weak hash of a user, e.g. unsalted sha256 or
+	// low-cost bcrypt, with one of Algorithm after a successful login. The
+	// config file must be writable and is rewritten.
+	Rehash bool `toml:"rehash" yaml:"rehash"`
+}
+
+// BruteForce slows down and locks out clients guessing passwords. Each
+// failed login blocks the client IP and the username for Backoff seconds,
+// doubled with each further failure. Reaching the maximum failures locks them
+// out for Lockout seconds, likewise doubled up to MaxLockout.
+type BruteForce struct {
+	Enabled         bool     `toml:"enabled" yaml:"enabled"`
+	MaxIPFailures   int      `toml:"max_ip_failures" yaml:"max_ip_failures"`     // 0 disables lockouts of client IPs
+	MaxUserFailures int      `toml:"max_user_failures" yaml:"max_user_failures"` // 0 disables lockouts of usernames
+	Backoff         int      `toml:"backoff" yaml:"backoff"`
+	Lockout         int      `toml:"lockout" yaml:"lockout"`
+	MaxLockout      int      `toml:"max_lockout" yaml:"max_lockout"`
+	ResetAfter      int      `toml:"reset_after" yaml:"reset_after"` // Seconds after the end of a block to forget failures
+	Allowlist       []string `toml:"allowlist" yaml:"allowlist"`     // Networks never blocked, e.g. "10.0.0.0/8"
+}
+
+// Cache remembers successful password logins, so that slow hashes and LDAP
+// binds are not repeated for every request. A changed hash in the config or
+// htpasswd file invalidates the cached logins of the user.
+type Cache struct {
+	Enabled    bool `toml:"enabled" yaml:"enabled"`
+	TTL        int  `toml:"ttl" yaml:"ttl"` // Seconds
+	MaxEntries int  `toml:"max_entries" yaml:"max_entries"`
+	// Session sets a cookie after a password login of a browser, which is
+	// accepted instead of the password for SessionTTL seconds, or until the
+	// password changes. LDAP users are looked up instead, for each request.
+	Session    bool `toml:"session" yaml:"session"`
+	SessionTTL int  `toml:"session_ttl" yaml:"session_ttl"`
+}
+
+// Digest offers HTTP Digest auth (RFC 7616) next to Basic, for users with a
+// DigestHA1. Their password is never sent, not even over plain HTTP.
+type Digest struct {
+	Enabled    bool     `toml:"enabled" yaml:"enabled"`
+	Realm      string   `toml:"realm" yaml:"realm"`           // Part of the HA1 of users
+	Algorithms []string `toml:"algorithms" yaml:"algorithms"` // "SHA-256" and/or "MD5", in order of preference
+	NonceTTL   int      `toml:"nonce_ttl" yaml:"nonce_ttl"`   // Seconds
+}
+
+// Htpasswd checks passwords against an Apache htpasswd file. A user with an
+// [[auth.user]] entry of the same username gets the settings of that entry,
+// the password fields of which are ignored, any other user gets Default.
+type Htpasswd struct {
+	Path           string `toml:"path" yaml:"path"`
+	ReloadInterval int    `toml:"reload_interval" yaml:"reload_interval"` // Seconds between checks for a changed file
+	// HashAlgorithm is used when auth.hashing.rehash upgrades a hash in the
+	// file. Apache only understands "bcrypt".
+	HashAlgorithm string `toml:"hash_algorithm" yaml:"hash_algorithm"`
+	// Default may use "{username}" in sub_fs_dir, sub_path and the fs_dir
+	// of mounts, e.g. sub_fs_dir = "home/{username}".
+	Default User `toml:"default" yaml:"default"`
+}
+
+// LDAP checks passwords by binding to a directory server, either directly
+// with UserDN or with the DN found by searching UserFilter below BaseDN.
+// Users with an [[auth.user]] entry get its settings like with Htpasswd.
+type LDAP struct {
+	URL                string `toml:"url" yaml:"url"` // "ldap://host:389" or "ldaps://host:636"
+	StartTLS           bool   `toml:"start_tls" yaml:"start_tls"`
+	CABundle           string `toml:"ca_bundle" yaml:"ca_bundle"` // Extra CAs trusted for the server certificate
+	InsecureSkipVerify bool   `toml:"insecure_skip_verify" yaml:"insecure_skip_verify"`
+	Timeout            int    `toml:"timeout" yaml:"timeout"` // Seconds
+	// UserDN enables direct bind, e.g. "uid={username},ou=people,dc=example,dc=org".
+	UserDN       string `toml:"user_dn" yaml:"user_dn"`
+	BindDN       string `toml:"bind_dn" yaml:"bind_dn"` // Searches as this DN instead of anonymously
+	BindPassword string `toml:"bind_password" yaml:"bind_password"`
+	BaseDN       string `toml:"base_dn" yaml:"base_dn"`
+	UserFilter   string `toml:"user_filter" yaml:"user_filter"` // e.g. "(uid={username})" or "(sAMAccountName={username})"
+	// Groups are read from GroupAttribute of the user entry, or searched
+	// below GroupBaseDN with GroupFilter if set, e.g. "(member={dn})".
+	GroupAttribute     string      `toml:"group_attribute" yaml:"group_attribute"`
+	GroupBaseDN        string      `toml:"group_base_dn" yaml:"group_base_dn"`
+	GroupFilter        string      `toml:"group_filter" yaml:"group_filter"`
+	GroupNameAttribute string      `toml:"group_name_attribute" yaml:"group_name_attribute"`
+	RequireGroup       bool        `toml:"require_group" yaml:"require_group"` // Rejects users in none of Group
+	Group              []LDAPGroup `toml:"group" yaml:"group"`
+	// Default may use "{username}" and "{<attribute>}" of the user entry,
+	// e.g. sub_fs_dir = "/home/{uid}" or "{homeDirectory}".
+	Default User `toml:"default" yaml:"default"`
+}
+
+// OIDC accepts "Authorization: Bearer" JWTs of an OpenID Connect issuer in
+// addition to the passwords of the backend. With RedirectURL set, the web UI
+// can log in through the issuer at /oidc/login.
+type OIDC struct {
+	Enabled       bool     `toml:"enabled" yaml:"enabled"`
+	Issuer        string   `toml:"issuer" yaml:"issuer"`
+	Audience      []string `toml:"audience" yaml:"audience"`             // Accepted token audiences besides ClientID
+	UsernameClaim string   `toml:"username_claim" yaml:"username_claim"` // e.g. "preferred_username", "email" or "sub"
+	GroupsClaim   string   `toml:"groups_claim" yaml:"groups_claim"`     // Claim listing groups of the user
+	CABundle      string   `toml:"ca_bundle" yaml:"ca_bundle"`           // Extra CAs trusted when talking to the issuer
+	ClientID      string   `toml:"client_id" yaml:"client_id"`
+	ClientSecret  string   `toml:"client_secret" yaml:"client_secret"`
+	RedirectURL   string   `toml:"redirect_url" yaml:"redirect_url"` // e.g. "https://dav.example.com/oidc/callback"
+	Scopes        []string `toml:"scopes" yaml:"scopes"`
+	// Default may use "{username}" and "{<claim>}" of string claims.
+	Default User `toml:"default" yaml:"default"`
+}
+
+// LDAPGroup grants permissions to members of an LDAP group. A user in
+// several groups gets the permissions of all of them.
+type LDAPGroup struct {
+	Name        string       `toml:"name" yaml:"name"` // Group name, e.g. the cn
+	Permissions []Permission `toml:"permissions" yaml:"permissions"`
 }
 
 type File struct {
@@ -3,14 +3,21 @@ package main
 import (
 	"fmt"
 	"os"
+	"path"
 	"path/filepath"
+	"strings"
 
 	"github.com/BurntSushi/toml"
 	"github.com/alexflint/go-arg"
 	"github.com/pluveto/flydav/cmd/flydav/app"
 	"github.com/pluveto/flydav/cmd/flydav/conf"
+	"github.com/pluveto/flydav/pkg/digestauth"
+	"github.com/pluveto/flydav/pkg/ipfilter"
 	"github.com/pluveto/flydav/pkg/logger"
 	"github.com/pluveto/flydav/pkg/misc"
+	"github.com/pluveto/flydav/pkg/passhash"
+	"github.com/pluveto/flydav/pkg/storage"
+	"github.com/pluveto/flydav/pkg/tlsutil"
 	"github.com/sirupsen/logrus"
 	"golang.org/x/crypto/bcrypt"
 	"golang.org/x/term"
@@ -38,20 +45,288 @@ func main() {
 	app.InitLogger(cnf.Log, args.Verbose)
 	logger.Debug("log level: ", logger.GetLevel())
 	app.Run(cnf)
+	app.CloseLogger()
 }
 
 func validateConf(conf *conf.Conf) {
-	if len(conf.Auth.User) == 0 {
-		logger.Fatal("No user configured")
+	switch conf.Auth.Backend {
+	case "config", "":
+		if len(conf.Auth.User) == 0 {
+			logger.Fatal("No user configured")
+		}
+		if conf.Auth.User[0].Username == "" {
+			logger.Fatal("No username configured")
+		}
+		if conf.Auth.User[0].PasswordHash == "" {
+			logger.Fatal("No password configured")
+		}
+	case "htpasswd":
+		if conf.Auth.Htpasswd.Path == "" {
+			logger.Fatal("htpasswd backend enabled but path not configured")
+		}
+		for _, perm := range conf.Auth.Htpasswd.Default.Permissions {
+			if !validPermission(perm) {
+				logger.Fatalf("Unknown permission %q of htpasswd default user", perm)
+			}
+		}
+		validateMounts(conf.Auth.Htpasswd.Default.Mount, "htpasswd default user")
+	case "ldap":
+		ldap := conf.Auth.LDAP
+		if ldap.URL == "" {
+			logger.Fatal("ldap backend enabled but url not configured")
+		}
+		if ldap.UserDN == "" && (ldap.BaseDN == "" || ldap.UserFilter == "") {
+			logger.Fatal("ldap backend needs user_dn, or base_dn and user_filter")
+		}
+		for _, group := range ldap.Group {
+			if group.Name == "" || len(group.Permissions) == 0 {
+				logger.Fatal("ldap group needs name and permissions")
+			}
+			for _, perm := range group.Permissions {
+				if !validPermission(perm) {
+					logger.Fatalf("Unknown permission %q of ldap group %s", perm, group.Name)
+				}
+			}
+		}
+		for _, perm := range ldap.Default.Permissions {
+			if !validPermission(perm) {
+				logger.Fatalf("Unknown permission %q of ldap default user", perm)
+			}
+		}
+		validateMounts(ldap.Default.Mount, "ldap default user")
+	default:
+		logger.Fatalf("Unknown auth backend %q", conf.Auth.Backend)
+	}
+	for _, user := range conf.Auth.User {
+		for _, perm := range user.Permissions {
+			if !validPermission(perm) {
+				logger.Fatalf("Unknown permission %q of user %s", perm, user.Username)
+			}
+		}
+	}
+	for _, group := range conf.Auth.Group {
+		if group.Name == "" {
+			logger.Fatal("Group without name configured")
+		}
+		validateMounts(group.Mount, "group "+group.Name)
+	}
+	for _, user := range conf.Auth.User {
+		validateMounts(user.Mount, "user "+user.Username)
+		names := make(map[string]bool)
+		for _, appPassword := range user.AppPassword {
+			if appPassword.Name == "" || names[appPassword.Name] {
+				logger.Fatalf("App passwords of user %s need distinct names", user.Username)
+			}
+			names[appPassword.Name] = true
+			if appPassword.PasswordHash == "" {
+				logger.Fatalf("No password configured for app password %s of user %s", appPassword.Name, user.Username)
+			}
+			for _, perm := range appPassword.Permissions {
+				if !validPermission(perm) {
+					logger.Fatalf("Unknown permission %q of app password %s of user %s", perm, appPassword.Name, user.Username)
+				}
+			}
+		}
+	}
+	for i, rule := range conf.Auth.ACL {
+		if rule.Action != "allow" && rule.Action != "deny" {
+			logger.Fatalf("ACL rule %d: action must be allow or deny", i)
+		}
+		if _, err := misc.MatchPathGlob(rule.Path, "/"); rule.Path == "" || err != nil {
+			logger.Fatalf("ACL rule %d: invalid path %q", i, rule.Path)
+		}
+		for _, perm := range rule.Permissions {
+			if !validPermission(perm) {
+				logger.Fatalf("ACL rule %d: unknown permission %q", i, perm)
+			}
+		}
+	}
+	for _, algorithm := range []string{conf.Auth.Hashing.Algorithm, conf.Auth.Htpasswd.HashAlgorithm} {
+		if !passhash.Hashable(algorithm) {
+			logger.Fatalf("Unsupported password hash algorithm %q", algorithm)
+		}
+	}
+	publicPaths := make(map[string]bool)
+	for _, public := range conf.Server.Public {
+		clean := path.Clean("/" + public.Path)
+		if public.Path == "" || public.FsDir == "" || clean == "/" || publicPaths[clean] {
+			logger.Fatal("Public directories need distinct paths other than / and an fs_dir")
+		}
+		if clean == path.Clean("/"+conf.Server.Path) || clean == path.Clean("/"+conf.UI.Path) {
+			logger.Fatalf("Public path %s conflicts with the path of the server or the UI", public.Path)
+		}
+		publicPaths[clean] = true
+	}
+	if share := conf.Share; share.Enabled {
+		sharePath, apiPath := path.Clean("/"+share.Path), path.Clean("/"+share.APIPath)
+		if share.Path == "" || share.APIPath == "" || sharePath == "/" || apiPath == "/" || sharePath == apiPath {
+			logger.Fatal("Shares need distinct path and api_path other than /")
+		}
+		for _, clean := range []string{sharePath, apiPath} {
+			if publicPaths[clean] || clean == path.Clean("/"+conf.Server.Path) || clean == path.Clean("/"+conf.UI.Path) {
+				logger.Fatalf("Share path %s conflicts with another path of the server", clean)
+			}
+		}
+		if share.DefaultTTL <= 0 || share.MaxTTL < 0 || (share.MaxTTL > 0 && share.DefaultTTL > share.MaxTTL) {
+			logger.Fatal("Shares need a positive default_ttl not above max_ttl")
+		}
+	}
+	if clientAuth := conf.Server.TLS.ClientAuth; clientAuth.Enabled {
+		if !conf.Server.TLS.Enabled || clientAuth.CABundle == "" {
+			logger.Fatal("client_auth enabled but TLS or ca_bundle not configured")
+		}
+		if !tlsutil.ValidCertField(clientAuth.UsernameFrom) {
+			logger.Fatalf("Unknown client_auth username_from %q", clientAuth.UsernameFrom)
+		}
+	}
+	if digest := conf.Auth.Digest; digest.Enabled {
+		if len(digest.Algorithms) == 0 || digest.NonceTTL <= 0 {
+			logger.Fatal("Digest enabled but algorithms or nonce_ttl not configured")
+		}
+		// HA1 values come from [[auth.user]] only, other backends have none
+		if conf.Auth.Backend != "config" && conf.Auth.Backend != "" {
+			logger.Fatalf("Digest needs the config auth backend, not %s", conf.Auth.Backend)
+		}
+		for _, algorithm := range digest.Algorithms {
+			if !digestauth.Supported(algorithm) {
+				logger.Fatalf("Unsupported digest algorithm %q", algorithm)
+			}
+		}
+	}
+	for _, user := range conf.Auth.User {
+		for _, ha1 := range user.DigestHA1 {
+			if digestauth.AlgorithmOf(ha1) == "" {
+				logger.Fatalf("digest_ha1 of user %s must be hex MD5 or SHA-256 digests", user.Username)
+			}
+		}
+	}
+	if _, err := ipfilter.New(conf.Server.AllowIPs, conf.Server.DenyIPs); err != nil {
+		logger.Fatal("Invalid allow_ips or deny_ips: ", err)
 	}
-	if conf.Auth.User[0].Username == "" {
-		logger.Fatal("No username configured")
+	if _, err := misc.ParseNetworks(conf.Server.TrustedProxies); err != nil {
+		logger.Fatal("Invalid trusted_proxies: ", err)
 	}
-	if conf.Auth.User[0].PasswordHash == "" {
-		logger.Fatal("No password configured")
+	for _, user := range conf.Auth.User {
+		if _, err := ipfilter.New(user.AllowIPs, user.DenyIPs); err != nil {
+			logger.Fatalf("Invalid allow_ips or deny_ips of user %s: %s", user.Username, err)
+		}
+	}
+	if _, err := misc.ParseNetworks(conf.Auth.BruteForce.Allowlist); err != nil {
+		logger.Fatal("Invalid brute_force allowlist: ", err)
+	}
+	if oidc := conf.Auth.OIDC; oidc.Enabled {
+		if oidc.Issuer == "" || oidc.UsernameClaim == "" {
+			logger.Fatal("OIDC enabled but issuer or username_claim not configured")
+		}
+		if oidc.ClientID == "" && len(oidc.Audience) == 0 {
+			logger.Fatal("OIDC enabled but neither client_id nor audience configured")
+		}
+		if oidc.RedirectURL != "" && oidc.ClientID == "" {
+			logger.Fatal("OIDC redirect_url configured but client_id not configured")
+		}
+		for _, perm := range oidc.Default.Permissions {
+			if !validPermission(perm) {
+				logger.Fatalf("Unknown permission %q of OIDC default user", perm)
+			}
+		}
+		validateMounts(oidc.Default.Mount, "OIDC default user")
+	}
+	validateStorages(conf)
+	if conf.Server.TLS.Enabled {
+		acme := conf.Server.TLS.ACME
+		if acme.Enabled && (len(acme.Domains) == 0 || acme.CacheDir == "") {
+			logger.Fatal("ACME enabled but domains or cache_dir not configured")
+		}
+		if !acme.Enabled && (conf.Server.TLS.CertFile == "" || conf.Server.TLS.KeyFile == "") {
+			logger.Fatal("TLS enabled but cert_file or key_file not configured")
+		}
 	}
 }
 
+func validateMounts(mounts []conf.Mount, owner string) {
+	for _, mount := range mounts {
+		if mount.Path == "" {
+			logger.Fatalf("Mount without path configured for %s", owner)
+		}
+		for _, perm := range mount.Permissions {
+			if !validPermission(perm) {
+				logger.Fatalf("Unknown permission %q of mount %s for %s", perm, mount.Path, owner)
+			}
+		}
+	}
+}
+
+// validateStorages checks the storages and that users, mounts and public
+// directories only refer to defined ones.
+func validateStorages(cnf *conf.Conf) {
+	checkEncryption := func(enc conf.Encryption, owner string) {
+		if enc.Enabled && enc.KeyFile == "" {
+			logger.Fatalf("Encryption of %s needs a key_file", owner)
+		}
+	}
+	checkEncryption(cnf.Server.Encryption, "fs_dir")
+	names := make(map[string]bool)
+	for _, s := range cnf.Storage {
+		if s.Name == "" || names[s.Name] {
+			logger.Fatal("Storages need distinct names")
+		}
+		names[s.Name] = true
+		if !validBackend(s.Backend) {
+			logger.Fatalf("Unknown backend %q of storage %s, available are %s", s.Backend, s.Name, strings.Join(storage.Backends(), ", "))
+		}
+		checkEncryption(s.Encryption, "storage "+s.Name)
+	}
+	check := func(name, owner string) {
+		if name != "" && !names[name] {
+			logger.Fatalf("Unknown storage %q of %s", name, owner)
+		}
+	}
+	checkUser := func(user conf.User, owner string) {
+		check(user.Storage, owner)
+		for _, mount := range user.Mount {
+			check(mount.Storage, "mount "+mount.Path+" of "+owner)
+			for _, layer := range mount.Lower {
+				check(layer.Storage, "lower layer of mount "+mount.Path+" of "+owner)
+			}
+		}
+	}
+	for _, user := range cnf.Auth.User {
+		checkUser(user, "user "+user.Username)
+	}
+	checkUser(cnf.Auth.Htpasswd.Default, "htpasswd default user")
+	checkUser(cnf.Auth.LDAP.Default, "ldap default user")
+	checkUser(cnf.Auth.OIDC.Default, "OIDC default user")
+	for _, group := range cnf.Auth.Group {
+		for _, mount := range group.Mount {
+			check(mount.Storage, "mount "+mount.Path+" of group "+group.Name)
+			for _, layer := range mount.Lower {
+				check(layer.Storage, "lower layer of mount "+mount.Path+" of group "+group.Name)
+			}
+		}
+	}
+	for _, public := range cnf.Server.Public {
+		check(public.Storage, "public directory "+public.Path)
+	}
+}
+
+func validBackend(backend string) bool {
+	for _, b := range storage.Backends() {
+		if b == backend {
+			return true
+		}
+	}
+	return false
+}
+
+func validPermission(perm conf.Permission) bool {
+	for _, p := range conf.AllPermissions {
+		if p == perm {
+			return true
+		}
+	}
+	return false
+}
+
 func overrideConf(cnf *conf.Conf, args app.Args) {
 	if args.Verbose {
 		cnf.Log.Level = logrus.DebugLevel.String()
@@ -66,6 +341,8 @@ func overrideConf(cnf *conf.Conf, args app.Args) {
 		args.Username = "flydav"
 	}
 	if args.Config == "" {
+		// the prompted password is not saved anywhere
+		cnf.Path = ""
 		cnf.Auth.User = []conf.User{
 			{
 				Username:      args.Username,
@@ -129,14 +406,14 @@ func loadConfValid(verbose bool, path string, defaultConf conf.Conf, defaultConf
 	err := decode(path, &defaultConf)
 	if err != nil && verbose {
 		os.Stderr.WriteString(fmt.Sprintf("Failed to load config file: %s\n", err))
-	}else
-	{
+	} else if err == nil {
+		defaultConf.Path = path
 		logger.WithField("conf", &defaultConf).Debug("configuration loaded")
 	}
 	return defaultConf
 }
 
-func decode(path string, conf *conf.Conf) (error) {
+func decode(path string, conf *conf.Conf) error {
 	ext, err := misc.MustGetFileExt(path)
 	if err != nil {
 		return err
@@ -150,7 +427,7 @@ func decode(path string, conf *conf.Conf) (error) {
 		if err != nil {
 			return fmt.Errorf("failed to read config file: %s", err)
 		}
-		
+
 		err = yaml.Unmarshal([]byte(content), conf)
 		if err != nil {
 			return fmt.Errorf("failed to parse config file: %s", err)
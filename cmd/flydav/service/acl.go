@@ -0,0 +1,63 @@
+package service
+
+import (
+	"github.com/pluveto/flydav/cmd/flydav/conf"
+	"github.com/pluveto/flydav/pkg/logger"
+	"github.com/pluveto/flydav/pkg/misc"
+)
+
+type ACLService struct {
+	Rules []conf.ACLRule
+}
+
+func NewACLService(rules []conf.ACLRule) *ACLService {
+	return &ACLService{Rules: rules}
+}
+
+func (s *ACLService) Decide(username string, groups []string, path string, perm conf.Permission) conf.ACLAction {
+	for _, rule := range s.Rules {
+		if !ruleAppliesTo(rule, username, groups) || !ruleCovers(rule, perm) {
+			continue
+		}
+		ok, err := misc.MatchPathGlob(rule.Path, path)
+		if err != nil {
+			logger.Warn("invalid ACL path ", rule.Path, ": ", err)
+			continue
+		}
+		if ok {
+			return rule.Action
+		}
+	}
+	return ""
+}
+
+func ruleAppliesTo(rule conf.ACLRule, username string, groups []string) bool {
+	if len(rule.Users) == 0 && len(rule.Groups) == 0 {
+		return true
+	}
+	for _, u := range rule.Users {
+		if u == "*" || u == username {
+			return true
+		}
+	}
+	for _, g := range rule.Groups {
+		for _, group := range groups {
+			if g == group {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func ruleCovers(rule conf.ACLRule, perm conf.Permission) bool {
+	if len(rule.Permissions) == 0 {
+		return true
+	}
+	for _, p := range rule.Permissions {
+		if p == perm {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,181 @@
+package service
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/pluveto/flydav/cmd/flydav/conf"
+	"github.com/pluveto/flydav/pkg/logger"
+	"github.com/pluveto/flydav/pkg/misc"
+)
+
+// AppPasswordService checks the app passwords of [[auth.user]] entries and
+// records when each was last used.
+type AppPasswordService struct {
+	users    map[string][]conf.AppPassword
+	lastUsed *lastUsed
+	now      func() time.Time
+}
+
+// NewAppPasswordService keeps the last-used times in stateDir, or in memory
+// only if it is empty.
+func NewAppPasswordService(users []conf.User, stateDir string) (*AppPasswordService, error) {
+	ret := &AppPasswordService{
+		users: make(map[string][]conf.AppPassword),
+		now:   time.Now,
+	}
+	for _, user := range users {
+		if len(user.AppPassword) != 0 {
+			ret.users[user.Username] = user.AppPassword
+		}
+	}
+	var err error
+	ret.lastUsed, err = loadLastUsed(stateDir)
+	return ret, err
+}
+
+// Authenticate returns the valid app password of username matching password.
+func (s *AppPasswordService) Authenticate(username, password string) (*conf.AppPassword, error) {
+	for i := range s.users[username] {
+		appPassword := &s.users[username][i]
+		if !s.valid(appPassword) {
+			continue
+		}
+		err := verifyPassword(conf.User{PasswordHash: appPassword.PasswordHash, PasswordCrypt: appPassword.PasswordCrypt}, password)
+		if err == nil {
+			s.Touch(username, appPassword.Name)
+			return appPassword, nil
+		}
+		if err != ErrCrendential {
+			logger.Warn("app password ", appPassword.Name, " of user ", username, ": ", err)
+		}
+	}
+	return nil, ErrCrendential
+}
+
+// Get returns the app password of username called name if it is valid.
+func (s *AppPasswordService) Get(username, name string) (*conf.AppPassword, bool) {
+	for i := range s.users[username] {
+		if appPassword := &s.users[username][i]; appPassword.Name == name && s.valid(appPassword) {
+			return appPassword, true
+		}
+	}
+	return nil, false
+}
+
+// CredentialVersion changes when the app password is revoked or expires.
+func (s *AppPasswordService) CredentialVersion(username, name string) string {
+	if appPassword, ok := s.Get(username, name); ok {
+		return appPassword.PasswordHash
+	}
+	return ""
+}
+
+// Touch records that an app password has been used.
+func (s *AppPasswordService) Touch(username, name string) {
+	s.lastUsed.touch(username, name, s.now())
+}
+
+// Flush saves the pending last-used times, e.g. before shutting down.
+func (s *AppPasswordService) Flush() {
+	s.lastUsed.flush()
+}
+
+// LastUsed returns when an app password was used the last time, zero if
+// never.
+func (s *AppPasswordService) LastUsed(username, name string) time.Time {
+	return s.lastUsed.get(username, name)
+}
+
+func (s *AppPasswordService) valid(appPassword *conf.AppPassword) bool {
+	return !appPassword.Revoked && (appPassword.Expires.IsZero() || s.now().Before(appPassword.Expires))
+}
+
+// lastUsed keeps the last-used times of app passwords, saved to a JSON file
+// at most once a minute. Saving merges with the file, which a process taking
+// over on upgrade may have saved in the meantime.
+type lastUsed struct {
+	path string
+
+	mu    sync.Mutex
+	times map[string]map[string]time.Time // By username and app password name
+	timer *time.Timer                     // Set while a save is pending
+}
+
+func loadLastUsed(stateDir string) (*lastUsed, error) {
+	ret := &lastUsed{times: make(map[string]map[string]time.Time)}
+	if stateDir == "" {
+		return ret, nil
+	}
+	ret.path = filepath.Join(stateDir, "app_passwords.json")
+	content, err := os.ReadFile(ret.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return ret, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return ret, json.Unmarshal(content, &ret.times)
+}
+
+func (l *lastUsed) touch(username, name string, now time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.times[username] == nil {
+		l.times[username] = make(map[string]time.Time)
+	}
+	l.times[username][name] = now.UTC().Truncate(time.Second)
+	if l.path != "" && l.timer == nil {
+		l.timer = time.AfterFunc(time.Minute, l.save)
+	}
+}
+
+func (l *lastUsed) get(username, name string) time.Time {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.times[username][name]
+}
+
+func (l *lastUsed) flush() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.timer != nil {
+		l.timer.Stop()
+		l.saveLocked()
+	}
+}
+
+func (l *lastUsed) save() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.saveLocked()
+}
+
+func (l *lastUsed) saveLocked() {
+	l.timer = nil
+	var saved map[string]map[string]time.Time
+	if content, err := os.ReadFile(l.path); err == nil {
+		json.Unmarshal(content, &saved)
+	}
+	for username, times := range saved {
+		if l.times[username] == nil {
+			l.times[username] = make(map[string]time.Time)
+		}
+		for name, t := range times {
+			if t.After(l.times[username][name]) {
+				l.times[username][name] = t
+			}
+		}
+	}
+	content, err := json.MarshalIndent(l.times, "", "  ")
+	if err == nil {
+		err = misc.ReplaceFile(l.path, content)
+	}
+	if err != nil {
+		logger.Error("failed to save the last use of app passwords: ", err)
+	}
+}
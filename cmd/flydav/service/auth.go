@@ -4,22 +4,31 @@ import (
 	"crypto/sha256"
 	"encoding/hex"
 	"errors"
+	"sort"
+	"sync"
 
 	"github.com/pluveto/flydav/cmd/flydav/conf"
 	"github.com/pluveto/flydav/pkg/logger"
-	"golang.org/x/crypto/bcrypt"
+	"github.com/pluveto/flydav/pkg/passhash"
 )
 
 type BasicAuthService struct {
-	UserMap map[string]conf.User
+	UserMap  map[string]conf.User
+	GroupMap map[string]conf.Group
+	mu       sync.RWMutex // Guards UserMap against upgraded hashes
+	rehash   *rehasher
 }
 
-func NewBasicAuthService(users []conf.User) *BasicAuthService {
+func NewBasicAuthService(users []conf.User, groups []conf.Group) *BasicAuthService {
 	ret := &BasicAuthService{}
 	ret.UserMap = make(map[string]conf.User)
 	for _, user := range users {
 		ret.UserMap[user.Username] = user
 	}
+	ret.GroupMap = make(map[string]conf.Group)
+	for _, group := range groups {
+		ret.GroupMap[group.Name] = group
+	}
 	return ret
 }
 
@@ -28,45 +37,158 @@ var (
 	ErrUnsupportedHashMethod = errors.New("unsupported hash method")
 )
 
+// UpgradeHashes makes Authenticate replace hashes weaker than algorithm in
+// the config file at path, see conf.Hashing.
+func (s *BasicAuthService) UpgradeHashes(algorithm, path string) {
+	s.rehash = newRehasher(algorithm, func(username, oldHash, newHash string) error {
+		return replaceInConfig(path, oldHash, newHash)
+	})
+}
+
 func (s *BasicAuthService) Authenticate(username, password string) error {
-	user, ok := s.UserMap[username]
+	user, ok := s.user(username)
 	if !ok {
 		logger.Debug("no such user: ", username)
 		return ErrCrendential
 	}
-	hashMethod := user.PasswordCrypt
-	// todo: sha256
-	switch hashMethod {
-	case conf.BcryptHash:
-		err := bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(password))
-		if user.Username == username && err == nil {
-			return nil
+	if err := verifyPassword(user, password); err != nil {
+		return err
+	}
+	if hash := s.rehash.upgrade(username, user.PasswordHash, password); hash != user.PasswordHash {
+		s.mu.Lock()
+		user.PasswordHash = hash
+		s.UserMap[username] = user
+		s.mu.Unlock()
+	}
+	return nil
+}
+
+// CredentialVersion changes whenever the password hash of the user does.
+func (s *BasicAuthService) CredentialVersion(username string) string {
+	user, _ := s.user(username)
+	return user.PasswordHash
+}
+
+// verifyPassword checks a password against a hash detected by its prefix, see
+// package passhash, or else against an unsalted hex SHA-256 hash.
+func verifyPassword(user conf.User, password string) error {
+	if algorithm := passhash.Identify(user.PasswordHash); algorithm != "" {
+		ok, err := passhash.Verify(user.PasswordHash, password)
+		if err != nil {
+			logger.Debug(algorithm, " compare error: ", err)
+			return ErrUnsupportedHashMethod
+		}
+		if !ok {
+			return ErrCrendential
 		}
-		logger.Debug("bcrypt compare error: ", err)
+		return nil
+	}
+	switch user.PasswordCrypt {
 	case conf.SHA256Hash:
 		gen := sha256.New()
 		gen.Write([]byte(password))
 		expectedHash := hex.EncodeToString(gen.Sum(nil))
-		if user.Username == username && user.PasswordHash == expectedHash {
+		if user.PasswordHash == expectedHash {
 			return nil
 		}
 		logger.Debug("sha256 compare error, expected hash: ", user.PasswordHash, ", actual hash: ", expectedHash)
+		return ErrCrendential
 	default:
 		return ErrUnsupportedHashMethod
 	}
-	return ErrCrendential
+}
 
+func (s *BasicAuthService) user(username string) (conf.User, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	user, ok := s.UserMap[username]
+	return user, ok
 }
 
 func (s *BasicAuthService) GetAuthorizedSubDir(username string) (string, error) {
-	user, ok := s.UserMap[username]
+	user, ok := s.user(username)
 	if !ok {
 		return "", errors.New("no such user")
 	}
 	return user.SubFsDir, nil
 }
+
+func (s *BasicAuthService) GetStorage(username string) (string, error) {
+	user, ok := s.user(username)
+	if !ok {
+		return "", errors.New("no such user")
+	}
+	return user.Storage, nil
+}
+
+func (s *BasicAuthService) GetPermissions(username string) ([]conf.Permission, error) {
+	user, ok := s.user(username)
+	if !ok {
+		return nil, errors.New("no such user")
+	}
+	return userPermissions(user), nil
+}
+
+func userPermissions(user conf.User) []conf.Permission {
+	if len(user.Permissions) == 0 {
+		return conf.AllPermissions
+	}
+	return user.Permissions
+}
+
+func (s *BasicAuthService) GetGroups(username string) ([]string, error) {
+	user, ok := s.user(username)
+	if !ok {
+		return nil, errors.New("no such user")
+	}
+	return userGroups(user, s.GroupMap), nil
+}
+
+func (s *BasicAuthService) GetMounts(username string) ([]conf.Mount, error) {
+	user, ok := s.user(username)
+	if !ok {
+		return nil, errors.New("no such user")
+	}
+	return userMounts(user, s.GroupMap), nil
+}
+
+// userGroups returns the groups listed by the user and the ones listing the
+// user as a member.
+func userGroups(user conf.User, groups map[string]conf.Group) []string {
+	ret := append([]string{}, user.Groups...)
+	seen := make(map[string]bool)
+	for _, name := range ret {
+		seen[name] = true
+	}
+	names := make([]string, 0, len(groups))
+	for name := range groups {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if seen[name] {
+			continue
+		}
+		for _, member := range groups[name].Members {
+			if member == user.Username {
+				ret = append(ret, name)
+				break
+			}
+		}
+	}
+	return ret
+}
+
+func userMounts(user conf.User, groups map[string]conf.Group) []conf.Mount {
+	ret := append([]conf.Mount{}, user.Mount...)
+	for _, name := range userGroups(user, groups) {
+		ret = append(ret, groups[name].Mount...)
+	}
+	return ret
+}
+
 func (s *BasicAuthService) GetPathPrefix(username string) (string, error) {
-	user, ok := s.UserMap[username]
+	user, ok := s.user(username)
 	if !ok {
 		return "", errors.New("no such user")
 	}
@@ -0,0 +1,32 @@
+package service
+
+import (
+	"strings"
+
+	"github.com/pluveto/flydav/cmd/flydav/conf"
+	"github.com/pluveto/flydav/pkg/digestauth"
+)
+
+// DigestService provides the digest_ha1 of [[auth.user]] entries.
+type DigestService struct {
+	ha1 map[string]map[string]string // By username and algorithm
+}
+
+func NewDigestService(users []conf.User) *DigestService {
+	ret := &DigestService{ha1: make(map[string]map[string]string)}
+	for _, user := range users {
+		for _, ha1 := range user.DigestHA1 {
+			if ret.ha1[user.Username] == nil {
+				ret.ha1[user.Username] = make(map[string]string)
+			}
+			ret.ha1[user.Username][digestauth.AlgorithmOf(ha1)] = strings.ToLower(ha1)
+		}
+	}
+	return ret
+}
+
+// HA1 returns the HA1 of username computed with algorithm.
+func (s *DigestService) HA1(username, algorithm string) (string, bool) {
+	ha1, ok := s.ha1[username][strings.ToUpper(algorithm)]
+	return ha1, ok
+}
@@ -0,0 +1,82 @@
+package service
+
+import (
+	"errors"
+	"time"
+
+	"github.com/pluveto/flydav/cmd/flydav/conf"
+	"github.com/pluveto/flydav/pkg/htpasswd"
+	"github.com/pluveto/flydav/pkg/logger"
+	"github.com/pluveto/flydav/pkg/passhash"
+)
+
+// HtpasswdAuthService checks passwords against an htpasswd file that is
+// reloaded when it changes. The other settings of a user come from the
+// [[auth.user]] entry of the same username, or from a default profile.
+type HtpasswdAuthService struct {
+	profileService
+	File     *htpasswd.File
+	Profiles *BasicAuthService
+	Default  conf.User
+	rehash   *rehasher
+}
+
+func NewHtpasswdAuthService(cnf conf.Htpasswd, users []conf.User, groups []conf.Group) (*HtpasswdAuthService, error) {
+	file, err := htpasswd.Open(cnf.Path, time.Duration(cnf.ReloadInterval)*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	file.OnError(func(err error) {
+		logger.Error("failed to reload htpasswd file, keeping the previous users: ", err)
+	})
+	ret := &HtpasswdAuthService{
+		File:     file,
+		Profiles: NewBasicAuthService(users, groups),
+		Default:  cnf.Default,
+	}
+	ret.profileService = profileService{lookup: ret.user, groups: ret.Profiles.GroupMap}
+	return ret, nil
+}
+
+// UpgradeHashes makes Authenticate replace hashes weaker than algorithm in
+// the htpasswd file.
+func (s *HtpasswdAuthService) UpgradeHashes(algorithm string) {
+	s.rehash = newRehasher(algorithm, func(username, _, newHash string) error {
+		return s.File.Update(username, newHash)
+	})
+}
+
+func (s *HtpasswdAuthService) Authenticate(username, password string) error {
+	hash, ok := s.File.Lookup(username)
+	if !ok {
+		logger.Debug("no such user: ", username)
+		return ErrCrendential
+	}
+	ok, err := htpasswd.Verify(hash, password)
+	if err != nil {
+		logger.Debug("htpasswd compare error: ", err)
+		if errors.Is(err, htpasswd.ErrUnsupportedHash) || errors.Is(err, passhash.ErrUnsupportedHash) {
+			return ErrUnsupportedHashMethod
+		}
+	}
+	if !ok {
+		return ErrCrendential
+	}
+	s.rehash.upgrade(username, hash, password)
+	return nil
+}
+
+// CredentialVersion changes whenever the hash of the user in the file does.
+func (s *HtpasswdAuthService) CredentialVersion(username string) string {
+	hash, _ := s.File.Lookup(username)
+	return hash
+}
+
+// user returns the profile of a user listed in the htpasswd file.
+func (s *HtpasswdAuthService) user(username string) (conf.User, error) {
+	if _, ok := s.File.Lookup(username); !ok {
+		return conf.User{}, errors.New("no such user")
+	}
+	vars := map[string]string{"username": username}
+	return externalProfile(s.Profiles, s.Default, username, vars, nil), nil
+}
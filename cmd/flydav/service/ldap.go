@@ -0,0 +1,113 @@
+package service
+
+import (
+	"crypto/tls"
+	"time"
+
+	"github.com/pluveto/flydav/cmd/flydav/conf"
+	"github.com/pluveto/flydav/pkg/ldapauth"
+	"github.com/pluveto/flydav/pkg/logger"
+	"github.com/pluveto/flydav/pkg/tlsutil"
+)
+
+// LDAPAuthService binds to a directory server for every authentication and
+// remembers the resulting profile until the next one of the same user.
+type LDAPAuthService struct {
+	profileService
+	Client           *ldapauth.Client
+	Profiles         *BasicAuthService
+	Default          conf.User
+	GroupPermissions map[string][]conf.Permission
+	RequireGroup     bool
+	cache            *profileCache
+}
+
+func NewLDAPAuthService(cnf conf.LDAP, users []conf.User, groups []conf.Group) (*LDAPAuthService, error) {
+	tlsConfig := &tls.Config{InsecureSkipVerify: cnf.InsecureSkipVerify}
+	if cnf.CABundle != "" {
+		pool, err := tlsutil.LoadCABundle(cnf.CABundle, true)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.RootCAs = pool
+	}
+	ret := &LDAPAuthService{
+		Client: ldapauth.New(ldapauth.Config{
+			URL:                cnf.URL,
+			StartTLS:           cnf.StartTLS,
+			TLSConfig:          tlsConfig,
+			Timeout:            time.Duration(cnf.Timeout) * time.Second,
+			UserDN:             cnf.UserDN,
+			BindDN:             cnf.BindDN,
+			BindPassword:       cnf.BindPassword,
+			BaseDN:             cnf.BaseDN,
+			UserFilter:         cnf.UserFilter,
+			GroupAttribute:     cnf.GroupAttribute,
+			GroupBaseDN:        cnf.GroupBaseDN,
+			GroupFilter:        cnf.GroupFilter,
+			GroupNameAttribute: cnf.GroupNameAttribute,
+		}),
+		Profiles:         NewBasicAuthService(users, groups),
+		Default:          cnf.Default,
+		GroupPermissions: make(map[string][]conf.Permission),
+		RequireGroup:     cnf.RequireGroup,
+		cache:            newProfileCache(),
+	}
+	ret.profileService = profileService{lookup: ret.cache.lookup, groups: ret.Profiles.GroupMap}
+	for _, group := range cnf.Group {
+		ret.GroupPermissions[group.Name] = append(ret.GroupPermissions[group.Name], group.Permissions...)
+	}
+	return ret, nil
+}
+
+func (s *LDAPAuthService) Authenticate(username, password string) error {
+	entry, err := s.Client.Authenticate(username, password)
+	if err == ldapauth.ErrInvalidCredentials {
+		return ErrCrendential
+	}
+	if err != nil {
+		logger.Error("ldap authentication failed: ", err)
+		return ErrCrendential
+	}
+	return s.store(username, entry)
+}
+
+// ResolveUser looks up username in the directory without a password, e.g.
+// for a login with a client certificate, and remembers the profile like
+// Authenticate.
+func (s *LDAPAuthService) ResolveUser(username string) error {
+	entry, err := s.Client.Lookup(username)
+	if err != nil {
+		return err
+	}
+	return s.store(username, entry)
+}
+
+// store remembers the profile of the directory entry of username.
+func (s *LDAPAuthService) store(username string, entry *ldapauth.User) error {
+	vars := make(map[string]string)
+	for name, value := range entry.Attributes {
+		vars[name] = value
+	}
+	vars["username"] = username
+	// LDAP groups join the configured ones, so ACL rules and group mounts
+	// can refer to them
+	user := externalProfile(s.Profiles, s.Default, username, vars, entry.Groups)
+	var granted []conf.Permission
+	matched := false
+	for _, group := range entry.Groups {
+		if perms, ok := s.GroupPermissions[group]; ok {
+			matched = true
+			granted = append(granted, perms...)
+		}
+	}
+	if matched {
+		user.Permissions = granted
+	} else if s.RequireGroup {
+		logger.Debug("ldap user ", username, " is in no configured group")
+		return ErrCrendential
+	}
+
+	s.cache.store(user)
+	return nil
+}
@@ -0,0 +1,73 @@
+package service
+
+import (
+	"context"
+	"crypto/tls"
+	"net/http"
+
+	"github.com/pluveto/flydav/cmd/flydav/conf"
+	"github.com/pluveto/flydav/pkg/logger"
+	"github.com/pluveto/flydav/pkg/oidcauth"
+	"github.com/pluveto/flydav/pkg/tlsutil"
+)
+
+// OIDCAuthService authenticates bearer tokens of an OpenID Connect issuer and
+// remembers the resulting profile until the next token of the same user.
+type OIDCAuthService struct {
+	profileService
+	Verifier *oidcauth.Verifier
+	Profiles *BasicAuthService
+	Default  conf.User
+	cache    *profileCache
+}
+
+func NewOIDCAuthService(cnf conf.OIDC, users []conf.User, groups []conf.Group) (*OIDCAuthService, error) {
+	var client *http.Client
+	if cnf.CABundle != "" {
+		pool, err := tlsutil.LoadCABundle(cnf.CABundle, true)
+		if err != nil {
+			return nil, err
+		}
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+		client = &http.Client{Transport: transport}
+	}
+	audiences := cnf.Audience
+	if cnf.ClientID != "" {
+		audiences = append([]string{cnf.ClientID}, audiences...)
+	}
+	verifier, err := oidcauth.NewVerifier(context.Background(), oidcauth.Config{
+		Issuer:        cnf.Issuer,
+		Audiences:     audiences,
+		UsernameClaim: cnf.UsernameClaim,
+		GroupsClaim:   cnf.GroupsClaim,
+		HTTPClient:    client,
+	})
+	if err != nil {
+		return nil, err
+	}
+	ret := &OIDCAuthService{
+		Verifier: verifier,
+		Profiles: NewBasicAuthService(users, groups),
+		Default:  cnf.Default,
+		cache:    newProfileCache(),
+	}
+	ret.profileService = profileService{lookup: ret.cache.lookup, groups: ret.Profiles.GroupMap}
+	return ret, nil
+}
+
+// AuthenticateToken verifies a JWT and returns the username it maps to.
+func (s *OIDCAuthService) AuthenticateToken(token string) (string, error) {
+	id, err := s.Verifier.Verify(context.Background(), token)
+	if err != nil {
+		logger.Debug("token verification failed: ", err)
+		return "", ErrCrendential
+	}
+	vars := make(map[string]string)
+	for name, value := range id.Claims {
+		vars[name] = value
+	}
+	vars["username"] = id.Username
+	s.cache.store(externalProfile(s.Profiles, s.Default, id.Username, vars, id.Groups))
+	return id.Username, nil
+}
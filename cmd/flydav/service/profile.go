@@ -0,0 +1,137 @@
+package service
+
+import (
+	"errors"
+	"path"
+	"strings"
+	"sync"
+
+	"github.com/pluveto/flydav/cmd/flydav/conf"
+)
+
+// profileService answers the profile getters of an auth service whose users
+// are looked up by a function, e.g. in an htpasswd file or in the profiles
+// remembered from the last authentication.
+type profileService struct {
+	lookup func(username string) (conf.User, error)
+	groups map[string]conf.Group
+}
+
+func (s profileService) GetAuthorizedSubDir(username string) (string, error) {
+	user, err := s.lookup(username)
+	if err != nil {
+		return "", err
+	}
+	return user.SubFsDir, nil
+}
+
+func (s profileService) GetStorage(username string) (string, error) {
+	user, err := s.lookup(username)
+	if err != nil {
+		return "", err
+	}
+	return user.Storage, nil
+}
+
+func (s profileService) GetPathPrefix(username string) (string, error) {
+	user, err := s.lookup(username)
+	if err != nil {
+		return "", err
+	}
+	return user.SubPath, nil
+}
+
+func (s profileService) GetPermissions(username string) ([]conf.Permission, error) {
+	user, err := s.lookup(username)
+	if err != nil {
+		return nil, err
+	}
+	return userPermissions(user), nil
+}
+
+func (s profileService) GetGroups(username string) ([]string, error) {
+	user, err := s.lookup(username)
+	if err != nil {
+		return nil, err
+	}
+	return userGroups(user, s.groups), nil
+}
+
+func (s profileService) GetMounts(username string) ([]conf.Mount, error) {
+	user, err := s.lookup(username)
+	if err != nil {
+		return nil, err
+	}
+	return userMounts(user, s.groups), nil
+}
+
+// profileCache remembers the profiles of users authenticated by an external
+// backend until their next authentication.
+type profileCache struct {
+	mu    sync.RWMutex
+	users map[string]conf.User
+}
+
+func newProfileCache() *profileCache {
+	return &profileCache{users: make(map[string]conf.User)}
+}
+
+func (c *profileCache) store(user conf.User) {
+	c.mu.Lock()
+	c.users[user.Username] = user
+	c.mu.Unlock()
+}
+
+func (c *profileCache) lookup(username string) (conf.User, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	user, ok := c.users[username]
+	if !ok {
+		return conf.User{}, errors.New("no such user")
+	}
+	return user, nil
+}
+
+// externalProfile returns the [[auth.user]] entry of username if any, or
+// fills the template otherwise. Groups from the external backend are added
+// to the configured ones.
+func externalProfile(profiles *BasicAuthService, tmpl conf.User, username string, vars map[string]string, groups []string) conf.User {
+	user, ok := profiles.user(username)
+	if !ok {
+		user = expandProfile(tmpl, username, vars)
+	}
+	user.Groups = append(append([]string{}, user.Groups...), groups...)
+	return user
+}
+
+// expandProfile fills a profile template for username, replacing "{key}" with
+// vars[key] in the sub dir, path prefix and mount directories. Directories
+// are cleaned so that values like "../x" cannot leave the server fs_dir.
+func expandProfile(tmpl conf.User, username string, vars map[string]string) conf.User {
+	pairs := make([]string, 0, 2*len(vars))
+	for k, v := range vars {
+		pairs = append(pairs, "{"+k+"}", v)
+	}
+	replacer := strings.NewReplacer(pairs...)
+	dir := func(tmpl string) string {
+		if tmpl == "" {
+			return ""
+		}
+		return path.Clean("/" + replacer.Replace(tmpl))
+	}
+
+	user := tmpl
+	user.Username = username
+	user.SubFsDir = dir(tmpl.SubFsDir)
+	user.SubPath = replacer.Replace(tmpl.SubPath)
+	user.Mount = make([]conf.Mount, len(tmpl.Mount))
+	for i, mount := range tmpl.Mount {
+		mount.FsDir = dir(mount.FsDir)
+		mount.Lower = append([]conf.Layer{}, mount.Lower...)
+		for j := range mount.Lower {
+			mount.Lower[j].FsDir = dir(mount.Lower[j].FsDir)
+		}
+		user.Mount[i] = mount
+	}
+	return user
+}
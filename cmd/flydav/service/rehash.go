@@ -0,0 +1,68 @@
+package service
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/pluveto/flydav/pkg/logger"
+	"github.com/pluveto/flydav/pkg/misc"
+	"github.com/pluveto/flydav/pkg/passhash"
+)
+
+// rehasher replaces weak password hashes, see passhash.NeedsRehash, with
+// ones of algorithm after successful logins, when the password is known. A user whose new hash cannot be saved, e.g. because the
+// file is read-only, is not tried again.
+type rehasher struct {
+	algorithm string
+	save      func(username, oldHash, newHash string) error
+
+	mu     sync.Mutex
+	failed map[string]bool
+}
+
+func newRehasher(algorithm string, save func(username, oldHash, newHash string) error) *rehasher {
+	return &rehasher{algorithm: algorithm, save: save, failed: make(map[string]bool)}
+}
+
+// upgrade returns the hash in effect for username after the login with
+// password, which has been verified against hash.
+func (r *rehasher) upgrade(username, hash, password string) string {
+	if r == nil || !passhash.NeedsRehash(hash) {
+		return hash
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.failed[username] {
+		return hash
+	}
+	newHash, err := passhash.Hash(r.algorithm, password)
+	if err == nil {
+		err = r.save(username, hash, newHash)
+	}
+	if err != nil {
+		r.failed[username] = true
+		logger.Warn("failed to upgrade the password hash of user ", username, ": ", err)
+		return hash
+	}
+	logger.Info("upgraded the password hash of user ", username, " to ", r.algorithm)
+	return newHash
+}
+
+// replaceInConfig replaces the only occurrence of oldHash in the config file,
+// which keeps its comments and layout.
+func replaceInConfig(path, oldHash, newHash string) error {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	switch strings.Count(string(content), oldHash) {
+	case 1:
+	case 0:
+		return fmt.Errorf("hash not found in %s", path)
+	default:
+		return fmt.Errorf("hash appears more than once in %s", path)
+	}
+	return misc.ReplaceFile(path, []byte(strings.Replace(string(content), oldHash, newHash, 1)))
+}
@@ -0,0 +1,152 @@
+package credcache
+
+import (
+	"container/list"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"sync"
+	"time"
+)
+
+type entry struct {
+	key      string
+	username string
+	version  string
+	scope    string
+	expires  time.Time
+}
+
+// Cache remembers successful logins, or sessions standing for them, for a
+// limited time. When full, the least recently used entry is dropped.
+// Logins are keyed by an HMAC of username and password with a random key, so
+// passwords are not kept in memory and a user may have several, e.g. app
+// passwords.
+type Cache struct {
+	ttl    time.Duration
+	max    int
+	secret []byte
+	now    func() time.Time
+
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	order   *list.List // Most recently used first
+}
+
+func New(ttl time.Duration, maxEntries int) *Cache {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		panic(err)
+	}
+	return &Cache{
+		ttl:     ttl,
+		max:     maxEntries,
+		secret:  secret,
+		now:     time.Now,
+		entries: make(map[string]*list.Element),
+		order:   list.New(),
+	}
+}
+
+// Add remembers that password is valid for username while the stored
+// credentials have the given version, e.g. their hash. The scope tells which
+// of the credentials of the user matched, "" for the main password.
+func (c *Cache) Add(username, password, version, scope string) {
+	c.put(&entry{key: c.digest(username, password), username: username, version: version, scope: scope})
+}
+
+// Verify reports whether username logged in with password recently and
+// returns the scope of that login. The entry is only valid while the version
+// returned for the scope is still the same.
+func (c *Cache) Verify(username, password string, version func(scope string) string) (string, bool) {
+	key := c.digest(username, password)
+	e, ok := c.get(key)
+	if !ok {
+		return "", false
+	}
+	if e.version != version(e.scope) {
+		c.Remove(key)
+		return "", false
+	}
+	return e.scope, true
+}
+
+// NewSession returns a random token standing for username until it expires.
+func (c *Cache) NewSession(username, version string) string {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	token := hex.EncodeToString(b)
+	c.put(&entry{key: token, username: username, version: version})
+	return token
+}
+
+// Session returns the username and credential version of a session token.
+func (c *Cache) Session(token string) (username, version string, ok bool) {
+	e, ok := c.get(token)
+	if !ok {
+		return "", "", false
+	}
+	return e.username, e.version, true
+}
+
+// Remove forgets a session.
+func (c *Cache) Remove(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if elem, ok := c.entries[key]; ok {
+		c.order.Remove(elem)
+		delete(c.entries, key)
+	}
+}
+
+// TTL is how long entries are kept.
+func (c *Cache) TTL() time.Duration {
+	return c.ttl
+}
+
+func (c *Cache) put(e *entry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e.expires = c.now().Add(c.ttl)
+	if elem, ok := c.entries[e.key]; ok {
+		elem.Value = e
+		c.order.MoveToFront(elem)
+		return
+	}
+	c.entries[e.key] = c.order.PushFront(e)
+	for c.order.Len() > c.max {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*entry).key)
+	}
+}
+
+func (c *Cache) get(key string) (*entry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	elem, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	e := elem.Value.(*entry)
+	if !c.now().Before(e.expires) {
+		c.order.Remove(elem)
+		delete(c.entries, key)
+		return nil, false
+	}
+	c.order.MoveToFront(elem)
+	return e, true
+}
+
+// digest is base64, so that it never equals a session token, which is hex.
+func (c *Cache) digest(username, password string) string {
+	mac := hmac.New(sha256.New, c.secret)
+	mac.Write([]byte(username))
+	mac.Write([]byte{0})
+	mac.Write([]byte(password))
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
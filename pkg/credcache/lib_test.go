@@ -0,0 +1,96 @@
+package credcache
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestCache(ttl time.Duration, max int) (*Cache, *time.Time) {
+	c := New(ttl, max)
+	now := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	c.now = func() time.Time { return now }
+	return c, &now
+}
+
+func versions(m map[string]string) func(string) string {
+	return func(scope string) string { return m[scope] }
+}
+
+func TestCache_Verify(t *testing.T) {
+	c, now := newTestCache(time.Minute, 10)
+	current := map[string]string{"": "v1", "phone": "p1"}
+	verify := func(username, password string) (string, bool) {
+		return c.Verify(username, password, versions(current))
+	}
+	_, ok := verify("alice", "secretpass")
+	assert.False(t, ok)
+
+	c.Add("alice", "secretpass", "v1", "")
+	c.Add("alice", "phonepass", "p1", "phone")
+	scope, ok := verify("alice", "secretpass")
+	assert.True(t, ok)
+	assert.Equal(t, "", scope)
+	scope, ok = verify("alice", "phonepass")
+	assert.True(t, ok)
+	assert.Equal(t, "phone", scope)
+	_, ok = verify("alice", "wrongpass")
+	assert.False(t, ok)
+	_, ok = verify("bob", "secretpass")
+	assert.False(t, ok)
+
+	current["phone"] = ""
+	_, ok = verify("alice", "phonepass")
+	assert.False(t, ok, "a revoked app password invalidates its entry")
+	_, ok = verify("alice", "secretpass")
+	assert.True(t, ok)
+	current[""] = "v2"
+	_, ok = verify("alice", "secretpass")
+	assert.False(t, ok, "a changed hash invalidates the entry")
+
+	c.Add("alice", "secretpass", "v2", "")
+	*now = now.Add(time.Minute)
+	_, ok = verify("alice", "secretpass")
+	assert.False(t, ok, "expired")
+}
+
+func TestCache_Bounded(t *testing.T) {
+	c, _ := newTestCache(time.Minute, 2)
+	verify := func(username, password string) bool {
+		_, ok := c.Verify(username, password, versions(nil))
+		return ok
+	}
+	c.Add("alice", "a", "", "")
+	c.Add("bob", "b", "", "")
+	assert.True(t, verify("alice", "a"))
+	c.Add("carol", "c", "", "")
+
+	assert.True(t, verify("alice", "a"))
+	assert.False(t, verify("bob", "b"), "least recently used")
+	assert.True(t, verify("carol", "c"))
+	assert.Len(t, c.entries, 2)
+}
+
+func TestCache_Session(t *testing.T) {
+	c, now := newTestCache(time.Hour, 10)
+	token := c.NewSession("alice", "v1")
+	assert.Len(t, token, 64)
+	assert.NotEqual(t, token, c.NewSession("alice", "v1"))
+
+	username, version, ok := c.Session(token)
+	assert.True(t, ok)
+	assert.Equal(t, "alice", username)
+	assert.Equal(t, "v1", version)
+	_, _, ok = c.Session("alice")
+	assert.False(t, ok)
+
+	c.Remove(token)
+	_, _, ok = c.Session(token)
+	assert.False(t, ok)
+
+	token = c.NewSession("alice", "v1")
+	*now = now.Add(time.Hour)
+	_, _, ok = c.Session(token)
+	assert.False(t, ok)
+}
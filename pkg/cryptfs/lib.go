@@ -0,0 +1,511 @@
+// Package cryptfs encrypts the files of a webdav.FileSystem, so that the
+// storage below only ever sees ciphertext.
+//
+// A file starts with a header holding its own random key, encrypted with a
+// key derived from the master key. The content follows in chunks of
+// ChunkSize, each sealed with AES-GCM and bound to its position, so that
+// reordered or truncated chunks fail to decrypt and ranges can be read
+// without decrypting the whole file. File and directory names can be
+// encrypted too, deterministically so that they can be looked up.
+package cryptfs
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+
+	"golang.org/x/crypto/hkdf"
+	"golang.org/x/net/webdav"
+)
+
+const (
+	ChunkSize = 64 << 10
+	KeySize   = 32
+
+	magic      = "FDC1"
+	nonceSize  = 12
+	tagSize    = 16
+	headerSize = len(magic) + nonceSize + KeySize + tagSize
+	overhead   = nonceSize + tagSize
+)
+
+var (
+	ErrCorrupt      = errors.New("cryptfs: file is corrupt or encrypted with another key")
+	ErrPartialWrite = errors.New("cryptfs: files can only be written whole, with O_TRUNC")
+)
+
+// nameEncoding is case insensitive, for file systems that are too.
+var nameEncoding = base32.HexEncoding.WithPadding(base32.NoPadding)
+
+// LoadKey reads a base64 encoded master key of KeySize bytes, e.g. made with
+// "openssl rand -base64 32".
+func LoadKey(file string) ([]byte, error) {
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(b)))
+	if err != nil || len(key) != KeySize {
+		return nil, fmt.Errorf("%s: need %d base64 encoded bytes", file, KeySize)
+	}
+	return key, nil
+}
+
+type FileSystem struct {
+	fs      webdav.FileSystem
+	wrap    cipher.AEAD // Seals the keys of files
+	names   cipher.AEAD // Seals names, nil if they are kept
+	nameMAC []byte      // Derives the nonces of names
+}
+
+// New encrypts the files of fs with masterKey, and their names if
+// encryptNames is set.
+func New(fs webdav.FileSystem, masterKey []byte, encryptNames bool) (*FileSystem, error) {
+	if len(masterKey) != KeySize {
+		return nil, fmt.Errorf("cryptfs: key of %d bytes, need %d", len(masterKey), KeySize)
+	}
+	derive := func(purpose string) []byte {
+		key := make([]byte, KeySize)
+		io.ReadFull(hkdf.New(sha256.New, masterKey, nil, []byte("flydav "+purpose)), key)
+		return key
+	}
+	ret := &FileSystem{fs: fs}
+	var err error
+	if ret.wrap, err = newGCM(derive("file keys")); err != nil {
+		return nil, err
+	}
+	if encryptNames {
+		if ret.names, err = newGCM(derive("names")); err != nil {
+			return nil, err
+		}
+		ret.nameMAC = derive("name nonces")
+	}
+	return ret, nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// PlainSize returns the size of the content of a file of cipherSize bytes.
+func PlainSize(cipherSize int64) int64 {
+	body := cipherSize - int64(headerSize)
+	if body <= 0 {
+		return 0
+	}
+	chunks := (body + ChunkSize + overhead - 1) / (ChunkSize + overhead)
+	if size := body - chunks*overhead; size > 0 {
+		return size
+	}
+	return 0
+}
+
+// encryptName seals name with a nonce derived from it, so that a name
+// always gets the same ciphertext.
+func (fs *FileSystem) encryptName(name string) string {
+	mac := hmac.New(sha256.New, fs.nameMAC)
+	mac.Write([]byte(name))
+	nonce := mac.Sum(nil)[:nonceSize]
+	return strings.ToLower(nameEncoding.EncodeToString(fs.names.Seal(nonce, nonce, []byte(name), nil)))
+}
+
+func (fs *FileSystem) decryptName(name string) (string, error) {
+	b, err := nameEncoding.DecodeString(strings.ToUpper(name))
+	if err != nil || len(b) < overhead {
+		return "", ErrCorrupt
+	}
+	plain, err := fs.names.Open(nil, b[:nonceSize], b[nonceSize:], nil)
+	if err != nil {
+		return "", ErrCorrupt
+	}
+	return string(plain), nil
+}
+
+// path returns the name of the file in the storage below.
+func (fs *FileSystem) path(name string) string {
+	name = path.Clean("/" + name)
+	if fs.names == nil || name == "/" {
+		return name
+	}
+	parts := strings.Split(name[1:], "/")
+	for i, part := range parts {
+		parts[i] = fs.encryptName(part)
+	}
+	return "/" + strings.Join(parts, "/")
+}
+
+// fileInfo shows the name and size of the plaintext.
+type fileInfo struct {
+	os.FileInfo
+	name string
+	size int64
+}
+
+func (fi *fileInfo) Name() string { return fi.name }
+func (fi *fileInfo) Size() int64  { return fi.size }
+
+func plainInfo(info os.FileInfo, name string) os.FileInfo {
+	size := info.Size()
+	if !info.IsDir() {
+		size = PlainSize(size)
+	}
+	return &fileInfo{FileInfo: info, name: name, size: size}
+}
+
+func (fs *FileSystem) Mkdir(ctx context.Context, name string, perm os.FileMode) error {
+	return fs.fs.Mkdir(ctx, fs.path(name), perm)
+}
+
+func (fs *FileSystem) RemoveAll(ctx context.Context, name string) error {
+	return fs.fs.RemoveAll(ctx, fs.path(name))
+}
+
+func (fs *FileSystem) Rename(ctx context.Context, oldName, newName string) error {
+	return fs.fs.Rename(ctx, fs.path(oldName), fs.path(newName))
+}
+
+func (fs *FileSystem) Stat(ctx context.Context, name string) (os.FileInfo, error) {
+	info, err := fs.fs.Stat(ctx, fs.path(name))
+	if err != nil {
+		return nil, err
+	}
+	return plainInfo(info, path.Base(path.Clean("/"+name))), nil
+}
+
+func (fs *FileSystem) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (webdav.File, error) {
+	base := path.Base(path.Clean("/" + name))
+	if flag&os.O_APPEND != 0 {
+		return nil, &os.PathError{Op: "open", Path: name, Err: ErrPartialWrite}
+	}
+	f, err := fs.fs.OpenFile(ctx, fs.path(name), flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	if info.IsDir() {
+		return &dir{File: f, fs: fs, info: plainInfo(info, base)}, nil
+	}
+	if flag&(os.O_WRONLY|os.O_RDWR) == 0 {
+		r, err := fs.newReader(f, info, base)
+		if err != nil {
+			f.Close()
+			return nil, &os.PathError{Op: "open", Path: name, Err: err}
+		}
+		return r, nil
+	}
+	if flag&os.O_TRUNC == 0 && info.Size() > 0 {
+		// webdav.Handler opens files O_RDWR for PROPPATCH without writing
+		if flag&os.O_RDWR == 0 {
+			f.Close()
+			return nil, &os.PathError{Op: "open", Path: name, Err: ErrPartialWrite}
+		}
+		r, err := fs.newReader(f, info, base)
+		if err != nil {
+			f.Close()
+			return nil, &os.PathError{Op: "open", Path: name, Err: err}
+		}
+		r.writable = true
+		return r, nil
+	}
+	w, err := fs.newWriter(f, info, base)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return w, nil
+}
+
+// additionalData binds a chunk to its position.
+func additionalData(index int64, last bool) []byte {
+	ret := make([]byte, 9)
+	binary.BigEndian.PutUint64(ret, uint64(index))
+	if last {
+		ret[8] = 1
+	}
+	return ret
+}
+
+// reader decrypts the chunk at the position when read.
+type reader struct {
+	f      webdav.File
+	aead   cipher.AEAD
+	info   os.FileInfo
+	chunks int64
+	pos    int64
+	index  int64 // Of the chunk in plain
+	plain  []byte
+	raw    []byte
+	// writable is set for O_RDWR without O_TRUNC, writes fail nevertheless
+	writable bool
+}
+
+func (fs *FileSystem) newReader(f webdav.File, info os.FileInfo, name string) (*reader, error) {
+	header := make([]byte, headerSize)
+	if _, err := io.ReadFull(f, header); err != nil || !bytes.HasPrefix(header, []byte(magic)) {
+		return nil, ErrCorrupt
+	}
+	nonce := header[len(magic) : len(magic)+nonceSize]
+	key, err := fs.wrap.Open(nil, nonce, header[len(magic)+nonceSize:], []byte(magic))
+	if err != nil {
+		return nil, ErrCorrupt
+	}
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	body := info.Size() - int64(headerSize)
+	chunks := (body + ChunkSize + overhead - 1) / (ChunkSize + overhead)
+	if chunks == 0 {
+		return nil, ErrCorrupt
+	}
+	return &reader{
+		f:      f,
+		aead:   aead,
+		info:   plainInfo(info, name),
+		chunks: chunks,
+		index:  -1,
+		raw:    make([]byte, ChunkSize+overhead),
+	}, nil
+}
+
+func (r *reader) load(index int64) error {
+	if _, err := r.f.Seek(int64(headerSize)+index*(ChunkSize+overhead), io.SeekStart); err != nil {
+		return err
+	}
+	n, err := io.ReadFull(r.f, r.raw)
+	if err == io.ErrUnexpectedEOF && index == r.chunks-1 {
+		err = nil
+	}
+	if err != nil {
+		return err
+	}
+	if n < overhead {
+		return ErrCorrupt
+	}
+	plain, err := r.aead.Open(r.plain[:0], r.raw[:nonceSize], r.raw[nonceSize:n], additionalData(index, index == r.chunks-1))
+	if err != nil {
+		r.index = -1
+		return ErrCorrupt
+	}
+	r.plain, r.index = plain, index
+	return nil
+}
+
+func (r *reader) Read(p []byte) (int, error) {
+	if r.pos >= r.info.Size() {
+		return 0, io.EOF
+	}
+	index := r.pos / ChunkSize
+	if index != r.index {
+		if err := r.load(index); err != nil {
+			return 0, err
+		}
+	}
+	offset := int(r.pos - index*ChunkSize)
+	if offset >= len(r.plain) {
+		return 0, ErrCorrupt
+	}
+	n := copy(p, r.plain[offset:])
+	r.pos += int64(n)
+	return n, nil
+}
+
+func (r *reader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += r.pos
+	case io.SeekEnd:
+		offset += r.info.Size()
+	}
+	if offset < 0 {
+		return 0, errors.New("cryptfs: negative position")
+	}
+	r.pos = offset
+	return offset, nil
+}
+
+func (r *reader) Stat() (os.FileInfo, error) {
+	return r.info, nil
+}
+
+func (r *reader) Close() error {
+	return r.f.Close()
+}
+
+func (r *reader) Write(p []byte) (int, error) {
+	if r.writable {
+		return 0, ErrPartialWrite
+	}
+	return 0, os.ErrPermission
+}
+
+func (r *reader) Readdir(count int) ([]os.FileInfo, error) {
+	return nil, errors.New("not a directory")
+}
+
+// writer encrypts what is written to it, holding back the last chunk until
+// it is closed to mark it as the last.
+type writer struct {
+	f      webdav.File
+	aead   cipher.AEAD
+	info   os.FileInfo
+	name   string
+	index  int64
+	size   int64
+	plain  []byte
+	sealed []byte
+	closed bool
+	err    error
+}
+
+func (fs *FileSystem) newWriter(f webdav.File, info os.FileInfo, name string) (*writer, error) {
+	key := make([]byte, KeySize)
+	header := make([]byte, len(magic)+nonceSize, headerSize)
+	copy(header, magic)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	if _, err := rand.Read(header[len(magic):]); err != nil {
+		return nil, err
+	}
+	header = fs.wrap.Seal(header, header[len(magic):], key, []byte(magic))
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := f.Write(header); err != nil {
+		return nil, err
+	}
+	return &writer{
+		f:      f,
+		aead:   aead,
+		info:   info,
+		name:   name,
+		plain:  make([]byte, 0, ChunkSize),
+		sealed: make([]byte, 0, ChunkSize+overhead),
+	}, nil
+}
+
+func (w *writer) writeChunk(last bool) error {
+	nonce := w.sealed[:nonceSize]
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+	sealed := w.aead.Seal(nonce, nonce, w.plain, additionalData(w.index, last))
+	if _, err := w.f.Write(sealed); err != nil {
+		return err
+	}
+	w.index++
+	w.plain = w.plain[:0]
+	return nil
+}
+
+func (w *writer) Write(p []byte) (int, error) {
+	if w.err != nil {
+		return 0, w.err
+	}
+	written := 0
+	for len(p) > 0 {
+		if len(w.plain) == ChunkSize {
+			if w.err = w.writeChunk(false); w.err != nil {
+				return written, w.err
+			}
+		}
+		n := ChunkSize - len(w.plain)
+		if n > len(p) {
+			n = len(p)
+		}
+		w.plain = append(w.plain, p[:n]...)
+		p = p[n:]
+		written += n
+		w.size += int64(n)
+	}
+	return written, nil
+}
+
+// Close writes the last chunk, the file is incomplete before.
+func (w *writer) Close() error {
+	if w.closed {
+		return w.err
+	}
+	w.closed = true
+	if w.err == nil {
+		w.err = w.writeChunk(true)
+	}
+	if err := w.f.Close(); w.err == nil {
+		w.err = err
+	}
+	return w.err
+}
+
+func (w *writer) Stat() (os.FileInfo, error) {
+	return &fileInfo{FileInfo: w.info, name: w.name, size: w.size}, nil
+}
+
+func (w *writer) Seek(offset int64, whence int) (int64, error) {
+	if offset == 0 && whence == io.SeekCurrent {
+		return w.size, nil
+	}
+	return 0, ErrPartialWrite
+}
+
+func (w *writer) Read(p []byte) (int, error) {
+	return 0, os.ErrPermission
+}
+
+func (w *writer) Readdir(count int) ([]os.FileInfo, error) {
+	return nil, errors.New("not a directory")
+}
+
+// dir shows the plaintext names and sizes of its entries, skipping names
+// that do not decrypt.
+type dir struct {
+	webdav.File
+	fs   *FileSystem
+	info os.FileInfo
+}
+
+func (d *dir) Readdir(count int) ([]os.FileInfo, error) {
+	entries, err := d.File.Readdir(count)
+	ret := make([]os.FileInfo, 0, len(entries))
+	for _, entry := range entries {
+		name := entry.Name()
+		if d.fs.names != nil {
+			var nameErr error
+			if name, nameErr = d.fs.decryptName(name); nameErr != nil {
+				continue
+			}
+		}
+		ret = append(ret, plainInfo(entry, name))
+	}
+	return ret, err
+}
+
+func (d *dir) Stat() (os.FileInfo, error) {
+	return d.info, nil
+}
+
+func (d *dir) Write(p []byte) (int, error) {
+	return 0, errors.New("is a directory")
+}
@@ -0,0 +1,222 @@
+package cryptfs
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/pluveto/flydav/pkg/storage/storagetest"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/webdav"
+)
+
+var (
+	ctx = context.Background()
+	key = bytes.Repeat([]byte{7}, KeySize)
+)
+
+func newFS(t *testing.T, inner webdav.FileSystem, encryptNames bool) *FileSystem {
+	fs, err := New(inner, key, encryptNames)
+	assert.NoError(t, err)
+	return fs
+}
+
+func TestFileSystem(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T) webdav.FileSystem {
+		return newFS(t, webdav.NewMemFS(), false)
+	})
+}
+
+func TestFileSystemWithNames(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T) webdav.FileSystem {
+		return newFS(t, webdav.Dir(t.TempDir()), true)
+	})
+}
+
+func writeFile(t *testing.T, fs webdav.FileSystem, name string, content []byte) {
+	f, err := fs.OpenFile(ctx, name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if assert.NoError(t, err, name) {
+		_, err = f.Write(content)
+		assert.NoError(t, err)
+		assert.NoError(t, f.Close())
+	}
+}
+
+func readFile(fs webdav.FileSystem, name string) ([]byte, error) {
+	f, err := fs.OpenFile(ctx, name, os.O_RDONLY, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return io.ReadAll(f)
+}
+
+func TestCiphertext(t *testing.T) {
+	dir := t.TempDir()
+	fs := newFS(t, webdav.Dir(dir), true)
+	assert.NoError(t, fs.Mkdir(ctx, "/secret plans", 0755))
+	content := bytes.Repeat([]byte("attack at dawn "), 10000)
+	writeFile(t, fs, "/secret plans/dawn.txt", content)
+
+	entries, err := os.ReadDir(dir)
+	assert.NoError(t, err)
+	if assert.Len(t, entries, 1) {
+		assert.NotContains(t, entries[0].Name(), "secret")
+		assert.Equal(t, fs.encryptName("secret plans"), entries[0].Name(), "names are deterministic")
+		files, err := filepath.Glob(filepath.Join(dir, entries[0].Name(), "*"))
+		assert.NoError(t, err)
+		if assert.Len(t, files, 1) {
+			raw, err := os.ReadFile(files[0])
+			assert.NoError(t, err)
+			assert.False(t, bytes.Contains(raw, []byte("attack")))
+			assert.Equal(t, int64(len(content)), PlainSize(int64(len(raw))))
+		}
+	}
+
+	info, err := fs.Stat(ctx, "/secret plans/dawn.txt")
+	assert.NoError(t, err)
+	assert.Equal(t, "dawn.txt", info.Name())
+	assert.Equal(t, int64(len(content)), info.Size(), "the plaintext size")
+	got, err := readFile(fs, "/secret plans/dawn.txt")
+	assert.NoError(t, err)
+	assert.Equal(t, content, got)
+
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "stray"), []byte("x"), 0644))
+	f, err := fs.OpenFile(ctx, "/", os.O_RDONLY, 0)
+	assert.NoError(t, err)
+	infos, err := f.Readdir(-1)
+	assert.NoError(t, err)
+	assert.NoError(t, f.Close())
+	if assert.Len(t, infos, 1, "names that do not decrypt are skipped") {
+		assert.Equal(t, "secret plans", infos[0].Name())
+	}
+}
+
+func TestSeek(t *testing.T) {
+	fs := newFS(t, webdav.NewMemFS(), false)
+	content := make([]byte, 3*ChunkSize+100)
+	rand.New(rand.NewSource(1)).Read(content)
+	writeFile(t, fs, "/a.bin", content)
+
+	for _, size := range []int{0, 1, ChunkSize - 1, ChunkSize, 2 * ChunkSize} {
+		writeFile(t, fs, "/b.bin", content[:size])
+		got, err := readFile(fs, "/b.bin")
+		assert.NoError(t, err)
+		assert.Equal(t, size, len(got), "whole chunks")
+		assert.Equal(t, content[:size], got)
+	}
+
+	f, err := fs.OpenFile(ctx, "/a.bin", os.O_RDONLY, 0)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer f.Close()
+	for _, offset := range []int64{ChunkSize*2 + 10, 5, ChunkSize - 3, int64(len(content)) - 1} {
+		pos, err := f.Seek(offset, io.SeekStart)
+		assert.NoError(t, err)
+		assert.Equal(t, offset, pos)
+		buf := make([]byte, 10)
+		n, err := io.ReadFull(f, buf)
+		if offset+10 > int64(len(content)) {
+			assert.ErrorIs(t, err, io.ErrUnexpectedEOF)
+		} else {
+			assert.NoError(t, err)
+		}
+		assert.Equal(t, content[offset:offset+int64(n)], buf[:n])
+	}
+	end, err := f.Seek(0, io.SeekEnd)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(len(content)), end)
+}
+
+func TestTamper(t *testing.T) {
+	dir := t.TempDir()
+	fs := newFS(t, webdav.Dir(dir), false)
+	content := bytes.Repeat([]byte("x"), 2*ChunkSize+5)
+	writeFile(t, fs, "/a.txt", content)
+	raw, err := os.ReadFile(filepath.Join(dir, "a.txt"))
+	assert.NoError(t, err)
+
+	flipped := append([]byte(nil), raw...)
+	flipped[len(flipped)-1] ^= 1
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "a.txt"), flipped, 0644))
+	_, err = readFile(fs, "/a.txt")
+	assert.ErrorIs(t, err, ErrCorrupt)
+
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "a.txt"), raw[:headerSize+2*(ChunkSize+overhead)], 0644))
+	_, err = readFile(fs, "/a.txt")
+	assert.ErrorIs(t, err, ErrCorrupt, "truncated at a chunk boundary")
+
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "a.txt"), raw, 0644))
+	other, err := New(webdav.Dir(dir), bytes.Repeat([]byte{8}, KeySize), false)
+	assert.NoError(t, err)
+	_, err = readFile(other, "/a.txt")
+	assert.ErrorIs(t, err, ErrCorrupt, "another key")
+	got, err := readFile(fs, "/a.txt")
+	assert.NoError(t, err)
+	assert.Equal(t, content, got)
+}
+
+func TestPartialWrite(t *testing.T) {
+	fs := newFS(t, webdav.NewMemFS(), false)
+	writeFile(t, fs, "/a.txt", []byte("hello"))
+	_, err := fs.OpenFile(ctx, "/a.txt", os.O_WRONLY, 0)
+	assert.ErrorIs(t, err, ErrPartialWrite)
+	_, err = fs.OpenFile(ctx, "/a.txt", os.O_WRONLY|os.O_APPEND, 0)
+	assert.ErrorIs(t, err, ErrPartialWrite)
+
+	f, err := fs.OpenFile(ctx, "/a.txt", os.O_RDWR, 0)
+	if assert.NoError(t, err, "opened like by PROPPATCH") {
+		_, err = f.Write([]byte("x"))
+		assert.ErrorIs(t, err, ErrPartialWrite)
+		got, err := io.ReadAll(f)
+		assert.NoError(t, err)
+		assert.Equal(t, "hello", string(got))
+		assert.NoError(t, f.Close())
+	}
+	got, err := readFile(fs, "/a.txt")
+	assert.NoError(t, err)
+	assert.Equal(t, "hello", string(got))
+}
+
+func TestPropPatch(t *testing.T) {
+	fs := newFS(t, webdav.Dir(t.TempDir()), true)
+	handler := &webdav.Handler{FileSystem: fs, LockSystem: webdav.NewMemLS()}
+	do := func(method, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(method, "/report.docx", strings.NewReader(body)))
+		return w
+	}
+	assert.Equal(t, http.StatusCreated, do("PUT", "quarterly numbers").Code)
+	// Windows sets the file times after saving
+	w := do("PROPPATCH", `<?xml version="1.0" encoding="utf-8" ?>
+<D:propertyupdate xmlns:D="DAV:" xmlns:Z="urn:schemas-microsoft-com:">
+  <D:set><D:prop><Z:Win32LastModifiedTime>Wed, 01 Feb 2023 10:00:00 GMT</Z:Win32LastModifiedTime></D:prop></D:set>
+</D:propertyupdate>`)
+	assert.Equal(t, http.StatusMultiStatus, w.Code)
+	w = do("GET", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "quarterly numbers", w.Body.String())
+}
+
+func TestLoadKey(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "key")
+	assert.NoError(t, os.WriteFile(file, []byte(base64.StdEncoding.EncodeToString(key)+"\n"), 0600))
+	got, err := LoadKey(file)
+	assert.NoError(t, err)
+	assert.Equal(t, key, got)
+	assert.NoError(t, os.WriteFile(file, []byte("c2hvcnQ="), 0600))
+	_, err = LoadKey(file)
+	assert.Error(t, err)
+	_, err = New(webdav.NewMemFS(), []byte("short"), false)
+	assert.Error(t, err)
+}
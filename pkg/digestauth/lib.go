@@ -0,0 +1,349 @@
+package digestauth
+
+import (
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Algorithms of RFC 7616. The -sess variants are not supported.
+const (
+	MD5    = "MD5"
+	SHA256 = "SHA-256"
+)
+
+var (
+	ErrMalformed = errors.New("malformed digest credentials")
+	ErrStale     = errors.New("digest nonce expired")
+	ErrResponse  = errors.New("wrong digest response")
+	ErrReplay    = errors.New("digest nonce count reused")
+)
+
+// Supported reports whether algorithm is one of MD5 and SHA-256.
+func Supported(algorithm string) bool {
+	return newHash(algorithm) != nil
+}
+
+func newHash(algorithm string) hash.Hash {
+	switch strings.ToUpper(algorithm) {
+	case MD5:
+		return md5.New()
+	case SHA256:
+		return sha256.New()
+	}
+	return nil
+}
+
+func h(algorithm string, data string) string {
+	hash := newHash(algorithm)
+	hash.Write([]byte(data))
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// HA1 returns the hash of username, realm and password that servers store
+// instead of the password.
+func HA1(algorithm, username, realm, password string) string {
+	return h(algorithm, username+":"+realm+":"+password)
+}
+
+// AlgorithmOf tells the algorithm of a hex encoded HA1 by its length, "" if
+// it is none.
+func AlgorithmOf(ha1 string) string {
+	if _, err := hex.DecodeString(ha1); err != nil {
+		return ""
+	}
+	switch len(ha1) {
+	case 2 * md5.Size:
+		return MD5
+	case 2 * sha256.Size:
+		return SHA256
+	}
+	return ""
+}
+
+// Credentials are the parameters of an "Authorization: Digest" header.
+type Credentials struct {
+	Username  string
+	Realm     string
+	Nonce     string
+	URI       string
+	Response  string
+	Algorithm string // MD5 if the client sent none
+	Cnonce    string
+	NC        string
+	Qop       string
+	Opaque    string
+	Userhash  bool
+}
+
+// Parse parses the value of an Authorization header. It returns false if
+// the scheme is not Digest.
+func Parse(header string) (*Credentials, bool, error) {
+	scheme, rest, _ := strings.Cut(strings.TrimSpace(header), " ")
+	if !strings.EqualFold(scheme, "Digest") {
+		return nil, false, nil
+	}
+	params, err := parseParams(rest)
+	if err != nil {
+		return nil, true, err
+	}
+	c := &Credentials{
+		Username:  params["username"],
+		Realm:     params["realm"],
+		Nonce:     params["nonce"],
+		URI:       params["uri"],
+		Response:  params["response"],
+		Algorithm: params["algorithm"],
+		Cnonce:    params["cnonce"],
+		NC:        params["nc"],
+		Qop:       params["qop"],
+		Opaque:    params["opaque"],
+		Userhash:  strings.EqualFold(params["userhash"], "true"),
+	}
+	if c.Algorithm == "" {
+		c.Algorithm = MD5
+	}
+	if c.Username == "" || c.Nonce == "" || c.URI == "" || c.Response == "" {
+		return nil, true, ErrMalformed
+	}
+	return c, true, nil
+}
+
+// parseParams parses comma separated key=value pairs, values being tokens
+// or quoted strings.
+func parseParams(s string) (map[string]string, error) {
+	params := make(map[string]string)
+	for {
+		s = strings.TrimLeft(s, " \t,")
+		if s == "" {
+			return params, nil
+		}
+		eq := strings.IndexByte(s, '=')
+		if eq <= 0 {
+			return nil, ErrMalformed
+		}
+		key := strings.ToLower(strings.TrimSpace(s[:eq]))
+		s = strings.TrimLeft(s[eq+1:], " \t")
+		var value strings.Builder
+		if strings.HasPrefix(s, `"`) {
+			i := 1
+			for ; i < len(s) && s[i] != '"'; i++ {
+				if s[i] == '\\' && i+1 < len(s) {
+					i++
+				}
+				value.WriteByte(s[i])
+			}
+			if i == len(s) {
+				return nil, ErrMalformed
+			}
+			s = s[i+1:]
+		} else {
+			end := strings.IndexByte(s, ',')
+			if end < 0 {
+				end = len(s)
+			}
+			value.WriteString(strings.TrimSpace(s[:end]))
+			s = s[end:]
+		}
+		params[key] = value.String()
+	}
+}
+
+// Server issues nonces and verifies digest responses. Nonces carry the time
+// they were issued, random bytes and an HMAC, so no state is kept for nonces
+// that are never used. The nonce counts of used ones are tracked to reject
+// replays. Clients sending requests in parallel may use counts out of order,
+// so the recent ones are remembered in a window rather than only the highest.
+type Server struct {
+	realm      string
+	algorithms []string
+	expiry     time.Duration
+	key        []byte
+	opaque     string
+	now        func() time.Time
+
+	mu        sync.Mutex
+	counts    map[string]*window // Nonce counts seen by nonce
+	lastSweep time.Time
+}
+
+// New returns a Server offering algorithms in the order given, with nonces
+// valid for expiry.
+func New(realm string, algorithms []string, expiry time.Duration) *Server {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		panic(err)
+	}
+	opaque := make([]byte, 16)
+	if _, err := rand.Read(opaque); err != nil {
+		panic(err)
+	}
+	return &Server{
+		realm:      realm,
+		algorithms: algorithms,
+		expiry:     expiry,
+		key:        key,
+		opaque:     hex.EncodeToString(opaque),
+		now:        time.Now,
+		counts:     make(map[string]*window),
+	}
+}
+
+// Challenges returns a WWW-Authenticate value for each algorithm. Stale
+// tells clients that only the nonce expired, so they retry without asking
+// the user.
+func (s *Server) Challenges(stale bool) []string {
+	nonce := s.nonce(s.now())
+	var ret []string
+	for _, algorithm := range s.algorithms {
+		challenge := fmt.Sprintf(`Digest realm="%s", qop="auth", algorithm=%s, nonce="%s", opaque="%s"`,
+			s.realm, algorithm, nonce, s.opaque)
+		if stale {
+			challenge += ", stale=true"
+		}
+		ret = append(ret, challenge)
+	}
+	return ret
+}
+
+const nonceData = 16 // Issue time and random bytes
+
+func (s *Server) nonce(issued time.Time) string {
+	buf := make([]byte, nonceData, nonceData+sha256.Size)
+	binary.BigEndian.PutUint64(buf, uint64(issued.UnixNano()))
+	if _, err := rand.Read(buf[8:]); err != nil {
+		panic(err)
+	}
+	mac := hmac.New(sha256.New, s.key)
+	mac.Write(buf)
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(buf))
+}
+
+// checkNonce verifies that the server issued nonce and that it has not
+// expired.
+func (s *Server) checkNonce(nonce string) error {
+	buf, err := base64.RawURLEncoding.DecodeString(nonce)
+	if err != nil || len(buf) != nonceData+sha256.Size {
+		return ErrResponse
+	}
+	mac := hmac.New(sha256.New, s.key)
+	mac.Write(buf[:nonceData])
+	if !hmac.Equal(mac.Sum(nil), buf[nonceData:]) {
+		return ErrResponse
+	}
+	issued := time.Unix(0, int64(binary.BigEndian.Uint64(buf[:8])))
+	if s.now().Sub(issued) > s.expiry {
+		return ErrStale
+	}
+	return nil
+}
+
+// Verify checks the response of c to a request with method against the
+// stored ha1 of the user. The request URI is checked by the caller.
+func (s *Server) Verify(c *Credentials, method, ha1 string) error {
+	if c.Realm != s.realm || c.Opaque != s.opaque || c.Userhash {
+		return ErrResponse
+	}
+	if !s.offers(c.Algorithm) || c.Qop != "auth" || c.Cnonce == "" {
+		return ErrResponse
+	}
+	nc, err := parseNC(c.NC)
+	if err != nil {
+		return err
+	}
+	if err := s.checkNonce(c.Nonce); err != nil {
+		return err
+	}
+	ha2 := h(c.Algorithm, method+":"+c.URI)
+	expected := h(c.Algorithm, strings.Join([]string{ha1, c.Nonce, c.NC, c.Cnonce, c.Qop, ha2}, ":"))
+	if ha1 == "" || subtle.ConstantTimeCompare([]byte(expected), []byte(strings.ToLower(c.Response))) != 1 {
+		return ErrResponse
+	}
+	return s.count(c.Nonce, nc)
+}
+
+func (s *Server) offers(algorithm string) bool {
+	for _, a := range s.algorithms {
+		if strings.EqualFold(a, algorithm) {
+			return true
+		}
+	}
+	return false
+}
+
+func parseNC(nc string) (uint64, error) {
+	if len(nc) != 8 {
+		return 0, ErrMalformed
+	}
+	buf, err := hex.DecodeString(nc)
+	if err != nil {
+		return 0, ErrMalformed
+	}
+	return uint64(binary.BigEndian.Uint32(buf)), nil
+}
+
+// windowSize is how far below the highest nonce count others are accepted.
+const windowSize = 64
+
+// window holds the highest nonce count seen and, bit i set, whether the
+// count i below it was seen.
+type window struct {
+	highest uint64
+	seen    uint64
+}
+
+// add records nc, false if it was seen or is too old to tell.
+func (w *window) add(nc uint64) bool {
+	if nc > w.highest {
+		// counts moving out of the window are shifted out to 0
+		shift := nc - w.highest
+		w.seen = w.seen<<shift | 1<<(shift-1)
+		w.highest = nc
+		return true
+	}
+	diff := w.highest - nc
+	if diff == 0 || diff > windowSize || w.seen&(1<<(diff-1)) != 0 {
+		return false
+	}
+	w.seen |= 1 << (diff - 1)
+	return true
+}
+
+// count records nc for nonce, which must not have been used before.
+func (s *Server) count(nonce string, nc uint64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := s.now()
+	if now.Sub(s.lastSweep) > s.expiry {
+		s.sweep()
+		s.lastSweep = now
+	}
+	w, ok := s.counts[nonce]
+	if !ok {
+		w = &window{}
+		s.counts[nonce] = w
+	}
+	if !w.add(nc) {
+		return ErrReplay
+	}
+	return nil
+}
+
+func (s *Server) sweep() {
+	for nonce := range s.counts {
+		if s.checkNonce(nonce) != nil {
+			delete(s.counts, nonce)
+		}
+	}
+}
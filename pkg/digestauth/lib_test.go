@@ -0,0 +1,162 @@
+package digestauth
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHA1(t *testing.T) {
+	// RFC 7616, section 3.9.1
+	assert.Equal(t, MD5, AlgorithmOf(HA1(MD5, "Mufasa", "http-auth@example.org", "Circle of Life")))
+	assert.Equal(t, SHA256, AlgorithmOf(HA1(SHA256, "Mufasa", "http-auth@example.org", "Circle of Life")))
+	assert.Equal(t, "", AlgorithmOf("not hex"))
+	assert.Equal(t, "", AlgorithmOf("abcd"))
+}
+
+// TestVerify_RFCExample checks the responses of RFC 7616, section 3.9.1.
+func TestVerify_RFCExample(t *testing.T) {
+	for algorithm, response := range map[string]string{
+		MD5:    "8ca523f5e9506fed4657c9700eebdbec",
+		SHA256: "753927fa0e85d155564e2e272a28d1802ca10daf4496794697cf8db5856cb6c1",
+	} {
+		ha1 := HA1(algorithm, "Mufasa", "http-auth@example.org", "Circle of Life")
+		ha2 := h(algorithm, "GET:/dir/index.html")
+		nonce := "7ypf/xlj9XXwfDPEoM4URrv/xwf94BcCAzFZH4GiTo0v"
+		got := h(algorithm, strings.Join([]string{ha1, nonce, "00000001", "f2/wE4q74E6zIJEtWaHKaf5wv/H5QzzpXusqGemxURZJ", "auth", ha2}, ":"))
+		assert.Equal(t, response, got, algorithm)
+	}
+}
+
+func respond(c *Credentials, method, ha1 string) {
+	ha2 := h(c.Algorithm, method+":"+c.URI)
+	c.Response = h(c.Algorithm, strings.Join([]string{ha1, c.Nonce, c.NC, c.Cnonce, c.Qop, ha2}, ":"))
+}
+
+func challenge(t *testing.T, s *Server, i int) *Credentials {
+	params, err := parseParams(strings.TrimPrefix(s.Challenges(false)[i], "Digest "))
+	assert.NoError(t, err)
+	return &Credentials{
+		Username:  "alice",
+		Realm:     params["realm"],
+		Nonce:     params["nonce"],
+		Opaque:    params["opaque"],
+		Algorithm: params["algorithm"],
+		Qop:       params["qop"],
+		URI:       "/webdav/a.txt",
+		Cnonce:    "0a4f113b",
+		NC:        "00000001",
+	}
+}
+
+func TestServer_Verify(t *testing.T) {
+	s := New("FlyDav", []string{SHA256, MD5}, time.Minute)
+	now := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	s.now = func() time.Time { return now }
+
+	for i, algorithm := range []string{SHA256, MD5} {
+		ha1 := HA1(algorithm, "alice", "FlyDav", "secret")
+		c := challenge(t, s, i)
+		assert.Equal(t, algorithm, c.Algorithm)
+		respond(c, "GET", ha1)
+		assert.NoError(t, s.Verify(c, "GET", ha1))
+		assert.Equal(t, ErrReplay, s.Verify(c, "GET", ha1))
+		c.NC = "00000002"
+		respond(c, "GET", ha1)
+		assert.NoError(t, s.Verify(c, "GET", ha1))
+
+		c.NC = "00000003"
+		respond(c, "GET", HA1(algorithm, "alice", "FlyDav", "wrong"))
+		assert.Equal(t, ErrResponse, s.Verify(c, "GET", ha1))
+		respond(c, "GET", ha1)
+		assert.Equal(t, ErrResponse, s.Verify(c, "PUT", ha1), "the method is part of the response")
+		assert.Equal(t, ErrResponse, s.Verify(c, "GET", ""), "users without HA1 cannot log in")
+	}
+
+	ha1 := HA1(MD5, "alice", "FlyDav", "secret")
+	c := challenge(t, s, 1)
+	c.Qop = ""
+	respond(c, "GET", ha1)
+	assert.Equal(t, ErrResponse, s.Verify(c, "GET", ha1), "qop is required")
+
+	c = challenge(t, s, 1)
+	c.Nonce = s.nonce(now.Add(-time.Hour))
+	respond(c, "GET", ha1)
+	assert.Equal(t, ErrStale, s.Verify(c, "GET", ha1))
+
+	c = challenge(t, s, 1)
+	c.Nonce = New("FlyDav", []string{MD5}, time.Minute).nonce(now)
+	respond(c, "GET", ha1)
+	assert.Equal(t, ErrResponse, s.Verify(c, "GET", ha1), "nonces of another server are rejected")
+}
+
+func TestServer_VerifyOutOfOrder(t *testing.T) {
+	s := New("FlyDav", []string{MD5}, time.Minute)
+	ha1 := HA1(MD5, "alice", "FlyDav", "secret")
+	c := challenge(t, s, 0)
+	verify := func(nc uint64) error {
+		c.NC = fmt.Sprintf("%08x", nc)
+		respond(c, "GET", ha1)
+		return s.Verify(c, "GET", ha1)
+	}
+	assert.NoError(t, verify(5))
+	assert.NoError(t, verify(3), "parallel requests may arrive out of order")
+	assert.Equal(t, ErrReplay, verify(3))
+	assert.Equal(t, ErrReplay, verify(5))
+	assert.Equal(t, ErrReplay, verify(0))
+	assert.NoError(t, verify(1))
+	assert.NoError(t, verify(70))
+	assert.NoError(t, verify(6))
+	assert.Equal(t, ErrReplay, verify(5), "out of the window")
+	assert.Equal(t, ErrReplay, verify(6))
+	assert.NoError(t, verify(200))
+	assert.NoError(t, verify(136))
+	assert.Equal(t, ErrReplay, verify(70))
+	assert.Equal(t, ErrReplay, verify(135))
+}
+
+func TestServer_Challenges(t *testing.T) {
+	s := New("FlyDav", []string{MD5}, time.Minute)
+	challenges := s.Challenges(true)
+	assert.Len(t, challenges, 1)
+	assert.True(t, strings.HasPrefix(challenges[0], `Digest realm="FlyDav", qop="auth", algorithm=MD5, nonce="`))
+	assert.True(t, strings.HasSuffix(challenges[0], ", stale=true"))
+}
+
+func TestParse(t *testing.T) {
+	c, ok, err := Parse(`Digest username="Mufasa", realm="http-auth@example.org", uri="/dir/index.html", ` +
+		`algorithm=SHA-256, nonce="7ypf/xlj9XXwfDPEoM4URrv/xwf94BcCAzFZH4GiTo0v", nc=00000001, ` +
+		`cnonce="f2/wE4q74E6zIJEtWaHKaf5wv/H5QzzpXusqGemxURZJ", qop=auth, ` +
+		`response="753927fa0e85d155564e2e272a28d1802ca10daf4496794697cf8db5856cb6c1", ` +
+		`opaque="FQhe/qaU925kfnzjCev0ciny7QMkPqMAFRtzCUYo5tdS"`)
+	assert.True(t, ok)
+	assert.NoError(t, err)
+	assert.Equal(t, &Credentials{
+		Username:  "Mufasa",
+		Realm:     "http-auth@example.org",
+		Nonce:     "7ypf/xlj9XXwfDPEoM4URrv/xwf94BcCAzFZH4GiTo0v",
+		URI:       "/dir/index.html",
+		Response:  "753927fa0e85d155564e2e272a28d1802ca10daf4496794697cf8db5856cb6c1",
+		Algorithm: SHA256,
+		Cnonce:    "f2/wE4q74E6zIJEtWaHKaf5wv/H5QzzpXusqGemxURZJ",
+		NC:        "00000001",
+		Qop:       "auth",
+		Opaque:    "FQhe/qaU925kfnzjCev0ciny7QMkPqMAFRtzCUYo5tdS",
+	}, c)
+
+	c, _, err = Parse(`Digest username="a\"b", nonce=n, uri="/", response=r`)
+	assert.NoError(t, err)
+	assert.Equal(t, `a"b`, c.Username)
+	assert.Equal(t, MD5, c.Algorithm)
+
+	_, ok, _ = Parse("Basic YTpi")
+	assert.False(t, ok)
+	_, ok, err = Parse(`Digest username="alice`)
+	assert.True(t, ok)
+	assert.Equal(t, ErrMalformed, err)
+	_, _, err = Parse(`Digest username="alice"`)
+	assert.Equal(t, ErrMalformed, err)
+}
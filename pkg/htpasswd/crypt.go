@@ -0,0 +1,275 @@
+package htpasswd
+
+import (
+	"crypto/md5"
+	"strings"
+)
+
+const (
+	apr1Magic = "$apr1$"
+	md5Magic  = "$1$"
+	itoa64    = "./0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+)
+
+// md5Crypt implements the MD5 based crypt of FreeBSD, which Apache uses with
+// the "$apr1$" magic.
+func md5Crypt(password, salt, magic string) string {
+	if len(salt) > 8 {
+		salt = salt[:8]
+	}
+	pw := []byte(password)
+
+	alt := md5.New()
+	alt.Write(pw)
+	alt.Write([]byte(salt))
+	alt.Write(pw)
+	altSum := alt.Sum(nil)
+
+	ctx := md5.New()
+	ctx.Write(pw)
+	ctx.Write([]byte(magic))
+	ctx.Write([]byte(salt))
+	for i := len(pw); i > 0; i -= 16 {
+		if i > 16 {
+			ctx.Write(altSum)
+		} else {
+			ctx.Write(altSum[:i])
+		}
+	}
+	for i := len(pw); i > 0; i >>= 1 {
+		if i&1 != 0 {
+			ctx.Write([]byte{0})
+		} else {
+			ctx.Write(pw[:1])
+		}
+	}
+	final := ctx.Sum(nil)
+
+	for i := 0; i < 1000; i++ {
+		round := md5.New()
+		if i&1 != 0 {
+			round.Write(pw)
+		} else {
+			round.Write(final)
+		}
+		if i%3 != 0 {
+			round.Write([]byte(salt))
+		}
+		if i%7 != 0 {
+			round.Write(pw)
+		}
+		if i&1 != 0 {
+			round.Write(final)
+		} else {
+			round.Write(pw)
+		}
+		final = round.Sum(nil)
+	}
+
+	var b strings.Builder
+	b.WriteString(magic)
+	b.WriteString(salt)
+	b.WriteByte('$')
+	to64 := func(v uint32, n int) {
+		for ; n > 0; n-- {
+			b.WriteByte(itoa64[v&0x3f])
+			v >>= 6
+		}
+	}
+	for _, idx := range [][3]int{{0, 6, 12}, {1, 7, 13}, {2, 8, 14}, {3, 9, 15}, {4, 10, 5}} {
+		to64(uint32(final[idx[0]])<<16|uint32(final[idx[1]])<<8|uint32(final[idx[2]]), 4)
+	}
+	to64(uint32(final[11]), 2)
+	return b.String()
+}
+
+func isDESCrypt(hash string) bool {
+	if len(hash) != 13 {
+		return false
+	}
+	for i := 0; i < len(hash); i++ {
+		if strings.IndexByte(itoa64, hash[i]) < 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// desCrypt implements the traditional crypt(3): 25 DES encryptions of a zero
+// block keyed by the first 8 password characters, with the expansion table
+// perturbed by the 12 bit salt.
+func desCrypt(password, salt string) string {
+	var key uint64
+	for i := 0; i < 8; i++ {
+		key <<= 8
+		if i < len(password) {
+			key |= uint64(password[i]<<1) & 0xff
+		}
+	}
+	subkeys := desSubkeys(key)
+
+	expansion := desE
+	for i := 0; i < 2; i++ {
+		v := strings.IndexByte(itoa64, salt[i])
+		for j := 0; j < 6; j++ {
+			if v>>j&1 != 0 {
+				k := 6*i + j
+				expansion[k], expansion[k+24] = expansion[k+24], expansion[k]
+			}
+		}
+	}
+
+	var block uint64
+	for i := 0; i < 25; i++ {
+		block = desEncrypt(block, &subkeys, &expansion)
+	}
+
+	var b strings.Builder
+	b.WriteString(salt)
+	// 64 bits padded to 66 make 11 characters, most significant first
+	for i := 0; i < 11; i++ {
+		shift := 58 - 6*i
+		var v uint64
+		if shift >= 0 {
+			v = block >> shift
+		} else {
+			v = block << -shift
+		}
+		b.WriteByte(itoa64[v&0x3f])
+	}
+	return b.String()
+}
+
+// permute picks the bits listed in table, numbered from 1 at the most
+// significant of width bits.
+func permute(in uint64, width int, table []byte) uint64 {
+	var out uint64
+	for _, pos := range table {
+		out = out<<1 | in>>(width-int(pos))&1
+	}
+	return out
+}
+
+func desSubkeys(key uint64) [16]uint64 {
+	var ret [16]uint64
+	cd := permute(key, 64, desPC1[:])
+	c, d := cd>>28, cd&0xfffffff
+	rotate := func(v uint64, n int) uint64 {
+		return (v<<n | v>>(28-n)) & 0xfffffff
+	}
+	for i, n := range desShifts {
+		c, d = rotate(c, int(n)), rotate(d, int(n))
+		ret[i] = permute(c<<28|d, 56, desPC2[:])
+	}
+	return ret
+}
+
+func desEncrypt(block uint64, subkeys *[16]uint64, expansion *[48]byte) uint64 {
+	block = permute(block, 64, desIP[:])
+	l, r := block>>32, block&0xffffffff
+	for _, k := range subkeys {
+		x := permute(r, 32, expansion[:]) ^ k
+		var s uint64
+		for i := 0; i < 8; i++ {
+			six := x >> (42 - 6*i) & 0x3f
+			row := six>>4&2 | six&1
+			col := six >> 1 & 0xf
+			s = s<<4 | uint64(desS[i][row*16+col])
+		}
+		l, r = r, l^permute(s, 32, desP[:])
+	}
+	return permute(r<<32|l, 64, desFP[:])
+}
+
+var desIP = [64]byte{
+	58, 50, 42, 34, 26, 18, 10, 2, 60, 52, 44, 36, 28, 20, 12, 4,
+	62, 54, 46, 38, 30, 22, 14, 6, 64, 56, 48, 40, 32, 24, 16, 8,
+	57, 49, 41, 33, 25, 17, 9, 1, 59, 51, 43, 35, 27, 19, 11, 3,
+	61, 53, 45, 37, 29, 21, 13, 5, 63, 55, 47, 39, 31, 23, 15, 7,
+}
+
+var desFP = [64]byte{
+	40, 8, 48, 16, 56, 24, 64, 32, 39, 7, 47, 15, 55, 23, 63, 31,
+	38, 6, 46, 14, 54, 22, 62, 30, 37, 5, 45, 13, 53, 21, 61, 29,
+	36, 4, 44, 12, 52, 20, 60, 28, 35, 3, 43, 11, 51, 19, 59, 27,
+	34, 2, 42, 10, 50, 18, 58, 26, 33, 1, 41, 9, 49, 17, 57, 25,
+}
+
+var desE = [48]byte{
+	32, 1, 2, 3, 4, 5, 4, 5, 6, 7, 8, 9,
+	8, 9, 10, 11, 12, 13, 12, 13, 14, 15, 16, 17,
+	16, 17, 18, 19, 20, 21, 20, 21, 22, 23, 24, 25,
+	24, 25, 26, 27, 28, 29, 28, 29, 30, 31, 32, 1,
+}
+
+var desP = [32]byte{
+	16, 7, 20, 21, 29, 12, 28, 17, 1, 15, 23, 26, 5, 18, 31, 10,
+	2, 8, 24, 14, 32, 27, 3, 9, 19, 13, 30, 6, 22, 11, 4, 25,
+}
+
+var desPC1 = [56]byte{
+	57, 49, 41, 33, 25, 17, 9, 1, 58, 50, 42, 34, 26, 18,
+	10, 2, 59, 51, 43, 35, 27, 19, 11, 3, 60, 52, 44, 36,
+	63, 55, 47, 39, 31, 23, 15, 7, 62, 54, 46, 38, 30, 22,
+	14, 6, 61, 53, 45, 37, 29, 21, 13, 5, 28, 20, 12, 4,
+}
+
+var desPC2 = [48]byte{
+	14, 17, 11, 24, 1, 5, 3, 28, 15, 6, 21, 10,
+	23, 19, 12, 4, 26, 8, 16, 7, 27, 20, 13, 2,
+	41, 52, 31, 37, 47, 55, 30, 40, 51, 45, 33, 48,
+	44, 49, 39, 56, 34, 53, 46, 42, 50, 36, 29, 32,
+}
+
+var desShifts = [16]byte{1, 1, 2, 2, 2, 2, 2, 2, 1, 2, 2, 2, 2, 2, 2, 1}
+
+var desS = [8][64]byte{
+	{
+		14, 4, 13, 1, 2, 15, 11, 8, 3, 10, 6, 12, 5, 9, 0, 7,
+		0, 15, 7, 4, 14, 2, 13, 1, 10, 6, 12, 11, 9, 5, 3, 8,
+		4, 1, 14, 8, 13, 6, 2, 11, 15, 12, 9, 7, 3, 10, 5, 0,
+		15, 12, 8, 2, 4, 9, 1, 7, 5, 11, 3, 14, 10, 0, 6, 13,
+	},
+	{
+		15, 1, 8, 14, 6, 11, 3, 4, 9, 7, 2, 13, 12, 0, 5, 10,
+		3, 13, 4, 7, 15, 2, 8, 14, 12, 0, 1, 10, 6, 9, 11, 5,
+		0, 14, 7, 11, 10, 4, 13, 1, 5, 8, 12, 6, 9, 3, 2, 15,
+		13, 8, 10, 1, 3, 15, 4, 2, 11, 6, 7, 12, 0, 5, 14, 9,
+	},
+	{
+		10, 0, 9, 14, 6, 3, 15, 5, 1, 13, 12, 7, 11, 4, 2, 8,
+		13, 7, 0, 9, 3, 4, 6, 10, 2, 8, 5, 14, 12, 11, 15, 1,
+		13, 6, 4, 9, 8, 15, 3, 0, 11, 1, 2, 12, 5, 10, 14, 7,
+		1, 10, 13, 0, 6, 9, 8, 7, 4, 15, 14, 3, 11, 5, 2, 12,
+	},
+	{
+		7, 13, 14, 3, 0, 6, 9, 10, 1, 2, 8, 5, 11, 12, 4, 15,
+		13, 8, 11, 5, 6, 15, 0, 3, 4, 7, 2, 12, 1, 10, 14, 9,
+		10, 6, 9, 0, 12, 11, 7, 13, 15, 1, 3, 14, 5, 2, 8, 4,
+		3, 15, 0, 6, 10, 1, 13, 8, 9, 4, 5, 11, 12, 7, 2, 14,
+	},
+	{
+		2, 12, 4, 1, 7, 10, 11, 6, 8, 5, 3, 15, 13, 0, 14, 9,
+		14, 11, 2, 12, 4, 7, 13, 1, 5, 0, 15, 10, 3, 9, 8, 6,
+		4, 2, 1, 11, 10, 13, 7, 8, 15, 9, 12, 5, 6, 3, 0, 14,
+		11, 8, 12, 7, 1, 14, 2, 13, 6, 15, 0, 9, 10, 4, 5, 3,
+	},
+	{
+		12, 1, 10, 15, 9, 2, 6, 8, 0, 13, 3, 4, 14, 7, 5, 11,
+		10, 15, 4, 2, 7, 12, 9, 5, 6, 1, 13, 14, 0, 11, 3, 8,
+		9, 14, 15, 5, 2, 8, 12, 3, 7, 0, 4, 10, 1, 13, 11, 6,
+		4, 3, 2, 12, 9, 5, 15, 10, 11, 14, 1, 7, 6, 0, 8, 13,
+	},
+	{
+		4, 11, 2, 14, 15, 0, 8, 13, 3, 12, 9, 7, 5, 10, 6, 1,
+		13, 0, 11, 7, 4, 9, 1, 10, 14, 3, 5, 12, 2, 15, 8, 6,
+		1, 4, 11, 13, 12, 3, 7, 14, 10, 15, 6, 8, 0, 5, 9, 2,
+		6, 11, 13, 8, 1, 4, 10, 7, 9, 5, 0, 15, 14, 2, 3, 12,
+	},
+	{
+		13, 2, 8, 4, 6, 15, 11, 1, 10, 9, 3, 14, 5, 0, 12, 7,
+		1, 15, 13, 8, 10, 3, 7, 4, 12, 5, 6, 11, 0, 14, 9, 2,
+		7, 11, 4, 1, 9, 12, 14, 2, 0, 6, 10, 13, 15, 3, 5, 8,
+		2, 1, 14, 7, 4, 10, 8, 13, 15, 12, 9, 0, 3, 5, 6, 11,
+	},
+}
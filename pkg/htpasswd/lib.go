@@ -0,0 +1,207 @@
+package htpasswd
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pluveto/flydav/pkg/misc"
+	"github.com/pluveto/flydav/pkg/passhash"
+	"golang.org/x/crypto/bcrypt"
+)
+
+var ErrUnsupportedHash = errors.New("unsupported htpasswd hash")
+
+// Parse reads "username:hash" lines. Blank lines and lines starting with "#"
+// are skipped, a later entry of the same user replaces an earlier one.
+func Parse(r io.Reader) (map[string]string, error) {
+	ret := make(map[string]string)
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		username, hash, ok := strings.Cut(line, ":")
+		if !ok || username == "" {
+			return nil, fmt.Errorf("line %d: expected username:hash", n)
+		}
+		ret[username] = hash
+	}
+	return ret, scanner.Err()
+}
+
+// Verify checks password against a hash written by Apache htpasswd: bcrypt,
+// "{SHA}", APR1-MD5 ("$apr1$", also "$1$") or traditional DES crypt. The
+// hashes of package passhash, e.g. "$argon2id$", are accepted as well.
+func Verify(hash, password string) (bool, error) {
+	switch {
+	case strings.HasPrefix(hash, "$2a$"), strings.HasPrefix(hash, "$2b$"), strings.HasPrefix(hash, "$2y$"):
+		err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
+		if err == bcrypt.ErrMismatchedHashAndPassword {
+			return false, nil
+		}
+		return err == nil, err
+	case strings.HasPrefix(hash, "{SHA}"):
+		sum := sha1.Sum([]byte(password))
+		return equal(hash[len("{SHA}"):], base64.StdEncoding.EncodeToString(sum[:])), nil
+	case strings.HasPrefix(hash, apr1Magic), strings.HasPrefix(hash, md5Magic):
+		magic := apr1Magic
+		if strings.HasPrefix(hash, md5Magic) {
+			magic = md5Magic
+		}
+		salt, _, ok := strings.Cut(hash[len(magic):], "$")
+		if !ok {
+			return false, ErrUnsupportedHash
+		}
+		return equal(hash, md5Crypt(password, salt, magic)), nil
+	case isDESCrypt(hash):
+		return equal(hash, desCrypt(password, hash[:2])), nil
+	case passhash.Identify(hash) != "":
+		return passhash.Verify(hash, password)
+	default:
+		return false, ErrUnsupportedHash
+	}
+}
+
+func equal(a, b string) bool {
+	return subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
+
+// File holds the entries of an htpasswd file and reloads them when the file
+// changes on disk.
+type File struct {
+	path     string
+	interval time.Duration
+
+	mu        sync.RWMutex
+	entries   map[string]string
+	modTime   time.Time
+	lastCheck time.Time
+	onError   func(error)
+}
+
+// Open loads the file once and fails if it is unusable. The file is checked
+// again at most once per interval.
+func Open(path string, interval time.Duration) (*File, error) {
+	f := &File{
+		path:     path,
+		interval: interval,
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if err := f.load(info.ModTime()); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// OnError sets a callback invoked when a changed file fails to load. The
+// previously loaded entries stay in use in that case.
+func (f *File) OnError(fn func(error)) {
+	f.onError = fn
+}
+
+// Lookup returns the hash stored for username.
+func (f *File) Lookup(username string) (string, bool) {
+	f.maybeReload()
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	hash, ok := f.entries[username]
+	return hash, ok
+}
+
+// Authenticate reports whether the file has username with a matching
+// password.
+func (f *File) Authenticate(username, password string) (bool, error) {
+	hash, ok := f.Lookup(username)
+	if !ok {
+		return false, nil
+	}
+	return Verify(hash, password)
+}
+
+// Update replaces the hash of username in the file. Other lines, including
+// comments, are kept as they are.
+func (f *File) Update(username, hash string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	content, err := os.ReadFile(f.path)
+	if err != nil {
+		return err
+	}
+	lines := strings.SplitAfter(string(content), "\n")
+	found := -1
+	for i, line := range lines {
+		name, _, ok := strings.Cut(strings.TrimSpace(line), ":")
+		if ok && name == username {
+			// the last entry is the one in effect
+			found = i
+		}
+	}
+	if found < 0 {
+		return fmt.Errorf("user %s not found in %s", username, f.path)
+	}
+	lines[found] = username + ":" + hash + "\n"
+	if err := misc.ReplaceFile(f.path, []byte(strings.Join(lines, ""))); err != nil {
+		return err
+	}
+	if info, err := os.Stat(f.path); err == nil {
+		f.modTime = info.ModTime()
+	}
+	f.entries[username] = hash
+	return nil
+}
+
+func (f *File) maybeReload() {
+	f.mu.RLock()
+	due := time.Since(f.lastCheck) >= f.interval
+	f.mu.RUnlock()
+	if !due {
+		return
+	}
+
+	f.mu.Lock()
+	f.lastCheck = time.Now()
+	current := f.modTime
+	f.mu.Unlock()
+
+	info, err := os.Stat(f.path)
+	if err == nil && info.ModTime().Equal(current) {
+		return
+	}
+	if err == nil {
+		err = f.load(info.ModTime())
+	}
+	if err != nil && f.onError != nil {
+		f.onError(err)
+	}
+}
+
+func (f *File) load(modTime time.Time) error {
+	file, err := os.Open(f.path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	entries, err := Parse(file)
+	if err != nil {
+		return fmt.Errorf("failed to parse %s: %w", f.path, err)
+	}
+	f.mu.Lock()
+	f.entries = entries
+	f.modTime = modTime
+	f.lastCheck = time.Now()
+	f.mu.Unlock()
+	return nil
+}
@@ -0,0 +1,112 @@
+package htpasswd
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestVerify(t *testing.T) {
+	bcryptHash, err := bcrypt.GenerateFromPassword([]byte("secretpass"), bcrypt.MinCost)
+	assert.NoError(t, err)
+
+	tests := []struct {
+		name string
+		hash string
+	}{
+		{"bcrypt", string(bcryptHash)},
+		{"bcrypt 2y", "$2y$" + strings.TrimPrefix(string(bcryptHash), "$2a$")},
+		{"sha1", "{SHA}NkvfLtd6hUTTtxGgO2nurcxjydc="},
+		{"apr1", "$apr1$abcdefgh$lhHWHuVs2YDoc.E4ROpKH1"},
+		{"md5", "$1$saltsalt$7DwGF604FLHMzlPQKL50l."},
+		{"crypt", "abSsy3GvmHpeQ"},
+		{"scrypt", scryptHash},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ok, err := Verify(tt.hash, "secretpass")
+			assert.NoError(t, err)
+			assert.True(t, ok)
+			ok, err = Verify(tt.hash, "wrongpass")
+			assert.NoError(t, err)
+			assert.False(t, ok)
+		})
+	}
+
+	_, err = Verify("plaintext", "plaintext")
+	assert.ErrorIs(t, err, ErrUnsupportedHash)
+}
+
+const scryptHash = "$scrypt$ln=4,r=8,p=1$MDEyMzQ1Njc4OWFiY2RlZg$aHJQwwVNJVSreHMAl/Zas03pgEMu1GPRyNca6bZQE2o"
+
+func TestDESCrypt(t *testing.T) {
+	assert.Equal(t, "zzJZ5PtvFqi9o", desCrypt("a", "zz"))
+	// only the first 8 characters count
+	assert.Equal(t, "./qw5JW./79Vg", desCrypt("12345678longer", "./"))
+}
+
+func TestParse(t *testing.T) {
+	entries, err := Parse(strings.NewReader("# comment\nalice:{SHA}x\n\nbob:$apr1$a$b\nalice:abSsy3GvmHpeQ\n"))
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{"alice": "abSsy3GvmHpeQ", "bob": "$apr1$a$b"}, entries)
+
+	_, err = Parse(strings.NewReader("no separator\n"))
+	assert.Error(t, err)
+}
+
+func TestFile_Reload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "htpasswd")
+	start := time.Now().Add(-time.Minute)
+	write := func(content string, modTime time.Time) {
+		assert.NoError(t, os.WriteFile(path, []byte(content), 0600))
+		assert.NoError(t, os.Chtimes(path, modTime, modTime))
+	}
+
+	write("alice:{SHA}NkvfLtd6hUTTtxGgO2nurcxjydc=\n", start)
+	f, err := Open(path, 0)
+	assert.NoError(t, err)
+	ok, err := f.Authenticate("alice", "secretpass")
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	ok, _ = f.Authenticate("bob", "secretpass")
+	assert.False(t, ok)
+
+	write("bob:abSsy3GvmHpeQ\n", start.Add(time.Second))
+	ok, _ = f.Authenticate("alice", "secretpass")
+	assert.False(t, ok)
+	ok, _ = f.Authenticate("bob", "secretpass")
+	assert.True(t, ok)
+
+	// a broken file keeps the previous entries
+	var reloadErr error
+	f.OnError(func(err error) { reloadErr = err })
+	write("broken\n", start.Add(2*time.Second))
+	ok, _ = f.Authenticate("bob", "secretpass")
+	assert.True(t, ok)
+	assert.Error(t, reloadErr)
+}
+
+func TestFile_Update(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "htpasswd")
+	assert.NoError(t, os.WriteFile(path, []byte("# users\nalice:{SHA}NkvfLtd6hUTTtxGgO2nurcxjydc=\nbob:abSsy3GvmHpeQ\n"), 0640))
+	f, err := Open(path, 0)
+	assert.NoError(t, err)
+
+	assert.NoError(t, f.Update("alice", scryptHash))
+	content, err := os.ReadFile(path)
+	assert.NoError(t, err)
+	assert.Equal(t, "# users\nalice:"+scryptHash+"\nbob:abSsy3GvmHpeQ\n", string(content))
+	info, err := os.Stat(path)
+	assert.NoError(t, err)
+	assert.Equal(t, os.FileMode(0640), info.Mode().Perm())
+	ok, err := f.Authenticate("alice", "secretpass")
+	assert.NoError(t, err)
+	assert.True(t, ok)
+
+	assert.Error(t, f.Update("carol", scryptHash))
+}
@@ -0,0 +1,134 @@
+package ipfilter
+
+import (
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/pluveto/flydav/pkg/misc"
+)
+
+// Filter admits client IPs by CIDR lists. Deny takes precedence over Allow,
+// and a non-empty Allow admits nothing else.
+type Filter struct {
+	allow []*net.IPNet
+	deny  []*net.IPNet
+}
+
+// New parses the lists of IPs and CIDRs. It returns nil if both are empty.
+func New(allow, deny []string) (*Filter, error) {
+	if len(allow) == 0 && len(deny) == 0 {
+		return nil, nil
+	}
+	var err error
+	ret := &Filter{}
+	if ret.allow, err = misc.ParseNetworks(allow); err != nil {
+		return nil, err
+	}
+	if ret.deny, err = misc.ParseNetworks(deny); err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+// Allowed reports whether ip is admitted. A nil Filter admits everyone.
+func (f *Filter) Allowed(ip net.IP) bool {
+	if f == nil {
+		return true
+	}
+	if contains(f.deny, ip) {
+		return false
+	}
+	return len(f.allow) == 0 || contains(f.allow, ip)
+}
+
+func contains(networks []*net.IPNet, ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	for _, network := range networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// ClientIP returns the address a request comes from. If it comes from one
+// of the trusted proxies, the address is taken from the Forwarded header, or
+// without it from X-Forwarded-For, skipping further trusted proxies from
+// the right. Connections without an IP, e.g. over unix sockets, are trusted
+// as soon as any proxy is.
+func ClientIP(r *http.Request, trusted []*net.IPNet) net.IP {
+	ip := remoteIP(r.RemoteAddr)
+	if len(trusted) == 0 || (ip != nil && !contains(trusted, ip)) {
+		return ip
+	}
+	hops := forwardedFor(r.Header.Values("Forwarded"))
+	if hops == nil {
+		hops = xForwardedFor(r.Header.Values("X-Forwarded-For"))
+	}
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := net.ParseIP(hops[i])
+		if hop == nil {
+			// obfuscated or unknown, nothing left to trust
+			return ip
+		}
+		ip = hop
+		if !contains(trusted, hop) {
+			break
+		}
+	}
+	return ip
+}
+
+func remoteIP(addr string) net.IP {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	return net.ParseIP(host)
+}
+
+// forwardedFor returns the for= parameters of RFC 7239 headers, nil if
+// there are none.
+func forwardedFor(values []string) []string {
+	var ret []string
+	for _, value := range values {
+		for _, element := range strings.Split(value, ",") {
+			for _, pair := range strings.Split(element, ";") {
+				key, node, ok := strings.Cut(strings.TrimSpace(pair), "=")
+				if !ok || !strings.EqualFold(key, "for") {
+					continue
+				}
+				ret = append(ret, nodeIP(strings.Trim(node, `"`)))
+			}
+		}
+	}
+	return ret
+}
+
+// nodeIP strips the port and brackets of a Forwarded node like
+// "[2001:db8::1]:4711" or "192.0.2.60:4711".
+func nodeIP(node string) string {
+	if strings.HasPrefix(node, "[") {
+		if end := strings.IndexByte(node, ']'); end > 0 {
+			return node[1:end]
+		}
+		return node
+	}
+	if host, _, err := net.SplitHostPort(node); err == nil {
+		return host
+	}
+	return node
+}
+
+func xForwardedFor(values []string) []string {
+	var ret []string
+	for _, value := range values {
+		for _, hop := range strings.Split(value, ",") {
+			ret = append(ret, strings.TrimSpace(hop))
+		}
+	}
+	return ret
+}
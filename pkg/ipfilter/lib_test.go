@@ -0,0 +1,69 @@
+package ipfilter
+
+import (
+	"net"
+	"net/http"
+	"testing"
+
+	"github.com/pluveto/flydav/pkg/misc"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFilter_Allowed(t *testing.T) {
+	f, err := New(nil, nil)
+	assert.NoError(t, err)
+	assert.Nil(t, f)
+	assert.True(t, f.Allowed(net.ParseIP("192.0.2.1")), "a nil filter admits everyone")
+
+	f, err = New([]string{"10.0.0.0/8", "2001:db8::/32"}, []string{"10.0.9.0/24"})
+	assert.NoError(t, err)
+	assert.True(t, f.Allowed(net.ParseIP("10.1.2.3")))
+	assert.True(t, f.Allowed(net.ParseIP("2001:db8::1")))
+	assert.False(t, f.Allowed(net.ParseIP("10.0.9.1")), "deny takes precedence")
+	assert.False(t, f.Allowed(net.ParseIP("192.0.2.1")))
+	assert.False(t, f.Allowed(nil))
+
+	f, err = New(nil, []string{"192.0.2.1"})
+	assert.NoError(t, err)
+	assert.False(t, f.Allowed(net.ParseIP("192.0.2.1")))
+	assert.True(t, f.Allowed(net.ParseIP("192.0.2.2")))
+
+	_, err = New([]string{"10.0.0.0/33"}, nil)
+	assert.Error(t, err)
+}
+
+func TestClientIP(t *testing.T) {
+	trusted, err := misc.ParseNetworks([]string{"10.0.0.1", "10.0.0.2"})
+	assert.NoError(t, err)
+	request := func(remote string, header http.Header) *http.Request {
+		return &http.Request{RemoteAddr: remote, Header: header}
+	}
+
+	for _, c := range []struct {
+		remote   string
+		header   http.Header
+		trusted  bool
+		expected string
+	}{
+		{"192.0.2.1:1234", nil, true, "192.0.2.1"},
+		{"192.0.2.1:1234", http.Header{"X-Forwarded-For": {"198.51.100.1"}}, true, "192.0.2.1"},
+		{"10.0.0.1:1234", http.Header{"X-Forwarded-For": {"198.51.100.1"}}, false, "10.0.0.1"},
+		{"10.0.0.1:1234", http.Header{"X-Forwarded-For": {"198.51.100.1"}}, true, "198.51.100.1"},
+		// only the rightmost untrusted hop counts, the rest may be forged
+		{"10.0.0.1:1234", http.Header{"X-Forwarded-For": {"203.0.113.9, 198.51.100.1, 10.0.0.2"}}, true, "198.51.100.1"},
+		{"10.0.0.1:1234", http.Header{"X-Forwarded-For": {"203.0.113.9", "198.51.100.1"}}, true, "198.51.100.1"},
+		{"10.0.0.1:1234", http.Header{"X-Forwarded-For": {"garbage"}}, true, "10.0.0.1"},
+		{"10.0.0.1:1234", http.Header{"Forwarded": {`for=192.0.2.60;proto=http;by=203.0.113.43`}}, true, "192.0.2.60"},
+		{"10.0.0.1:1234", http.Header{"Forwarded": {`for="[2001:db8:cafe::17]:4711"`}}, true, "2001:db8:cafe::17"},
+		{"10.0.0.1:1234", http.Header{"Forwarded": {`for=198.51.100.1, for="10.0.0.2:80"`}, "X-Forwarded-For": {"203.0.113.9"}}, true, "198.51.100.1"},
+		{"10.0.0.1:1234", http.Header{"Forwarded": {`for=_hidden`}}, true, "10.0.0.1"},
+		{"@", http.Header{"X-Forwarded-For": {"198.51.100.1"}}, true, "198.51.100.1"},
+		{"@", http.Header{"X-Forwarded-For": {"198.51.100.1"}}, false, "<nil>"},
+	} {
+		var networks []*net.IPNet
+		if c.trusted {
+			networks = trusted
+		}
+		assert.Equal(t, c.expected, ClientIP(request(c.remote, c.header), networks).String(), "%s %v", c.remote, c.header)
+	}
+}
@@ -0,0 +1,304 @@
+package ldapauth
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/go-ldap/ldap/v3"
+)
+
+var (
+	ErrInvalidCredentials = errors.New("invalid username or password")
+	ErrNoSuchUser         = errors.New("no such user")
+)
+
+// Config selects direct bind when UserDN is set, e.g.
+// "uid={username},ou=people,dc=example,dc=org". Otherwise the user is looked
+// up below BaseDN with UserFilter, optionally bound as BindDN, and then bound
+// with the found DN.
+type Config struct {
+	URL       string // "ldap://host:389" or "ldaps://host:636"
+	StartTLS  bool
+	TLSConfig *tls.Config
+	Timeout   time.Duration
+
+	UserDN       string
+	BindDN       string
+	BindPassword string
+	BaseDN       string
+	UserFilter   string // e.g. "(uid={username})"
+
+	// Groups are read from GroupAttribute of the user entry, e.g. "memberOf",
+	// or when GroupFilter is set searched below GroupBaseDN, e.g. with
+	// "(member={dn})" or "(memberUid={username})".
+	GroupAttribute     string
+	GroupBaseDN        string
+	GroupFilter        string
+	GroupNameAttribute string // e.g. "cn"
+}
+
+// User is an authenticated directory entry.
+type User struct {
+	DN         string
+	Attributes map[string]string // First value of each attribute
+	Groups     []string          // Group names, the GroupNameAttribute or the first RDN value
+}
+
+type Client struct {
+	cfg Config
+}
+
+func New(cfg Config) *Client {
+	return &Client{cfg: cfg}
+}
+
+// Authenticate binds as username and reads its entry and groups. Wrong
+// credentials and unknown users result in ErrInvalidCredentials.
+func (c *Client) Authenticate(username, password string) (*User, error) {
+	// an empty password would be an unauthenticated bind, which succeeds
+	if username == "" || password == "" {
+		return nil, ErrInvalidCredentials
+	}
+	conn, err := c.dial()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	var entry *ldap.Entry
+	if c.cfg.UserDN != "" {
+		dn := expand(c.cfg.UserDN, map[string]string{"username": escapeDN(username)})
+		if err := bind(conn, dn, password); err != nil {
+			return nil, err
+		}
+		entry, err = c.readEntry(conn, dn)
+	} else {
+		entry, err = c.searchUser(conn, username)
+		if err == nil {
+			err = bind(conn, entry.DN, password)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return c.user(conn, username, entry)
+}
+
+// Lookup reads the entry and groups of username without its password, e.g.
+// for a login with a client certificate. It binds as BindDN if set, or
+// anonymously. Unknown users result in ErrNoSuchUser.
+func (c *Client) Lookup(username string) (*User, error) {
+	if username == "" {
+		return nil, ErrNoSuchUser
+	}
+	conn, err := c.dial()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	var entry *ldap.Entry
+	if c.cfg.UserDN != "" {
+		if c.cfg.BindDN != "" {
+			if err := conn.Bind(c.cfg.BindDN, c.cfg.BindPassword); err != nil {
+				return nil, fmt.Errorf("service bind: %w", err)
+			}
+		}
+		entry, err = c.readEntry(conn, expand(c.cfg.UserDN, map[string]string{"username": escapeDN(username)}))
+		if ldap.IsErrorWithCode(err, ldap.LDAPResultNoSuchObject) {
+			err = ErrNoSuchUser
+		}
+	} else {
+		entry, err = c.searchUser(conn, username)
+		if err == ErrInvalidCredentials {
+			err = ErrNoSuchUser
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return c.user(conn, username, entry)
+}
+
+// user reads the attributes and groups of the entry of username.
+func (c *Client) user(conn *ldap.Conn, username string, entry *ldap.Entry) (*User, error) {
+	user := &User{DN: entry.DN, Attributes: make(map[string]string)}
+	for _, attr := range entry.Attributes {
+		if len(attr.Values) > 0 {
+			user.Attributes[attr.Name] = attr.Values[0]
+		}
+	}
+	var err error
+	user.Groups, err = c.groups(conn, username, entry)
+	if err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+func (c *Client) dial() (*ldap.Conn, error) {
+	u, err := url.Parse(c.cfg.URL)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig := &tls.Config{}
+	if c.cfg.TLSConfig != nil {
+		tlsConfig = c.cfg.TLSConfig.Clone()
+	}
+	if tlsConfig.ServerName == "" {
+		tlsConfig.ServerName = u.Hostname()
+	}
+	dialer := &net.Dialer{Timeout: c.cfg.Timeout}
+	conn, err := ldap.DialURL(c.cfg.URL, ldap.DialWithDialer(dialer), ldap.DialWithTLSConfig(tlsConfig))
+	if err != nil {
+		return nil, err
+	}
+	conn.SetTimeout(c.cfg.Timeout)
+	if c.cfg.StartTLS {
+		if err := conn.StartTLS(tlsConfig); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("starttls: %w", err)
+		}
+	}
+	return conn, nil
+}
+
+func bind(conn *ldap.Conn, dn, password string) error {
+	err := conn.Bind(dn, password)
+	if ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials) {
+		return ErrInvalidCredentials
+	}
+	return err
+}
+
+func (c *Client) attributes() []string {
+	ret := []string{"*"}
+	if c.cfg.GroupFilter == "" && c.cfg.GroupAttribute != "" {
+		// operational attributes like memberOf are only returned on request
+		ret = append(ret, c.cfg.GroupAttribute)
+	}
+	return ret
+}
+
+func (c *Client) searchUser(conn *ldap.Conn, username string) (*ldap.Entry, error) {
+	if c.cfg.BindDN != "" {
+		if err := conn.Bind(c.cfg.BindDN, c.cfg.BindPassword); err != nil {
+			return nil, fmt.Errorf("service bind: %w", err)
+		}
+	}
+	filter := expand(c.cfg.UserFilter, map[string]string{"username": ldap.EscapeFilter(username)})
+	res, err := conn.Search(ldap.NewSearchRequest(
+		c.cfg.BaseDN, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 2, 0, false,
+		filter, c.attributes(), nil,
+	))
+	if err != nil && !ldap.IsErrorWithCode(err, ldap.LDAPResultSizeLimitExceeded) {
+		return nil, err
+	}
+	if res == nil || len(res.Entries) != 1 {
+		// unknown or ambiguous
+		return nil, ErrInvalidCredentials
+	}
+	return res.Entries[0], nil
+}
+
+func (c *Client) readEntry(conn *ldap.Conn, dn string) (*ldap.Entry, error) {
+	res, err := conn.Search(ldap.NewSearchRequest(
+		dn, ldap.ScopeBaseObject, ldap.NeverDerefAliases, 1, 0, false,
+		"(objectClass=*)", c.attributes(), nil,
+	))
+	if err != nil {
+		return nil, err
+	}
+	if len(res.Entries) == 0 {
+		return nil, fmt.Errorf("%w: entry %s not found", ErrNoSuchUser, dn)
+	}
+	return res.Entries[0], nil
+}
+
+func (c *Client) groups(conn *ldap.Conn, username string, entry *ldap.Entry) ([]string, error) {
+	if c.cfg.GroupFilter == "" {
+		var ret []string
+		for _, dn := range attributeValues(entry, c.cfg.GroupAttribute) {
+			ret = append(ret, groupName(dn))
+		}
+		return ret, nil
+	}
+
+	baseDN := c.cfg.GroupBaseDN
+	if baseDN == "" {
+		baseDN = c.cfg.BaseDN
+	}
+	filter := expand(c.cfg.GroupFilter, map[string]string{
+		"username": ldap.EscapeFilter(username),
+		"dn":       ldap.EscapeFilter(entry.DN),
+	})
+	res, err := conn.Search(ldap.NewSearchRequest(
+		baseDN, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 0, 0, false,
+		filter, []string{c.cfg.GroupNameAttribute}, nil,
+	))
+	if err != nil {
+		return nil, fmt.Errorf("group search: %w", err)
+	}
+	var ret []string
+	for _, group := range res.Entries {
+		name := groupName(group.DN)
+		if values := attributeValues(group, c.cfg.GroupNameAttribute); len(values) > 0 {
+			name = values[0]
+		}
+		ret = append(ret, name)
+	}
+	return ret, nil
+}
+
+// attributeValues looks up an attribute ignoring the case of its name.
+func attributeValues(entry *ldap.Entry, name string) []string {
+	for _, attr := range entry.Attributes {
+		if strings.EqualFold(attr.Name, name) {
+			return attr.Values
+		}
+	}
+	return nil
+}
+
+// groupName returns the value of the first RDN, e.g. "admins" of
+// "cn=admins,ou=groups,dc=example,dc=org".
+func groupName(dn string) string {
+	parsed, err := ldap.ParseDN(dn)
+	if err != nil || len(parsed.RDNs) == 0 || len(parsed.RDNs[0].Attributes) == 0 {
+		return dn
+	}
+	return parsed.RDNs[0].Attributes[0].Value
+}
+
+func expand(tmpl string, vars map[string]string) string {
+	pairs := make([]string, 0, 2*len(vars))
+	for k, v := range vars {
+		pairs = append(pairs, "{"+k+"}", v)
+	}
+	return strings.NewReplacer(pairs...).Replace(tmpl)
+}
+
+// escapeDN escapes an attribute value for use in a DN as of RFC 4514.
+func escapeDN(value string) string {
+	var b strings.Builder
+	for i := 0; i < len(value); i++ {
+		ch := value[i]
+		switch {
+		case strings.IndexByte(`,+"\<>;=`, ch) >= 0,
+			ch == '#' && i == 0,
+			ch == ' ' && (i == 0 || i == len(value)-1):
+			b.WriteByte('\\')
+			b.WriteByte(ch)
+		case ch < 0x20 || ch == 0x7f:
+			fmt.Fprintf(&b, "\\%02x", ch)
+		default:
+			b.WriteByte(ch)
+		}
+	}
+	return b.String()
+}
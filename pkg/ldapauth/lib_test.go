@@ -0,0 +1,230 @@
+package ldapauth
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	ber "github.com/go-asn1-ber/asn1-ber"
+	"github.com/stretchr/testify/assert"
+)
+
+type testEntry struct {
+	dn       string
+	password string
+	attrs    map[string][]string
+}
+
+var testDirectory = []testEntry{
+	{"cn=admin,dc=example,dc=org", "adminpass", map[string][]string{"cn": {"admin"}}},
+	{"uid=alice,ou=people,dc=example,dc=org", "alicepass", map[string][]string{
+		"uid":           {"alice"},
+		"homeDirectory": {"/home/alice"},
+		"memberOf":      {"cn=staff,ou=groups,dc=example,dc=org"},
+	}},
+	{"uid=bob,ou=people,dc=example,dc=org", "bobpass", map[string][]string{"uid": {"bob"}}},
+	{"cn=staff,ou=groups,dc=example,dc=org", "", map[string][]string{
+		"cn":     {"staff"},
+		"member": {"uid=alice,ou=people,dc=example,dc=org"},
+	}},
+}
+
+// serveLDAP answers simple binds and searches with equality, presence, and
+// and or filters against testDirectory, which is enough for the client.
+func serveLDAP(t *testing.T) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go serveConn(conn)
+		}
+	}()
+	return "ldap://" + ln.Addr().String()
+}
+
+func serveConn(conn net.Conn) {
+	defer conn.Close()
+	for {
+		packet, err := ber.ReadPacket(conn)
+		if err != nil || len(packet.Children) < 2 {
+			return
+		}
+		id := packet.Children[0].Value
+		op := packet.Children[1]
+		switch op.Tag {
+		case 0: // bind
+			dn := op.Children[1].Data.String()
+			password := op.Children[2].Data.String()
+			code := 49
+			for _, e := range testDirectory {
+				if dn == "" || (e.dn == dn && e.password == password && password != "") {
+					code = 0
+				}
+			}
+			conn.Write(response(id, 1, code).Bytes())
+		case 3: // search
+			base := op.Children[0].Data.String()
+			scope := op.Children[1].Value.(int64)
+			for _, e := range testDirectory {
+				inScope := e.dn == base || (scope != 0 && strings.HasSuffix(e.dn, ","+base))
+				if !inScope || !matches(op.Children[6], e) {
+					continue
+				}
+				conn.Write(searchEntry(id, e).Bytes())
+			}
+			conn.Write(response(id, 5, 0).Bytes())
+		default: // unbind
+			return
+		}
+	}
+}
+
+func matches(filter *ber.Packet, e testEntry) bool {
+	switch filter.Tag {
+	case 0, 1: // and, or
+		for _, child := range filter.Children {
+			if matches(child, e) == (filter.Tag == 1) {
+				return filter.Tag == 1
+			}
+		}
+		return filter.Tag == 0
+	case 3: // equality
+		attr, value := filter.Children[0].Data.String(), filter.Children[1].Data.String()
+		for name, values := range e.attrs {
+			if strings.EqualFold(name, attr) {
+				for _, v := range values {
+					if strings.EqualFold(v, value) {
+						return true
+					}
+				}
+			}
+		}
+		return false
+	case 7: // present
+		return true
+	}
+	return false
+}
+
+func envelope(id interface{}, op *ber.Packet) *ber.Packet {
+	packet := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "LDAP Response")
+	packet.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, id, "MessageID"))
+	packet.AppendChild(op)
+	return packet
+}
+
+func response(id interface{}, tag ber.Tag, code int) *ber.Packet {
+	op := ber.Encode(ber.ClassApplication, ber.TypeConstructed, tag, nil, "Response")
+	op.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagEnumerated, code, "resultCode"))
+	op.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", "matchedDN"))
+	op.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", "diagnosticMessage"))
+	return envelope(id, op)
+}
+
+func searchEntry(id interface{}, e testEntry) *ber.Packet {
+	op := ber.Encode(ber.ClassApplication, ber.TypeConstructed, 4, nil, "Search Result Entry")
+	op.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, e.dn, "objectName"))
+	attrs := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "attributes")
+	for name, values := range e.attrs {
+		attr := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "attribute")
+		attr.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, name, "type"))
+		set := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSet, nil, "vals")
+		for _, v := range values {
+			set.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, v, "value"))
+		}
+		attr.AppendChild(set)
+		attrs.AppendChild(attr)
+	}
+	op.AppendChild(attrs)
+	return envelope(id, op)
+}
+
+func TestClient_DirectBind(t *testing.T) {
+	client := New(Config{
+		URL:            serveLDAP(t),
+		Timeout:        time.Second,
+		UserDN:         "uid={username},ou=people,dc=example,dc=org",
+		GroupAttribute: "memberOf",
+	})
+
+	user, err := client.Authenticate("alice", "alicepass")
+	assert.NoError(t, err)
+	assert.Equal(t, "uid=alice,ou=people,dc=example,dc=org", user.DN)
+	assert.Equal(t, "/home/alice", user.Attributes["homeDirectory"])
+	assert.Equal(t, []string{"staff"}, user.Groups)
+
+	_, err = client.Authenticate("alice", "wrong")
+	assert.ErrorIs(t, err, ErrInvalidCredentials)
+	_, err = client.Authenticate("alice", "")
+	assert.ErrorIs(t, err, ErrInvalidCredentials)
+}
+
+func TestClient_SearchThenBind(t *testing.T) {
+	client := New(Config{
+		URL:                serveLDAP(t),
+		Timeout:            time.Second,
+		BindDN:             "cn=admin,dc=example,dc=org",
+		BindPassword:       "adminpass",
+		BaseDN:             "dc=example,dc=org",
+		UserFilter:         "(uid={username})",
+		GroupBaseDN:        "ou=groups,dc=example,dc=org",
+		GroupFilter:        "(member={dn})",
+		GroupNameAttribute: "cn",
+	})
+
+	user, err := client.Authenticate("alice", "alicepass")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"staff"}, user.Groups)
+
+	user, err = client.Authenticate("bob", "bobpass")
+	assert.NoError(t, err)
+	assert.Empty(t, user.Groups)
+
+	_, err = client.Authenticate("bob", "alicepass")
+	assert.ErrorIs(t, err, ErrInvalidCredentials)
+	_, err = client.Authenticate("mallory", "alicepass")
+	assert.ErrorIs(t, err, ErrInvalidCredentials)
+}
+
+func TestClient_Lookup(t *testing.T) {
+	url := serveLDAP(t)
+	search := New(Config{
+		URL:            url,
+		Timeout:        time.Second,
+		BindDN:         "cn=admin,dc=example,dc=org",
+		BindPassword:   "adminpass",
+		BaseDN:         "dc=example,dc=org",
+		UserFilter:     "(uid={username})",
+		GroupAttribute: "memberOf",
+	})
+	user, err := search.Lookup("alice")
+	assert.NoError(t, err)
+	assert.Equal(t, "/home/alice", user.Attributes["homeDirectory"])
+	assert.Equal(t, []string{"staff"}, user.Groups)
+	_, err = search.Lookup("mallory")
+	assert.ErrorIs(t, err, ErrNoSuchUser)
+
+	direct := New(Config{
+		URL:            url,
+		Timeout:        time.Second,
+		UserDN:         "uid={username},ou=people,dc=example,dc=org",
+		GroupAttribute: "memberOf",
+	})
+	user, err = direct.Lookup("alice")
+	assert.NoError(t, err)
+	assert.Equal(t, "uid=alice,ou=people,dc=example,dc=org", user.DN)
+	_, err = direct.Lookup("mallory")
+	assert.ErrorIs(t, err, ErrNoSuchUser)
+}
+
+func TestEscapeDN(t *testing.T) {
+	assert.Equal(t, "alice", escapeDN("alice"))
+	assert.Equal(t, `a\,b\=c`, escapeDN("a,b=c"))
+	assert.Equal(t, `\#a\ `, escapeDN("#a "))
+}
@@ -0,0 +1,349 @@
+package listener
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"os/exec"
+	"os/user"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	envFds     = "FLYDAV_LISTEN_FDS"
+	envFdNames = "FLYDAV_LISTEN_FDNAMES"
+	envReadyFd = "FLYDAV_READY_FD"
+
+	// Environment of systemd socket activation, see sd_listen_fds(3).
+	envSystemdPid     = "LISTEN_PID"
+	envSystemdFds     = "LISTEN_FDS"
+	envSystemdFdNames = "LISTEN_FDNAMES"
+
+	// firstFd is the first descriptor after stdin, stdout and stderr.
+	firstFd = 3
+
+	unixPrefix    = "unix:"
+	systemdPrefix = "systemd:"
+)
+
+var ErrNotUpgraded = errors.New("process was not started by an upgrade")
+
+type filer interface {
+	File() (*os.File, error)
+}
+
+// SocketOptions are applied to unix socket files created by Pool.Listen.
+type SocketOptions struct {
+	Mode  os.FileMode // 0 keeps the mode derived from umask
+	Owner string      // User name or uid, empty keeps the current user
+	Group string      // Group name or gid, empty keeps the current group
+}
+
+// Pool hands out listeners by address. Addresses are "host:port",
+// "unix:/path/to/socket" or "systemd:<name>" for sockets passed by systemd.
+// Listeners inherited from an upgraded parent process are reused.
+type Pool struct {
+	options   SocketOptions
+	inherited map[string]net.Listener
+	active    map[string]net.Listener
+}
+
+// NewPool collects the listeners handed over by a parent process or by
+// systemd socket activation.
+func NewPool(options SocketOptions) (*Pool, error) {
+	p := &Pool{
+		options:   options,
+		inherited: make(map[string]net.Listener),
+		active:    make(map[string]net.Listener),
+	}
+	if err := p.inheritUpgrade(); err != nil {
+		return nil, err
+	}
+	if err := p.inheritSystemd(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+func (p *Pool) inheritUpgrade() error {
+	count := os.Getenv(envFds)
+	if count == "" {
+		return nil
+	}
+	names := strings.Split(os.Getenv(envFdNames), ":")
+	n, err := strconv.Atoi(count)
+	if err != nil || n != len(names) {
+		return fmt.Errorf("invalid %s=%q for %s=%q", envFds, count, envFdNames, os.Getenv(envFdNames))
+	}
+	os.Unsetenv(envFds)
+	os.Unsetenv(envFdNames)
+
+	for i, name := range names {
+		addr, err := url.QueryUnescape(name)
+		if err != nil {
+			return err
+		}
+		if err := p.inheritFd(firstFd+i, addr); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (p *Pool) inheritSystemd() error {
+	pid, err := strconv.Atoi(os.Getenv(envSystemdPid))
+	if err != nil || pid != os.Getpid() {
+		return nil
+	}
+	n, err := strconv.Atoi(os.Getenv(envSystemdFds))
+	if err != nil {
+		return fmt.Errorf("invalid %s: %w", envSystemdFds, err)
+	}
+	var names []string
+	if v := os.Getenv(envSystemdFdNames); v != "" {
+		names = strings.Split(v, ":")
+	}
+	os.Unsetenv(envSystemdPid)
+	os.Unsetenv(envSystemdFds)
+	os.Unsetenv(envSystemdFdNames)
+
+	seen := make(map[string]int)
+	for i := 0; i < n; i++ {
+		name := "unknown"
+		if i < len(names) && names[i] != "" {
+			name = names[i]
+		}
+		// sockets of the same unit share a name, number all but the first
+		seen[name]++
+		addr := systemdPrefix + name
+		if seen[name] > 1 {
+			addr = fmt.Sprintf("%s#%d", addr, seen[name])
+		}
+		if err := p.inheritFd(firstFd+i, addr); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (p *Pool) inheritFd(fd int, addr string) error {
+	f := os.NewFile(uintptr(fd), addr)
+	ln, err := net.FileListener(f)
+	f.Close()
+	if err != nil {
+		return fmt.Errorf("failed to inherit listener %s: %w", addr, err)
+	}
+	p.inherited[addr] = ln
+	return nil
+}
+
+// Activated returns the addresses of sockets passed by systemd, including
+// those passed on through an upgrade.
+func (p *Pool) Activated() []string {
+	var ret []string
+	for addr := range p.inherited {
+		if strings.HasPrefix(addr, systemdPrefix) {
+			ret = append(ret, addr)
+		}
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+// Listen returns the inherited listener for addr or creates a new one.
+func (p *Pool) Listen(addr string) (net.Listener, error) {
+	if _, ok := p.active[addr]; ok {
+		return nil, fmt.Errorf("duplicate listen address %s", addr)
+	}
+	ln, ok := p.inherited[addr]
+	if ok {
+		delete(p.inherited, addr)
+	} else {
+		var err error
+		ln, err = p.listen(addr)
+		if err != nil {
+			return nil, err
+		}
+	}
+	p.active[addr] = ln
+	return ln, nil
+}
+
+func (p *Pool) listen(addr string) (net.Listener, error) {
+	if strings.HasPrefix(addr, systemdPrefix) {
+		return nil, fmt.Errorf("no socket %s passed by systemd", addr)
+	}
+	if !strings.HasPrefix(addr, unixPrefix) {
+		return net.Listen("tcp", addr)
+	}
+
+	path := strings.TrimPrefix(addr, unixPrefix)
+	// remove a stale socket left by a previous run, but never a regular file
+	if info, err := os.Lstat(path); err == nil && info.Mode()&os.ModeSocket != 0 {
+		os.Remove(path)
+	}
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := p.options.apply(path); err != nil {
+		ln.Close()
+		return nil, err
+	}
+	return ln, nil
+}
+
+func (o SocketOptions) apply(path string) error {
+	if o.Mode != 0 {
+		if err := os.Chmod(path, o.Mode); err != nil {
+			return err
+		}
+	}
+	if o.Owner == "" && o.Group == "" {
+		return nil
+	}
+	uid, gid := -1, -1
+	if o.Owner != "" {
+		u, err := user.Lookup(o.Owner)
+		if err != nil {
+			u, err = user.LookupId(o.Owner)
+		}
+		if err != nil {
+			return err
+		}
+		uid, _ = strconv.Atoi(u.Uid)
+	}
+	if o.Group != "" {
+		g, err := user.LookupGroup(o.Group)
+		if err != nil {
+			g, err = user.LookupGroupId(o.Group)
+		}
+		if err != nil {
+			return err
+		}
+		gid, _ = strconv.Atoi(g.Gid)
+	}
+	return os.Chown(path, uid, gid)
+}
+
+// Upgrade starts a new instance of the current binary which inherits all
+// listeners returned by Listen. It returns once the new process called
+// Ready, or fails if the process exits or does not become ready before the
+// timeout.
+func (p *Pool) Upgrade(timeout time.Duration) (*os.Process, error) {
+	addrs := make([]string, 0, len(p.active))
+	for addr := range p.active {
+		addrs = append(addrs, addr)
+	}
+	sort.Strings(addrs)
+
+	var files []*os.File
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+	names := make([]string, 0, len(addrs))
+	for _, addr := range addrs {
+		ln, ok := p.active[addr].(filer)
+		if !ok {
+			return nil, fmt.Errorf("listener %s cannot be handed over", addr)
+		}
+		f, err := ln.File()
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, f)
+		names = append(names, url.QueryEscape(addr))
+	}
+
+	readyR, readyW, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	defer readyR.Close()
+	files = append(files, readyW)
+
+	// resolve the path again so that a replaced binary is picked up
+	path, err := exec.LookPath(os.Args[0])
+	if err != nil {
+		return nil, err
+	}
+	cmd := exec.Command(path, os.Args[1:]...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.ExtraFiles = files
+	cmd.Env = append(os.Environ(),
+		fmt.Sprintf("%s=%d", envFds, len(names)),
+		fmt.Sprintf("%s=%s", envFdNames, strings.Join(names, ":")),
+		fmt.Sprintf("%s=%d", envReadyFd, firstFd+len(names)),
+	)
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	readyW.Close()
+	files = files[:len(files)-1]
+
+	ready := make(chan error, 1)
+	go func() {
+		buf := make([]byte, 1)
+		_, err := readyR.Read(buf)
+		if err == io.EOF {
+			err = errors.New("new process exited before becoming ready")
+		}
+		ready <- err
+	}()
+	select {
+	case err = <-ready:
+	case <-time.After(timeout):
+		err = errors.New("timeout waiting for new process to become ready")
+	}
+	if err != nil {
+		cmd.Process.Kill()
+		cmd.Wait()
+		return nil, err
+	}
+	go cmd.Wait()
+
+	// the socket files belong to the new process now
+	for _, ln := range p.active {
+		if unixLn, ok := ln.(*net.UnixListener); ok {
+			unixLn.SetUnlinkOnClose(false)
+		}
+	}
+	return cmd.Process, nil
+}
+
+// Ready tells the parent process that inherited listeners are being served
+// and that it may shut down.
+func Ready() error {
+	fd := os.Getenv(envReadyFd)
+	if fd == "" {
+		return ErrNotUpgraded
+	}
+	os.Unsetenv(envReadyFd)
+	n, err := strconv.Atoi(fd)
+	if err != nil {
+		return fmt.Errorf("invalid %s=%q", envReadyFd, fd)
+	}
+	f := os.NewFile(uintptr(n), "ready")
+	defer f.Close()
+	_, err = f.Write([]byte{1})
+	return err
+}
+
+// CloseUnused closes inherited listeners which were not requested by Listen,
+// e.g. because the configuration changed across an upgrade.
+func (p *Pool) CloseUnused() {
+	for addr, ln := range p.inherited {
+		ln.Close()
+		delete(p.inherited, addr)
+	}
+}
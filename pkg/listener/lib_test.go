@@ -0,0 +1,303 @@
+//go:build !windows
+
+package listener
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"os/user"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// envHelper makes the test binary act as a process inheriting listeners.
+const envHelper = "FLYDAV_TEST_HELPER"
+
+func TestMain(m *testing.M) {
+	switch os.Getenv(envHelper) {
+	case "":
+		os.Exit(m.Run())
+	case "inherit":
+		helperInherit()
+	case "systemd":
+		// systemd sets LISTEN_PID after forking, the test cannot know it
+		if os.Getenv(envSystemdPid) == "self" {
+			os.Setenv(envSystemdPid, strconv.Itoa(os.Getpid()))
+		}
+		helperInherit()
+	case "upgrade":
+		helperUpgrade()
+	}
+	os.Exit(0)
+}
+
+// helperInherit prints the inherited listeners as "addr=local address".
+func helperInherit() {
+	p, err := NewPool(SocketOptions{})
+	if err != nil {
+		fmt.Println("error:", err)
+		return
+	}
+	addrs := make([]string, 0, len(p.inherited))
+	for addr := range p.inherited {
+		addrs = append(addrs, addr)
+	}
+	sort.Strings(addrs)
+	for _, addr := range addrs {
+		ln, err := p.Listen(addr)
+		if err != nil {
+			fmt.Println("error:", err)
+			return
+		}
+		fmt.Printf("%s=%s\n", addr, ln.Addr())
+	}
+	fmt.Printf("env=%s\n", os.Getenv(envFds))
+}
+
+// helperUpgrade serves the inherited listeners with "new" until /quit.
+func helperUpgrade() {
+	p, err := NewPool(SocketOptions{})
+	if err != nil {
+		os.Exit(1)
+	}
+	quit := make(chan struct{})
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "new")
+		if r.URL.Path == "/quit" {
+			close(quit)
+		}
+	})}
+	for addr := range p.inherited {
+		ln, err := p.Listen(addr)
+		if err != nil {
+			os.Exit(1)
+		}
+		go srv.Serve(ln)
+	}
+	if Ready() != nil {
+		os.Exit(1)
+	}
+	select {
+	case <-quit:
+	case <-time.After(10 * time.Second):
+	}
+}
+
+func fileOf(t *testing.T, ln net.Listener) *os.File {
+	f, err := ln.(filer).File()
+	assert.NoError(t, err)
+	t.Cleanup(func() { f.Close() })
+	return f
+}
+
+func TestInheritUpgrade(t *testing.T) {
+	var files []*os.File
+	var names []string
+	want := []string{}
+	for i := 0; i < 2; i++ {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		assert.NoError(t, err)
+		defer ln.Close()
+		files = append(files, fileOf(t, ln))
+		names = append(names, url.QueryEscape(ln.Addr().String()))
+		want = append(want, ln.Addr().String()+"="+ln.Addr().String())
+	}
+	sock := filepath.Join(t.TempDir(), "dav.sock")
+	ln, err := net.Listen("unix", sock)
+	assert.NoError(t, err)
+	defer ln.Close()
+	files = append(files, fileOf(t, ln))
+	names = append(names, url.QueryEscape("unix:"+sock))
+	want = append(want, "unix:"+sock+"="+sock)
+	sort.Strings(want)
+
+	cmd := exec.Command(os.Args[0])
+	cmd.ExtraFiles = files
+	cmd.Env = append(os.Environ(),
+		envHelper+"=inherit",
+		fmt.Sprintf("%s=%d", envFds, len(names)),
+		envFdNames+"="+strings.Join(names, ":"),
+	)
+	out, err := cmd.Output()
+	assert.NoError(t, err)
+	lines := strings.Split(strings.TrimSpace(string(out)), "\n")
+	assert.Equal(t, append(want, "env="), lines, "the listener at fd 3+i is named by the i-th name")
+}
+
+func TestInheritUpgradeInvalid(t *testing.T) {
+	t.Setenv(envFds, "2")
+	t.Setenv(envFdNames, url.QueryEscape("127.0.0.1:7086"))
+	_, err := NewPool(SocketOptions{})
+	assert.Error(t, err, "names do not match the count")
+
+	t.Setenv(envFds, "x")
+	_, err = NewPool(SocketOptions{})
+	assert.Error(t, err)
+}
+
+func TestReadyWithoutParent(t *testing.T) {
+	assert.ErrorIs(t, Ready(), ErrNotUpgraded)
+}
+
+func get(t *testing.T, client *http.Client, url string) string {
+	res, err := client.Get(url)
+	if !assert.NoError(t, err) {
+		return ""
+	}
+	defer res.Body.Close()
+	b, err := io.ReadAll(res.Body)
+	assert.NoError(t, err)
+	return string(b)
+}
+
+// TestUpgradeDrain hands over a listener while a request is in flight. The
+// old server finishes it, new requests are served by the new process.
+func TestUpgradeDrain(t *testing.T) {
+	p, err := NewPool(SocketOptions{})
+	assert.NoError(t, err)
+	ln, err := p.Listen("127.0.0.1:0")
+	if !assert.NoError(t, err) {
+		return
+	}
+	base := "http://" + ln.Addr().String()
+
+	started, release := make(chan struct{}), make(chan struct{})
+	old := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+		io.WriteString(w, "old")
+	})}
+	go old.Serve(ln)
+	client := &http.Client{Transport: &http.Transport{DisableKeepAlives: true}, Timeout: 10 * time.Second}
+	inFlight := make(chan string, 1)
+	go func() { inFlight <- get(t, client, base+"/slow") }()
+	<-started
+
+	// the child re-runs this binary, which acts as helperUpgrade
+	args := os.Args
+	os.Args = []string{args[0]}
+	defer func() { os.Args = args }()
+	t.Setenv(envHelper, "upgrade")
+	child, err := p.Upgrade(10 * time.Second)
+	if !assert.NoError(t, err) {
+		close(release)
+		return
+	}
+	defer child.Kill()
+
+	drained := make(chan error, 1)
+	go func() { drained <- old.Shutdown(context.Background()) }()
+	assert.Eventually(t, func() bool {
+		return get(t, client, base+"/") == "new"
+	}, 5*time.Second, 50*time.Millisecond, "the new process accepts connections")
+	select {
+	case <-drained:
+		t.Fatal("shutdown returned while a request is in flight")
+	default:
+	}
+
+	close(release)
+	assert.Equal(t, "old", <-inFlight, "the in-flight request is finished")
+	assert.NoError(t, <-drained)
+	assert.Equal(t, "new", get(t, client, base+"/quit"))
+}
+
+func TestInheritSystemd(t *testing.T) {
+	var files []*os.File
+	var want []string
+	for i := 0; i < 3; i++ {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		assert.NoError(t, err)
+		defer ln.Close()
+		files = append(files, fileOf(t, ln))
+		want = append(want, ln.Addr().String())
+	}
+
+	run := func(pid string) []string {
+		cmd := exec.Command(os.Args[0])
+		cmd.ExtraFiles = files
+		cmd.Env = append(os.Environ(),
+			envHelper+"=systemd",
+			envSystemdPid+"="+pid,
+			envSystemdFds+"=3",
+			envSystemdFdNames+"=web:web:admin",
+		)
+		out, err := cmd.Output()
+		assert.NoError(t, err)
+		return strings.Split(strings.TrimSpace(string(out)), "\n")
+	}
+	assert.Equal(t, []string{
+		"systemd:admin=" + want[2],
+		"systemd:web=" + want[0],
+		"systemd:web#2=" + want[1],
+		"env=",
+	}, run("self"), "sockets sharing a name are numbered")
+	assert.Equal(t, []string{"env="}, run("1"), "the sockets are meant for another process")
+}
+
+func TestListenUnix(t *testing.T) {
+	p, err := NewPool(SocketOptions{Mode: 0660})
+	assert.NoError(t, err)
+	sock := filepath.Join(t.TempDir(), "dav.sock")
+
+	// a socket left behind by a process that did not clean up
+	stale, err := net.Listen("unix", sock)
+	assert.NoError(t, err)
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	assert.NoError(t, stale.Close())
+	_, err = os.Stat(sock)
+	assert.NoError(t, err)
+
+	ln, err := p.Listen(unixPrefix + sock)
+	if !assert.NoError(t, err, "the stale socket is replaced") {
+		return
+	}
+	defer ln.Close()
+	info, err := os.Stat(sock)
+	assert.NoError(t, err)
+	assert.Equal(t, os.FileMode(0660), info.Mode().Perm())
+	conn, err := net.Dial("unix", sock)
+	if assert.NoError(t, err) {
+		conn.Close()
+	}
+
+	file := filepath.Join(t.TempDir(), "dav.sock")
+	assert.NoError(t, os.WriteFile(file, []byte("data"), 0644))
+	_, err = p.Listen(unixPrefix + file)
+	assert.Error(t, err)
+	content, err := os.ReadFile(file)
+	assert.NoError(t, err)
+	assert.Equal(t, "data", string(content), "a regular file is never removed")
+}
+
+func TestListenUnixOwner(t *testing.T) {
+	u, err := user.Current()
+	if err != nil {
+		t.Skip(err)
+	}
+	sock := filepath.Join(t.TempDir(), "dav.sock")
+	p, err := NewPool(SocketOptions{Owner: u.Username, Group: u.Gid})
+	assert.NoError(t, err)
+	ln, err := p.Listen(unixPrefix + sock)
+	if assert.NoError(t, err) {
+		ln.Close()
+	}
+
+	sock = filepath.Join(t.TempDir(), "dav.sock")
+	p, err = NewPool(SocketOptions{Owner: "flydav-no-such-user"})
+	assert.NoError(t, err)
+	_, err = p.Listen(unixPrefix + sock)
+	assert.Error(t, err)
+}
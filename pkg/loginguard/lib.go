@@ -0,0 +1,181 @@
+package loginguard
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// Config controls how failed logins slow down and lock out further attempts.
+type Config struct {
+	MaxIPFailures   int           // Failures of a client IP before a lockout, 0 disables lockouts but not the backoff
+	MaxUserFailures int           // Failures of a username before a lockout, 0 disables lockouts but not the backoff
+	Backoff         time.Duration // Delay after the first failure, doubled with each further one up to Lockout
+	Lockout         time.Duration // Duration of the first lockout, doubled with each further failure
+	MaxLockout      time.Duration
+	Forget          time.Duration // Failures are forgotten this long after a block ends
+	Allowlist       []*net.IPNet  // Clients that are never blocked
+	MaxEntries      int           // Bounds the number of tracked client IPs and usernames each, 0 means 100000
+}
+
+// Lockout describes a client IP or username that has been locked out.
+type Lockout struct {
+	IP       string // Set for a client IP lockout
+	Username string // Set for a username lockout
+	Failures int
+	Until    time.Time
+}
+
+type entry struct {
+	failures int
+	blocked  time.Time // No attempt is allowed before
+}
+
+// Guard counts failed logins by client IP and by username. Both are blocked
+// for an exponentially growing delay after each failure, and locked out once
+// they reach the configured number of failures.
+type Guard struct {
+	cfg       Config
+	onLockout func(Lockout)
+	now       func() time.Time
+
+	mu        sync.Mutex
+	ips       map[string]*entry
+	users     map[string]*entry
+	lastSweep time.Time
+}
+
+func New(cfg Config) *Guard {
+	if cfg.MaxEntries == 0 {
+		cfg.MaxEntries = 100000
+	}
+	if cfg.MaxLockout < cfg.Lockout {
+		cfg.MaxLockout = cfg.Lockout
+	}
+	return &Guard{
+		cfg:   cfg,
+		now:   time.Now,
+		ips:   make(map[string]*entry),
+		users: make(map[string]*entry),
+	}
+}
+
+// OnLockout sets a callback invoked whenever a client IP or username gets
+// locked out, e.g. to log it for fail2ban.
+func (g *Guard) OnLockout(fn func(Lockout)) {
+	g.onLockout = fn
+}
+
+// Allowed reports whether ip is in the allowlist.
+func (g *Guard) Allowed(ip net.IP) bool {
+	for _, network := range g.cfg.Allowlist {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Check returns how long a login of username from ip has to wait, 0 if it
+// may proceed. The username may be empty, e.g. for bearer tokens. The ip is
+// nil for clients without one, e.g. over unix sockets, which share no IP
+// block.
+func (g *Guard) Check(ip net.IP, username string) time.Duration {
+	if g.Allowed(ip) {
+		return 0
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	now := g.now()
+	wait := time.Duration(0)
+	if e, ok := g.ips[ip.String()]; ok && ip != nil && e.blocked.After(now) {
+		wait = e.blocked.Sub(now)
+	}
+	if e, ok := g.users[username]; ok && username != "" && e.blocked.After(now) && e.blocked.Sub(now) > wait {
+		wait = e.blocked.Sub(now)
+	}
+	return wait
+}
+
+// Fail records a failed login.
+func (g *Guard) Fail(ip net.IP, username string) {
+	if g.Allowed(ip) {
+		return
+	}
+	g.mu.Lock()
+	now := g.now()
+	g.sweep(now)
+	var lockouts []Lockout
+	if ip != nil {
+		key := ip.String()
+		if _, ok := g.ips[key]; ok || len(g.ips) < g.cfg.MaxEntries {
+			if until, locked := g.fail(g.ips, key, g.cfg.MaxIPFailures, now); locked {
+				lockouts = append(lockouts, Lockout{IP: key, Failures: g.ips[key].failures, Until: until})
+			}
+		}
+	}
+	if _, ok := g.users[username]; username != "" && (ok || len(g.users) < g.cfg.MaxEntries) {
+		if until, locked := g.fail(g.users, username, g.cfg.MaxUserFailures, now); locked {
+			lockouts = append(lockouts, Lockout{Username: username, Failures: g.users[username].failures, Until: until})
+		}
+	}
+	g.mu.Unlock()
+
+	if g.onLockout != nil {
+		for _, lockout := range lockouts {
+			g.onLockout(lockout)
+		}
+	}
+}
+
+// Succeed forgets the failures of the username. Those of the client IP are
+// kept, or a client could clear them by logging in to an account of its own
+// between guesses.
+func (g *Guard) Succeed(ip net.IP, username string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	delete(g.users, username)
+}
+
+// fail counts a failure of key and blocks it, locking it out at max failures
+// unless max is 0. It reports whether the block is a lockout.
+func (g *Guard) fail(entries map[string]*entry, key string, max int, now time.Time) (time.Time, bool) {
+	e, ok := entries[key]
+	if !ok || now.Sub(e.blocked) > g.cfg.Forget {
+		e = &entry{}
+		entries[key] = e
+	}
+	e.failures++
+	if max > 0 && e.failures >= max {
+		e.blocked = now.Add(double(g.cfg.Lockout, e.failures-max, g.cfg.MaxLockout))
+		return e.blocked, true
+	}
+	e.blocked = now.Add(double(g.cfg.Backoff, e.failures-1, g.cfg.Lockout))
+	return e.blocked, false
+}
+
+// sweep drops entries whose failures are forgotten, at most once a minute.
+func (g *Guard) sweep(now time.Time) {
+	if now.Sub(g.lastSweep) < time.Minute {
+		return
+	}
+	g.lastSweep = now
+	for _, entries := range []map[string]*entry{g.ips, g.users} {
+		for key, e := range entries {
+			if now.Sub(e.blocked) > g.cfg.Forget {
+				delete(entries, key)
+			}
+		}
+	}
+}
+
+// double returns d doubled n times, at most max.
+func double(d time.Duration, n int, max time.Duration) time.Duration {
+	for ; n > 0 && d < max; n-- {
+		d *= 2
+	}
+	if d > max {
+		return max
+	}
+	return d
+}
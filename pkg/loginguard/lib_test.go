@@ -0,0 +1,139 @@
+package loginguard
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestGuard(cfg Config) (*Guard, *time.Time) {
+	g := New(cfg)
+	now := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	g.now = func() time.Time { return now }
+	return g, &now
+}
+
+func TestGuard_Backoff(t *testing.T) {
+	g, now := newTestGuard(Config{MaxIPFailures: 10, Backoff: time.Second, Lockout: time.Hour, Forget: time.Hour})
+	ip := net.ParseIP("192.0.2.1")
+
+	assert.Zero(t, g.Check(ip, "alice"))
+	g.Fail(ip, "alice")
+	assert.Equal(t, time.Second, g.Check(ip, "alice"))
+	assert.Equal(t, time.Second, g.Check(ip, "bob"), "the IP is blocked for any user")
+	assert.Equal(t, time.Second, g.Check(net.ParseIP("192.0.2.2"), "alice"), "so is the username from any IP")
+	assert.Zero(t, g.Check(net.ParseIP("192.0.2.2"), "bob"))
+
+	*now = now.Add(time.Second)
+	assert.Zero(t, g.Check(ip, "alice"))
+	g.Fail(ip, "alice")
+	assert.Equal(t, 2*time.Second, g.Check(ip, "alice"))
+	*now = now.Add(2 * time.Second)
+	g.Fail(ip, "alice")
+	assert.Equal(t, 4*time.Second, g.Check(ip, "alice"))
+
+	g.Succeed(ip, "bob")
+	assert.Equal(t, 4*time.Second, g.Check(ip, "alice"), "a login keeps the failures of the IP")
+
+	g, _ = newTestGuard(Config{MaxUserFailures: 10, Backoff: time.Second, Lockout: time.Hour, Forget: time.Hour})
+	g.Fail(ip, "alice")
+	assert.Equal(t, time.Second, g.Check(nil, "alice"))
+	g.Succeed(ip, "alice")
+	assert.Zero(t, g.Check(nil, "alice"), "a login clears the failures of the username")
+}
+
+func TestGuard_BackoffWithoutLockout(t *testing.T) {
+	g, now := newTestGuard(Config{Backoff: time.Second, Lockout: time.Hour, Forget: time.Hour})
+	ip := net.ParseIP("192.0.2.1")
+	var lockouts []Lockout
+	g.OnLockout(func(l Lockout) { lockouts = append(lockouts, l) })
+	for i := 0; i < 20; i++ {
+		g.Fail(ip, "")
+		*now = now.Add(g.Check(ip, ""))
+	}
+	g.Fail(ip, "")
+	assert.Equal(t, time.Hour, g.Check(ip, ""), "max_ip_failures = 0 still backs off, up to the lockout duration")
+	assert.Empty(t, lockouts)
+
+	g.Fail(nil, "alice")
+	assert.Equal(t, time.Second, g.Check(nil, "alice"), "so does max_user_failures = 0")
+}
+
+func TestGuard_NoIP(t *testing.T) {
+	g, _ := newTestGuard(Config{MaxIPFailures: 1, MaxUserFailures: 10, Backoff: time.Second, Lockout: time.Hour, Forget: time.Hour})
+	g.Fail(nil, "alice")
+	assert.Empty(t, g.ips, "clients without an IP share no bucket")
+	assert.Zero(t, g.Check(nil, "bob"))
+	assert.Equal(t, time.Second, g.Check(nil, "alice"))
+}
+
+func TestGuard_Lockout(t *testing.T) {
+	g, now := newTestGuard(Config{MaxIPFailures: 3, MaxUserFailures: 5, Lockout: time.Minute, MaxLockout: 3 * time.Minute, Forget: time.Hour})
+	var lockouts []Lockout
+	g.OnLockout(func(l Lockout) { lockouts = append(lockouts, l) })
+	ip := net.ParseIP("2001:db8::1")
+
+	g.Fail(ip, "alice")
+	g.Fail(ip, "alice")
+	assert.Empty(t, lockouts)
+	g.Fail(ip, "alice")
+	assert.Equal(t, []Lockout{{IP: "2001:db8::1", Failures: 3, Until: now.Add(time.Minute)}}, lockouts)
+	assert.Equal(t, time.Minute, g.Check(ip, "alice"))
+
+	// further failures double the lockout up to the maximum
+	*now = now.Add(time.Minute)
+	g.Fail(ip, "alice")
+	assert.Equal(t, 2*time.Minute, g.Check(ip, ""))
+	*now = now.Add(2 * time.Minute)
+	g.Fail(ip, "alice")
+	assert.Equal(t, 3*time.Minute, g.Check(ip, ""))
+	assert.Len(t, lockouts, 4)
+	assert.Equal(t, "alice", lockouts[3].Username, "the user reached its own limit")
+
+	// another client IP is blocked by the username only
+	other := net.ParseIP("198.51.100.7")
+	assert.NotZero(t, g.Check(other, "alice"))
+	assert.Zero(t, g.Check(other, "bob"))
+}
+
+func TestGuard_Forget(t *testing.T) {
+	g, now := newTestGuard(Config{MaxIPFailures: 2, Lockout: time.Minute, Forget: time.Hour})
+	ip := net.ParseIP("192.0.2.1")
+
+	g.Fail(ip, "")
+	*now = now.Add(2 * time.Hour)
+	g.Fail(ip, "")
+	assert.Zero(t, g.Check(ip, ""), "the first failure is forgotten")
+	assert.Len(t, g.ips, 1)
+
+	*now = now.Add(2 * time.Hour)
+	g.Fail(net.ParseIP("192.0.2.2"), "")
+	assert.Len(t, g.ips, 1, "forgotten entries are swept")
+}
+
+func TestGuard_Allowlist(t *testing.T) {
+	_, network, _ := net.ParseCIDR("10.0.0.0/8")
+	g, _ := newTestGuard(Config{MaxIPFailures: 1, MaxUserFailures: 1, Lockout: time.Minute, Allowlist: []*net.IPNet{network}})
+	trusted := net.ParseIP("10.1.2.3")
+
+	g.Fail(trusted, "alice")
+	assert.Zero(t, g.Check(trusted, "alice"))
+	assert.Zero(t, g.Check(net.ParseIP("192.0.2.1"), "alice"))
+
+	g.Fail(net.ParseIP("192.0.2.1"), "alice")
+	assert.Zero(t, g.Check(trusted, "alice"), "trusted clients ignore lockouts")
+}
+
+func TestGuard_MaxEntries(t *testing.T) {
+	g, _ := newTestGuard(Config{MaxIPFailures: 1, Lockout: time.Minute, MaxEntries: 1})
+	g.Fail(net.ParseIP("192.0.2.1"), "")
+	g.Fail(net.ParseIP("192.0.2.2"), "")
+	assert.Len(t, g.ips, 1)
+
+	g, _ = newTestGuard(Config{MaxUserFailures: 1, Lockout: time.Minute, MaxEntries: 1})
+	g.Fail(nil, "alice")
+	g.Fail(nil, "random")
+	assert.Len(t, g.users, 1, "usernames are bounded too")
+}
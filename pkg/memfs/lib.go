@@ -0,0 +1,237 @@
+// Package memfs keeps files in memory like webdav.NewMemFS, with limits on
+// their total size and number, and optionally removes files not modified
+// for a while. It suits scratch space that is lost on restart anyway.
+package memfs
+
+import (
+	"context"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"golang.org/x/net/webdav"
+)
+
+// ErrFull is returned when a limit would be exceeded. It is the error of a
+// full disk, so that callers treat both alike.
+var ErrFull error = syscall.ENOSPC
+
+type Limits struct {
+	MaxBytes int64         // Total size of the files, 0 means no limit
+	MaxFiles int           // Files and directories, 0 means no limit
+	TTL      time.Duration // Files not modified for longer are removed, 0 keeps them
+}
+
+type FileSystem struct {
+	fs     webdav.FileSystem
+	limits Limits
+	done   chan struct{}
+	stop   sync.Once
+
+	mu      sync.Mutex
+	entries map[string]*entry
+	bytes   int64
+}
+
+// entry is what is known of a file or directory to enforce the limits.
+type entry struct {
+	dir     bool
+	size    int64
+	modTime time.Time
+	removed bool // Open files may outlive the entry
+}
+
+func New(limits Limits) *FileSystem {
+	fs := &FileSystem{
+		fs:      webdav.NewMemFS(),
+		limits:  limits,
+		entries: make(map[string]*entry),
+	}
+	if limits.TTL > 0 {
+		fs.done = make(chan struct{})
+		go fs.evictLoop(fs.done)
+	}
+	return fs
+}
+
+// Close stops the removal of old files.
+func (fs *FileSystem) Close() error {
+	if fs.done != nil {
+		fs.stop.Do(func() { close(fs.done) })
+	}
+	return nil
+}
+
+// Usage returns the total size of the files and the number of files and
+// directories.
+func (fs *FileSystem) Usage() (int64, int) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	return fs.bytes, len(fs.entries)
+}
+
+func cleanPath(name string) string {
+	return path.Clean("/" + name)
+}
+
+func full(op, name string) error {
+	return &os.PathError{Op: op, Path: name, Err: ErrFull}
+}
+
+// forget drops the entries of name and below, once removed or replaced.
+func (fs *FileSystem) forget(name string) {
+	for key, e := range fs.entries {
+		if key == name || strings.HasPrefix(key, name+"/") {
+			fs.bytes -= e.size
+			e.removed = true
+			delete(fs.entries, key)
+		}
+	}
+}
+
+func (fs *FileSystem) hasRoomForFile() bool {
+	return fs.limits.MaxFiles == 0 || len(fs.entries) < fs.limits.MaxFiles
+}
+
+func (fs *FileSystem) Mkdir(ctx context.Context, name string, perm os.FileMode) error {
+	name = cleanPath(name)
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if _, ok := fs.entries[name]; !ok && !fs.hasRoomForFile() {
+		return full("mkdir", name)
+	}
+	if err := fs.fs.Mkdir(ctx, name, perm); err != nil {
+		return err
+	}
+	fs.entries[name] = &entry{dir: true, modTime: time.Now()}
+	return nil
+}
+
+func (fs *FileSystem) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (webdav.File, error) {
+	name = cleanPath(name)
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	e, exists := fs.entries[name]
+	if !exists && flag&os.O_CREATE != 0 && name != "/" && !fs.hasRoomForFile() {
+		return nil, full("open", name)
+	}
+	f, err := fs.fs.OpenFile(ctx, name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	if name == "/" {
+		return f, nil
+	}
+	if !exists {
+		e = &entry{modTime: time.Now()}
+		fs.entries[name] = e
+	}
+	if flag&os.O_TRUNC != 0 && !e.dir {
+		fs.bytes -= e.size
+		e.size = 0
+		e.modTime = time.Now()
+	}
+	return &file{File: f, fs: fs, name: name, entry: e}, nil
+}
+
+func (fs *FileSystem) RemoveAll(ctx context.Context, name string) error {
+	name = cleanPath(name)
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if err := fs.fs.RemoveAll(ctx, name); err != nil {
+		return err
+	}
+	fs.forget(name)
+	return nil
+}
+
+func (fs *FileSystem) Rename(ctx context.Context, oldName, newName string) error {
+	oldName, newName = cleanPath(oldName), cleanPath(newName)
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if err := fs.fs.Rename(ctx, oldName, newName); err != nil {
+		return err
+	}
+	if oldName == newName {
+		return nil
+	}
+	fs.forget(newName)
+	for key, e := range fs.entries {
+		if key == oldName || strings.HasPrefix(key, oldName+"/") {
+			delete(fs.entries, key)
+			fs.entries[newName+strings.TrimPrefix(key, oldName)] = e
+		}
+	}
+	return nil
+}
+
+func (fs *FileSystem) Stat(ctx context.Context, name string) (os.FileInfo, error) {
+	return fs.fs.Stat(ctx, name)
+}
+
+func (fs *FileSystem) evictLoop(done chan struct{}) {
+	interval := fs.limits.TTL / 2
+	if interval > time.Minute {
+		interval = time.Minute
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case now := <-ticker.C:
+			fs.evict(now.Add(-fs.limits.TTL))
+		}
+	}
+}
+
+// evict removes the files last modified before, directories are kept.
+func (fs *FileSystem) evict(before time.Time) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	for name, e := range fs.entries {
+		if e.dir || !e.modTime.Before(before) {
+			continue
+		}
+		if err := fs.fs.RemoveAll(context.Background(), name); err == nil {
+			fs.forget(name)
+		}
+	}
+}
+
+// file counts what is written to it. A write exceeding MaxBytes fails as a
+// whole, what was written before is kept until the caller removes the file.
+type file struct {
+	webdav.File
+	fs    *FileSystem
+	name  string
+	entry *entry
+}
+
+func (f *file) Write(p []byte) (int, error) {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+	if f.entry.removed {
+		return f.File.Write(p)
+	}
+	pos, err := f.File.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return 0, err
+	}
+	end := pos + int64(len(p))
+	if grow := end - f.entry.size; grow > 0 && f.fs.limits.MaxBytes > 0 && f.fs.bytes+grow > f.fs.limits.MaxBytes {
+		return 0, full("write", f.name)
+	}
+	n, err := f.File.Write(p)
+	if end = pos + int64(n); end > f.entry.size {
+		f.fs.bytes += end - f.entry.size
+		f.entry.size = end
+	}
+	f.entry.modTime = time.Now()
+	return n, err
+}
@@ -0,0 +1,97 @@
+package memfs
+
+import (
+	"context"
+	"errors"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/pluveto/flydav/pkg/storage/storagetest"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/webdav"
+)
+
+var ctx = context.Background()
+
+func TestFileSystem(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T) webdav.FileSystem {
+		return New(Limits{MaxBytes: 1 << 20, MaxFiles: 100})
+	})
+}
+
+func write(fs webdav.FileSystem, name, content string) error {
+	f, err := fs.OpenFile(ctx, name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write([]byte(content))
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+func TestMaxBytes(t *testing.T) {
+	fs := New(Limits{MaxBytes: 10})
+	assert.NoError(t, write(fs, "/a.txt", "12345"))
+	assert.NoError(t, write(fs, "/b.txt", "12345"))
+	err := write(fs, "/c.txt", "1")
+	assert.True(t, errors.Is(err, ErrFull), "%v", err)
+	size, files := fs.Usage()
+	assert.Equal(t, int64(10), size)
+	assert.Equal(t, 3, files, "the empty file is created")
+
+	assert.NoError(t, write(fs, "/a.txt", "123"), "overwriting frees the old content")
+	assert.NoError(t, write(fs, "/c.txt", "12"))
+	assert.True(t, errors.Is(write(fs, "/c.txt", "123"), ErrFull))
+
+	assert.NoError(t, fs.RemoveAll(ctx, "/b.txt"))
+	assert.NoError(t, write(fs, "/c.txt", "1234567"))
+	size, _ = fs.Usage()
+	assert.Equal(t, int64(10), size)
+
+	f, err := fs.OpenFile(ctx, "/a.txt", os.O_WRONLY, 0)
+	if assert.NoError(t, err) {
+		_, err = f.Write([]byte("abc"))
+		assert.NoError(t, err, "writing over existing content needs no room")
+		assert.NoError(t, f.Close())
+	}
+}
+
+func TestMaxFiles(t *testing.T) {
+	fs := New(Limits{MaxFiles: 3})
+	assert.NoError(t, fs.Mkdir(ctx, "/docs", 0755))
+	assert.NoError(t, write(fs, "/docs/a.txt", "a"))
+	assert.NoError(t, write(fs, "/b.txt", "b"))
+	assert.True(t, errors.Is(write(fs, "/c.txt", "c"), ErrFull))
+	assert.True(t, errors.Is(fs.Mkdir(ctx, "/more", 0755), ErrFull))
+	assert.NoError(t, write(fs, "/b.txt", "bb"), "existing files can be overwritten")
+
+	assert.NoError(t, fs.Rename(ctx, "/docs", "/papers"))
+	_, files := fs.Usage()
+	assert.Equal(t, 3, files)
+	assert.NoError(t, fs.Rename(ctx, "/b.txt", "/papers/a.txt"), "replacing a file")
+	_, files = fs.Usage()
+	assert.Equal(t, 2, files)
+	assert.NoError(t, write(fs, "/c.txt", "c"))
+	assert.NoError(t, fs.RemoveAll(ctx, "/papers"))
+	_, files = fs.Usage()
+	assert.Equal(t, 1, files)
+}
+
+func TestTTL(t *testing.T) {
+	fs := New(Limits{TTL: 100 * time.Millisecond})
+	defer fs.Close()
+	assert.NoError(t, fs.Mkdir(ctx, "/docs", 0755))
+	assert.NoError(t, write(fs, "/docs/a.txt", "a"))
+	assert.Eventually(t, func() bool {
+		_, err := fs.Stat(ctx, "/docs/a.txt")
+		return os.IsNotExist(err)
+	}, 2*time.Second, 20*time.Millisecond)
+	_, err := fs.Stat(ctx, "/docs")
+	assert.NoError(t, err, "directories are kept")
+	size, files := fs.Usage()
+	assert.Equal(t, int64(0), size)
+	assert.Equal(t, 1, files)
+}
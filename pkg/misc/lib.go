@@ -2,6 +2,9 @@ package misc
 
 import (
 	"fmt"
+	"net"
+	"os"
+	"path"
 	"path/filepath"
 	"strings"
 )
@@ -14,3 +17,91 @@ func MustGetFileExt(path string) (string, error) {
     return strings.TrimPrefix(ext, "."), nil
 }
 
+// ReplaceFile writes data to a temporary file next to path and renames it
+// over path, so readers never see a partially written file. The mode of an
+// existing file is kept, a new file is only readable by the owner.
+func ReplaceFile(path string, data []byte) error {
+	mode := os.FileMode(0600)
+	if info, err := os.Stat(path); err == nil {
+		mode = info.Mode().Perm()
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(mode); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// ParseNetworks parses CIDR notations like "10.0.0.0/8". A plain address
+// stands for a network of just that address.
+func ParseNetworks(list []string) ([]*net.IPNet, error) {
+	ret := make([]*net.IPNet, 0, len(list))
+	for _, s := range list {
+		if ip := net.ParseIP(s); ip != nil {
+			if v4 := ip.To4(); v4 != nil {
+				ret = append(ret, &net.IPNet{IP: v4, Mask: net.CIDRMask(32, 32)})
+			} else {
+				ret = append(ret, &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)})
+			}
+			continue
+		}
+		_, network, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, network)
+	}
+	return ret, nil
+}
+
+// MatchPathGlob reports whether the slash separated name matches pattern.
+// Within a segment the syntax of path.Match applies, a "**" segment matches
+// any number of segments including none.
+func MatchPathGlob(pattern, name string) (bool, error) {
+	return matchSegments(splitPath(pattern), splitPath(name))
+}
+
+func splitPath(name string) []string {
+	name = strings.Trim(path.Clean("/"+name), "/")
+	if name == "" {
+		return nil
+	}
+	return strings.Split(name, "/")
+}
+
+func matchSegments(patterns, segments []string) (bool, error) {
+	for len(patterns) > 0 {
+		if patterns[0] == "**" {
+			for i := 0; i <= len(segments); i++ {
+				ok, err := matchSegments(patterns[1:], segments[i:])
+				if err != nil || ok {
+					return ok, err
+				}
+			}
+			return false, nil
+		}
+		if len(segments) == 0 {
+			return false, nil
+		}
+		ok, err := path.Match(patterns[0], segments[0])
+		if err != nil || !ok {
+			return false, err
+		}
+		patterns, segments = patterns[1:], segments[1:]
+	}
+	return len(segments) == 0, nil
+}
@@ -1,6 +1,10 @@
 package misc
 
-import "testing"
+import (
+	"net"
+	"testing"
+)
+
 func TestMustGetFileExt(t *testing.T) {
     tests := []struct {
         path     string
@@ -25,3 +29,67 @@ func TestMustGetFileExt(t *testing.T) {
         }
     }
 }
+
+func TestMatchPathGlob(t *testing.T) {
+	tests := []struct {
+		pattern  string
+		name     string
+		expected bool
+	}{
+		{"/team/*.txt", "/team/a.txt", true},
+		{"/team/*.txt", "/team/sub/a.txt", false},
+		{"/team/**", "/team", true},
+		{"/team/**", "/team/private/a.txt", true},
+		{"/team/**/secret", "/team/a/b/secret", true},
+		{"/team/**/secret", "/team/secret", true},
+		{"/team/**/secret", "/team/a/b/public", false},
+		{"/**", "/", true},
+		{"/team", "/team/", true},
+		{"/team", "/teams", false},
+	}
+
+	for _, test := range tests {
+		ok, err := MatchPathGlob(test.pattern, test.name)
+		if err != nil {
+			t.Errorf("Unexpected error for pattern %s: %v", test.pattern, err)
+		}
+		if ok != test.expected {
+			t.Errorf("Expected %v for pattern %s and path %s, but got %v", test.expected, test.pattern, test.name, ok)
+		}
+	}
+
+	if _, err := MatchPathGlob("/team/[", "/team/a"); err == nil {
+		t.Errorf("Expected error for malformed pattern")
+	}
+}
+
+func TestParseNetworks(t *testing.T) {
+	networks, err := ParseNetworks([]string{"10.0.0.0/8", "192.0.2.1", "2001:db8::/32"})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	tests := []struct {
+		ip       string
+		expected bool
+	}{
+		{"10.1.2.3", true},
+		{"192.0.2.1", true},
+		{"192.0.2.2", false},
+		{"2001:db8::1", true},
+		{"2001:db9::1", false},
+	}
+
+	for _, test := range tests {
+		found := false
+		for _, network := range networks {
+			found = found || network.Contains(net.ParseIP(test.ip))
+		}
+		if found != test.expected {
+			t.Errorf("Expected %v for %s, but got %v", test.expected, test.ip, found)
+		}
+	}
+
+	if _, err := ParseNetworks([]string{"10.0.0.0/33"}); err == nil {
+		t.Errorf("Expected error for malformed network")
+	}
+}
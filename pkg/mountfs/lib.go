@@ -0,0 +1,299 @@
+package mountfs
+
+import (
+	"context"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"golang.org/x/net/webdav"
+)
+
+// Mount attaches a file system at Path, e.g. "/team-design".
+type Mount struct {
+	Path string
+	FS   webdav.FileSystem
+}
+
+// FileSystem composes several file systems into one namespace. Directories
+// above mount points that no mounted file system provides are virtual and
+// read-only.
+type FileSystem struct {
+	mounts []Mount
+}
+
+func New(mounts ...Mount) *FileSystem {
+	ret := &FileSystem{}
+	for _, m := range mounts {
+		ret.mounts = append(ret.mounts, Mount{Path: cleanPath(m.Path), FS: m.FS})
+	}
+	// the longest mount path wins
+	sort.SliceStable(ret.mounts, func(i, j int) bool {
+		return len(ret.mounts[i].Path) > len(ret.mounts[j].Path)
+	})
+	return ret
+}
+
+func cleanPath(name string) string {
+	return path.Clean("/" + name)
+}
+
+// Resolve returns the mount serving name and the path inside of it. The
+// mount is nil if name is a virtual directory or does not exist.
+func (fs *FileSystem) Resolve(name string) (*Mount, string) {
+	name = cleanPath(name)
+	for i := range fs.mounts {
+		m := &fs.mounts[i]
+		if m.Path == "/" {
+			return m, name
+		}
+		if name == m.Path {
+			return m, "/"
+		}
+		if strings.HasPrefix(name, m.Path+"/") {
+			return m, strings.TrimPrefix(name, m.Path)
+		}
+	}
+	return nil, ""
+}
+
+// children returns the names of the entries under dir leading to deeper
+// mount points.
+func (fs *FileSystem) children(dir string) []string {
+	prefix := dir
+	if prefix != "/" {
+		prefix += "/"
+	}
+	seen := make(map[string]bool)
+	var ret []string
+	for _, m := range fs.mounts {
+		if !strings.HasPrefix(m.Path, prefix) || m.Path == dir {
+			continue
+		}
+		child := strings.SplitN(strings.TrimPrefix(m.Path, prefix), "/", 2)[0]
+		if !seen[child] {
+			seen[child] = true
+			ret = append(ret, child)
+		}
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+// pinned reports whether name is a mount point or one of its ancestors,
+// which must not be removed or renamed.
+func (fs *FileSystem) pinned(name string) bool {
+	for _, m := range fs.mounts {
+		if m.Path == name {
+			return true
+		}
+	}
+	return len(fs.children(name)) > 0
+}
+
+func (fs *FileSystem) Mkdir(ctx context.Context, name string, perm os.FileMode) error {
+	name = cleanPath(name)
+	if fs.pinned(name) {
+		return os.ErrExist
+	}
+	m, rest := fs.Resolve(name)
+	if m == nil {
+		return os.ErrPermission
+	}
+	return m.FS.Mkdir(ctx, rest, perm)
+}
+
+func (fs *FileSystem) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (webdav.File, error) {
+	name = cleanPath(name)
+	children := fs.children(name)
+	m, rest := fs.Resolve(name)
+	if m != nil {
+		f, err := m.FS.OpenFile(ctx, rest, flag, perm)
+		if err == nil {
+			if len(children) == 0 {
+				return f, nil
+			}
+			return &mergedDir{File: f, extra: children}, nil
+		}
+		if !os.IsNotExist(err) || len(children) == 0 {
+			return nil, err
+		}
+	} else if len(children) == 0 {
+		return nil, os.ErrNotExist
+	}
+	if flag&(os.O_WRONLY|os.O_RDWR|os.O_CREATE|os.O_TRUNC) != 0 {
+		return nil, os.ErrPermission
+	}
+	return &virtualDir{name: name, children: children}, nil
+}
+
+func (fs *FileSystem) RemoveAll(ctx context.Context, name string) error {
+	name = cleanPath(name)
+	if fs.pinned(name) {
+		return os.ErrPermission
+	}
+	m, rest := fs.Resolve(name)
+	if m == nil {
+		return os.ErrNotExist
+	}
+	return m.FS.RemoveAll(ctx, rest)
+}
+
+// Rename moves within a mounted file system. Across mounts the tree is
+// copied and the source removed afterwards.
+func (fs *FileSystem) Rename(ctx context.Context, oldName, newName string) error {
+	oldName, newName = cleanPath(oldName), cleanPath(newName)
+	if fs.pinned(oldName) || fs.pinned(newName) {
+		return os.ErrPermission
+	}
+	src, oldRest := fs.Resolve(oldName)
+	dst, newRest := fs.Resolve(newName)
+	if src == nil || dst == nil {
+		return os.ErrNotExist
+	}
+	if src == dst {
+		return src.FS.Rename(ctx, oldRest, newRest)
+	}
+	if err := copyTree(ctx, src.FS, oldRest, dst.FS, newRest); err != nil {
+		return err
+	}
+	return src.FS.RemoveAll(ctx, oldRest)
+}
+
+func (fs *FileSystem) Stat(ctx context.Context, name string) (os.FileInfo, error) {
+	name = cleanPath(name)
+	m, rest := fs.Resolve(name)
+	if m != nil {
+		info, err := m.FS.Stat(ctx, rest)
+		if err == nil || !os.IsNotExist(err) || len(fs.children(name)) == 0 {
+			return info, err
+		}
+	} else if len(fs.children(name)) == 0 {
+		return nil, os.ErrNotExist
+	}
+	return virtualInfo(path.Base(name)), nil
+}
+
+func copyTree(ctx context.Context, srcFS webdav.FileSystem, src string, dstFS webdav.FileSystem, dst string) error {
+	srcFile, err := srcFS.OpenFile(ctx, src, os.O_RDONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer srcFile.Close()
+	info, err := srcFile.Stat()
+	if err != nil {
+		return err
+	}
+
+	if info.IsDir() {
+		if err := dstFS.Mkdir(ctx, dst, info.Mode().Perm()); err != nil {
+			return err
+		}
+		children, err := srcFile.Readdir(-1)
+		if err != nil {
+			return err
+		}
+		for _, c := range children {
+			err := copyTree(ctx, srcFS, path.Join(src, c.Name()), dstFS, path.Join(dst, c.Name()))
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	dstFile, err := dstFS.OpenFile(ctx, dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(dstFile, srcFile); err != nil {
+		dstFile.Close()
+		return err
+	}
+	return dstFile.Close()
+}
+
+type fileInfo struct {
+	name string
+}
+
+func virtualInfo(name string) os.FileInfo {
+	return fileInfo{name: name}
+}
+
+func (i fileInfo) Name() string       { return i.name }
+func (i fileInfo) Size() int64        { return 0 }
+func (i fileInfo) Mode() os.FileMode  { return os.ModeDir | 0555 }
+func (i fileInfo) ModTime() time.Time { return time.Time{} }
+func (i fileInfo) IsDir() bool        { return true }
+func (i fileInfo) Sys() interface{}   { return nil }
+
+// virtualDir lists the mount points below a directory no file system provides.
+type virtualDir struct {
+	name     string
+	children []string
+	offset   int
+}
+
+func (d *virtualDir) Close() error { return nil }
+
+func (d *virtualDir) Read(p []byte) (int, error) { return 0, os.ErrInvalid }
+
+func (d *virtualDir) Write(p []byte) (int, error) { return 0, os.ErrPermission }
+
+func (d *virtualDir) Seek(offset int64, whence int) (int64, error) { return 0, os.ErrInvalid }
+
+func (d *virtualDir) Stat() (os.FileInfo, error) { return virtualInfo(path.Base(d.name)), nil }
+
+func (d *virtualDir) Readdir(count int) ([]os.FileInfo, error) {
+	rest := d.children[d.offset:]
+	if count > 0 {
+		if len(rest) == 0 {
+			return nil, io.EOF
+		}
+		if count < len(rest) {
+			rest = rest[:count]
+		}
+	}
+	d.offset += len(rest)
+	ret := make([]os.FileInfo, 0, len(rest))
+	for _, name := range rest {
+		ret = append(ret, virtualInfo(name))
+	}
+	return ret, nil
+}
+
+// mergedDir adds the mount points below a directory to its own entries.
+type mergedDir struct {
+	webdav.File
+	extra []string
+}
+
+func (d *mergedDir) Readdir(count int) ([]os.FileInfo, error) {
+	infos, err := d.File.Readdir(count)
+	if err != nil && err != io.EOF {
+		return infos, err
+	}
+	// mount points shadow entries of the same name
+	shadowed := make(map[string]bool)
+	for _, name := range d.extra {
+		shadowed[name] = true
+	}
+	ret := infos[:0]
+	for _, info := range infos {
+		if !shadowed[info.Name()] {
+			ret = append(ret, info)
+		}
+	}
+	for _, name := range d.extra {
+		ret = append(ret, virtualInfo(name))
+	}
+	d.extra = nil
+	if len(ret) == 0 {
+		return ret, err
+	}
+	return ret, nil
+}
@@ -0,0 +1,83 @@
+package mountfs
+
+import (
+	"context"
+	"io"
+	"os"
+	"sort"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/webdav"
+)
+
+func names(t *testing.T, fs webdav.FileSystem, dir string) []string {
+	f, err := fs.OpenFile(context.Background(), dir, os.O_RDONLY, 0)
+	assert.NoError(t, err)
+	defer f.Close()
+	infos, err := f.Readdir(-1)
+	assert.NoError(t, err)
+	var ret []string
+	for _, info := range infos {
+		ret = append(ret, info.Name())
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+func writeFile(t *testing.T, fs webdav.FileSystem, name, content string) {
+	f, err := fs.OpenFile(context.Background(), name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	assert.NoError(t, err)
+	_, err = f.Write([]byte(content))
+	assert.NoError(t, err)
+	assert.NoError(t, f.Close())
+}
+
+func readFile(t *testing.T, fs webdav.FileSystem, name string) string {
+	f, err := fs.OpenFile(context.Background(), name, os.O_RDONLY, 0)
+	assert.NoError(t, err)
+	defer f.Close()
+	b, err := io.ReadAll(f)
+	assert.NoError(t, err)
+	return string(b)
+}
+
+func TestFileSystem(t *testing.T) {
+	ctx := context.Background()
+	home, design := webdav.NewMemFS(), webdav.NewMemFS()
+	fs := New(Mount{Path: "/home", FS: home}, Mount{Path: "/team/design", FS: design})
+
+	assert.Equal(t, []string{"home", "team"}, names(t, fs, "/"))
+	assert.Equal(t, []string{"design"}, names(t, fs, "/team"))
+
+	writeFile(t, fs, "/home/a.txt", "hello")
+	assert.Equal(t, "hello", readFile(t, home, "/a.txt"))
+
+	// virtual directories are read-only and mount points are pinned
+	_, err := fs.OpenFile(ctx, "/b.txt", os.O_WRONLY|os.O_CREATE, 0644)
+	assert.Error(t, err)
+	assert.Error(t, fs.RemoveAll(ctx, "/team"))
+	assert.Error(t, fs.Rename(ctx, "/home", "/house"))
+
+	info, err := fs.Stat(ctx, "/team")
+	assert.NoError(t, err)
+	assert.True(t, info.IsDir())
+	_, err = fs.Stat(ctx, "/nothing")
+	assert.True(t, os.IsNotExist(err))
+
+	// moving across mounts copies and removes the source
+	assert.NoError(t, fs.Rename(ctx, "/home/a.txt", "/team/design/a.txt"))
+	assert.Equal(t, "hello", readFile(t, design, "/a.txt"))
+	_, err = home.Stat(ctx, "/a.txt")
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestFileSystem_RootMount(t *testing.T) {
+	root, public := webdav.NewMemFS(), webdav.NewMemFS()
+	fs := New(Mount{Path: "/", FS: root}, Mount{Path: "/public", FS: public})
+
+	writeFile(t, fs, "/a.txt", "a")
+	writeFile(t, fs, "/public/b.txt", "b")
+	assert.Equal(t, []string{"a.txt", "public"}, names(t, fs, "/"))
+	assert.Equal(t, []string{"b.txt"}, names(t, public, "/"))
+}
@@ -0,0 +1,122 @@
+package oidcauth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"golang.org/x/oauth2"
+)
+
+// Config describes the tokens accepted from an OpenID Connect issuer.
+type Config struct {
+	Issuer        string
+	Audiences     []string // A token must be issued for one of them
+	UsernameClaim string   // e.g. "preferred_username", "email" or "sub"
+	GroupsClaim   string   // Optional, a string or a list of strings
+	HTTPClient    *http.Client
+}
+
+// Identity is the result of a verified token.
+type Identity struct {
+	Username string
+	Groups   []string
+	Claims   map[string]string // Claims with a string value
+	Nonce    string
+	Expiry   time.Time
+}
+
+// Verifier checks JWTs against the keys published by the issuer. Keys are
+// fetched on demand and refreshed when a token with an unknown key shows up.
+type Verifier struct {
+	cfg      Config
+	ctx      context.Context
+	provider *oidc.Provider
+	verifier *oidc.IDTokenVerifier
+}
+
+// NewVerifier discovers the issuer through its
+// /.well-known/openid-configuration document.
+func NewVerifier(ctx context.Context, cfg Config) (*Verifier, error) {
+	if len(cfg.Audiences) == 0 {
+		return nil, errors.New("no audience configured")
+	}
+	if cfg.HTTPClient != nil {
+		ctx = oidc.ClientContext(ctx, cfg.HTTPClient)
+	}
+	provider, err := oidc.NewProvider(ctx, cfg.Issuer)
+	if err != nil {
+		return nil, err
+	}
+	return &Verifier{
+		cfg:      cfg,
+		ctx:      ctx,
+		provider: provider,
+		// the audience is checked against all configured ones below
+		verifier: provider.Verifier(&oidc.Config{SkipClientIDCheck: true}),
+	}, nil
+}
+
+// Endpoint returns the OAuth2 endpoints of the issuer for the login flow.
+func (v *Verifier) Endpoint() oauth2.Endpoint {
+	return v.provider.Endpoint()
+}
+
+// Context carries the HTTP client used to talk to the issuer.
+func (v *Verifier) Context() context.Context {
+	return v.ctx
+}
+
+// Verify checks the signature, issuer, audience and expiry of a token and
+// maps its claims to an identity.
+func (v *Verifier) Verify(ctx context.Context, rawToken string) (*Identity, error) {
+	token, err := v.verifier.Verify(ctx, rawToken)
+	if err != nil {
+		return nil, err
+	}
+	if !intersects(token.Audience, v.cfg.Audiences) {
+		return nil, fmt.Errorf("token audience %v not accepted", token.Audience)
+	}
+
+	var claims map[string]interface{}
+	if err := token.Claims(&claims); err != nil {
+		return nil, err
+	}
+	ret := &Identity{Claims: make(map[string]string), Nonce: token.Nonce, Expiry: token.Expiry}
+	for k, v := range claims {
+		if s, ok := v.(string); ok {
+			ret.Claims[k] = s
+		}
+	}
+	ret.Username = ret.Claims[v.cfg.UsernameClaim]
+	if ret.Username == "" {
+		return nil, fmt.Errorf("token has no %s claim", v.cfg.UsernameClaim)
+	}
+	if v.cfg.GroupsClaim != "" {
+		switch groups := claims[v.cfg.GroupsClaim].(type) {
+		case string:
+			ret.Groups = []string{groups}
+		case []interface{}:
+			for _, g := range groups {
+				if s, ok := g.(string); ok {
+					ret.Groups = append(ret.Groups, s)
+				}
+			}
+		}
+	}
+	return ret, nil
+}
+
+func intersects(a, b []string) bool {
+	for _, x := range a {
+		for _, y := range b {
+			if x == y {
+				return true
+			}
+		}
+	}
+	return false
+}
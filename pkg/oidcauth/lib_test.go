@@ -0,0 +1,105 @@
+package oidcauth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	jose "gopkg.in/square/go-jose.v2"
+)
+
+// mockProvider serves discovery and the JWKS of key like a minimal issuer.
+func mockProvider(t *testing.T, key *rsa.PrivateKey) *httptest.Server {
+	mux := http.NewServeMux()
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"issuer":                 srv.URL,
+			"authorization_endpoint": srv.URL + "/auth",
+			"token_endpoint":         srv.URL + "/token",
+			"jwks_uri":               srv.URL + "/keys",
+		})
+	})
+	mux.HandleFunc("/keys", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(jose.JSONWebKeySet{Keys: []jose.JSONWebKey{
+			{Key: &key.PublicKey, KeyID: "test", Algorithm: "RS256", Use: "sig"},
+		}})
+	})
+	return srv
+}
+
+func sign(t *testing.T, key *rsa.PrivateKey, claims map[string]interface{}) string {
+	signer, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.RS256, Key: key},
+		(&jose.SignerOptions{}).WithHeader("kid", "test"))
+	assert.NoError(t, err)
+	payload, err := json.Marshal(claims)
+	assert.NoError(t, err)
+	jws, err := signer.Sign(payload)
+	assert.NoError(t, err)
+	token, err := jws.CompactSerialize()
+	assert.NoError(t, err)
+	return token
+}
+
+func TestVerifier_Verify(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoError(t, err)
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoError(t, err)
+	srv := mockProvider(t, key)
+
+	v, err := NewVerifier(context.Background(), Config{
+		Issuer:        srv.URL,
+		Audiences:     []string{"flydav"},
+		UsernameClaim: "preferred_username",
+		GroupsClaim:   "groups",
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, srv.URL+"/token", v.Endpoint().TokenURL)
+
+	claims := func(changes map[string]interface{}) map[string]interface{} {
+		ret := map[string]interface{}{
+			"iss":                srv.URL,
+			"aud":                "flydav",
+			"sub":                "1234",
+			"exp":                time.Now().Add(time.Hour).Unix(),
+			"preferred_username": "alice",
+			"groups":             []string{"staff", "admins"},
+		}
+		for k, v := range changes {
+			ret[k] = v
+		}
+		return ret
+	}
+
+	id, err := v.Verify(context.Background(), sign(t, key, claims(nil)))
+	assert.NoError(t, err)
+	assert.Equal(t, "alice", id.Username)
+	assert.Equal(t, []string{"staff", "admins"}, id.Groups)
+	assert.Equal(t, "1234", id.Claims["sub"])
+
+	tests := []struct {
+		name  string
+		key   *rsa.PrivateKey
+		claim map[string]interface{}
+	}{
+		{"wrong audience", key, map[string]interface{}{"aud": "other"}},
+		{"expired", key, map[string]interface{}{"exp": time.Now().Add(-time.Hour).Unix()}},
+		{"wrong issuer", key, map[string]interface{}{"iss": "https://evil.example.com"}},
+		{"no username", key, map[string]interface{}{"preferred_username": ""}},
+		{"unknown key", otherKey, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := v.Verify(context.Background(), sign(t, tt.key, claims(tt.claim)))
+			assert.Error(t, err)
+		})
+	}
+}
@@ -0,0 +1,510 @@
+// Package overlayfs layers a writable file system over read-only ones, like
+// the overlay file system of Linux.
+//
+// Files are looked up in the upper layer first, then in the lower layers in
+// order, and the contents of directories present in several layers are
+// merged. Changes only go to the upper layer: files of lower layers are
+// copied up before they are written, and removed ones are hidden by a
+// whiteout, an empty file named ".wh.<name>" next to where they were. A
+// directory recreated over a removed one gets an opaque marker ".wh..wh..opq"
+// hiding the lower contents. Names starting with ".wh." are reserved.
+package overlayfs
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strings"
+
+	"golang.org/x/net/webdav"
+)
+
+const (
+	whiteoutPrefix = ".wh."
+	opaqueMarker   = ".wh..wh..opq"
+)
+
+type FileSystem struct {
+	upper  webdav.FileSystem
+	lowers []webdav.FileSystem
+}
+
+// New layers upper over lowers, the first of lowers is the topmost.
+func New(upper webdav.FileSystem, lowers ...webdav.FileSystem) *FileSystem {
+	return &FileSystem{upper: upper, lowers: lowers}
+}
+
+func cleanPath(name string) string {
+	return path.Clean("/" + name)
+}
+
+func whiteout(name string) string {
+	return path.Join(path.Dir(name), whiteoutPrefix+path.Base(name))
+}
+
+func pathError(op, name string, err error) error {
+	return &os.PathError{Op: op, Path: name, Err: err}
+}
+
+// reserved reports whether name refers to a whiteout or an opaque marker.
+func reserved(name string) bool {
+	for _, part := range strings.Split(name, "/") {
+		if strings.HasPrefix(part, whiteoutPrefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// exists stats name in fs, telling a missing file from other errors.
+func exists(ctx context.Context, fs webdav.FileSystem, name string) (os.FileInfo, bool, error) {
+	info, err := fs.Stat(ctx, name)
+	if err == nil {
+		return info, true, nil
+	}
+	if os.IsNotExist(err) {
+		return nil, false, nil
+	}
+	return nil, false, err
+}
+
+// lowersOf returns the lower layers not hidden at name by a whiteout or an
+// opaque directory above it.
+func (fs *FileSystem) lowersOf(ctx context.Context, name string) ([]webdav.FileSystem, error) {
+	dir := "/"
+	for _, part := range strings.Split(strings.Trim(name, "/"), "/") {
+		if part == "" {
+			break
+		}
+		for _, marker := range []string{path.Join(dir, opaqueMarker), path.Join(dir, whiteoutPrefix+part)} {
+			if _, ok, err := exists(ctx, fs.upper, marker); err != nil || ok {
+				return nil, err
+			}
+		}
+		dir = path.Join(dir, part)
+	}
+	return fs.lowers, nil
+}
+
+// lookup returns the topmost layer holding name.
+func (fs *FileSystem) lookup(ctx context.Context, name string) (os.FileInfo, webdav.FileSystem, error) {
+	if info, ok, err := exists(ctx, fs.upper, name); ok || err != nil {
+		return info, fs.upper, err
+	}
+	lowers, err := fs.lowersOf(ctx, name)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, lower := range lowers {
+		if info, ok, err := exists(ctx, lower, name); ok || err != nil {
+			return info, lower, err
+		}
+	}
+	return nil, nil, os.ErrNotExist
+}
+
+// inLowers reports whether a lower layer shows name, which then needs a
+// whiteout once removed from the upper layer.
+func (fs *FileSystem) inLowers(ctx context.Context, name string) (bool, error) {
+	lowers, err := fs.lowersOf(ctx, name)
+	if err != nil {
+		return false, err
+	}
+	for _, lower := range lowers {
+		if _, ok, err := exists(ctx, lower, name); ok || err != nil {
+			return ok, err
+		}
+	}
+	return false, nil
+}
+
+// checkParent fails unless the parent of name is a directory in some layer.
+func (fs *FileSystem) checkParent(ctx context.Context, op, name string) error {
+	info, _, err := fs.lookup(ctx, path.Dir(name))
+	if err != nil {
+		return pathError(op, name, err)
+	}
+	if !info.IsDir() {
+		return pathError(op, name, errors.New("parent is not a directory"))
+	}
+	return nil
+}
+
+// copyUpDir creates dir and its parents in the upper layer.
+func (fs *FileSystem) copyUpDir(ctx context.Context, dir string) error {
+	info, ok, err := exists(ctx, fs.upper, dir)
+	if err != nil {
+		return err
+	}
+	if ok {
+		if !info.IsDir() {
+			return pathError("mkdir", dir, errors.New("not a directory"))
+		}
+		return nil
+	}
+	if err := fs.copyUpDir(ctx, path.Dir(dir)); err != nil {
+		return err
+	}
+	return fs.upper.Mkdir(ctx, dir, 0755)
+}
+
+// copyUpFile copies the file name of lower to the upper layer.
+func (fs *FileSystem) copyUpFile(ctx context.Context, lower webdav.FileSystem, name string) error {
+	if err := fs.copyUpDir(ctx, path.Dir(name)); err != nil {
+		return err
+	}
+	src, err := lower.OpenFile(ctx, name, os.O_RDONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	dst, err := fs.upper.OpenFile(ctx, name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(dst, src)
+	if closeErr := dst.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// createWhiteout hides name of the lower layers.
+func (fs *FileSystem) createWhiteout(ctx context.Context, name string) error {
+	if err := fs.copyUpDir(ctx, path.Dir(name)); err != nil {
+		return err
+	}
+	f, err := fs.upper.OpenFile(ctx, whiteout(name), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// clearWhiteout removes the whiteout of name before it is created again,
+// reporting whether there was one.
+func (fs *FileSystem) clearWhiteout(ctx context.Context, name string) (bool, error) {
+	_, ok, err := exists(ctx, fs.upper, whiteout(name))
+	if !ok || err != nil {
+		return false, err
+	}
+	return true, fs.upper.RemoveAll(ctx, whiteout(name))
+}
+
+func (fs *FileSystem) Stat(ctx context.Context, name string) (os.FileInfo, error) {
+	name = cleanPath(name)
+	if reserved(name) {
+		return nil, pathError("stat", name, os.ErrNotExist)
+	}
+	info, _, err := fs.lookup(ctx, name)
+	if err != nil {
+		return nil, pathError("stat", name, err)
+	}
+	return info, nil
+}
+
+func (fs *FileSystem) Mkdir(ctx context.Context, name string, perm os.FileMode) error {
+	name = cleanPath(name)
+	if reserved(name) {
+		return pathError("mkdir", name, os.ErrPermission)
+	}
+	if _, _, err := fs.lookup(ctx, name); err == nil {
+		return pathError("mkdir", name, os.ErrExist)
+	} else if !os.IsNotExist(err) {
+		return pathError("mkdir", name, err)
+	}
+	if err := fs.checkParent(ctx, "mkdir", name); err != nil {
+		return err
+	}
+	if err := fs.copyUpDir(ctx, path.Dir(name)); err != nil {
+		return pathError("mkdir", name, err)
+	}
+	hidden, err := fs.clearWhiteout(ctx, name)
+	if err != nil {
+		return pathError("mkdir", name, err)
+	}
+	if err := fs.upper.Mkdir(ctx, name, perm); err != nil {
+		return err
+	}
+	if !hidden {
+		return nil
+	}
+	f, err := fs.upper.OpenFile(ctx, path.Join(name, opaqueMarker), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return pathError("mkdir", name, err)
+	}
+	return f.Close()
+}
+
+func (fs *FileSystem) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (webdav.File, error) {
+	name = cleanPath(name)
+	write := flag&(os.O_WRONLY|os.O_RDWR|os.O_CREATE|os.O_TRUNC|os.O_APPEND) != 0
+	if reserved(name) {
+		if write {
+			return nil, pathError("open", name, os.ErrPermission)
+		}
+		return nil, pathError("open", name, os.ErrNotExist)
+	}
+	info, layer, err := fs.lookup(ctx, name)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, pathError("open", name, err)
+	}
+	if !write {
+		if err != nil {
+			return nil, pathError("open", name, err)
+		}
+		if info.IsDir() {
+			return &dir{fs: fs, ctx: ctx, name: name, info: info}, nil
+		}
+		return layer.OpenFile(ctx, name, flag, perm)
+	}
+
+	switch {
+	case err == nil && flag&os.O_CREATE != 0 && flag&os.O_EXCL != 0:
+		return nil, pathError("open", name, os.ErrExist)
+	case err == nil && info.IsDir():
+		return nil, pathError("open", name, errors.New("is a directory"))
+	case err != nil && flag&os.O_CREATE == 0:
+		return nil, pathError("open", name, err)
+	}
+	if err := fs.checkParent(ctx, "open", name); err != nil {
+		return nil, err
+	}
+	switch {
+	case err == nil && layer != fs.upper && flag&os.O_TRUNC == 0:
+		err = fs.copyUpFile(ctx, layer, name)
+	case err == nil:
+		err = fs.copyUpDir(ctx, path.Dir(name))
+	default:
+		if err = fs.copyUpDir(ctx, path.Dir(name)); err == nil {
+			_, err = fs.clearWhiteout(ctx, name)
+		}
+	}
+	if err != nil {
+		return nil, pathError("open", name, err)
+	}
+	return fs.upper.OpenFile(ctx, name, flag, perm)
+}
+
+func (fs *FileSystem) RemoveAll(ctx context.Context, name string) error {
+	name = cleanPath(name)
+	if name == "/" {
+		return pathError("removeall", name, os.ErrInvalid)
+	}
+	if reserved(name) {
+		return pathError("removeall", name, os.ErrPermission)
+	}
+	if _, _, err := fs.lookup(ctx, name); os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return pathError("removeall", name, err)
+	}
+	if err := fs.upper.RemoveAll(ctx, name); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	inLowers, err := fs.inLowers(ctx, name)
+	if err == nil && inLowers {
+		err = fs.createWhiteout(ctx, name)
+	}
+	if err != nil {
+		return pathError("removeall", name, err)
+	}
+	return nil
+}
+
+// Rename moves within the upper layer what is only there. Anything else is
+// copied up to the new name and removed from the old one.
+func (fs *FileSystem) Rename(ctx context.Context, oldName, newName string) error {
+	oldName, newName = cleanPath(oldName), cleanPath(newName)
+	if oldName == "/" || newName == "/" || strings.HasPrefix(newName, oldName+"/") {
+		return pathError("rename", oldName, os.ErrInvalid)
+	}
+	if reserved(oldName) || reserved(newName) {
+		return pathError("rename", oldName, os.ErrPermission)
+	}
+	info, layer, err := fs.lookup(ctx, oldName)
+	if err != nil {
+		return pathError("rename", oldName, err)
+	}
+	if oldName == newName {
+		return nil
+	}
+	if err := fs.checkParent(ctx, "rename", newName); err != nil {
+		return err
+	}
+	inLowers, err := fs.inLowers(ctx, oldName)
+	if err != nil {
+		return pathError("rename", oldName, err)
+	}
+	// newName is replaced like by rename(2), hiding it in the lower layers
+	if err := fs.RemoveAll(ctx, newName); err != nil {
+		return err
+	}
+	if layer != fs.upper || inLowers {
+		if err := fs.copyTree(ctx, oldName, newName, info); err != nil {
+			return pathError("rename", oldName, err)
+		}
+		return fs.RemoveAll(ctx, oldName)
+	}
+
+	if err := fs.copyUpDir(ctx, path.Dir(newName)); err != nil {
+		return pathError("rename", oldName, err)
+	}
+	hidden, err := fs.clearWhiteout(ctx, newName)
+	if err != nil {
+		return pathError("rename", oldName, err)
+	}
+	if err := fs.upper.Rename(ctx, oldName, newName); err != nil {
+		return err
+	}
+	if !hidden || !info.IsDir() {
+		return nil
+	}
+	f, err := fs.upper.OpenFile(ctx, path.Join(newName, opaqueMarker), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return pathError("rename", oldName, err)
+	}
+	return f.Close()
+}
+
+// copyTree copies the merged contents of from to the upper layer at to.
+func (fs *FileSystem) copyTree(ctx context.Context, from, to string, info os.FileInfo) error {
+	if !info.IsDir() {
+		src, err := fs.OpenFile(ctx, from, os.O_RDONLY, 0)
+		if err != nil {
+			return err
+		}
+		defer src.Close()
+		dst, err := fs.OpenFile(ctx, to, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, info.Mode().Perm())
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(dst, src)
+		if closeErr := dst.Close(); err == nil {
+			err = closeErr
+		}
+		return err
+	}
+	if err := fs.Mkdir(ctx, to, info.Mode().Perm()); err != nil {
+		return err
+	}
+	entries, err := fs.list(ctx, from)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if err := fs.copyTree(ctx, path.Join(from, entry.Name()), path.Join(to, entry.Name()), entry); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// list merges the entries of the directory name of all layers showing it.
+func (fs *FileSystem) list(ctx context.Context, name string) ([]os.FileInfo, error) {
+	var ret []os.FileInfo
+	seen := make(map[string]bool)
+	add := func(layer webdav.FileSystem, upper bool) (bool, error) {
+		info, ok, err := exists(ctx, layer, name)
+		if !ok || err != nil || !info.IsDir() {
+			return false, err
+		}
+		f, err := layer.OpenFile(ctx, name, os.O_RDONLY, 0)
+		if err != nil {
+			return false, err
+		}
+		defer f.Close()
+		entries, err := f.Readdir(-1)
+		if err != nil {
+			return false, err
+		}
+		opaque := false
+		for _, entry := range entries {
+			switch {
+			case upper && entry.Name() == opaqueMarker:
+				opaque = true
+			case upper && strings.HasPrefix(entry.Name(), whiteoutPrefix):
+				seen[strings.TrimPrefix(entry.Name(), whiteoutPrefix)] = true
+			case !seen[entry.Name()]:
+				seen[entry.Name()] = true
+				ret = append(ret, entry)
+			}
+		}
+		return opaque, nil
+	}
+
+	opaque, err := add(fs.upper, true)
+	if err != nil {
+		return nil, err
+	}
+	if !opaque {
+		lowers, err := fs.lowersOf(ctx, name)
+		if err != nil {
+			return nil, err
+		}
+		for _, lower := range lowers {
+			if _, err := add(lower, false); err != nil {
+				return nil, err
+			}
+		}
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].Name() < ret[j].Name() })
+	return ret, nil
+}
+
+// dir lists a merged directory when first read.
+type dir struct {
+	fs      *FileSystem
+	ctx     context.Context
+	name    string
+	info    os.FileInfo
+	entries []os.FileInfo
+	listed  bool
+}
+
+func (d *dir) Readdir(count int) ([]os.FileInfo, error) {
+	if !d.listed {
+		entries, err := d.fs.list(d.ctx, d.name)
+		if err != nil {
+			return nil, err
+		}
+		d.entries, d.listed = entries, true
+	}
+	if count <= 0 {
+		ret := d.entries
+		d.entries = nil
+		return ret, nil
+	}
+	if len(d.entries) == 0 {
+		return nil, io.EOF
+	}
+	if count > len(d.entries) {
+		count = len(d.entries)
+	}
+	ret := d.entries[:count]
+	d.entries = d.entries[count:]
+	return ret, nil
+}
+
+func (d *dir) Stat() (os.FileInfo, error) {
+	return d.info, nil
+}
+
+func (d *dir) Close() error {
+	return nil
+}
+
+func (d *dir) Read(p []byte) (int, error) {
+	return 0, errors.New("is a directory")
+}
+
+func (d *dir) Seek(offset int64, whence int) (int64, error) {
+	return 0, errors.New("is a directory")
+}
+
+func (d *dir) Write(p []byte) (int, error) {
+	return 0, errors.New("is a directory")
+}
@@ -0,0 +1,162 @@
+package overlayfs
+
+import (
+	"context"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"testing"
+
+	"github.com/pluveto/flydav/pkg/storage"
+	"github.com/pluveto/flydav/pkg/storage/storagetest"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/webdav"
+)
+
+var ctx = context.Background()
+
+func TestFileSystem(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T) webdav.FileSystem {
+		return New(webdav.NewMemFS(), webdav.NewMemFS())
+	})
+}
+
+func TestFileSystemOverLocal(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T) webdav.FileSystem {
+		return New(webdav.Dir(t.TempDir()), webdav.Dir(t.TempDir()))
+	})
+}
+
+func writeFile(t *testing.T, fs webdav.FileSystem, name, content string) {
+	assert.NoError(t, storage.MkdirAll(ctx, fs, path.Dir(name)))
+	f, err := fs.OpenFile(ctx, name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if assert.NoError(t, err, name) {
+		_, err = f.Write([]byte(content))
+		assert.NoError(t, err)
+		assert.NoError(t, f.Close())
+	}
+}
+
+func readFile(t *testing.T, fs webdav.FileSystem, name string) string {
+	f, err := fs.OpenFile(ctx, name, os.O_RDONLY, 0)
+	if !assert.NoError(t, err, name) {
+		return ""
+	}
+	defer f.Close()
+	b, err := io.ReadAll(f)
+	assert.NoError(t, err)
+	return string(b)
+}
+
+func names(t *testing.T, fs webdav.FileSystem, dir string) []string {
+	f, err := fs.OpenFile(ctx, dir, os.O_RDONLY, 0)
+	if !assert.NoError(t, err, dir) {
+		return nil
+	}
+	defer f.Close()
+	entries, err := f.Readdir(-1)
+	assert.NoError(t, err)
+	ret := []string{}
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() {
+			name += "/"
+		}
+		ret = append(ret, name)
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+func exist(fs webdav.FileSystem, name string) bool {
+	_, err := fs.Stat(ctx, name)
+	return err == nil
+}
+
+// layers returns an overlay of two lower layers with templates.
+func layers(t *testing.T) (*FileSystem, webdav.FileSystem, webdav.FileSystem, webdav.FileSystem) {
+	upper, top, bottom := webdav.NewMemFS(), webdav.NewMemFS(), webdav.NewMemFS()
+	writeFile(t, top, "/docs/a.txt", "top a")
+	writeFile(t, bottom, "/docs/a.txt", "bottom a")
+	writeFile(t, bottom, "/docs/b.txt", "bottom b")
+	writeFile(t, bottom, "/docs/sub/c.txt", "bottom c")
+	writeFile(t, bottom, "/readme.txt", "readme")
+	return New(upper, top, bottom), upper, top, bottom
+}
+
+func TestLookup(t *testing.T) {
+	fs, _, _, _ := layers(t)
+	assert.Equal(t, "top a", readFile(t, fs, "/docs/a.txt"), "the topmost layer wins")
+	assert.Equal(t, "bottom b", readFile(t, fs, "/docs/b.txt"))
+	assert.Equal(t, []string{"docs/", "readme.txt"}, names(t, fs, "/"))
+	assert.Equal(t, []string{"a.txt", "b.txt", "sub/"}, names(t, fs, "/docs"))
+}
+
+func TestCopyUp(t *testing.T) {
+	fs, upper, _, bottom := layers(t)
+	f, err := fs.OpenFile(ctx, "/docs/sub/c.txt", os.O_WRONLY, 0)
+	if assert.NoError(t, err) {
+		_, err = f.Write([]byte("upper"))
+		assert.NoError(t, err)
+		assert.NoError(t, f.Close())
+	}
+	assert.Equal(t, "upperm c", readFile(t, fs, "/docs/sub/c.txt"), "written over the copied content")
+	assert.Equal(t, "upperm c", readFile(t, upper, "/docs/sub/c.txt"))
+	assert.Equal(t, "bottom c", readFile(t, bottom, "/docs/sub/c.txt"), "lower layers are untouched")
+
+	writeFile(t, fs, "/docs/new.txt", "new")
+	assert.Equal(t, []string{"a.txt", "b.txt", "new.txt", "sub/"}, names(t, fs, "/docs"))
+	assert.False(t, exist(bottom, "/docs/new.txt"))
+}
+
+func TestWhiteout(t *testing.T) {
+	fs, upper, top, bottom := layers(t)
+	assert.NoError(t, fs.RemoveAll(ctx, "/docs/a.txt"))
+	assert.False(t, exist(fs, "/docs/a.txt"), "hidden in all lower layers")
+	assert.True(t, exist(top, "/docs/a.txt"))
+	assert.Equal(t, []string{"b.txt", "sub/"}, names(t, fs, "/docs"))
+	assert.Equal(t, []string{".wh.a.txt"}, names(t, upper, "/docs"))
+
+	writeFile(t, fs, "/docs/a.txt", "again")
+	assert.Equal(t, "again", readFile(t, fs, "/docs/a.txt"))
+	assert.Equal(t, []string{"a.txt"}, names(t, upper, "/docs"), "the whiteout is gone")
+
+	assert.NoError(t, fs.RemoveAll(ctx, "/docs"))
+	assert.False(t, exist(fs, "/docs/sub/c.txt"))
+	assert.Equal(t, []string{"readme.txt"}, names(t, fs, "/"))
+	assert.NoError(t, fs.Mkdir(ctx, "/docs", 0755))
+	assert.Equal(t, []string{}, names(t, fs, "/docs"), "a recreated directory is opaque")
+	assert.False(t, exist(fs, "/docs/b.txt"))
+	assert.True(t, exist(bottom, "/docs/b.txt"))
+
+	assert.NoError(t, fs.RemoveAll(ctx, "/missing"))
+}
+
+func TestRename(t *testing.T) {
+	fs, _, _, bottom := layers(t)
+	assert.NoError(t, fs.Rename(ctx, "/docs", "/papers"))
+	assert.Equal(t, []string{"papers/", "readme.txt"}, names(t, fs, "/"))
+	assert.Equal(t, []string{"a.txt", "b.txt", "sub/"}, names(t, fs, "/papers"))
+	assert.Equal(t, "top a", readFile(t, fs, "/papers/a.txt"))
+	assert.Equal(t, "bottom c", readFile(t, fs, "/papers/sub/c.txt"))
+	assert.True(t, exist(bottom, "/docs/b.txt"))
+
+	writeFile(t, fs, "/mine.txt", "mine")
+	assert.NoError(t, fs.Rename(ctx, "/mine.txt", "/readme.txt"), "replacing a lower file")
+	assert.Equal(t, "mine", readFile(t, fs, "/readme.txt"))
+	assert.Equal(t, []string{"papers/", "readme.txt"}, names(t, fs, "/"))
+
+	assert.NoError(t, fs.Mkdir(ctx, "/empty", 0755))
+	assert.NoError(t, fs.Rename(ctx, "/empty", "/papers"), "replacing a lower directory")
+	assert.Equal(t, []string{}, names(t, fs, "/papers"))
+}
+
+func TestReserved(t *testing.T) {
+	fs, _, _, _ := layers(t)
+	assert.NoError(t, fs.RemoveAll(ctx, "/readme.txt"))
+	assert.False(t, exist(fs, "/.wh.readme.txt"))
+	_, err := fs.OpenFile(ctx, "/.wh.x", os.O_WRONLY|os.O_CREATE, 0644)
+	assert.ErrorIs(t, err, os.ErrPermission)
+	assert.ErrorIs(t, fs.Mkdir(ctx, "/docs/.wh..wh..opq", 0755), os.ErrPermission)
+}
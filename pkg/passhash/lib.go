@@ -0,0 +1,288 @@
+package passhash
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"hash"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/crypto/pbkdf2"
+	"golang.org/x/crypto/scrypt"
+)
+
+// Algorithms of self-describing hashes, as returned by Identify.
+const (
+	Argon2id     = "argon2id"      // $argon2id$v=19$m=65536,t=3,p=4$salt$hash
+	Scrypt       = "scrypt"        // $scrypt$ln=15,r=8,p=1$salt$hash
+	PBKDF2SHA256 = "pbkdf2-sha256" // $pbkdf2-sha256$i=600000$salt$hash
+	PBKDF2SHA512 = "pbkdf2-sha512" // $pbkdf2-sha512$i=210000$salt$hash
+	Bcrypt       = "bcrypt"        // $2a$, $2b$ or $2y$
+	SHA256Crypt  = "sha256-crypt"  // $5$, e.g. from mkpasswd -m sha-256
+	SHA512Crypt  = "sha512-crypt"  // $6$, e.g. from mkpasswd -m sha-512
+	SSHA256      = "ssha256"       // {SSHA256}base64(digest + salt)
+	SSHA512      = "ssha512"       // {SSHA512}base64(digest + salt)
+)
+
+// Parameters of new hashes, and the minimum below which a hash needs a
+// rehash.
+const (
+	argon2Memory  = 64 * 1024 // KiB
+	argon2Time    = 3
+	argon2Threads = 4
+	scryptLogN    = 15
+	scryptR       = 8
+	scryptP       = 1
+	pbkdf2SHA256  = 600000
+	pbkdf2SHA512  = 210000
+	saltLen       = 16
+	keyLen        = 32
+)
+
+var ErrUnsupportedHash = errors.New("unsupported password hash")
+
+// Identify returns the algorithm of a hash, or "" if it is not
+// self-describing, e.g. a bare hex digest.
+func Identify(hash string) string {
+	switch {
+	case strings.HasPrefix(hash, "$argon2id$"):
+		return Argon2id
+	case strings.HasPrefix(hash, "$scrypt$"):
+		return Scrypt
+	case strings.HasPrefix(hash, "$pbkdf2-sha256$"):
+		return PBKDF2SHA256
+	case strings.HasPrefix(hash, "$pbkdf2-sha512$"):
+		return PBKDF2SHA512
+	case strings.HasPrefix(hash, "$2a$"), strings.HasPrefix(hash, "$2b$"), strings.HasPrefix(hash, "$2y$"):
+		return Bcrypt
+	case strings.HasPrefix(hash, sha256CryptMagic):
+		return SHA256Crypt
+	case strings.HasPrefix(hash, sha512CryptMagic):
+		return SHA512Crypt
+	case strings.HasPrefix(hash, "{SSHA256}"):
+		return SSHA256
+	case strings.HasPrefix(hash, "{SSHA512}"):
+		return SSHA512
+	}
+	return ""
+}
+
+// Verify checks password against a hash of any algorithm Identify knows.
+func Verify(hash, password string) (bool, error) {
+	switch Identify(hash) {
+	case Argon2id:
+		p, err := parsePHC(hash)
+		if err != nil {
+			return false, err
+		}
+		sum := argon2.IDKey([]byte(password), p.salt, uint32(p.params["t"]), uint32(p.params["m"]), uint8(p.params["p"]), uint32(len(p.sum)))
+		return equal(sum, p.sum), nil
+	case Scrypt:
+		p, err := parsePHC(hash)
+		if err != nil {
+			return false, err
+		}
+		sum, err := scrypt.Key([]byte(password), p.salt, 1<<p.params["ln"], p.params["r"], p.params["p"], len(p.sum))
+		if err != nil {
+			return false, err
+		}
+		return equal(sum, p.sum), nil
+	case PBKDF2SHA256, PBKDF2SHA512:
+		p, err := parsePHC(hash)
+		if err != nil {
+			return false, err
+		}
+		sum := pbkdf2.Key([]byte(password), p.salt, p.params["i"], len(p.sum), pbkdf2Hash(p.id))
+		return equal(sum, p.sum), nil
+	case Bcrypt:
+		err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
+		if err == bcrypt.ErrMismatchedHashAndPassword {
+			return false, nil
+		}
+		return err == nil, err
+	case SHA256Crypt, SHA512Crypt:
+		computed, err := shaCrypt(password, hash)
+		if err != nil {
+			return false, err
+		}
+		return equal([]byte(computed), []byte(hash)), nil
+	case SSHA256:
+		return verifySSHA(sha256.New, hash[len("{SSHA256}"):], password)
+	case SSHA512:
+		return verifySSHA(sha512.New, hash[len("{SSHA512}"):], password)
+	}
+	return false, ErrUnsupportedHash
+}
+
+// Hashable reports whether Hash supports algorithm: Argon2id, Scrypt,
+// PBKDF2SHA256, PBKDF2SHA512 and Bcrypt.
+func Hashable(algorithm string) bool {
+	switch algorithm {
+	case Argon2id, Scrypt, PBKDF2SHA256, PBKDF2SHA512, Bcrypt:
+		return true
+	}
+	return false
+}
+
+// Hash creates a hash with a random salt, see Hashable.
+func Hash(algorithm, password string) (string, error) {
+	if algorithm == Bcrypt {
+		b, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+		return string(b), err
+	}
+	salt := make([]byte, saltLen)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	var params string
+	var sum []byte
+	switch algorithm {
+	case Argon2id:
+		params = fmt.Sprintf("v=%d$m=%d,t=%d,p=%d", argon2.Version, argon2Memory, argon2Time, argon2Threads)
+		sum = argon2.IDKey([]byte(password), salt, argon2Time, argon2Memory, argon2Threads, keyLen)
+	case Scrypt:
+		params = fmt.Sprintf("ln=%d,r=%d,p=%d", scryptLogN, scryptR, scryptP)
+		var err error
+		sum, err = scrypt.Key([]byte(password), salt, 1<<scryptLogN, scryptR, scryptP, keyLen)
+		if err != nil {
+			return "", err
+		}
+	case PBKDF2SHA256, PBKDF2SHA512:
+		iterations := pbkdf2SHA256
+		if algorithm == PBKDF2SHA512 {
+			iterations = pbkdf2SHA512
+		}
+		params = fmt.Sprintf("i=%d", iterations)
+		sum = pbkdf2.Key([]byte(password), salt, iterations, keyLen, pbkdf2Hash(algorithm))
+	default:
+		return "", ErrUnsupportedHash
+	}
+	return "$" + algorithm + "$" + params + "$" + b64.EncodeToString(salt) + "$" + b64.EncodeToString(sum), nil
+}
+
+// NeedsRehash reports whether a hash is weak and should be replaced: an
+// unsalted digest, a salted SHA-2 hash, bcrypt below the default cost, or
+// weaker parameters than Hash would use. Strong hashes of any algorithm are
+// kept.
+func NeedsRehash(hash string) bool {
+	algorithm := Identify(hash)
+	switch algorithm {
+	case "", SHA256Crypt, SHA512Crypt, SSHA256, SSHA512:
+		return true
+	case Bcrypt:
+		cost, err := bcrypt.Cost([]byte(hash))
+		return err != nil || cost < bcrypt.DefaultCost
+	}
+	p, err := parsePHC(hash)
+	if err != nil {
+		return true
+	}
+	switch algorithm {
+	case Argon2id:
+		return p.params["m"] < argon2Memory || p.params["t"] < argon2Time
+	case Scrypt:
+		return p.params["ln"] < scryptLogN
+	case PBKDF2SHA256:
+		return p.params["i"] < pbkdf2SHA256
+	case PBKDF2SHA512:
+		return p.params["i"] < pbkdf2SHA512
+	}
+	return false
+}
+
+// b64 is the encoding of PHC strings. Decoding also accepts the "." for "+"
+// and the padding written by passlib.
+var b64 = base64.RawStdEncoding
+
+func decodeB64(s string) ([]byte, error) {
+	return b64.DecodeString(strings.ReplaceAll(strings.TrimRight(s, "="), ".", "+"))
+}
+
+type phc struct {
+	id     string
+	params map[string]int
+	salt   []byte
+	sum    []byte
+}
+
+// parsePHC splits "$id[$v=19]$k=v,...$salt$hash". The bare rounds of passlib,
+// "$pbkdf2-sha256$29000$salt$hash", are read as i=29000.
+func parsePHC(hash string) (*phc, error) {
+	fields := strings.Split(hash, "$")
+	if len(fields) == 6 && strings.HasPrefix(fields[2], "v=") {
+		if fields[2] != fmt.Sprintf("v=%d", argon2.Version) {
+			return nil, fmt.Errorf("%w: version %s", ErrUnsupportedHash, fields[2])
+		}
+		fields = append(fields[:2], fields[3:]...)
+	}
+	if len(fields) != 5 || fields[0] != "" {
+		return nil, fmt.Errorf("%w: malformed %s hash", ErrUnsupportedHash, fields[1])
+	}
+	ret := &phc{id: fields[1], params: make(map[string]int)}
+	for _, param := range strings.Split(fields[2], ",") {
+		key, value, ok := strings.Cut(param, "=")
+		if !ok {
+			key, value = "i", param
+		}
+		n, err := strconv.Atoi(value)
+		if err != nil || n <= 0 {
+			return nil, fmt.Errorf("%w: invalid parameter %q", ErrUnsupportedHash, param)
+		}
+		ret.params[key] = n
+	}
+	var err error
+	if ret.salt, err = decodeB64(fields[3]); err != nil {
+		return nil, fmt.Errorf("%w: invalid salt", ErrUnsupportedHash)
+	}
+	if ret.sum, err = decodeB64(fields[4]); err != nil || len(ret.sum) == 0 {
+		return nil, fmt.Errorf("%w: invalid hash", ErrUnsupportedHash)
+	}
+
+	var required []string
+	switch ret.id {
+	case Argon2id:
+		required = []string{"m", "t", "p"}
+	case Scrypt:
+		required = []string{"ln", "r", "p"}
+	default:
+		required = []string{"i"}
+	}
+	for _, key := range required {
+		if ret.params[key] == 0 {
+			return nil, fmt.Errorf("%w: %s hash without %s", ErrUnsupportedHash, ret.id, key)
+		}
+	}
+	if ret.id == Argon2id && ret.params["p"] > 255 || ret.id == Scrypt && ret.params["ln"] > 30 {
+		return nil, fmt.Errorf("%w: parameters out of range", ErrUnsupportedHash)
+	}
+	return ret, nil
+}
+
+func pbkdf2Hash(algorithm string) func() hash.Hash {
+	if algorithm == PBKDF2SHA512 {
+		return sha512.New
+	}
+	return sha256.New
+}
+
+func verifySSHA(newHash func() hash.Hash, encoded, password string) (bool, error) {
+	raw, err := base64.StdEncoding.DecodeString(encoded)
+	h := newHash()
+	if err != nil || len(raw) <= h.Size() {
+		return false, fmt.Errorf("%w: malformed salted SHA-2 hash", ErrUnsupportedHash)
+	}
+	h.Write([]byte(password))
+	h.Write(raw[h.Size():])
+	return equal(h.Sum(nil), raw[:h.Size()]), nil
+}
+
+func equal(a, b []byte) bool {
+	return subtle.ConstantTimeCompare(a, b) == 1
+}
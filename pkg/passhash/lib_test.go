@@ -0,0 +1,94 @@
+package passhash
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestVerify(t *testing.T) {
+	tests := []struct {
+		name      string
+		hash      string
+		algorithm string
+	}{
+		{"scrypt", "$scrypt$ln=4,r=8,p=1$MDEyMzQ1Njc4OWFiY2RlZg$aHJQwwVNJVSreHMAl/Zas03pgEMu1GPRyNca6bZQE2o", Scrypt},
+		{"pbkdf2-sha256", "$pbkdf2-sha256$i=1000$MDEyMzQ1Njc4OWFiY2RlZg$Kmg10lkKkbaG2nLDWlxqeLpml/xJtufFVcbj1MAp6C0", PBKDF2SHA256},
+		{"pbkdf2-sha512 passlib", "$pbkdf2-sha512$1000$MDEyMzQ1Njc4OWFiY2RlZg$O2RSbYsLY9Cgy8wPAIboPAXedKDq/DFbLyExk7UtF7GeNUyLcLWIk5T3lqVi2/dMWodQRCV8Xae1w19YEeYUoA", PBKDF2SHA512},
+		{"sha256-crypt", "$5$saltstring$a.hTpNLNXAx2Axh5tQ0nK7EdnGiJMSvsTuQse18eAk4", SHA256Crypt},
+		{"sha512-crypt", "$6$saltstring$vfksln.N4cnbLdesiHPKy.OP2NOhOXnKN9rm3yqTpF5x7A5NQNXFy5cqdYwaUXJaazccqMURtJuEW8H9b/1zO.", SHA512Crypt},
+		{"ssha256", "{SSHA256}iPrrAL6bkQUJV9PlM6aybY30WGOEkSqaRFNJsc1pbClzYWx0MTIzNA==", SSHA256},
+		{"ssha512", "{SSHA512}auWVo3bbXvqqvYYPJeieJXRCfSVTrpfWrNxFhWUQeBT2af3xDA5Qg0JeeQHVGfQv7Vz/H4UtF8PIlcaCjF6/4XNhbHQxMjM0", SSHA512},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.algorithm, Identify(tt.hash))
+			ok, err := Verify(tt.hash, "secretpass")
+			assert.NoError(t, err)
+			assert.True(t, ok)
+			ok, err = Verify(tt.hash, "wrongpass")
+			assert.NoError(t, err)
+			assert.False(t, ok)
+		})
+	}
+
+	_, err := Verify("d66086d3dad88379ae3aa038282b3978574132262d4b8505660ab78c2e2ae27e", "secretpass")
+	assert.ErrorIs(t, err, ErrUnsupportedHash)
+	_, err = Verify("$argon2id$v=19$m=65536$c2FsdA$aGFzaA", "secretpass")
+	assert.ErrorIs(t, err, ErrUnsupportedHash)
+}
+
+func TestShaCrypt(t *testing.T) {
+	tests := []struct {
+		password string
+		hash     string
+	}{
+		{"Hello world!", "$5$saltstring$5B8vYYiY.CVt1RlTTf8KbXBH3hsxY/GNooZaBBGWEc5"},
+		{"Hello world!", "$6$saltstring$svn8UoSVapNtMuq1ukKS4tPQd8iKwSMHWjl/O817G3uBnIFNjnQJuesI68u4OTLiBFdcbYEdFCoEOfaS35inz1"},
+		{"This is just a test", "$5$rounds=5000$toolongsaltstrin$Un/5jzAHMgOGZ5.mWJpuVolil07guHPvOW8mGRcvxa5"},
+		{"rounds test", "$6$toolongsaltstrin$XRokWTiFNLb61FsgnynBPaFziH4Ng.F1XARRBixsg9MNOx7aUAvihUj7Gr2cEGP60S.D4uobPQ50Kpjcj6laH0"},
+	}
+	for _, tt := range tests {
+		computed, err := shaCrypt(tt.password, tt.hash)
+		assert.NoError(t, err)
+		assert.Equal(t, tt.hash, computed)
+	}
+}
+
+func TestHash(t *testing.T) {
+	for _, algorithm := range []string{Argon2id, Scrypt, PBKDF2SHA256, PBKDF2SHA512, Bcrypt} {
+		t.Run(algorithm, func(t *testing.T) {
+			hash, err := Hash(algorithm, "secretpass")
+			assert.NoError(t, err)
+			assert.True(t, Hashable(algorithm))
+			assert.Equal(t, algorithm, Identify(hash))
+			ok, err := Verify(hash, "secretpass")
+			assert.NoError(t, err)
+			assert.True(t, ok)
+			ok, _ = Verify(hash, "wrongpass")
+			assert.False(t, ok)
+			assert.False(t, NeedsRehash(hash))
+
+			other, err := Hash(algorithm, "secretpass")
+			assert.NoError(t, err)
+			assert.NotEqual(t, hash, other, "salt must be random")
+		})
+	}
+
+	assert.False(t, Hashable(SSHA256))
+	_, err := Hash(SSHA256, "secretpass")
+	assert.ErrorIs(t, err, ErrUnsupportedHash)
+}
+
+func TestNeedsRehash(t *testing.T) {
+	assert.True(t, NeedsRehash("d66086d3dad88379ae3aa038282b3978574132262d4b8505660ab78c2e2ae27e"), "unsalted sha256")
+	assert.True(t, NeedsRehash("{SSHA256}iPrrAL6bkQUJV9PlM6aybY30WGOEkSqaRFNJsc1pbClzYWx0MTIzNA=="))
+	assert.True(t, NeedsRehash("$scrypt$ln=4,r=8,p=1$MDEyMzQ1Njc4OWFiY2RlZg$aHJQwwVNJVSreHMAl/Zas03pgEMu1GPRyNca6bZQE2o"))
+	assert.True(t, NeedsRehash("$pbkdf2-sha256$i=1000$MDEyMzQ1Njc4OWFiY2RlZg$Kmg10lkKkbaG2nLDWlxqeLpml/xJtufFVcbj1MAp6C0"))
+	assert.True(t, NeedsRehash("$argon2id$v=19$m=19456,t=2,p=1$c2FsdA$aGFzaA"))
+	assert.True(t, NeedsRehash("$2a$04$"+strings.Repeat("a", 53)))
+	assert.False(t, NeedsRehash("$argon2id$v=19$m=65536,t=3,p=4$c2FsdA$aGFzaA"))
+	assert.False(t, NeedsRehash("$2a$10$"+strings.Repeat("a", 53)), "bcrypt at the default cost is kept")
+	assert.False(t, NeedsRehash("$2a$12$"+strings.Repeat("a", 53)))
+}
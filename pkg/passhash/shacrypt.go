@@ -0,0 +1,156 @@
+package passhash
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"fmt"
+	"hash"
+	"strconv"
+	"strings"
+)
+
+const (
+	sha256CryptMagic = "$5$"
+	sha512CryptMagic = "$6$"
+	roundsPrefix     = "rounds="
+	defaultRounds    = 5000
+	itoa64           = "./0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+)
+
+// Byte order of the final encoding, three bytes per group of four characters.
+var (
+	sha256CryptOrder = [][3]int{
+		{0, 10, 20}, {21, 1, 11}, {12, 22, 2}, {3, 13, 23}, {24, 4, 14},
+		{15, 25, 5}, {6, 16, 26}, {27, 7, 17}, {18, 28, 8}, {9, 19, 29},
+	}
+	sha512CryptOrder = [][3]int{
+		{0, 21, 42}, {22, 43, 1}, {44, 2, 23}, {3, 24, 45}, {25, 46, 4},
+		{47, 5, 26}, {6, 27, 48}, {28, 49, 7}, {50, 8, 29}, {9, 30, 51},
+		{31, 52, 10}, {53, 11, 32}, {12, 33, 54}, {34, 55, 13}, {56, 14, 35},
+		{15, 36, 57}, {37, 58, 16}, {59, 17, 38}, {18, 39, 60}, {40, 61, 19},
+		{62, 20, 41},
+	}
+)
+
+// shaCrypt implements the SHA-256 and SHA-512 based crypt of glibc, taking
+// the magic, rounds and salt from an existing "$5$" or "$6$" hash.
+func shaCrypt(password, setting string) (string, error) {
+	magic := setting[:3]
+	newHash, order := sha256.New, sha256CryptOrder
+	if magic == sha512CryptMagic {
+		newHash, order = sha512.New, sha512CryptOrder
+	}
+	rest := setting[len(magic):]
+	rounds, customRounds := defaultRounds, false
+	if strings.HasPrefix(rest, roundsPrefix) {
+		value, tail, ok := strings.Cut(rest[len(roundsPrefix):], "$")
+		n, err := strconv.Atoi(value)
+		if !ok || err != nil {
+			return "", fmt.Errorf("%w: invalid rounds", ErrUnsupportedHash)
+		}
+		rounds, customRounds, rest = clamp(n, 1000, 999999999), true, tail
+	}
+	salt, _, _ := strings.Cut(rest, "$")
+	if len(salt) > 16 {
+		salt = salt[:16]
+	}
+	pw, s := []byte(password), []byte(salt)
+
+	b := digest(newHash, pw, s, pw)
+	a := newHash()
+	a.Write(pw)
+	a.Write(s)
+	a.Write(repeat(b, len(pw)))
+	for i := len(pw); i > 0; i >>= 1 {
+		if i&1 != 0 {
+			a.Write(b)
+		} else {
+			a.Write(pw)
+		}
+	}
+	sum := a.Sum(nil)
+
+	dp := newHash()
+	for range pw {
+		dp.Write(pw)
+	}
+	p := repeat(dp.Sum(nil), len(pw))
+	ds := newHash()
+	for i := 0; i < 16+int(sum[0]); i++ {
+		ds.Write(s)
+	}
+	sp := repeat(ds.Sum(nil), len(s))
+
+	for i := 0; i < rounds; i++ {
+		c := newHash()
+		if i&1 != 0 {
+			c.Write(p)
+		} else {
+			c.Write(sum)
+		}
+		if i%3 != 0 {
+			c.Write(sp)
+		}
+		if i%7 != 0 {
+			c.Write(p)
+		}
+		if i&1 != 0 {
+			c.Write(sum)
+		} else {
+			c.Write(p)
+		}
+		sum = c.Sum(nil)
+	}
+
+	var out strings.Builder
+	out.WriteString(magic)
+	if customRounds {
+		out.WriteString(roundsPrefix + strconv.Itoa(rounds) + "$")
+	}
+	out.WriteString(salt)
+	out.WriteByte('$')
+	for _, g := range order {
+		encode24(&out, sum[g[0]], sum[g[1]], sum[g[2]], 4)
+	}
+	if magic == sha512CryptMagic {
+		encode24(&out, 0, 0, sum[63], 2)
+	} else {
+		encode24(&out, 0, sum[31], sum[30], 3)
+	}
+	return out.String(), nil
+}
+
+func digest(newHash func() hash.Hash, parts ...[]byte) []byte {
+	h := newHash()
+	for _, part := range parts {
+		h.Write(part)
+	}
+	return h.Sum(nil)
+}
+
+// repeat returns n bytes of b repeated.
+func repeat(b []byte, n int) []byte {
+	ret := make([]byte, 0, n)
+	for len(ret)+len(b) <= n {
+		ret = append(ret, b...)
+	}
+	return append(ret, b[:n-len(ret)]...)
+}
+
+func encode24(out *strings.Builder, b2, b1, b0 byte, n int) {
+	w := uint(b2)<<16 | uint(b1)<<8 | uint(b0)
+	for ; n > 0; n-- {
+		out.WriteByte(itoa64[w&0x3f])
+		w >>= 6
+	}
+}
+
+func clamp(n, lo, hi int) int {
+	if n < lo {
+		return lo
+	}
+	if n > hi {
+		return hi
+	}
+	return n
+}
@@ -0,0 +1,599 @@
+// Package s3fs serves an S3 compatible bucket as a webdav.FileSystem and
+// registers it as the "s3" storage backend.
+//
+// Files are objects keyed by their path below Prefix. Directories are key
+// prefixes, created empty as a zero-byte object ending in "/" which other
+// tools create too. A directory exists as long as its marker or any object
+// below it does.
+package s3fs
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+	"github.com/pluveto/flydav/pkg/storage"
+	"golang.org/x/net/webdav"
+)
+
+// DefaultPartSize is the size of the parts uploads are streamed in. An
+// upload can have up to 10000 parts, so this limits files to about 156 GiB.
+const DefaultPartSize = 16 << 20
+
+var (
+	ErrAppend       = errors.New("s3fs: appending to objects is not supported")
+	ErrPartialWrite = errors.New("s3fs: objects can only be written whole, with O_TRUNC")
+)
+
+func init() {
+	storage.Register("s3", open)
+}
+
+type Config struct {
+	Endpoint     string // host[:port], e.g. "s3.amazonaws.com" or "localhost:9000"
+	Bucket       string
+	Prefix       string // Keys below, e.g. "users/alice"
+	AccessKey    string // Empty takes the AWS_* environment variables
+	SecretKey    string
+	SessionToken string
+	Region       string
+	Insecure     bool // Plain HTTP, e.g. for a local MinIO
+	PathStyle    bool // Bucket in the path instead of the host name
+	PartSize     uint64
+}
+
+// open builds a Config of storage options.
+func open(options map[string]string) (webdav.FileSystem, error) {
+	err := storage.CheckOptions(options, []string{"endpoint", "bucket"},
+		"prefix", "access_key", "secret_key", "session_token", "region", "insecure", "path_style", "part_size")
+	if err != nil {
+		return nil, err
+	}
+	cfg := Config{
+		Endpoint:     options["endpoint"],
+		Bucket:       options["bucket"],
+		Prefix:       options["prefix"],
+		AccessKey:    options["access_key"],
+		SecretKey:    options["secret_key"],
+		SessionToken: options["session_token"],
+		Region:       options["region"],
+	}
+	for key, value := range map[string]*bool{"insecure": &cfg.Insecure, "path_style": &cfg.PathStyle} {
+		if options[key] == "" {
+			continue
+		}
+		if *value, err = strconv.ParseBool(options[key]); err != nil {
+			return nil, fmt.Errorf("invalid option %s: %w", key, err)
+		}
+	}
+	if options["part_size"] != "" {
+		mib, err := strconv.ParseUint(options["part_size"], 10, 32)
+		if err != nil || mib < 5 {
+			return nil, fmt.Errorf("invalid option part_size %q, at least 5 MiB", options["part_size"])
+		}
+		cfg.PartSize = mib << 20
+	}
+	return New(context.Background(), cfg)
+}
+
+type FileSystem struct {
+	client   *minio.Client
+	bucket   string
+	prefix   string
+	partSize uint64
+}
+
+// New connects to the bucket, which must exist.
+func New(ctx context.Context, cfg Config) (*FileSystem, error) {
+	creds := credentials.NewEnvAWS()
+	if cfg.AccessKey != "" {
+		creds = credentials.NewStaticV4(cfg.AccessKey, cfg.SecretKey, cfg.SessionToken)
+	}
+	lookup := minio.BucketLookupAuto
+	if cfg.PathStyle {
+		lookup = minio.BucketLookupPath
+	}
+	client, err := minio.New(cfg.Endpoint, &minio.Options{
+		Creds:        creds,
+		Secure:       !cfg.Insecure,
+		Region:       cfg.Region,
+		BucketLookup: lookup,
+	})
+	if err != nil {
+		return nil, err
+	}
+	exists, err := client.BucketExists(ctx, cfg.Bucket)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		return nil, fmt.Errorf("bucket %s does not exist", cfg.Bucket)
+	}
+	fs := &FileSystem{
+		client:   client,
+		bucket:   cfg.Bucket,
+		prefix:   strings.Trim(cfg.Prefix, "/"),
+		partSize: cfg.PartSize,
+	}
+	if fs.partSize == 0 {
+		fs.partSize = DefaultPartSize
+	}
+	return fs, nil
+}
+
+// key returns the object key of name, "" for the root.
+func (fs *FileSystem) key(name string) string {
+	return strings.TrimPrefix(path.Join(fs.prefix, path.Clean("/"+name)), "/")
+}
+
+// dirKey returns the prefix of the objects below name.
+func (fs *FileSystem) dirKey(name string) string {
+	if key := fs.key(name); key != "" {
+		return key + "/"
+	}
+	return ""
+}
+
+func isRoot(name string) bool {
+	return path.Clean("/"+name) == "/"
+}
+
+func notFound(err error) bool {
+	code := minio.ToErrorResponse(err).Code
+	return code == "NoSuchKey" || code == "NotFound"
+}
+
+func pathError(op, name string, err error) error {
+	return &os.PathError{Op: op, Path: name, Err: err}
+}
+
+// hasChildren reports whether any object, including the directory marker,
+// starts with prefix.
+func (fs *FileSystem) hasChildren(ctx context.Context, prefix string) (bool, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	for object := range fs.client.ListObjects(ctx, fs.bucket, minio.ListObjectsOptions{Prefix: prefix, MaxKeys: 1}) {
+		return object.Err == nil, object.Err
+	}
+	return false, nil
+}
+
+func (fs *FileSystem) Stat(ctx context.Context, name string) (os.FileInfo, error) {
+	if isRoot(name) {
+		return &fileInfo{name: "/", dir: true}, nil
+	}
+	object, err := fs.client.StatObject(ctx, fs.bucket, fs.key(name), minio.StatObjectOptions{})
+	if err == nil {
+		return objectInfo(object), nil
+	}
+	if !notFound(err) {
+		return nil, pathError("stat", name, err)
+	}
+	exists, err := fs.hasChildren(ctx, fs.dirKey(name))
+	if err != nil {
+		return nil, pathError("stat", name, err)
+	}
+	if !exists {
+		return nil, pathError("stat", name, os.ErrNotExist)
+	}
+	return &fileInfo{name: path.Base(name), dir: true}, nil
+}
+
+// checkParent fails unless the parent of name is a directory.
+func (fs *FileSystem) checkParent(ctx context.Context, op, name string) error {
+	parent, err := fs.Stat(ctx, path.Dir(path.Clean("/"+name)))
+	if err != nil {
+		return pathError(op, name, os.ErrNotExist)
+	}
+	if !parent.IsDir() {
+		return pathError(op, name, errors.New("parent is not a directory"))
+	}
+	return nil
+}
+
+func (fs *FileSystem) Mkdir(ctx context.Context, name string, perm os.FileMode) error {
+	if isRoot(name) {
+		return pathError("mkdir", name, os.ErrExist)
+	}
+	if _, err := fs.Stat(ctx, name); err == nil {
+		return pathError("mkdir", name, os.ErrExist)
+	}
+	if err := fs.checkParent(ctx, "mkdir", name); err != nil {
+		return err
+	}
+	_, err := fs.client.PutObject(ctx, fs.bucket, fs.dirKey(name), strings.NewReader(""), 0, minio.PutObjectOptions{})
+	if err != nil {
+		return pathError("mkdir", name, err)
+	}
+	return nil
+}
+
+func (fs *FileSystem) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (webdav.File, error) {
+	if flag&(os.O_WRONLY|os.O_RDWR|os.O_CREATE|os.O_TRUNC|os.O_APPEND) == 0 {
+		info, err := fs.Stat(ctx, name)
+		if err != nil {
+			return nil, err
+		}
+		if info.IsDir() {
+			return &dir{fs: fs, ctx: ctx, name: name, info: info}, nil
+		}
+		object, err := fs.client.GetObject(ctx, fs.bucket, fs.key(name), minio.GetObjectOptions{})
+		if err != nil {
+			return nil, pathError("open", name, err)
+		}
+		return &file{Object: object, info: info}, nil
+	}
+
+	if flag&os.O_APPEND != 0 {
+		return nil, pathError("open", name, ErrAppend)
+	}
+	if isRoot(name) {
+		return nil, pathError("open", name, os.ErrInvalid)
+	}
+	info, err := fs.Stat(ctx, name)
+	switch {
+	case err == nil && flag&os.O_CREATE != 0 && flag&os.O_EXCL != 0:
+		return nil, pathError("open", name, os.ErrExist)
+	case err == nil && info.IsDir():
+		return nil, pathError("open", name, errors.New("is a directory"))
+	case err != nil && !errors.Is(err, os.ErrNotExist):
+		return nil, err
+	case err != nil && flag&os.O_CREATE == 0:
+		return nil, err
+	case err == nil && flag&os.O_TRUNC == 0:
+		// webdav.Handler opens files O_RDWR for PROPPATCH without writing,
+		// an upload would replace the object with nothing
+		if flag&os.O_RDWR == 0 {
+			return nil, pathError("open", name, ErrPartialWrite)
+		}
+		return fs.OpenFile(ctx, name, os.O_RDONLY, 0)
+	}
+	if err := fs.checkParent(ctx, "open", name); err != nil {
+		return nil, err
+	}
+	return fs.upload(ctx, name), nil
+}
+
+// upload streams the content written to the returned file to the object of
+// name, replacing it once the file is closed. Content fitting in one part is
+// put at once, larger content is uploaded in parts as it comes.
+func (fs *FileSystem) upload(ctx context.Context, name string) *writer {
+	r, w := io.Pipe()
+	ret := &writer{
+		pipe: w,
+		done: make(chan error, 1),
+		info: fileInfo{name: path.Base(name), modTime: time.Now()},
+	}
+	contentType := mime.TypeByExtension(path.Ext(name))
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	go func() {
+		opts := minio.PutObjectOptions{ContentType: contentType, PartSize: fs.partSize}
+		first := make([]byte, fs.partSize)
+		n, err := io.ReadFull(r, first)
+		switch err {
+		case io.EOF, io.ErrUnexpectedEOF:
+			_, err = fs.client.PutObject(ctx, fs.bucket, fs.key(name), bytes.NewReader(first[:n]), int64(n), opts)
+		case nil:
+			_, err = fs.client.PutObject(ctx, fs.bucket, fs.key(name), io.MultiReader(bytes.NewReader(first), r), -1, opts)
+		}
+		r.CloseWithError(err)
+		ret.done <- err
+	}()
+	return ret
+}
+
+func (fs *FileSystem) RemoveAll(ctx context.Context, name string) error {
+	if isRoot(name) {
+		return pathError("removeall", name, os.ErrInvalid)
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	objects := make(chan minio.ObjectInfo)
+	listErr := make(chan error, 1)
+	go func() {
+		defer close(objects)
+		objects <- minio.ObjectInfo{Key: fs.key(name)}
+		for object := range fs.client.ListObjects(ctx, fs.bucket, minio.ListObjectsOptions{Prefix: fs.dirKey(name), Recursive: true}) {
+			if object.Err != nil {
+				listErr <- object.Err
+				return
+			}
+			select {
+			case objects <- object:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	for err := range fs.client.RemoveObjects(ctx, fs.bucket, objects, minio.RemoveObjectsOptions{}) {
+		if !notFound(err.Err) {
+			return pathError("removeall", name, err.Err)
+		}
+	}
+	select {
+	case err := <-listErr:
+		return pathError("removeall", name, err)
+	default:
+		return nil
+	}
+}
+
+// Rename copies the objects on the server and removes the old ones, which
+// is not atomic.
+func (fs *FileSystem) Rename(ctx context.Context, oldName, newName string) error {
+	if isRoot(oldName) || isRoot(newName) {
+		return pathError("rename", oldName, os.ErrInvalid)
+	}
+	info, err := fs.Stat(ctx, oldName)
+	if err != nil {
+		return err
+	}
+	if err := fs.checkParent(ctx, "rename", newName); err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		if err := fs.copy(ctx, fs.key(oldName), fs.key(newName), info.Size()); err != nil {
+			return pathError("rename", oldName, err)
+		}
+		return fs.remove(ctx, fs.key(oldName))
+	}
+	oldPrefix, newPrefix := fs.dirKey(oldName), fs.dirKey(newName)
+	if strings.HasPrefix(newPrefix, oldPrefix) {
+		return pathError("rename", oldName, errors.New("cannot move a directory into itself"))
+	}
+	var objects []minio.ObjectInfo
+	for object := range fs.client.ListObjects(ctx, fs.bucket, minio.ListObjectsOptions{Prefix: oldPrefix, Recursive: true}) {
+		if object.Err != nil {
+			return pathError("rename", oldName, object.Err)
+		}
+		objects = append(objects, object)
+	}
+	for _, object := range objects {
+		if err := fs.copy(ctx, object.Key, newPrefix+strings.TrimPrefix(object.Key, oldPrefix), object.Size); err != nil {
+			return pathError("rename", oldName, err)
+		}
+	}
+	for _, object := range objects {
+		if err := fs.remove(ctx, object.Key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// maxCopySize is the largest object S3 copies in one request.
+const maxCopySize = 5 << 30
+
+// copy copies an object of size on the server, in parts if it is too large
+// for one request.
+func (fs *FileSystem) copy(ctx context.Context, from, to string, size int64) error {
+	dst := minio.CopyDestOptions{Bucket: fs.bucket, Object: to}
+	src := minio.CopySrcOptions{Bucket: fs.bucket, Object: from}
+	var err error
+	if size < maxCopySize {
+		_, err = fs.client.CopyObject(ctx, dst, src)
+	} else {
+		_, err = fs.client.ComposeObject(ctx, dst, src)
+	}
+	return err
+}
+
+func (fs *FileSystem) remove(ctx context.Context, key string) error {
+	if err := fs.client.RemoveObject(ctx, fs.bucket, key, minio.RemoveObjectOptions{}); err != nil && !notFound(err) {
+		return pathError("remove", key, err)
+	}
+	return nil
+}
+
+type fileInfo struct {
+	name        string
+	size        int64
+	modTime     time.Time
+	dir         bool
+	etag        string
+	contentType string
+}
+
+func objectInfo(object minio.ObjectInfo) *fileInfo {
+	return &fileInfo{
+		name:        path.Base(object.Key),
+		size:        object.Size,
+		modTime:     object.LastModified,
+		etag:        object.ETag,
+		contentType: object.ContentType,
+	}
+}
+
+func (fi *fileInfo) Name() string       { return fi.name }
+func (fi *fileInfo) Size() int64        { return fi.size }
+func (fi *fileInfo) ModTime() time.Time { return fi.modTime }
+func (fi *fileInfo) IsDir() bool        { return fi.dir }
+func (fi *fileInfo) Sys() interface{}   { return nil }
+
+func (fi *fileInfo) Mode() os.FileMode {
+	if fi.dir {
+		return os.ModeDir | 0755
+	}
+	return 0644
+}
+
+// ETag implements webdav.ETager with the ETag of the object.
+func (fi *fileInfo) ETag(ctx context.Context) (string, error) {
+	if fi.etag == "" {
+		return "", webdav.ErrNotImplemented
+	}
+	return `"` + strings.Trim(fi.etag, `"`) + `"`, nil
+}
+
+// ContentType implements webdav.ContentTyper, which saves reading the start
+// of the object to sniff it.
+func (fi *fileInfo) ContentType(ctx context.Context) (string, error) {
+	if fi.contentType == "" || fi.contentType == "application/octet-stream" || fi.contentType == "binary/octet-stream" {
+		return "", webdav.ErrNotImplemented
+	}
+	return fi.contentType, nil
+}
+
+// file reads an object, seeking with Range requests.
+type file struct {
+	*minio.Object
+	info os.FileInfo
+}
+
+func (f *file) Readdir(count int) ([]os.FileInfo, error) {
+	return nil, errors.New("not a directory")
+}
+
+func (f *file) Stat() (os.FileInfo, error) {
+	return f.info, nil
+}
+
+func (f *file) Write(p []byte) (int, error) {
+	return 0, os.ErrPermission
+}
+
+// writer uploads what is written to it.
+type writer struct {
+	pipe *io.PipeWriter
+	done chan error
+
+	mu     sync.Mutex
+	info   fileInfo
+	closed bool
+	err    error
+}
+
+func (w *writer) Write(p []byte) (int, error) {
+	n, err := w.pipe.Write(p)
+	w.mu.Lock()
+	w.info.size += int64(n)
+	w.mu.Unlock()
+	return n, err
+}
+
+// Close finishes the upload, the object is replaced only then.
+func (w *writer) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		return w.err
+	}
+	w.closed = true
+	w.pipe.Close()
+	w.err = <-w.done
+	return w.err
+}
+
+func (w *writer) Stat() (os.FileInfo, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	info := w.info
+	return &info, nil
+}
+
+func (w *writer) Read(p []byte) (int, error) {
+	return 0, os.ErrPermission
+}
+
+func (w *writer) Seek(offset int64, whence int) (int64, error) {
+	return 0, errors.New("s3fs: uploads cannot seek")
+}
+
+func (w *writer) Readdir(count int) ([]os.FileInfo, error) {
+	return nil, errors.New("not a directory")
+}
+
+// dir lists the objects and prefixes directly below a directory.
+type dir struct {
+	fs      *FileSystem
+	ctx     context.Context
+	name    string
+	info    os.FileInfo
+	entries []os.FileInfo
+	listed  bool
+}
+
+func (d *dir) Readdir(count int) ([]os.FileInfo, error) {
+	if !d.listed {
+		if err := d.list(); err != nil {
+			return nil, err
+		}
+	}
+	if count <= 0 {
+		ret := d.entries
+		d.entries = nil
+		return ret, nil
+	}
+	if len(d.entries) == 0 {
+		return nil, io.EOF
+	}
+	if count > len(d.entries) {
+		count = len(d.entries)
+	}
+	ret := d.entries[:count]
+	d.entries = d.entries[count:]
+	return ret, nil
+}
+
+func (d *dir) list() error {
+	prefix := d.fs.dirKey(d.name)
+	seen := make(map[string]bool)
+	for object := range d.fs.client.ListObjects(d.ctx, d.fs.bucket, minio.ListObjectsOptions{Prefix: prefix}) {
+		if object.Err != nil {
+			return pathError("readdir", d.name, object.Err)
+		}
+		name := strings.TrimPrefix(object.Key, prefix)
+		if name == "" {
+			// the directory marker
+			continue
+		}
+		if strings.HasSuffix(name, "/") {
+			name = strings.TrimSuffix(name, "/")
+			if !seen[name] {
+				d.entries = append(d.entries, &fileInfo{name: name, dir: true})
+			}
+		} else {
+			info := objectInfo(object)
+			info.name = name
+			d.entries = append(d.entries, info)
+		}
+		seen[name] = true
+	}
+	sort.Slice(d.entries, func(i, j int) bool { return d.entries[i].Name() < d.entries[j].Name() })
+	d.listed = true
+	return nil
+}
+
+func (d *dir) Stat() (os.FileInfo, error) {
+	return d.info, nil
+}
+
+func (d *dir) Close() error {
+	return nil
+}
+
+func (d *dir) Read(p []byte) (int, error) {
+	return 0, errors.New("is a directory")
+}
+
+func (d *dir) Seek(offset int64, whence int) (int64, error) {
+	return 0, errors.New("is a directory")
+}
+
+func (d *dir) Write(p []byte) (int, error) {
+	return 0, errors.New("is a directory")
+}
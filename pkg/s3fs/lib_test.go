@@ -0,0 +1,261 @@
+package s3fs
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pluveto/flydav/pkg/storage"
+	"github.com/pluveto/flydav/pkg/storage/storagetest"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/webdav"
+)
+
+func TestKey(t *testing.T) {
+	fs := &FileSystem{}
+	assert.Equal(t, "", fs.key("/"))
+	assert.Equal(t, "", fs.dirKey("/"))
+	assert.Equal(t, "a/b.txt", fs.key("/a/b.txt"))
+	assert.Equal(t, "a/", fs.dirKey("/a/"))
+	assert.Equal(t, "x", fs.key("/../../x"), "cannot leave the prefix")
+
+	fs.prefix = "users/alice"
+	assert.Equal(t, "users/alice", fs.key("/"))
+	assert.Equal(t, "users/alice/", fs.dirKey("/"))
+	assert.Equal(t, "users/alice/a/b.txt", fs.key("a/b.txt"))
+	assert.Equal(t, "users/alice/x", fs.key("/../x"))
+}
+
+func TestOpen(t *testing.T) {
+	assert.Contains(t, storage.Backends(), "s3")
+	_, err := storage.Open("s3", map[string]string{"endpoint": "localhost:9000"})
+	assert.Error(t, err, "bucket is required")
+	_, err = storage.Open("s3", map[string]string{"endpoint": "localhost:9000", "bucket": "b", "insecure": "maybe"})
+	assert.Error(t, err)
+	_, err = storage.Open("s3", map[string]string{"endpoint": "localhost:9000", "bucket": "b", "part_size": "1"})
+	assert.Error(t, err, "parts are at least 5 MiB")
+}
+
+// TestFileSystem runs against a bucket, e.g. of a local MinIO started with
+//
+//	minio server /tmp/minio
+//	mc mb local/flydav-test
+//
+// and FLYDAV_TEST_S3="endpoint=localhost:9000 bucket=flydav-test
+// access_key=minioadmin secret_key=minioadmin insecure=true".
+func TestFileSystem(t *testing.T) {
+	options := testOptions(t)
+	storagetest.Run(t, func(t *testing.T) webdav.FileSystem {
+		opts := make(map[string]string)
+		for k, v := range options {
+			opts[k] = v
+		}
+		opts["prefix"] = fmt.Sprintf("flydav-test/%d", time.Now().UnixNano())
+		fs, err := storage.Open("s3", opts)
+		if !assert.NoError(t, err) {
+			t.FailNow()
+		}
+		t.Cleanup(func() {
+			s3 := fs.(*FileSystem)
+			s3.prefix = ""
+			s3.RemoveAll(context.Background(), "/"+opts["prefix"])
+		})
+		return fs
+	})
+}
+
+// fakeS3 serves the requests s3fs makes to a path style bucket "test" from
+// memory. Requests are anonymous, see newFakeS3.
+type fakeS3 struct {
+	mu      sync.Mutex
+	objects map[string][]byte
+}
+
+func newFakeS3(t *testing.T) map[string]string {
+	s := &fakeS3{objects: make(map[string][]byte)}
+	srv := httptest.NewServer(s)
+	t.Cleanup(srv.Close)
+	// signed uploads over plain HTTP are sent in signed chunks
+	for _, env := range []string{"AWS_ACCESS_KEY_ID", "AWS_ACCESS_KEY", "AWS_SECRET_ACCESS_KEY", "AWS_SECRET_KEY", "AWS_SESSION_TOKEN"} {
+		t.Setenv(env, "")
+	}
+	return map[string]string{
+		"endpoint":   strings.TrimPrefix(srv.URL, "http://"),
+		"bucket":     "test",
+		"region":     "us-east-1",
+		"insecure":   "true",
+		"path_style": "true",
+	}
+}
+
+var modTime = time.Date(2023, 2, 1, 10, 0, 0, 0, time.UTC)
+
+func (s *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	bucket, key, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	if bucket != "test" {
+		s.error(w, http.StatusNotFound, "NoSuchBucket")
+		return
+	}
+	query := r.URL.Query()
+	switch {
+	case key == "" && r.Method == "HEAD":
+	case key == "" && r.Method == "GET":
+		s.list(w, query.Get("prefix"), query.Get("delimiter"), query.Get("max-keys"))
+	case key == "" && r.Method == "POST" && query.Has("delete"):
+		var req struct {
+			Objects []struct{ Key string } `xml:"Object"`
+		}
+		if err := xml.NewDecoder(r.Body).Decode(&req); err != nil {
+			s.error(w, http.StatusBadRequest, "MalformedXML")
+			return
+		}
+		for _, object := range req.Objects {
+			delete(s.objects, object.Key)
+		}
+		io.WriteString(w, "<DeleteResult></DeleteResult>")
+	case r.Method == "PUT" && r.Header.Get("X-Amz-Copy-Source") != "":
+		src, _ := url.PathUnescape(r.Header.Get("X-Amz-Copy-Source"))
+		content, ok := s.objects[strings.TrimPrefix(strings.TrimPrefix(src, "/"), bucket+"/")]
+		if !ok {
+			s.error(w, http.StatusNotFound, "NoSuchKey")
+			return
+		}
+		s.objects[key] = content
+		fmt.Fprintf(w, "<CopyObjectResult><ETag>\"x\"</ETag><LastModified>%s</LastModified></CopyObjectResult>", modTime.Format(time.RFC3339))
+	case r.Method == "PUT":
+		content, err := io.ReadAll(r.Body)
+		if err != nil {
+			s.error(w, http.StatusBadRequest, "IncompleteBody")
+			return
+		}
+		s.objects[key] = content
+		w.Header().Set("ETag", `"x"`)
+	case r.Method == "DELETE":
+		delete(s.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method == "HEAD" || r.Method == "GET":
+		content, ok := s.objects[key]
+		if !ok {
+			s.error(w, http.StatusNotFound, "NoSuchKey")
+			return
+		}
+		w.Header().Set("ETag", `"x"`)
+		http.ServeContent(w, r, key, modTime, bytes.NewReader(content))
+	default:
+		s.error(w, http.StatusNotImplemented, "NotImplemented")
+	}
+}
+
+func (s *fakeS3) list(w http.ResponseWriter, prefix, delimiter, maxKeys string) {
+	keys := make([]string, 0, len(s.objects))
+	for key := range s.objects {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	max, err := strconv.Atoi(maxKeys)
+	if err != nil {
+		max = 1000
+	}
+	fmt.Fprintf(w, "<ListBucketResult><Name>test</Name><Prefix>%s</Prefix><IsTruncated>false</IsTruncated>", prefix)
+	seen := make(map[string]bool)
+	for _, key := range keys {
+		if len(seen) == max {
+			break
+		}
+		if i := strings.Index(key[len(prefix):], delimiter); delimiter != "" && i >= 0 {
+			common := key[:len(prefix)+i+1]
+			if !seen[common] {
+				fmt.Fprintf(w, "<CommonPrefixes><Prefix>%s</Prefix></CommonPrefixes>", common)
+			}
+			seen[common] = true
+			continue
+		}
+		seen[key] = true
+		fmt.Fprintf(w, "<Contents><Key>%s</Key><Size>%d</Size><LastModified>%s</LastModified><ETag>\"x\"</ETag></Contents>",
+			key, len(s.objects[key]), modTime.Format(time.RFC3339))
+	}
+	io.WriteString(w, "</ListBucketResult>")
+}
+
+func (s *fakeS3) error(w http.ResponseWriter, status int, code string) {
+	w.WriteHeader(status)
+	fmt.Fprintf(w, "<Error><Code>%s</Code></Error>", code)
+}
+
+func TestFileSystemFake(t *testing.T) {
+	options := newFakeS3(t)
+	storagetest.Run(t, func(t *testing.T) webdav.FileSystem {
+		opts := make(map[string]string)
+		for k, v := range options {
+			opts[k] = v
+		}
+		opts["prefix"] = fmt.Sprintf("t%d", time.Now().UnixNano())
+		fs, err := storage.Open("s3", opts)
+		if !assert.NoError(t, err) {
+			t.FailNow()
+		}
+		return fs
+	})
+}
+
+func TestOpenFileKeepsContent(t *testing.T) {
+	fs, err := storage.Open("s3", newFakeS3(t))
+	if !assert.NoError(t, err) {
+		return
+	}
+	ctx := context.Background()
+	f, err := fs.OpenFile(ctx, "/a.txt", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if assert.NoError(t, err) {
+		io.WriteString(f, "hello")
+		assert.NoError(t, f.Close())
+	}
+
+	_, err = fs.OpenFile(ctx, "/a.txt", os.O_WRONLY, 0)
+	assert.ErrorIs(t, err, ErrPartialWrite)
+	f, err = fs.OpenFile(ctx, "/a.txt", os.O_RDWR, 0)
+	if assert.NoError(t, err) {
+		_, err = f.Write([]byte("x"))
+		assert.Error(t, err)
+		assert.NoError(t, f.Close())
+	}
+
+	handler := &webdav.Handler{FileSystem: fs, LockSystem: webdav.NewMemLS()}
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("PROPPATCH", "/a.txt", strings.NewReader(`<?xml version="1.0" encoding="utf-8" ?>
+<D:propertyupdate xmlns:D="DAV:" xmlns:Z="urn:schemas-microsoft-com:">
+  <D:set><D:prop><Z:Win32LastModifiedTime>Wed, 01 Feb 2023 10:00:00 GMT</Z:Win32LastModifiedTime></D:prop></D:set>
+</D:propertyupdate>`)))
+	assert.Equal(t, http.StatusMultiStatus, w.Code)
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/a.txt", nil))
+	assert.Equal(t, "hello", w.Body.String(), "PROPPATCH does not upload")
+}
+
+func testOptions(t *testing.T) map[string]string {
+	env := os.Getenv("FLYDAV_TEST_S3")
+	if env == "" {
+		t.Skip("FLYDAV_TEST_S3 not set")
+	}
+	options := make(map[string]string)
+	for _, pair := range strings.Fields(env) {
+		key, value, _ := strings.Cut(pair, "=")
+		options[key] = value
+	}
+	return options
+}
@@ -0,0 +1,455 @@
+// Package sftpfs serves a directory of a remote SFTP server as a
+// webdav.FileSystem and registers it as the "sftp" storage backend.
+//
+// Requests share a small pool of SSH connections, a connection that breaks
+// is dialed again by the next request using it.
+package sftpfs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/sftp"
+	"github.com/pluveto/flydav/pkg/storage"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+	"golang.org/x/net/webdav"
+)
+
+const (
+	DefaultConnections = 4
+	DefaultTimeout     = 10 * time.Second
+)
+
+func init() {
+	storage.Register("sftp", open)
+}
+
+type Config struct {
+	Addr          string // host[:port], port 22 by default
+	User          string
+	Password      string
+	Key           []byte // PEM or OpenSSH private key
+	KeyPassphrase string
+	// One of HostKey and KnownHosts is required, the server is not trusted
+	// blindly.
+	HostKey     string // "ssh-ed25519 AAAA..." or a fingerprint "SHA256:..."
+	KnownHosts  string // Path of a known_hosts file
+	Dir         string // Remote directory served, the login directory if empty
+	Connections int
+	Timeout     time.Duration // Of dialing and the SSH handshake
+}
+
+// open builds a Config of storage options.
+func open(options map[string]string) (webdav.FileSystem, error) {
+	err := storage.CheckOptions(options, []string{"addr", "user"},
+		"password", "key_file", "key_passphrase", "host_key", "known_hosts", "dir", "connections", "timeout")
+	if err != nil {
+		return nil, err
+	}
+	cfg := Config{
+		Addr:          options["addr"],
+		User:          options["user"],
+		Password:      options["password"],
+		KeyPassphrase: options["key_passphrase"],
+		HostKey:       options["host_key"],
+		KnownHosts:    options["known_hosts"],
+		Dir:           options["dir"],
+	}
+	if options["key_file"] != "" {
+		if cfg.Key, err = os.ReadFile(options["key_file"]); err != nil {
+			return nil, err
+		}
+	}
+	if options["connections"] != "" {
+		n, err := strconv.Atoi(options["connections"])
+		if err != nil || n < 1 {
+			return nil, fmt.Errorf("invalid option connections %q", options["connections"])
+		}
+		cfg.Connections = n
+	}
+	if options["timeout"] != "" {
+		seconds, err := strconv.Atoi(options["timeout"])
+		if err != nil || seconds < 1 {
+			return nil, fmt.Errorf("invalid option timeout %q", options["timeout"])
+		}
+		cfg.Timeout = time.Duration(seconds) * time.Second
+	}
+	return New(cfg)
+}
+
+// HostKeyCallback pins the host key of the server, given as a public key in
+// authorized_keys format or as its SHA256 fingerprint.
+func HostKeyCallback(hostKey string) (ssh.HostKeyCallback, error) {
+	if strings.HasPrefix(hostKey, "SHA256:") {
+		return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+			if ssh.FingerprintSHA256(key) != hostKey {
+				return fmt.Errorf("host key %s does not match", ssh.FingerprintSHA256(key))
+			}
+			return nil
+		}, nil
+	}
+	pinned, _, _, _, err := ssh.ParseAuthorizedKey([]byte(hostKey))
+	if err != nil {
+		return nil, fmt.Errorf("invalid host key: %w", err)
+	}
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		if key.Type() != pinned.Type() || string(key.Marshal()) != string(pinned.Marshal()) {
+			return fmt.Errorf("host key %s does not match", ssh.FingerprintSHA256(key))
+		}
+		return nil
+	}, nil
+}
+
+type FileSystem struct {
+	root  string
+	conns []*conn
+	next  uint32
+}
+
+// New connects to the server once to check the credentials and the
+// directory.
+func New(cfg Config) (*FileSystem, error) {
+	clientConfig := &ssh.ClientConfig{
+		User:    cfg.User,
+		Timeout: cfg.Timeout,
+	}
+	if clientConfig.Timeout == 0 {
+		clientConfig.Timeout = DefaultTimeout
+	}
+	if len(cfg.Key) > 0 {
+		var signer ssh.Signer
+		var err error
+		if cfg.KeyPassphrase != "" {
+			signer, err = ssh.ParsePrivateKeyWithPassphrase(cfg.Key, []byte(cfg.KeyPassphrase))
+		} else {
+			signer, err = ssh.ParsePrivateKey(cfg.Key)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid private key: %w", err)
+		}
+		clientConfig.Auth = append(clientConfig.Auth, ssh.PublicKeys(signer))
+	}
+	if cfg.Password != "" {
+		clientConfig.Auth = append(clientConfig.Auth, ssh.Password(cfg.Password))
+	}
+	if len(clientConfig.Auth) == 0 {
+		return nil, errors.New("a password or a private key is required")
+	}
+	var err error
+	switch {
+	case cfg.HostKey != "":
+		clientConfig.HostKeyCallback, err = HostKeyCallback(cfg.HostKey)
+	case cfg.KnownHosts != "":
+		clientConfig.HostKeyCallback, err = knownhosts.New(cfg.KnownHosts)
+	default:
+		err = errors.New("a host key or a known_hosts file is required")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	addr := cfg.Addr
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		addr = net.JoinHostPort(addr, "22")
+	}
+	n := cfg.Connections
+	if n == 0 {
+		n = DefaultConnections
+	}
+	fs := &FileSystem{conns: make([]*conn, n)}
+	for i := range fs.conns {
+		fs.conns[i] = &conn{addr: addr, config: clientConfig}
+	}
+
+	client, err := fs.conns[0].get()
+	if err != nil {
+		return nil, err
+	}
+	dir := cfg.Dir
+	if dir == "" {
+		dir = "."
+	}
+	if fs.root, err = client.RealPath(dir); err != nil {
+		fs.Close()
+		return nil, fmt.Errorf("%s: %w", dir, err)
+	}
+	info, err := client.Stat(fs.root)
+	if err == nil && !info.IsDir() {
+		err = errors.New("not a directory")
+	}
+	if err != nil {
+		fs.Close()
+		return nil, fmt.Errorf("%s: %w", fs.root, err)
+	}
+	return fs, nil
+}
+
+// Close closes the connections, the file system stays usable and dials
+// again when needed.
+func (fs *FileSystem) Close() error {
+	for _, c := range fs.conns {
+		c.close()
+	}
+	return nil
+}
+
+// conn is a slot of the pool, holding a connection once dialed.
+type conn struct {
+	addr   string
+	config *ssh.ClientConfig
+
+	mu     sync.Mutex
+	ssh    *ssh.Client
+	client *sftp.Client
+	broken chan struct{}
+}
+
+// get returns the client of the slot, dialing if it has none or it broke.
+func (c *conn) get() (*sftp.Client, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.client != nil {
+		select {
+		case <-c.broken:
+			c.ssh.Close()
+			c.client = nil
+		default:
+			return c.client, nil
+		}
+	}
+	sshClient, err := ssh.Dial("tcp", c.addr, c.config)
+	if err != nil {
+		return nil, err
+	}
+	client, err := sftp.NewClient(sshClient)
+	if err != nil {
+		sshClient.Close()
+		return nil, err
+	}
+	broken := make(chan struct{})
+	go func() {
+		client.Wait()
+		close(broken)
+	}()
+	c.ssh, c.client, c.broken = sshClient, client, broken
+	return client, nil
+}
+
+func (c *conn) close() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.client != nil {
+		c.client.Close()
+		c.ssh.Close()
+		c.client = nil
+	}
+}
+
+// client picks the connections in turn.
+func (fs *FileSystem) client() (*sftp.Client, error) {
+	i := atomic.AddUint32(&fs.next, 1)
+	return fs.conns[int(i)%len(fs.conns)].get()
+}
+
+// path returns the remote path of name, which cannot leave the root.
+func (fs *FileSystem) path(name string) string {
+	return path.Join(fs.root, path.Clean("/"+name))
+}
+
+func isRoot(name string) bool {
+	return path.Clean("/"+name) == "/"
+}
+
+func pathError(op, name string, err error) error {
+	return &os.PathError{Op: op, Path: name, Err: err}
+}
+
+func (fs *FileSystem) Stat(ctx context.Context, name string) (os.FileInfo, error) {
+	client, err := fs.client()
+	if err != nil {
+		return nil, pathError("stat", name, err)
+	}
+	info, err := client.Stat(fs.path(name))
+	if err != nil {
+		return nil, pathError("stat", name, err)
+	}
+	return info, nil
+}
+
+// exists tells apart the generic failures SFTP servers report for existing
+// files.
+func exists(client *sftp.Client, remote string, err error) error {
+	if _, statErr := client.Lstat(remote); statErr == nil {
+		return os.ErrExist
+	}
+	return err
+}
+
+func (fs *FileSystem) Mkdir(ctx context.Context, name string, perm os.FileMode) error {
+	client, err := fs.client()
+	if err != nil {
+		return pathError("mkdir", name, err)
+	}
+	remote := fs.path(name)
+	if err := client.Mkdir(remote); err != nil {
+		return pathError("mkdir", name, exists(client, remote, err))
+	}
+	return nil
+}
+
+func (fs *FileSystem) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (webdav.File, error) {
+	client, err := fs.client()
+	if err != nil {
+		return nil, pathError("open", name, err)
+	}
+	remote := fs.path(name)
+	if flag&(os.O_WRONLY|os.O_RDWR|os.O_CREATE|os.O_TRUNC|os.O_APPEND) == 0 {
+		info, err := client.Stat(remote)
+		if err != nil {
+			return nil, pathError("open", name, err)
+		}
+		if info.IsDir() {
+			return &dir{client: client, remote: remote, info: info}, nil
+		}
+	}
+	f, err := client.OpenFile(remote, flag)
+	if err != nil {
+		if flag&os.O_EXCL != 0 {
+			err = exists(client, remote, err)
+		}
+		return nil, pathError("open", name, err)
+	}
+	return &file{File: f}, nil
+}
+
+func (fs *FileSystem) RemoveAll(ctx context.Context, name string) error {
+	if isRoot(name) {
+		return pathError("removeall", name, os.ErrInvalid)
+	}
+	client, err := fs.client()
+	if err != nil {
+		return pathError("removeall", name, err)
+	}
+	if err := removeAll(client, fs.path(name)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return pathError("removeall", name, err)
+	}
+	return nil
+}
+
+// removeAll removes remote and what is below it, without following
+// symbolic links.
+func removeAll(client *sftp.Client, remote string) error {
+	info, err := client.Lstat(remote)
+	if err != nil {
+		return err
+	}
+	if info.IsDir() {
+		entries, err := client.ReadDir(remote)
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			if err := removeAll(client, path.Join(remote, entry.Name())); err != nil {
+				return err
+			}
+		}
+		return client.RemoveDirectory(remote)
+	}
+	return client.Remove(remote)
+}
+
+// Rename replaces newName atomically if the server supports it, otherwise
+// newName must not exist, which webdav.Handler ensures.
+func (fs *FileSystem) Rename(ctx context.Context, oldName, newName string) error {
+	if isRoot(oldName) || isRoot(newName) {
+		return pathError("rename", oldName, os.ErrInvalid)
+	}
+	client, err := fs.client()
+	if err != nil {
+		return pathError("rename", oldName, err)
+	}
+	if _, ok := client.HasExtension("posix-rename@openssh.com"); ok {
+		err = client.PosixRename(fs.path(oldName), fs.path(newName))
+	} else {
+		err = client.Rename(fs.path(oldName), fs.path(newName))
+	}
+	if err != nil {
+		return pathError("rename", oldName, err)
+	}
+	return nil
+}
+
+// file is a remote file, reads and writes go to the server as they come.
+type file struct {
+	*sftp.File
+}
+
+func (f *file) Readdir(count int) ([]os.FileInfo, error) {
+	return nil, errors.New("not a directory")
+}
+
+// dir lists a remote directory when first read.
+type dir struct {
+	client  *sftp.Client
+	remote  string
+	info    os.FileInfo
+	entries []os.FileInfo
+	listed  bool
+}
+
+func (d *dir) Readdir(count int) ([]os.FileInfo, error) {
+	if !d.listed {
+		entries, err := d.client.ReadDir(d.remote)
+		if err != nil {
+			return nil, err
+		}
+		sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+		d.entries, d.listed = entries, true
+	}
+	if count <= 0 {
+		ret := d.entries
+		d.entries = nil
+		return ret, nil
+	}
+	if len(d.entries) == 0 {
+		return nil, io.EOF
+	}
+	if count > len(d.entries) {
+		count = len(d.entries)
+	}
+	ret := d.entries[:count]
+	d.entries = d.entries[count:]
+	return ret, nil
+}
+
+func (d *dir) Stat() (os.FileInfo, error) {
+	return d.info, nil
+}
+
+func (d *dir) Close() error {
+	return nil
+}
+
+func (d *dir) Read(p []byte) (int, error) {
+	return 0, errors.New("is a directory")
+}
+
+func (d *dir) Seek(offset int64, whence int) (int64, error) {
+	return 0, errors.New("is a directory")
+}
+
+func (d *dir) Write(p []byte) (int, error) {
+	return 0, errors.New("is a directory")
+}
@@ -0,0 +1,228 @@
+package sftpfs
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pkg/sftp"
+	"github.com/pluveto/flydav/pkg/storage"
+	"github.com/pluveto/flydav/pkg/storage/storagetest"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/net/webdav"
+)
+
+// server is an SFTP server serving the local file system, accepting the
+// password "secret" and the key of clientKey.
+type server struct {
+	addr      string
+	hostKey   ssh.PublicKey
+	clientKey []byte
+
+	mu    sync.Mutex
+	conns []net.Conn
+	dials int
+}
+
+func newServer(t *testing.T) *server {
+	_, hostPriv, _ := ed25519.GenerateKey(rand.Reader)
+	hostSigner, err := ssh.NewSignerFromKey(hostPriv)
+	assert.NoError(t, err)
+	clientPub, clientPriv, _ := ed25519.GenerateKey(rand.Reader)
+	sshClientPub, err := ssh.NewPublicKey(clientPub)
+	assert.NoError(t, err)
+	der, err := x509.MarshalPKCS8PrivateKey(clientPriv)
+	assert.NoError(t, err)
+
+	config := &ssh.ServerConfig{
+		PasswordCallback: func(meta ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+			if meta.User() == "alice" && string(password) == "secret" {
+				return nil, nil
+			}
+			return nil, errors.New("wrong password")
+		},
+		PublicKeyCallback: func(meta ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if meta.User() == "alice" && string(key.Marshal()) == string(sshClientPub.Marshal()) {
+				return nil, nil
+			}
+			return nil, errors.New("unknown key")
+		},
+	}
+	config.AddHostKey(hostSigner)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	t.Cleanup(func() { l.Close() })
+	s := &server{
+		addr:      l.Addr().String(),
+		hostKey:   hostSigner.PublicKey(),
+		clientKey: pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}),
+	}
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			s.mu.Lock()
+			s.conns = append(s.conns, c)
+			s.dials++
+			s.mu.Unlock()
+			go s.serve(c, config)
+		}
+	}()
+	return s
+}
+
+func (s *server) serve(c net.Conn, config *ssh.ServerConfig) {
+	_, channels, requests, err := ssh.NewServerConn(c, config)
+	if err != nil {
+		return
+	}
+	go ssh.DiscardRequests(requests)
+	for newChannel := range channels {
+		if newChannel.ChannelType() != "session" {
+			newChannel.Reject(ssh.UnknownChannelType, "")
+			continue
+		}
+		channel, requests, err := newChannel.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			for req := range requests {
+				ok := req.Type == "subsystem" && string(req.Payload[4:]) == "sftp"
+				req.Reply(ok, nil)
+				if ok {
+					go func() {
+						if server, err := sftp.NewServer(channel); err == nil {
+							server.Serve()
+						}
+						channel.Close()
+					}()
+				}
+			}
+		}()
+	}
+}
+
+// drop closes the connections of the clients.
+func (s *server) drop() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, c := range s.conns {
+		c.Close()
+	}
+	s.conns = nil
+}
+
+func (s *server) options(dir string) map[string]string {
+	return map[string]string{
+		"addr":     s.addr,
+		"user":     "alice",
+		"password": "secret",
+		"host_key": string(ssh.MarshalAuthorizedKey(s.hostKey)),
+		"dir":      dir,
+	}
+}
+
+func TestFileSystem(t *testing.T) {
+	s := newServer(t)
+	storagetest.Run(t, func(t *testing.T) webdav.FileSystem {
+		fs, err := storage.Open("sftp", s.options(t.TempDir()))
+		if !assert.NoError(t, err) {
+			t.FailNow()
+		}
+		t.Cleanup(func() { fs.(*FileSystem).Close() })
+		return fs
+	})
+}
+
+func TestOpen(t *testing.T) {
+	s := newServer(t)
+	dir := t.TempDir()
+
+	fs, err := storage.Open("sftp", s.options(dir))
+	if assert.NoError(t, err) {
+		fs.(*FileSystem).Close()
+	}
+
+	opts := s.options(dir)
+	opts["password"] = "wrong"
+	_, err = storage.Open("sftp", opts)
+	assert.Error(t, err)
+
+	keyFile := filepath.Join(t.TempDir(), "id_ed25519")
+	assert.NoError(t, os.WriteFile(keyFile, s.clientKey, 0600))
+	opts = s.options(dir)
+	delete(opts, "password")
+	opts["key_file"] = keyFile
+	fs, err = storage.Open("sftp", opts)
+	if assert.NoError(t, err, "key auth") {
+		fs.(*FileSystem).Close()
+	}
+
+	opts = s.options(dir)
+	opts["host_key"] = ssh.FingerprintSHA256(s.hostKey)
+	fs, err = storage.Open("sftp", opts)
+	if assert.NoError(t, err, "pinned by fingerprint") {
+		fs.(*FileSystem).Close()
+	}
+
+	other := newServer(t)
+	opts = s.options(dir)
+	opts["host_key"] = string(ssh.MarshalAuthorizedKey(other.hostKey))
+	_, err = storage.Open("sftp", opts)
+	assert.ErrorContains(t, err, "does not match")
+	opts["host_key"] = ssh.FingerprintSHA256(other.hostKey)
+	_, err = storage.Open("sftp", opts)
+	assert.ErrorContains(t, err, "does not match")
+
+	opts = s.options(dir)
+	delete(opts, "host_key")
+	_, err = storage.Open("sftp", opts)
+	assert.Error(t, err, "the host key is required")
+
+	opts = s.options(filepath.Join(dir, "missing"))
+	_, err = storage.Open("sftp", opts)
+	assert.Error(t, err, "the directory must exist")
+}
+
+func TestReconnect(t *testing.T) {
+	s := newServer(t)
+	opts := s.options(t.TempDir())
+	opts["connections"] = "2"
+	fs, err := storage.Open("sftp", opts)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	defer fs.(*FileSystem).Close()
+	ctx := context.Background()
+
+	for i := 0; i < 4; i++ {
+		_, err := fs.Stat(ctx, "/")
+		assert.NoError(t, err)
+	}
+	s.mu.Lock()
+	assert.Equal(t, 2, s.dials, "connections are reused")
+	s.mu.Unlock()
+
+	s.drop()
+	assert.Eventually(t, func() bool {
+		_, err := fs.Stat(ctx, "/")
+		return err == nil
+	}, 5*time.Second, 50*time.Millisecond)
+	assert.NoError(t, fs.Mkdir(ctx, "/docs", 0755))
+}
@@ -0,0 +1,195 @@
+package sharestore
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pluveto/flydav/pkg/misc"
+	"github.com/pluveto/flydav/pkg/passhash"
+)
+
+// Modes of a share.
+const (
+	ModeRead   = "read"   // Download the file, or browse and download the folder
+	ModeUpload = "upload" // Put new files into the folder, without seeing its content
+)
+
+var (
+	ErrNotFound  = errors.New("share not found")
+	ErrExhausted = errors.New("download limit of share reached")
+)
+
+// Share is a link to a file or folder for people without an account.
+type Share struct {
+	Token        string    `json:"token"`
+	Owner        string    `json:"owner"`
+	Groups       []string  `json:"groups,omitempty"`  // Of the owner when sharing
+	Path         string    `json:"path"`              // In the namespace of the owner
+	Storage      string    `json:"storage,omitempty"` // Holding Target, "" for the default one
+	Target       string    `json:"target"`            // Relative to the storage
+	Dir          bool      `json:"dir"`
+	Mode         string    `json:"mode"`
+	PasswordHash string    `json:"password_hash,omitempty"`
+	Created      time.Time `json:"created"`
+	Expires      time.Time `json:"expires"`
+	MaxDownloads int       `json:"max_downloads,omitempty"` // 0 means no limit
+	Downloads    int       `json:"downloads"`
+}
+
+// Store keeps shares in a JSON file, rewritten on every change. Expired
+// shares are dropped.
+type Store struct {
+	path          string
+	hashAlgorithm string
+	now           func() time.Time
+
+	mu     sync.Mutex
+	shares map[string]*Share // By token
+}
+
+// Open loads the shares of path, or keeps them in memory only if it is
+// empty. Passwords are hashed with hashAlgorithm, see passhash.Hash.
+func Open(path, hashAlgorithm string) (*Store, error) {
+	s := &Store{
+		path:          path,
+		hashAlgorithm: hashAlgorithm,
+		now:           time.Now,
+		shares:        make(map[string]*Share),
+	}
+	if path == "" {
+		return s, nil
+	}
+	content, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var shares []*Share
+	if err := json.Unmarshal(content, &shares); err != nil {
+		return nil, err
+	}
+	for _, share := range shares {
+		s.shares[share.Token] = share
+	}
+	return s, nil
+}
+
+// Create stores share under a new random token, protected by password
+// unless it is empty.
+func (s *Store) Create(share Share, password string) (Share, error) {
+	token := make([]byte, 18)
+	if _, err := rand.Read(token); err != nil {
+		return Share{}, err
+	}
+	share.Token = base64.RawURLEncoding.EncodeToString(token)
+	share.Created = s.now()
+	share.Downloads = 0
+	share.PasswordHash = ""
+	if password != "" {
+		hash, err := passhash.Hash(s.hashAlgorithm, password)
+		if err != nil {
+			return Share{}, err
+		}
+		share.PasswordHash = hash
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.shares[share.Token] = &share
+	return share, s.save()
+}
+
+// Get returns the share of token, unless it has expired.
+func (s *Store) Get(token string) (Share, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	share, ok := s.shares[token]
+	if !ok || !s.valid(share) {
+		return Share{}, false
+	}
+	return *share, true
+}
+
+// List returns the valid shares of owner, oldest first.
+func (s *Store) List(owner string) []Share {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ret := []Share{}
+	for _, share := range s.shares {
+		if share.Owner == owner && s.valid(share) {
+			ret = append(ret, *share)
+		}
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].Created.Before(ret[j].Created) })
+	return ret
+}
+
+// Delete revokes a share of owner.
+func (s *Store) Delete(owner, token string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	share, ok := s.shares[token]
+	if !ok || share.Owner != owner {
+		return ErrNotFound
+	}
+	delete(s.shares, token)
+	return s.save()
+}
+
+// Download counts a download of the share, failing once MaxDownloads is
+// reached.
+func (s *Store) Download(token string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	share, ok := s.shares[token]
+	if !ok || !s.valid(share) {
+		return ErrNotFound
+	}
+	if share.MaxDownloads != 0 && share.Downloads >= share.MaxDownloads {
+		return ErrExhausted
+	}
+	share.Downloads++
+	return s.save()
+}
+
+// CheckPassword reports whether password opens share.
+func CheckPassword(share Share, password string) bool {
+	if share.PasswordHash == "" {
+		return true
+	}
+	ok, err := passhash.Verify(share.PasswordHash, password)
+	return err == nil && ok
+}
+
+func (s *Store) valid(share *Share) bool {
+	return share.Expires.IsZero() || s.now().Before(share.Expires)
+}
+
+// save writes the valid shares, the caller holds mu.
+func (s *Store) save() error {
+	shares := make([]*Share, 0, len(s.shares))
+	for token, share := range s.shares {
+		if !s.valid(share) {
+			delete(s.shares, token)
+			continue
+		}
+		shares = append(shares, share)
+	}
+	if s.path == "" {
+		return nil
+	}
+	sort.Slice(shares, func(i, j int) bool { return shares[i].Created.Before(shares[j].Created) })
+	content, err := json.MarshalIndent(shares, "", "  ")
+	if err != nil {
+		return err
+	}
+	return misc.ReplaceFile(s.path, content)
+}
@@ -0,0 +1,76 @@
+package sharestore
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/pluveto/flydav/pkg/passhash"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "shares.json")
+	s, err := Open(path, passhash.Bcrypt)
+	assert.NoError(t, err)
+	now := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	s.now = func() time.Time { return now }
+
+	share, err := s.Create(Share{Owner: "alice", Path: "/a.txt", Target: "/home/alice/a.txt", Mode: ModeRead, Expires: now.Add(time.Hour), MaxDownloads: 2}, "")
+	assert.NoError(t, err)
+	assert.Len(t, share.Token, 24)
+	assert.Equal(t, now, share.Created)
+	protected, err := s.Create(Share{Owner: "alice", Path: "/inbox", Target: "/home/alice/inbox", Dir: true, Mode: ModeUpload, Expires: now.Add(2 * time.Hour)}, "secret")
+	assert.NoError(t, err)
+	assert.NotEqual(t, share.Token, protected.Token)
+
+	got, ok := s.Get(share.Token)
+	assert.True(t, ok)
+	assert.Equal(t, share, got)
+	assert.True(t, CheckPassword(got, "anything"))
+	got, _ = s.Get(protected.Token)
+	assert.True(t, CheckPassword(got, "secret"))
+	assert.False(t, CheckPassword(got, "wrong"))
+	assert.Len(t, s.List("alice"), 2)
+	assert.Empty(t, s.List("bob"))
+
+	assert.NoError(t, s.Download(share.Token))
+	assert.NoError(t, s.Download(share.Token))
+	assert.Equal(t, ErrExhausted, s.Download(share.Token))
+
+	// shares survive a restart
+	s, err = Open(path, passhash.Bcrypt)
+	assert.NoError(t, err)
+	s.now = func() time.Time { return now }
+	got, ok = s.Get(share.Token)
+	assert.True(t, ok)
+	assert.Equal(t, 2, got.Downloads)
+	assert.Equal(t, ErrExhausted, s.Download(share.Token))
+
+	assert.Equal(t, ErrNotFound, s.Delete("bob", share.Token), "only the owner can delete a share")
+	assert.NoError(t, s.Delete("alice", share.Token))
+	_, ok = s.Get(share.Token)
+	assert.False(t, ok)
+
+	now = now.Add(3 * time.Hour)
+	_, ok = s.Get(protected.Token)
+	assert.False(t, ok, "expired")
+	assert.Equal(t, ErrNotFound, s.Download(protected.Token))
+	assert.Empty(t, s.List("alice"))
+}
+
+func TestOpen(t *testing.T) {
+	s, err := Open("", passhash.Bcrypt)
+	assert.NoError(t, err)
+	_, err = s.Create(Share{Owner: "alice"}, "")
+	assert.NoError(t, err, "without a path shares are kept in memory")
+
+	_, err = Open(filepath.Join(t.TempDir(), "missing.json"), passhash.Bcrypt)
+	assert.NoError(t, err)
+
+	path := filepath.Join(t.TempDir(), "shares.json")
+	assert.NoError(t, os.WriteFile(path, []byte("{"), 0600))
+	_, err = Open(path, passhash.Bcrypt)
+	assert.Error(t, err)
+}
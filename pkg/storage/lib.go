@@ -0,0 +1,201 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pluveto/flydav/pkg/memfs"
+	"golang.org/x/net/webdav"
+)
+
+// Factory opens a backend with its options, e.g. {"dir": "/srv/dav"}. It
+// fails on missing or unknown options.
+type Factory func(options map[string]string) (webdav.FileSystem, error)
+
+var (
+	mu        sync.RWMutex
+	factories = make(map[string]Factory)
+)
+
+var ErrUnknownBackend = errors.New("unknown storage backend")
+
+func init() {
+	Register("local", openLocal)
+	Register("memory", openMemory)
+}
+
+// Register makes a backend available to Open. It panics if name is taken.
+func Register(name string, factory Factory) {
+	mu.Lock()
+	defer mu.Unlock()
+	if _, ok := factories[name]; ok {
+		panic("storage: backend " + name + " registered twice")
+	}
+	factories[name] = factory
+}
+
+// Backends returns the names of the registered backends, sorted.
+func Backends() []string {
+	mu.RLock()
+	defer mu.RUnlock()
+	ret := make([]string, 0, len(factories))
+	for name := range factories {
+		ret = append(ret, name)
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+// Open opens a file system of the backend.
+func Open(backend string, options map[string]string) (webdav.FileSystem, error) {
+	mu.RLock()
+	factory, ok := factories[backend]
+	mu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("%w %q", ErrUnknownBackend, backend)
+	}
+	return factory(options)
+}
+
+// CheckOptions fails if options has keys other than known, or lacks one of
+// required.
+func CheckOptions(options map[string]string, required []string, known ...string) error {
+	for _, key := range required {
+		if options[key] == "" {
+			return fmt.Errorf("missing option %q", key)
+		}
+	}
+	for key := range options {
+		if !contains(required, key) && !contains(known, key) {
+			return fmt.Errorf("unknown option %q", key)
+		}
+	}
+	return nil
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// openLocal serves the directory of option "dir".
+func openLocal(options map[string]string) (webdav.FileSystem, error) {
+	if err := CheckOptions(options, []string{"dir"}); err != nil {
+		return nil, err
+	}
+	info, err := os.Stat(options["dir"])
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return nil, fmt.Errorf("%s is not a directory", options["dir"])
+	}
+	return webdav.Dir(options["dir"]), nil
+}
+
+// openMemory keeps files in memory, they are lost on restart. Options
+// "max_size" in MiB, "max_files" and "ttl" in seconds limit them.
+func openMemory(options map[string]string) (webdav.FileSystem, error) {
+	if err := CheckOptions(options, nil, "max_size", "max_files", "ttl"); err != nil {
+		return nil, err
+	}
+	values := make(map[string]int)
+	for _, key := range []string{"max_size", "max_files", "ttl"} {
+		if options[key] == "" {
+			continue
+		}
+		n, err := strconv.Atoi(options[key])
+		if err != nil || n < 1 {
+			return nil, fmt.Errorf("invalid option %s %q", key, options[key])
+		}
+		values[key] = n
+	}
+	return memfs.New(memfs.Limits{
+		MaxBytes: int64(values["max_size"]) << 20,
+		MaxFiles: values["max_files"],
+		TTL:      time.Duration(values["ttl"]) * time.Second,
+	}), nil
+}
+
+// MkdirAll creates dir and its missing parents.
+func MkdirAll(ctx context.Context, fs webdav.FileSystem, dir string) error {
+	current := "/"
+	for _, part := range strings.Split(strings.Trim(path.Clean("/"+dir), "/"), "/") {
+		if part == "" {
+			continue
+		}
+		current = path.Join(current, part)
+		err := fs.Mkdir(ctx, current, 0755)
+		if err == nil {
+			continue
+		}
+		if info, statErr := fs.Stat(ctx, current); statErr != nil || !info.IsDir() {
+			return err
+		}
+	}
+	return nil
+}
+
+// Sub returns the file system below dir of fs, which cannot be left with
+// ".." and whose root cannot be removed or renamed.
+func Sub(fs webdav.FileSystem, dir string) webdav.FileSystem {
+	dir = path.Clean("/" + dir)
+	if dir == "/" {
+		return fs
+	}
+	return &subFileSystem{fs: fs, dir: dir}
+}
+
+type subFileSystem struct {
+	fs  webdav.FileSystem
+	dir string
+}
+
+func (s *subFileSystem) resolve(name string) (string, bool) {
+	name = path.Clean("/" + name)
+	return path.Join(s.dir, name), name != "/"
+}
+
+func (s *subFileSystem) Mkdir(ctx context.Context, name string, perm os.FileMode) error {
+	full, _ := s.resolve(name)
+	return s.fs.Mkdir(ctx, full, perm)
+}
+
+func (s *subFileSystem) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (webdav.File, error) {
+	full, _ := s.resolve(name)
+	return s.fs.OpenFile(ctx, full, flag, perm)
+}
+
+func (s *subFileSystem) RemoveAll(ctx context.Context, name string) error {
+	full, ok := s.resolve(name)
+	if !ok {
+		return os.ErrInvalid
+	}
+	return s.fs.RemoveAll(ctx, full)
+}
+
+func (s *subFileSystem) Rename(ctx context.Context, oldName, newName string) error {
+	oldFull, oldOk := s.resolve(oldName)
+	newFull, newOk := s.resolve(newName)
+	if !oldOk || !newOk {
+		return os.ErrInvalid
+	}
+	return s.fs.Rename(ctx, oldFull, newFull)
+}
+
+func (s *subFileSystem) Stat(ctx context.Context, name string) (os.FileInfo, error) {
+	full, _ := s.resolve(name)
+	return s.fs.Stat(ctx, full)
+}
@@ -0,0 +1,66 @@
+package storage
+
+import (
+	"context"
+	"os"
+	"testing"
+
+	"github.com/pluveto/flydav/pkg/storage/storagetest"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/webdav"
+)
+
+func TestLocal(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T) webdav.FileSystem {
+		fs, err := Open("local", map[string]string{"dir": t.TempDir()})
+		assert.NoError(t, err)
+		return fs
+	})
+}
+
+func TestMemory(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T) webdav.FileSystem {
+		fs, err := Open("memory", nil)
+		assert.NoError(t, err)
+		return fs
+	})
+}
+
+func TestSub(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T) webdav.FileSystem {
+		fs := webdav.NewMemFS()
+		assert.NoError(t, MkdirAll(context.Background(), fs, "/home/alice"))
+		return Sub(fs, "/home/alice")
+	})
+
+	ctx := context.Background()
+	fs := webdav.NewMemFS()
+	assert.NoError(t, MkdirAll(ctx, fs, "/home/alice"))
+	assert.NoError(t, MkdirAll(ctx, fs, "/home/alice"), "existing directories are fine")
+	assert.NoError(t, MkdirAll(ctx, fs, "/home/bob"))
+	sub := Sub(fs, "home/alice")
+	assert.NoError(t, sub.Mkdir(ctx, "/../../docs", 0755), "cannot leave the directory")
+	_, err := fs.Stat(ctx, "/home/alice/docs")
+	assert.NoError(t, err)
+	assert.ErrorIs(t, sub.RemoveAll(ctx, "/"), os.ErrInvalid)
+	assert.ErrorIs(t, sub.Rename(ctx, "/", "/x"), os.ErrInvalid)
+	assert.Equal(t, fs, Sub(fs, "/"))
+}
+
+func TestOpen(t *testing.T) {
+	assert.Contains(t, Backends(), "local")
+	assert.Contains(t, Backends(), "memory")
+	_, err := Open("nope", nil)
+	assert.ErrorIs(t, err, ErrUnknownBackend)
+	_, err = Open("local", nil)
+	assert.Error(t, err, "dir is required")
+	_, err = Open("local", map[string]string{"dir": t.TempDir(), "bucket": "x"})
+	assert.Error(t, err, "unknown option")
+	_, err = Open("local", map[string]string{"dir": "/nonexistent/dir"})
+	assert.Error(t, err)
+	_, err = Open("memory", map[string]string{"max_size": "64", "max_files": "100", "ttl": "3600"})
+	assert.NoError(t, err)
+	_, err = Open("memory", map[string]string{"max_size": "0"})
+	assert.Error(t, err)
+	assert.Panics(t, func() { Register("memory", openMemory) })
+}
@@ -0,0 +1,228 @@
+// Package storagetest is the conformance suite every storage backend has to
+// pass, so that it behaves like webdav.Dir for the WebDAV handler.
+package storagetest
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/webdav"
+)
+
+// Run tests the file systems returned by newFS, which must be empty.
+func Run(t *testing.T, newFS func(t *testing.T) webdav.FileSystem) {
+	for _, c := range []struct {
+		name string
+		test func(t *testing.T, fs webdav.FileSystem)
+	}{
+		{"Files", testFiles},
+		{"Dirs", testDirs},
+		{"RemoveAll", testRemoveAll},
+		{"Rename", testRename},
+		{"Handler", testHandler},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			c.test(t, newFS(t))
+		})
+	}
+}
+
+var ctx = context.Background()
+
+func writeFile(t *testing.T, fs webdav.FileSystem, name, content string) {
+	f, err := fs.OpenFile(ctx, name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if !assert.NoError(t, err, name) {
+		return
+	}
+	_, err = io.WriteString(f, content)
+	assert.NoError(t, err, name)
+	assert.NoError(t, f.Close(), name)
+}
+
+func readFile(t *testing.T, fs webdav.FileSystem, name string) string {
+	f, err := fs.OpenFile(ctx, name, os.O_RDONLY, 0)
+	if !assert.NoError(t, err, name) {
+		return ""
+	}
+	defer f.Close()
+	content, err := io.ReadAll(f)
+	assert.NoError(t, err, name)
+	return string(content)
+}
+
+func names(t *testing.T, fs webdav.FileSystem, dir string) []string {
+	f, err := fs.OpenFile(ctx, dir, os.O_RDONLY, 0)
+	if !assert.NoError(t, err, dir) {
+		return nil
+	}
+	defer f.Close()
+	infos, err := f.Readdir(-1)
+	assert.NoError(t, err, dir)
+	ret := []string{}
+	for _, info := range infos {
+		name := info.Name()
+		if info.IsDir() {
+			name += "/"
+		}
+		ret = append(ret, name)
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+func testFiles(t *testing.T, fs webdav.FileSystem) {
+	writeFile(t, fs, "/a.txt", "hello world")
+	info, err := fs.Stat(ctx, "/a.txt")
+	if assert.NoError(t, err) {
+		assert.Equal(t, "a.txt", info.Name())
+		assert.Equal(t, int64(11), info.Size())
+		assert.False(t, info.IsDir())
+	}
+	assert.Equal(t, "hello world", readFile(t, fs, "/a.txt"))
+
+	f, err := fs.OpenFile(ctx, "/a.txt", os.O_RDONLY, 0)
+	if assert.NoError(t, err) {
+		_, err = f.Seek(6, io.SeekStart)
+		assert.NoError(t, err)
+		buf := make([]byte, 3)
+		_, err = io.ReadFull(f, buf)
+		assert.NoError(t, err)
+		assert.Equal(t, "wor", string(buf))
+		info, err := f.Stat()
+		assert.NoError(t, err)
+		assert.Equal(t, int64(11), info.Size())
+		assert.NoError(t, f.Close())
+	}
+
+	writeFile(t, fs, "/a.txt", "bye")
+	assert.Equal(t, "bye", readFile(t, fs, "/a.txt"), "O_TRUNC drops the old content")
+	f, err = fs.OpenFile(ctx, "/a.txt", os.O_RDWR, 0)
+	if assert.NoError(t, err, "opened like by PROPPATCH") {
+		assert.NoError(t, f.Close())
+	}
+	assert.Equal(t, "bye", readFile(t, fs, "/a.txt"), "O_RDWR without O_TRUNC keeps the content")
+
+	_, err = fs.OpenFile(ctx, "/a.txt", os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	assert.True(t, errors.Is(err, os.ErrExist), "O_EXCL on an existing file: %v", err)
+	_, err = fs.OpenFile(ctx, "/missing.txt", os.O_RDONLY, 0)
+	assert.True(t, errors.Is(err, os.ErrNotExist), "opening a missing file: %v", err)
+	_, err = fs.Stat(ctx, "/missing.txt")
+	assert.True(t, errors.Is(err, os.ErrNotExist), "stat of a missing file: %v", err)
+	_, err = fs.OpenFile(ctx, "/missing/a.txt", os.O_WRONLY|os.O_CREATE, 0644)
+	assert.Error(t, err, "creating a file in a missing directory")
+
+	writeFile(t, fs, "/empty.txt", "")
+	assert.Equal(t, "", readFile(t, fs, "/empty.txt"))
+}
+
+func testDirs(t *testing.T, fs webdav.FileSystem) {
+	info, err := fs.Stat(ctx, "/")
+	if assert.NoError(t, err) {
+		assert.True(t, info.IsDir())
+	}
+	assert.Equal(t, []string{}, names(t, fs, "/"))
+
+	assert.NoError(t, fs.Mkdir(ctx, "/docs", 0755))
+	err = fs.Mkdir(ctx, "/docs", 0755)
+	assert.True(t, errors.Is(err, os.ErrExist), "creating an existing directory: %v", err)
+	assert.Error(t, fs.Mkdir(ctx, "/missing/docs", 0755), "creating a directory in a missing one")
+	info, err = fs.Stat(ctx, "/docs")
+	if assert.NoError(t, err) {
+		assert.True(t, info.IsDir())
+		assert.Equal(t, "docs", info.Name())
+	}
+
+	assert.NoError(t, fs.Mkdir(ctx, "/docs/sub", 0755))
+	writeFile(t, fs, "/docs/a.txt", "a")
+	writeFile(t, fs, "/docs/sub/b.txt", "b")
+	assert.Equal(t, []string{"docs/"}, names(t, fs, "/"))
+	assert.Equal(t, []string{"a.txt", "sub/"}, names(t, fs, "/docs"))
+	assert.Equal(t, []string{"b.txt"}, names(t, fs, "/docs/sub/"))
+	assert.Equal(t, "b", readFile(t, fs, "/docs/sub/b.txt"))
+}
+
+func testRemoveAll(t *testing.T, fs webdav.FileSystem) {
+	assert.NoError(t, fs.Mkdir(ctx, "/docs", 0755))
+	assert.NoError(t, fs.Mkdir(ctx, "/docs/sub", 0755))
+	writeFile(t, fs, "/docs/sub/b.txt", "b")
+	writeFile(t, fs, "/a.txt", "a")
+
+	assert.NoError(t, fs.RemoveAll(ctx, "/a.txt"))
+	assert.NoError(t, fs.RemoveAll(ctx, "/docs"))
+	_, err := fs.Stat(ctx, "/docs/sub/b.txt")
+	assert.True(t, errors.Is(err, os.ErrNotExist), "stat below a removed directory: %v", err)
+	assert.Equal(t, []string{}, names(t, fs, "/"))
+	assert.NoError(t, fs.RemoveAll(ctx, "/missing"), "removing a missing file")
+}
+
+func testRename(t *testing.T, fs webdav.FileSystem) {
+	writeFile(t, fs, "/a.txt", "a")
+	assert.NoError(t, fs.Rename(ctx, "/a.txt", "/b.txt"))
+	assert.Equal(t, "a", readFile(t, fs, "/b.txt"))
+	_, err := fs.Stat(ctx, "/a.txt")
+	assert.True(t, errors.Is(err, os.ErrNotExist), "stat of a renamed file: %v", err)
+
+	assert.NoError(t, fs.Mkdir(ctx, "/docs", 0755))
+	assert.NoError(t, fs.Mkdir(ctx, "/docs/sub", 0755))
+	writeFile(t, fs, "/docs/sub/c.txt", "c")
+	assert.NoError(t, fs.Rename(ctx, "/docs", "/papers"))
+	assert.Equal(t, "c", readFile(t, fs, "/papers/sub/c.txt"))
+	assert.Equal(t, []string{"b.txt", "papers/"}, names(t, fs, "/"))
+
+	assert.NoError(t, fs.Rename(ctx, "/b.txt", "/papers/b.txt"))
+	assert.Equal(t, []string{"b.txt", "sub/"}, names(t, fs, "/papers"))
+	assert.Error(t, fs.Rename(ctx, "/missing", "/other"), "renaming a missing file")
+}
+
+const propPatch = `<?xml version="1.0" encoding="utf-8" ?>
+<D:propertyupdate xmlns:D="DAV:" xmlns:Z="urn:schemas-microsoft-com:">
+  <D:set><D:prop><Z:Win32LastModifiedTime>Wed, 01 Feb 2023 10:00:00 GMT</Z:Win32LastModifiedTime></D:prop></D:set>
+</D:propertyupdate>`
+
+// testHandler goes through webdav.Handler the way clients do.
+func testHandler(t *testing.T, fs webdav.FileSystem) {
+	handler := &webdav.Handler{FileSystem: fs, LockSystem: webdav.NewMemLS()}
+	do := func(method, target, body string, header map[string]string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, target, strings.NewReader(body))
+		for k, v := range header {
+			r.Header.Set(k, v)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w
+	}
+
+	assert.Equal(t, http.StatusCreated, do("MKCOL", "/docs/", "", nil).Code)
+	assert.Equal(t, http.StatusCreated, do("PUT", "/docs/a.txt", "hello", nil).Code)
+	assert.Equal(t, http.StatusCreated, do("PUT", "/docs/a.txt", "hello world", nil).Code)
+	w := do("GET", "/docs/a.txt", "", nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "hello world", w.Body.String())
+	w = do("GET", "/docs/a.txt", "", map[string]string{"Range": "bytes=6-"})
+	assert.Equal(t, http.StatusPartialContent, w.Code)
+	assert.Equal(t, "world", w.Body.String())
+
+	w = do("PROPFIND", "/docs/", "", map[string]string{"Depth": "1"})
+	assert.Equal(t, http.StatusMultiStatus, w.Code)
+	assert.Contains(t, w.Body.String(), "/docs/a.txt")
+
+	// Windows sets the file times after every save
+	w = do("PROPPATCH", "/docs/a.txt", propPatch, nil)
+	assert.Equal(t, http.StatusMultiStatus, w.Code)
+	assert.Equal(t, "hello world", do("GET", "/docs/a.txt", "", nil).Body.String(), "PROPPATCH keeps the content")
+
+	assert.Equal(t, http.StatusCreated, do("COPY", "/docs/a.txt", "", map[string]string{"Destination": "/docs/b.txt"}).Code)
+	assert.Equal(t, http.StatusCreated, do("MOVE", "/docs/", "", map[string]string{"Destination": "/papers/"}).Code)
+	assert.Equal(t, "hello world", do("GET", "/papers/b.txt", "", nil).Body.String())
+	assert.Equal(t, http.StatusNotFound, do("GET", "/docs/a.txt", "", nil).Code)
+	assert.Equal(t, http.StatusNoContent, do("DELETE", "/papers/", "", nil).Code)
+	assert.Equal(t, http.StatusNotFound, do("PROPFIND", "/papers/", "", map[string]string{"Depth": "0"}).Code)
+}
@@ -0,0 +1,236 @@
+package tlsutil
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// CertReloader serves a certificate pair loaded from disk and picks up
+// renewed files without restarting the server.
+type CertReloader struct {
+	certFile string
+	keyFile  string
+	interval time.Duration
+
+	mu        sync.RWMutex
+	cert      *tls.Certificate
+	modTime   time.Time
+	lastCheck time.Time
+	onError   func(error)
+}
+
+// NewCertReloader loads the pair once and fails if it is unusable. Files are
+// checked again at most once per interval.
+func NewCertReloader(certFile, keyFile string, interval time.Duration) (*CertReloader, error) {
+	r := &CertReloader{
+		certFile: certFile,
+		keyFile:  keyFile,
+		interval: interval,
+	}
+	modTime, err := r.latestModTime()
+	if err != nil {
+		return nil, err
+	}
+	if err := r.load(modTime); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// OnError sets a callback invoked when a changed pair fails to load. The
+// previously loaded certificate keeps being served in that case.
+func (r *CertReloader) OnError(fn func(error)) {
+	r.onError = fn
+}
+
+// GetCertificate can be used as tls.Config.GetCertificate.
+func (r *CertReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.maybeReload()
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.cert, nil
+}
+
+func (r *CertReloader) maybeReload() {
+	r.mu.RLock()
+	due := time.Since(r.lastCheck) >= r.interval
+	r.mu.RUnlock()
+	if !due {
+		return
+	}
+
+	r.mu.Lock()
+	r.lastCheck = time.Now()
+	current := r.modTime
+	r.mu.Unlock()
+
+	modTime, err := r.latestModTime()
+	if err == nil && modTime.Equal(current) {
+		return
+	}
+	if err == nil {
+		err = r.load(modTime)
+	}
+	if err != nil && r.onError != nil {
+		r.onError(err)
+	}
+}
+
+func (r *CertReloader) load(modTime time.Time) error {
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return fmt.Errorf("failed to load key pair: %w", err)
+	}
+	r.mu.Lock()
+	r.cert = &cert
+	r.modTime = modTime
+	r.lastCheck = time.Now()
+	r.mu.Unlock()
+	return nil
+}
+
+func (r *CertReloader) latestModTime() (time.Time, error) {
+	var latest time.Time
+	for _, path := range []string{r.certFile, r.keyFile} {
+		info, err := os.Stat(path)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+// LoadCABundle reads PEM certificates from path into a pool, on top of the
+// system roots if withSystem is set.
+func LoadCABundle(path string, withSystem bool) (*x509.CertPool, error) {
+	pem, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if withSystem {
+		if system, err := x509.SystemCertPool(); err == nil {
+			pool = system
+		}
+	}
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, errors.New("no certificate found in " + path)
+	}
+	return pool, nil
+}
+
+// ParseVersion converts a version string such as "1.2" to its tls constant.
+func ParseVersion(version string) (uint16, error) {
+	switch version {
+	case "1.0":
+		return tls.VersionTLS10, nil
+	case "1.1":
+		return tls.VersionTLS11, nil
+	case "1.2", "":
+		return tls.VersionTLS12, nil
+	case "1.3":
+		return tls.VersionTLS13, nil
+	default:
+		return 0, fmt.Errorf("unsupported TLS version: %s", version)
+	}
+}
+
+const (
+	PolicyModern       = "modern"
+	PolicyIntermediate = "intermediate"
+	PolicyCompatible   = "compatible"
+)
+
+// intermediateSuites only contains forward secret AEAD suites. TLS 1.3 suites
+// are not configurable and always enabled.
+var intermediateSuites = []uint16{
+	tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+	tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+	tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+	tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+	tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256,
+	tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256,
+}
+
+// ApplyPolicy sets cipher suites and the minimal version of cfg according to
+// a policy name. The modern policy only allows TLS 1.3, compatible keeps the
+// Go defaults.
+func ApplyPolicy(cfg *tls.Config, policy string, minVersion uint16) error {
+	cfg.MinVersion = minVersion
+	switch policy {
+	case PolicyModern:
+		cfg.MinVersion = tls.VersionTLS13
+	case PolicyIntermediate, "":
+		cfg.CipherSuites = intermediateSuites
+	case PolicyCompatible:
+		cfg.CipherSuites = nil
+	default:
+		return fmt.Errorf("unsupported cipher policy: %s", policy)
+	}
+	return nil
+}
+
+// CertMapper maps client certificates to usernames.
+type CertMapper struct {
+	// Field is where the name is taken from: "cn" (default), "email",
+	// "dns" or "uri" of the subject alternative names, or "subject", the
+	// whole subject like "CN=backup,O=Example".
+	Field string
+	// Users maps names to usernames. Without it the name is the username,
+	// with it certificates of names not listed are not mapped.
+	Users map[string]string
+}
+
+// ValidCertField reports whether field can be used as CertMapper.Field.
+func ValidCertField(field string) bool {
+	switch field {
+	case "", "cn", "email", "dns", "uri", "subject":
+		return true
+	}
+	return false
+}
+
+// Username returns the username of cert, trying each name of the field in
+// turn.
+func (m CertMapper) Username(cert *x509.Certificate) (string, bool) {
+	for _, name := range certNames(cert, m.Field) {
+		if m.Users == nil {
+			if name != "" {
+				return name, true
+			}
+			continue
+		}
+		if username, ok := m.Users[name]; ok {
+			return username, true
+		}
+	}
+	return "", false
+}
+
+func certNames(cert *x509.Certificate, field string) []string {
+	switch field {
+	case "", "cn":
+		return []string{cert.Subject.CommonName}
+	case "email":
+		return cert.EmailAddresses
+	case "dns":
+		return cert.DNSNames
+	case "uri":
+		var names []string
+		for _, uri := range cert.URIs {
+			names = append(names, uri.String())
+		}
+		return names
+	case "subject":
+		return []string{cert.Subject.String()}
+	}
+	return nil
+}
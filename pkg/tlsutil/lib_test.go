@@ -0,0 +1,123 @@
+package tlsutil
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func writeKeyPair(t *testing.T, dir, commonName string, modTime time.Time) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	assert.NoError(t, err)
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	assert.NoError(t, err)
+
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+	assert.NoError(t, os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600))
+	assert.NoError(t, os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600))
+	assert.NoError(t, os.Chtimes(certFile, modTime, modTime))
+	assert.NoError(t, os.Chtimes(keyFile, modTime, modTime))
+	return certFile, keyFile
+}
+
+func commonName(t *testing.T, cert *tls.Certificate) string {
+	parsed, err := x509.ParseCertificate(cert.Certificate[0])
+	assert.NoError(t, err)
+	return parsed.Subject.CommonName
+}
+
+func TestCertReloader_GetCertificate(t *testing.T) {
+	dir := t.TempDir()
+	start := time.Now().Add(-time.Minute)
+	certFile, keyFile := writeKeyPair(t, dir, "first", start)
+
+	reloader, err := NewCertReloader(certFile, keyFile, 0)
+	assert.NoError(t, err)
+	cert, err := reloader.GetCertificate(nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "first", commonName(t, cert))
+
+	writeKeyPair(t, dir, "second", start.Add(time.Second))
+	cert, err = reloader.GetCertificate(nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "second", commonName(t, cert))
+
+	// a broken renewal keeps the previous certificate
+	var reloadErr error
+	reloader.OnError(func(err error) { reloadErr = err })
+	assert.NoError(t, os.WriteFile(keyFile, []byte("garbage"), 0600))
+	cert, err = reloader.GetCertificate(nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "second", commonName(t, cert))
+	assert.Error(t, reloadErr)
+}
+
+func TestLoadCABundle(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := writeKeyPair(t, dir, "ca", time.Now())
+	_, err := LoadCABundle(certFile, false)
+	assert.NoError(t, err)
+	_, err = LoadCABundle(keyFile, false)
+	assert.Error(t, err)
+}
+
+func TestParseVersion(t *testing.T) {
+	v, err := ParseVersion("1.3")
+	assert.NoError(t, err)
+	assert.Equal(t, uint16(tls.VersionTLS13), v)
+	_, err = ParseVersion("2.0")
+	assert.Error(t, err)
+}
+
+func TestCertMapper_Username(t *testing.T) {
+	spiffe, _ := url.Parse("spiffe://example.org/backup")
+	cert := &x509.Certificate{
+		Subject:        pkix.Name{CommonName: "backup01", Organization: []string{"Example"}},
+		EmailAddresses: []string{"ops@example.org", "backup@example.org"},
+		DNSNames:       []string{"backup01.example.org"},
+		URIs:           []*url.URL{spiffe},
+	}
+
+	for field, expected := range map[string]string{
+		"":        "backup01",
+		"cn":      "backup01",
+		"email":   "ops@example.org",
+		"dns":     "backup01.example.org",
+		"uri":     "spiffe://example.org/backup",
+		"subject": "CN=backup01,O=Example",
+	} {
+		username, ok := CertMapper{Field: field}.Username(cert)
+		assert.True(t, ok, field)
+		assert.Equal(t, expected, username, field)
+	}
+
+	mapper := CertMapper{Field: "email", Users: map[string]string{"backup@example.org": "backup"}}
+	username, ok := mapper.Username(cert)
+	assert.True(t, ok)
+	assert.Equal(t, "backup", username, "the first mapped name is used")
+	_, ok = CertMapper{Field: "cn", Users: map[string]string{"other": "backup"}}.Username(cert)
+	assert.False(t, ok, "names not listed are not mapped")
+	_, ok = CertMapper{Field: "dns"}.Username(&x509.Certificate{})
+	assert.False(t, ok)
+}
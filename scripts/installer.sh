@@ -276,6 +276,11 @@ if [ -f /etc/systemd/system/flydav.service ]; then
     must_run systemctl stop flydav
     must_run systemctl disable flydav
     must_run rm -r /etc/systemd/system/flydav.service
+    if [ -f /etc/systemd/system/flydav.socket ]; then
+        must_run systemctl stop flydav.socket
+        must_run systemctl disable flydav.socket
+        must_run rm -r /etc/systemd/system/flydav.socket
+    fi
     must_run systemctl daemon-reload
 
 fi
@@ -297,6 +302,19 @@ if [ ! -d "$TMP_USER_FS_ROOT" ]; then
 
 fi
 
+SOCKET_ACTIVATION=0
+SOCKET_LISTEN="${HTTP_HOST:-0.0.0.0}:${HTTP_PORT:-7086}"
+echo "Use systemd socket activation? (y/n, default: n)"
+read -r answer
+if [ "$answer" = "y" ] || [ "$answer" = "yes" ]; then
+    SOCKET_ACTIVATION=1
+    echo "Socket to listen on, an address or a unix socket path (default: $SOCKET_LISTEN): "
+    read -r answer
+    if [ -n "$answer" ]; then
+        SOCKET_LISTEN="$answer"
+    fi
+fi
+
 echo "Creating systemd service"
 
 read -r -d '' SERVICE_TMPL <<'EOF'
@@ -317,11 +335,36 @@ StartLimitBurst=3
 WantedBy=multi-user.target
 EOF
 
+# flydav serves the sockets passed by systemd when server.listen is empty
+read -r -d '' SOCKET_TMPL <<EOF
+[Unit]
+Description=Flydav WebDAV server socket
+
+[Socket]
+ListenStream=$SOCKET_LISTEN
+SocketUser=flydav
+SocketGroup=flydav
+SocketMode=0660
+
+[Install]
+WantedBy=sockets.target
+EOF
+
+if [ "$SOCKET_ACTIVATION" = "1" ]; then
+    SERVICE_TMPL="${SERVICE_TMPL/After=network.target/After=network.target flydav.socket
+Requires=flydav.socket}"
+    must_run echo "$SOCKET_TMPL" > /etc/systemd/system/flydav.socket
+fi
+
 must_run echo "$SERVICE_TMPL" > /etc/systemd/system/flydav.service
 
 echo "Enabling systemd service"
 must_run systemctl daemon-reload
 must_run systemctl enable flydav.service
+if [ "$SOCKET_ACTIVATION" = "1" ]; then
+    must_run systemctl enable flydav.socket
+    must_run systemctl start flydav.socket
+fi
 
 echo "Starting systemd service"
 must_run systemctl start flydav.service
@@ -60,6 +60,11 @@ const App = (): JSX.Element => {
 
   React.useEffect(() => {
     if (settingsData.url == "") return;
+    if (settingsData.username == "") {
+      // signed in with SSO, the browser sends the login cookie
+      setClient(createClient(settingsData.url))
+      return;
+    }
     setClient(createClient(settingsData.url, {
       username: settingsData.username,
       password: settingsData.password,
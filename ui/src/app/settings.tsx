@@ -69,6 +69,12 @@ const Settings = (props: SettingsProps) => {
                     </div>
                     <div className={styles.modalEnd}>
                         <button onClick={props.onDiscard} className={sharedStyles.buttonDefault}>Discard</button>
+                        <button onClick={()=>{
+                            // works when the server has [auth.oidc] redirect_url set
+                            props.onSave({url, username: "", password: ""} as SettingsObject)
+                            window.location.href = new URL("/oidc/login?return_to=" +
+                                encodeURIComponent(window.location.pathname), url || window.location.href).toString()
+                        }} className={sharedStyles.buttonDefault}>Sign in with SSO</button>
                         <button onClick={()=>{
                             props.onSave({url, username, password} as SettingsObject)
                         }} className={sharedStyles.buttonPrimary}>Save</button>